@@ -16,13 +16,18 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
+	"strings"
 	"text/template"
 	"time"
 
@@ -33,8 +38,18 @@ import (
 const shellDateTimeformat = time.RFC3339
 
 var (
-	makefileFlag string
-	jobsFlag     int
+	makefileFlags stringsFlag
+	jobsFlag      int
+	maxLoadFlag   float64
+	timeoutFlag   time.Duration
+
+	sandboxWarningsFlag bool
+	criticalPathFlag    bool
+	deleteFailedFlag    bool
+	buildLogFlag        bool
+	persistentWorkers   bool
+	failureOutputTail   int
+	recipeTmpDir        bool
 
 	loadJSON string
 	saveJSON string
@@ -42,64 +57,269 @@ var (
 	saveGOB  string
 	useCache bool
 
-	m2n  bool
-	goma bool
-
-	cpuprofile          string
-	heapprofile         string
-	memstats            string
-	traceEventFile      string
-	syntaxCheckOnlyFlag bool
-	queryFlag           string
-	eagerCmdEvalFlag    bool
-	generateNinja       bool
-	regenNinja          bool
-	ninjaSuffix         string
-	gomaDir             string
-	detectAndroidEcho   bool
-	shellDate           string
+	loadProto string
+	saveProto string
+
+	funcStatsFile string
+
+	phaseStatsFormat string
+
+	memBudgetMB uint64
+
+	loadEvalSnapshot string
+	saveEvalSnapshot string
+
+	m2n              bool
+	goma             bool
+	loadMakefileList string
+
+	cpuprofile           string
+	heapprofile          string
+	memstats             string
+	traceEventFile       string
+	syntaxCheckOnlyFlag  bool
+	queryFlag            string
+	eagerCmdEvalFlag     bool
+	generateNinja        bool
+	regenNinja           bool
+	regenFlag            bool
+	ninjaSuffix          string
+	dumpStamps           bool
+	evalFlags            stringsFlag
+	builtinVarFlags      stringsFlag
+	noBuiltinRulesFlag   bool
+	noBuiltinVarsFlag    bool
+	builtinRuleFlags     stringsFlag
+	noBuiltinFlags       stringsFlag
+	writeDepfileFlags    stringsFlag
+	exportStarlark       string
+	htmlReport           string
+	cacheIgnoreEnvFlags  stringsFlag
+	deprecatedVarFlags   stringsFlag
+	obsoleteVarFlags     stringsFlag
+	retryFlags           stringsFlag
+	undefinedAllowlist   string
+	gomaDir              string
+	detectAndroidEcho    bool
+	ninjaMkdirOutputDirs bool
+	ninjaCacheKeys       bool
+	ninjaPhonyMissing    string
+	ninjaDir             string
+	ninjaEnvFile         bool
+	ninjaIncremental     bool
+	ninjaDeferredReport  bool
+	ninjaExpandDirInputs bool
+	ninjaTargetsOnly     bool
+	ninjaMSVCDepsPrefix  string
+	ninjaToolInputs      bool
+	ninjaToolWrappers    string
+	localPoolDepth       int
+	gomaPoolDepth        int
+	shellDate            string
 )
 
 func init() {
 	// TODO: Make this default and replace this by -d flag.
-	flag.StringVar(&makefileFlag, "f", "", "Use it as a makefile")
+	flag.Var(&makefileFlags, "f", "Use it as a makefile. Can be repeated to load makefiles independently and build them together.")
 	flag.IntVar(&jobsFlag, "j", 1, "Allow N jobs at once.")
+	flag.Float64Var(&maxLoadFlag, "l", 0, "Don't start multiple jobs unless the load average is below `N`.")
+	flag.Float64Var(&maxLoadFlag, "load_average", 0, "Same as -l.")
+	flag.DurationVar(&timeoutFlag, "kati_timeout", 0, "Abort evaluation and execution after the duration.")
 
 	flag.StringVar(&loadGOB, "load", "", "")
 	flag.StringVar(&saveGOB, "save", "", "")
 	flag.StringVar(&loadJSON, "load_json", "", "")
 	flag.StringVar(&saveJSON, "save_json", "", "")
+	flag.StringVar(&loadProto, "load_proto", "", "Load the graph saved by -save_proto.")
+	flag.StringVar(&saveProto, "save_proto", "", "Save the graph as protocol buffers in the schema of golang/kati/graph.proto.")
+	flag.StringVar(&loadEvalSnapshot, "load_eval_snapshot", "", "Load the snapshot saved by -save_eval_snapshot into the graph loaded by -load, -load_json or -load_proto, e.g. for -query.")
+	flag.StringVar(&saveEvalSnapshot, "save_eval_snapshot", "", "Save the state of evaluating makefiles which isn't saved with the graph, such as vpath.")
 	flag.BoolVar(&useCache, "use_cache", false, "Use cache.")
+	flag.StringVar(&kati.ParseCacheDir, "parse_cache_dir", "", "Keep parsed makefiles in `dir`, to skip parsing unchanged makefiles in later runs.")
+	flag.Var(&cacheIgnoreEnvFlags, "cache_ignore_env", "Don't invalidate the cache when the environment variable `NAME` changes, even if makefiles read it. TMPDIR is always ignored. Can be repeated.")
 
 	flag.BoolVar(&m2n, "m2n", false, "m2n mode")
 	flag.BoolVar(&goma, "goma", false, "ensure goma start")
+	flag.StringVar(&loadMakefileList, "load_makefile_list", "", "m2n mode for the makefiles listed in `file`, one per line. A directory means its Android.mk.")
 
 	flag.StringVar(&cpuprofile, "kati_cpuprofile", "", "write cpu profile to `file`")
 	flag.StringVar(&heapprofile, "kati_heapprofile", "", "write heap profile to `file`")
 	flag.StringVar(&memstats, "kati_memstats", "", "Show memstats with given templates")
 	flag.StringVar(&traceEventFile, "kati_trace_event", "", "write trace event to `file`")
 	flag.BoolVar(&syntaxCheckOnlyFlag, "c", false, "Syntax check only.")
-	flag.StringVar(&queryFlag, "query", "", "Show the target info")
+	flag.StringVar(&queryFlag, "query", "", "Show the target info. Use script:<target> to print a shell script that reproduces building the target, inputs:<target> to list all inputs of the target, whynorule:<target> to explain why the target has no rule, $RULE_CONFLICTS to list overridden commands as JSON, or $OWNERSHIP to count targets and command bytes per directory of makefiles.")
+	flag.StringVar(&htmlReport, "html_report", "", "Write statistics of the build graph as HTML to `file`.")
+	flag.StringVar(&exportStarlark, "export_starlark", "", "Write rules with commands as kati_genrule declarations in Starlark to `file`, and exit. Experimental.")
+	flag.Var(&writeDepfileFlags, "write_depfile_for", "Write a make dependency file listing all inputs of TARGET to PATH, given as TARGET:PATH. Can be repeated.")
 	flag.BoolVar(&eagerCmdEvalFlag, "eager_cmd_eval", false, "Eval commands first.")
 	flag.BoolVar(&generateNinja, "ninja", false, "Generate build.ninja.")
 	flag.BoolVar(&regenNinja, "gen_regen_rule", false, "Generate regenerate build.ninja rule.")
+	flag.BoolVar(&regenFlag, "regen", false, "With -ninja, exit without loading makefiles if the ninja file was generated with the same arguments and no inputs recorded in its stamp have changed. The stamp is written by -ninja runs with -regen.")
 	flag.StringVar(&ninjaSuffix, "ninja_suffix", "", "suffix for ninja files.")
+	flag.Var(&evalFlags, "eval", "Evaluate the makefile text before the makefile. Can be repeated.")
+	flag.BoolVar(&noBuiltinRulesFlag, "r", false, "Disable builtin rules.")
+	flag.BoolVar(&noBuiltinRulesFlag, "no-builtin-rules", false, "Alias of -r.")
+	flag.BoolVar(&noBuiltinVarsFlag, "R", false, "Disable builtin variables and rules.")
+	flag.BoolVar(&noBuiltinVarsFlag, "no-builtin-variables", false, "Alias of -R.")
+	flag.Var(&builtinVarFlags, "builtin_var", "Add a builtin variable NAME=VALUE. Can be repeated.")
+	flag.Var(&builtinRuleFlags, "builtin_rule", "Add a builtin rule 'TARGET: PREREQS; RECIPE'. Can be repeated.")
+	flag.Var(&noBuiltinFlags, "no_builtin", "Remove the builtin variable or rule named NAME. Can be repeated.")
+	flag.Var(&deprecatedVarFlags, "deprecated_var", "Warn when the variable NAME is read, given as NAME[:MESSAGE]. Can be repeated.")
+	flag.Var(&obsoleteVarFlags, "obsolete_var", "Fail when the variable NAME is read, given as NAME[:MESSAGE]. Can be repeated.")
+	flag.BoolVar(&kati.WarnUndefinedVars, "warn_undefined_variables", false, "Warn when an undefined variable is referenced.")
+	flag.BoolVar(&kati.WarnUndefinedVars, "warn-undefined-variables", false, "Alias of -warn_undefined_variables.")
+	flag.StringVar(&undefinedAllowlist, "warn_undefined_variables_allowlist", "", "Don't warn about undefined variables listed in `file`, one name or pattern with % per line.")
+	flag.BoolVar(&dumpStamps, "dump_stamps", false, "Check inputs recorded by the last -ninja -regen run, and print the first one which has changed.")
 	flag.StringVar(&gomaDir, "goma_dir", "", "If specified, use goma to build C/C++ files.")
+	flag.IntVar(&localPoolDepth, "local_pool_depth", 0, "Depth of the ninja pool for commands not using goma with -goma_dir. 0 means the number of CPUs.")
+	flag.IntVar(&gomaPoolDepth, "goma_pool_depth", 0, "Depth of the ninja pool for commands using goma with -goma_dir, and the number of ninja jobs. 0 means 500.")
 	// TODO(ukai): implement --regen
 	flag.BoolVar(&detectAndroidEcho, "detect_android_echo", false, "detect echo as ninja description.")
-
-	flag.StringVar(&shellDate, "shell_date", "", "specify $(shell date) time as "+shellDateTimeformat)
+	flag.BoolVar(&ninjaMkdirOutputDirs, "ninja_mkdir_output_dirs", false, "create output directories in ninja commands.")
+	flag.BoolVar(&ninjaCacheKeys, "ninja_cache_keys", false, "write the digest of the command, inputs and exported variables of each build edge to build.cache_keys.")
+	flag.BoolVar(&ninjaEnvFile, "ninja_env_file", false, "Write exported variables to env.sh, which is sourced by ninja.sh and each command in build.ninja.")
+	flag.BoolVar(&ninjaIncremental, "ninja_incremental", false, "Reuse commands generated by the last -ninja run for rules whose recipes and the variables they reference are unchanged.")
+	flag.BoolVar(&ninjaDeferredReport, "ninja_deferred_report", false, "Write build.deferred.json, which lists $(shell), $(realpath), $(info), $(warning) and $(error) in recipes left to run at ninja-time.")
+	flag.BoolVar(&ninjaExpandDirInputs, "ninja_expand_dir_inputs", false, "Make tar, zip and jar commands depend on all files under their directory inputs, with restat.")
+	flag.BoolVar(&ninjaTargetsOnly, "ninja_targets_only", false, "Emit build statements only for the targets given on the command line and their dependencies, or for the default goal if none is given.")
+	flag.BoolVar(&ninjaToolInputs, "ninja_tool_inputs", false, "Add tools run by commands, i.e. their first words if they are paths with a slash, as implicit inputs of build edges, so updating a prebuilt compiler rebuilds its outputs.")
+	flag.StringVar(&ninjaToolWrappers, "ninja_tool_wrappers", "", "comma separated names of wrapper commands, e.g. ccache, whose next word is the tool for -ninja_tool_inputs.")
+	flag.StringVar(&ninjaMSVCDepsPrefix, "ninja_msvc_deps_prefix", "", "Prefix of lines with included files written by cl.exe /showIncludes, for localized compilers. Commands running cl.exe or clang-cl with /showIncludes get deps = msvc instead of a depfile.")
+	flag.StringVar(&ninjaDir, "ninja_dir", "", "Directory ninja will run in. Relative paths in ninja files are rewritten against it.")
+	flag.StringVar(&ninjaPhonyMissing, "ninja_phony_missing", "", "comma separated patterns (with %) of missing inputs to emit phony placeholders in ninja.")
+
+	flag.StringVar(&shellDate, "shell_date", "", "specify $(shell date) time as "+shellDateTimeformat+", which also seeds $(shell uuidgen) and $(shell echo $$RANDOM). SOURCE_DATE_EPOCH is used if not set.")
 
 	flag.BoolVar(&kati.StatsFlag, "kati_stats", false, "Show a bunch of statistics")
 	flag.BoolVar(&kati.PeriodicStatsFlag, "kati_periodic_stats", false, "Show a bunch of periodic statistics")
 	flag.BoolVar(&kati.EvalStatsFlag, "kati_eval_stats", false, "Show eval statistics")
+	flag.StringVar(&funcStatsFile, "kati_func_stats", "", "Write counts and durations of evaluations of each function to `file`, as CSV if it ends with .csv, or JSON otherwise.")
+	flag.StringVar(&phaseStatsFormat, "kati_phase_stats", "", "Print wall and CPU time of parse, eval, dep build, serialize, ninja gen and exec phases, and the peak RSS, to stderr at exit, as a table or json.")
+	flag.BoolVar(&kati.FuncStatsSrcpos, "kati_func_stats_srcpos", false, "Break down -kati_func_stats by makefile locations of calls.")
+	flag.BoolVar(&kati.Progress, "progress", kati.IsTerminal(os.Stderr), "Report progress of loading makefiles to stderr every second. Enabled by default if stderr is a terminal.")
+	flag.Uint64Var(&memBudgetMB, "mem_budget", 0, "Keep the heap while loading makefiles within `MB`, by dropping the makefile cache and the directory cache of $(wildcard) and the find emulator, and running GC when it nears the budget.")
+	flag.BoolVar(&kati.EvalArena, "kati_eval_arena", false, "Allocate eval buffers from an arena reused after each statement. Stats are shown with -kati_stats.")
 
 	flag.BoolVar(&kati.DryRunFlag, "n", false, "Only print the commands that would be executed")
+	flag.Var(&retryFlags, "retry", "Retry failing recipes of targets matching PATTERN (with %) up to N times, given as PATTERN:N. Can be repeated. KATI_RETRY := N for a target overrides it.")
+	flag.BoolVar(&criticalPathFlag, "critical_path_priority", false, "Run ready jobs on longer chains of recipes first. Compare recipe time and parallelism with -kati_stats.")
+	flag.BoolVar(&deleteFailedFlag, "delete_failed_outputs", false, "Remove targets modified by failed recipes unless they are precious, as .DELETE_ON_ERROR does.")
+	flag.BoolVar(&buildLogFlag, "build_log", false, "Record commands and timestamps of built targets in .kati_log, to rebuild targets whose commands change.")
+	flag.IntVar(&failureOutputTail, "failure_output_tail", 0, "Include the last `N` bytes of the output of a failed command in the error, with the target, the recipe's location and the command.")
+	flag.BoolVar(&persistentWorkers, "persistent_workers", false, "Run commands of targets with KATI_WORKER by persistent worker processes started by it.")
+	flag.BoolVar(&recipeTmpDir, "recipe_tmpdir", false, "Run each recipe with TMPDIR set to a new directory, removed when the recipe succeeds. TMPDIR doesn't trigger regeneration with stamps.")
+	flag.BoolVar(&sandboxWarningsFlag, "sandbox_warnings", false, "Warn about recipes which write files other than their targets. Recipes run one at a time.")
+	flag.BoolVar(&kati.WarnEmptyAutoVars, "warn_empty_auto_vars", false, "Warn about recipes using $<, $^ or $+ in rules without prerequisites, or $* outside pattern rules.")
 
 	// TODO: Make this default.
 	flag.BoolVar(&kati.UseFindEmulator, "use_find_emulator", false, "use find emulator")
 	flag.BoolVar(&kati.UseShellBuiltins, "use_shell_builtins", true, "Use shell builtins")
 	flag.StringVar(&kati.IgnoreOptionalInclude, "ignore_optional_include", "", "If specified, skip reading -include directives start with the specified path.")
+	flag.IntVar(&kati.BacktraceDepth, "backtrace_depth", 0, "Show up to N includes and $(call)s leading to $(error) and $(warning).")
+	flag.BoolVar(&kati.Globstar, "globstar", false, "Make ** in $(wildcard) match zero or more directories.")
+	flag.Var((*stringsFlag)(&kati.OverlayDirs), "overlay_dir", "Overlay `DIR` on the working directory for $(wildcard) and the find emulator, which return a file in the first overlay dir having it. Can be repeated.")
+	flag.BoolVar(&kati.IncludeOnce, "include_once", false, "Skip re-evaluating makefiles already in MAKEFILE_LIST with the same content.")
+	flag.StringVar(&kati.ColorMode, "color", "never", "Color warnings, errors and recipe echo: auto (if the output is a terminal), always, or never.")
+	flag.StringVar(&kati.ShellStderrMode, "shell_stderr", "inherit", "Stderr of $(shell): inherit, discard, or capture. Captured stderr is reported with its location, or written to build.ninja with -ninja.")
+}
+
+// stringsFlag is a flag which can be specified multiple times.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ", ")
+}
+
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// parseRetryFlags parses PATTERN:N of -retry.
+func parseRetryFlags() ([]kati.RetryPattern, error) {
+	var retries []kati.RetryPattern
+	for _, s := range retryFlags {
+		i := strings.LastIndexByte(s, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid -retry %q: want PATTERN:N", s)
+		}
+		n, err := strconv.Atoi(s[i+1:])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid -retry %q: want PATTERN:N", s)
+		}
+		retries = append(retries, kati.RetryPattern{Pattern: s[:i], Count: n})
+	}
+	return retries, nil
+}
+
+// splitVarMessage splits NAME[:MESSAGE] of -deprecated_var and
+// -obsolete_var.
+func splitVarMessage(s string) (string, string) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i+1:]
+}
+
+func setupBuiltins() error {
+	for _, name := range noBuiltinFlags {
+		kati.RemoveBuiltin(name)
+	}
+	for _, v := range deprecatedVarFlags {
+		name, msg := splitVarMessage(v)
+		kati.DeprecateVar(name, msg)
+	}
+	for _, v := range obsoleteVarFlags {
+		name, msg := splitVarMessage(v)
+		kati.ObsoleteVar(name, msg)
+	}
+	if undefinedAllowlist != "" {
+		pats, err := readAllowlist(undefinedAllowlist)
+		if err != nil {
+			return err
+		}
+		for _, pat := range pats {
+			kati.AllowUndefinedVar(pat)
+		}
+	}
+	for _, kv := range builtinVarFlags {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			return fmt.Errorf("invalid -builtin_var %q: want NAME=VALUE", kv)
+		}
+		kati.SetBuiltinVar(kv[:i], kv[i+1:])
+	}
+	for _, r := range builtinRuleFlags {
+		i := strings.IndexByte(r, ':')
+		j := strings.IndexByte(r, ';')
+		if i < 0 || j < i {
+			return fmt.Errorf("invalid -builtin_rule %q: want 'TARGET: PREREQS; RECIPE'", r)
+		}
+		kati.SetBuiltinRule(kati.BuiltinRule{
+			Target:  strings.TrimSpace(r[:i]),
+			Prereqs: strings.TrimSpace(r[i+1 : j]),
+			Recipe:  strings.TrimSpace(r[j+1:]),
+		})
+	}
+	return nil
+}
+
+func writeFuncStats() error {
+	f, err := os.Create(funcStatsFile)
+	if err != nil {
+		return err
+	}
+	format := "json"
+	if filepath.Ext(funcStatsFile) == ".csv" {
+		format = "csv"
+	}
+	err = kati.WriteFuncStats(f, format)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
 
 func writeHeapProfile() {
@@ -126,7 +346,7 @@ func (t memStatsDumper) dump() {
 	}
 }
 
-func load(req kati.LoadReq) (*kati.DepGraph, error) {
+func load(ctx context.Context, req kati.LoadReq) (*kati.DepGraph, error) {
 	if loadGOB != "" {
 		g, err := kati.GOB.Load(loadGOB)
 		return g, err
@@ -135,7 +355,23 @@ func load(req kati.LoadReq) (*kati.DepGraph, error) {
 		g, err := kati.JSON.Load(loadJSON)
 		return g, err
 	}
-	g, err := kati.Load(req)
+	if loadProto != "" {
+		g, err := kati.PROTO.Load(loadProto)
+		return g, err
+	}
+	if len(makefileFlags) > 1 {
+		var graphs []*kati.DepGraph
+		for _, mk := range makefileFlags {
+			req.Makefile = mk
+			g, err := kati.LoadContext(ctx, req)
+			if err != nil {
+				return nil, err
+			}
+			graphs = append(graphs, g)
+		}
+		return kati.MergeGraphs(graphs...)
+	}
+	g, err := kati.LoadContext(ctx, req)
 	return g, err
 }
 
@@ -150,6 +386,18 @@ func save(g *kati.DepGraph, targets []string) error {
 			err = serr
 		}
 	}
+	if saveProto != "" {
+		serr := kati.PROTO.Save(g, saveProto, targets)
+		if err == nil {
+			err = serr
+		}
+	}
+	if saveEvalSnapshot != "" {
+		serr := kati.SaveEvalSnapshot(g, saveEvalSnapshot)
+		if err == nil {
+			err = serr
+		}
+	}
 	return err
 }
 
@@ -160,6 +408,75 @@ func m2nsetup() {
 	kati.UseFindEmulator = true
 }
 
+// oneShotMakefiles returns the makefiles to evaluate in m2n mode:
+// ones in -load_makefile_list, or Android.mk in the directory of the
+// first argument.
+func oneShotMakefiles(args []string) ([]string, error) {
+	if loadMakefileList != "" {
+		if len(args) > 0 {
+			fmt.Println("use makefiles in -load_makefile_list as ONE_SHOT_MAKEFILE. ignore arguments")
+		}
+		return readMakefileList(loadMakefileList)
+	}
+	if len(args) > 0 {
+		if len(args) > 1 {
+			fmt.Println("use only first argument as ONE_SHOT_MAKEFILE. ignore rest")
+		}
+		return []string{filepath.Join(args[0], "Android.mk")}, nil
+	}
+	return nil, nil
+}
+
+// readMakefileList reads the makefiles to evaluate in m2n mode from
+// filename. Each line names a makefile, or a directory for its
+// Android.mk. Empty lines and lines starting with # are ignored, as are
+// duplicates.
+func readMakefileList(filename string) ([]string, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var makefiles []string
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if fi, err := os.Stat(line); err == nil && fi.IsDir() {
+			line = filepath.Join(line, "Android.mk")
+		}
+		line = filepath.Clean(line)
+		if seen[line] {
+			continue
+		}
+		seen[line] = true
+		makefiles = append(makefiles, line)
+	}
+	if len(makefiles) == 0 {
+		return nil, fmt.Errorf("%s: no makefiles", filename)
+	}
+	return makefiles, nil
+}
+
+// readAllowlist reads names in filename, one per line. Blank lines and
+// lines starting with # are ignored.
+func readAllowlist(filename string) ([]string, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		names = append(names, line)
+	}
+	return names, nil
+}
+
 func gomasetup() {
 	for _, k := range []string{"CC_WRAPPER", "CXX_WRAPPER", "JAVAC_WRAPPER"} {
 		v := os.Getenv(k)
@@ -186,6 +503,25 @@ func gomasetup() {
 	}
 }
 
+// parseFlags parses flags in cmdline and returns the other arguments.
+// Like GNU make, flags may follow targets and variable assignments,
+// until "--".
+func parseFlags(cmdline []string) []string {
+	var args []string
+	for {
+		flag.CommandLine.Parse(cmdline)
+		rest := flag.Args()
+		if len(rest) == 0 {
+			return args
+		}
+		if n := len(cmdline) - len(rest); n > 0 && cmdline[n-1] == "--" {
+			return append(args, rest...)
+		}
+		args = append(args, rest[0])
+		cmdline = rest[1:]
+	}
+}
+
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	m2ncmd := false
@@ -193,18 +529,23 @@ func main() {
 		m2nsetup()
 		m2ncmd = true
 	}
-	flag.Parse()
-	args := flag.Args()
-	if m2n {
+	args := parseFlags(os.Args[1:])
+	// A sub-make of "make -n" gets n in MAKEFLAGS.
+	if strings.IndexByte(kati.MakeflagsLetters(os.Getenv("MAKEFLAGS")), 'n') >= 0 {
+		kati.DryRunFlag = true
+	}
+	if m2n || loadMakefileList != "" {
 		generateNinja = true
 		if !m2ncmd {
 			m2nsetup()
 		}
-		if len(args) > 1 {
-			fmt.Println("use only first argument as ONE_SHOT_MAKEFILE. ignore rest")
+		makefiles, err := oneShotMakefiles(args)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
 		}
-		if len(args) > 0 {
-			err := os.Setenv("ONE_SHOT_MAKEFILE", filepath.Join(args[0], "Android.mk"))
+		if len(makefiles) > 0 {
+			err = os.Setenv("ONE_SHOT_MAKEFILE", strings.Join(makefiles, " "))
 			if err != nil {
 				fmt.Println(err)
 				os.Exit(1)
@@ -218,13 +559,17 @@ func main() {
 	}
 	err := katiMain(args)
 	if err != nil {
-		fmt.Println(err)
+		fmt.Println(kati.FormatError(os.Stdout, err))
+		var ierr kati.InterruptError
+		if errors.As(err, &ierr) {
+			os.Exit(ierr.ExitStatus())
+		}
 		// http://www.gnu.org/software/make/manual/html_node/Running.html
 		os.Exit(2)
 	}
 }
 
-func katiMain(args []string) error {
+func katiMain(args []string) (err error) {
 	defer glog.Flush()
 	if cpuprofile != "" {
 		f, err := os.Create(cpuprofile)
@@ -238,6 +583,28 @@ func katiMain(args []string) error {
 		defer writeHeapProfile()
 	}
 	defer kati.DumpStats()
+	if funcStatsFile != "" {
+		kati.FuncStatsFlag = true
+		defer func() {
+			ferr := writeFuncStats()
+			if err == nil {
+				err = ferr
+			}
+		}()
+	}
+	switch phaseStatsFormat {
+	case "":
+	case "table", "json":
+		kati.PhaseStatsFlag = true
+		defer func() {
+			perr := kati.WritePhaseStats(os.Stderr, phaseStatsFormat)
+			if err == nil {
+				err = perr
+			}
+		}()
+	default:
+		return fmt.Errorf("invalid -kati_phase_stats %q: must be table or json", phaseStatsFormat)
+	}
 	if memstats != "" {
 		ms := memStatsDumper{
 			Template: template.Must(template.New("memstats").Parse(memstats)),
@@ -245,10 +612,11 @@ func katiMain(args []string) error {
 		ms.dump()
 		defer ms.dump()
 	}
+	kati.MemBudget = memBudgetMB << 20
 	if traceEventFile != "" {
 		f, err := os.Create(traceEventFile)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		kati.TraceEventStart(f)
 		defer kati.TraceEventStop()
@@ -260,28 +628,125 @@ func katiMain(args []string) error {
 		}
 		t, err := time.Parse(shellDateTimeformat, shellDate)
 		if err != nil {
-			panic(err)
+			return fmt.Errorf("invalid -shell_date %q: %v", shellDate, err)
 		}
 		kati.ShellDateTimestamp = t
+	} else if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		sec, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: %v", epoch, err)
+		}
+		kati.ShellDateTimestamp = time.Unix(sec, 0).UTC()
+	}
+
+	switch kati.ShellStderrMode {
+	case "inherit", "discard", "capture":
+	default:
+		return fmt.Errorf("invalid -shell_stderr %q: must be inherit, discard or capture", kati.ShellStderrMode)
+	}
+	switch kati.ColorMode {
+	case "auto", "always", "never":
+	default:
+		return fmt.Errorf("invalid -color %q: must be auto, always or never", kati.ColorMode)
+	}
+
+	if dumpStamps {
+		s, err := kati.LoadStamp(kati.StampFilename(ninjaSuffix))
+		if err != nil {
+			return err
+		}
+		diff, err := s.Diff()
+		if err != nil {
+			return err
+		}
+		if diff == "" {
+			diff = "no changes found"
+		}
+		fmt.Println(diff)
+		return nil
+	}
+
+	if generateNinja && regenFlag {
+		reason, err := kati.NeedsRegen(ninjaSuffix, os.Args[1:])
+		if err != nil {
+			return err
+		}
+		if reason == "" {
+			fmt.Println("No need to regenerate ninja file")
+			return nil
+		}
+		fmt.Printf("Regenerating ninja file: %s\n", reason)
+	}
+
+	err = setupBuiltins()
+	if err != nil {
+		return err
 	}
 
 	req := kati.FromCommandLine(args)
-	if makefileFlag != "" {
-		req.Makefile = makefileFlag
+	if len(makefileFlags) > 0 {
+		req.Makefile = makefileFlags[0]
 	}
 	req.EnvironmentVars = os.Environ()
 	req.UseCache = useCache
+	req.CacheIgnoreEnvs = cacheIgnoreEnvFlags
 	req.EagerEvalCommand = eagerCmdEvalFlag
+	// Accessed files are traced for the stamp.
+	req.TraceFileAccess = generateNinja && regenFlag
+	req.Evals = evalFlags
+	req.NoBuiltinRules = noBuiltinRulesFlag
+	req.NoBuiltinVars = noBuiltinVarsFlag
+	req.KeepRules = strings.HasPrefix(queryFlag, "whynorule:")
+
+	ctx := context.Background()
+	if timeoutFlag > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeoutFlag)
+		defer cancel()
+	}
 
-	g, err := load(req)
+	g, err := load(ctx, req)
 	if err != nil {
 		return err
 	}
+	if loadEvalSnapshot != "" {
+		err = kati.LoadEvalSnapshot(g, loadEvalSnapshot)
+		if err != nil {
+			return err
+		}
+	}
 
 	err = save(g, req.Targets)
 	if err != nil {
 		return err
 	}
+	if !generateNinja {
+		for _, e := range g.ShellStderrs() {
+			fmt.Fprintln(os.Stderr, e)
+		}
+	}
+
+	for _, td := range writeDepfileFlags {
+		i := strings.LastIndexByte(td, ':')
+		if i < 0 {
+			return fmt.Errorf("invalid -write_depfile_for %q: must be TARGET:PATH", td)
+		}
+		err = kati.WriteDepfile(td[i+1:], td[:i], g)
+		if err != nil {
+			return err
+		}
+	}
+
+	if htmlReport != "" {
+		err = writeHTMLReport(htmlReport, g)
+		if err != nil {
+			return err
+		}
+	}
+
+	if exportStarlark != "" {
+		return writeStarlark(exportStarlark, g)
+	}
 
 	if generateNinja {
 		var args []string
@@ -292,7 +757,27 @@ func katiMain(args []string) error {
 			Args:              args,
 			Suffix:            ninjaSuffix,
 			GomaDir:           gomaDir,
+			LocalPoolDepth:    localPoolDepth,
+			GomaPoolDepth:     gomaPoolDepth,
 			DetectAndroidEcho: detectAndroidEcho,
+			MkdirOutputDirs:   ninjaMkdirOutputDirs,
+			CacheKeys:         ninjaCacheKeys,
+			NinjaDir:          ninjaDir,
+			EnvFile:           ninjaEnvFile,
+			Incremental:       ninjaIncremental,
+			DeferredReport:    ninjaDeferredReport,
+			ExpandDirInputs:   ninjaExpandDirInputs,
+			TargetsOnly:       ninjaTargetsOnly,
+			MSVCDepsPrefix:    ninjaMSVCDepsPrefix,
+			ToolInputs:        ninjaToolInputs,
+			Stamp:             regenFlag,
+			StampArgs:         os.Args[1:],
+		}
+		if ninjaPhonyMissing != "" {
+			n.PhonyMissingPatterns = strings.Split(ninjaPhonyMissing, ",")
+		}
+		if ninjaToolWrappers != "" {
+			n.ToolWrappers = strings.Split(ninjaToolWrappers, ",")
 		}
 		return n.Save(g, "", req.Targets)
 	}
@@ -302,20 +787,64 @@ func katiMain(args []string) error {
 	}
 
 	if queryFlag != "" {
-		kati.Query(os.Stdout, queryFlag, g)
-		return nil
+		return kati.Query(os.Stdout, queryFlag, g)
 	}
 
+	retries, err := parseRetryFlags()
+	if err != nil {
+		return err
+	}
 	execOpt := &kati.ExecutorOpt{
-		NumJobs: jobsFlag,
+		NumJobs:         jobsFlag,
+		SandboxWarnings: sandboxWarningsFlag,
+		CriticalPath:    criticalPathFlag,
+		Retries:         retries,
+		HandleSignals:   true,
+
+		DeleteFailedOutputs: deleteFailedFlag,
+		PersistentWorkers:   persistentWorkers,
+		FailureOutputTail:   failureOutputTail,
+		MaxLoad:             maxLoadFlag,
+		RecipeTmpDir:        recipeTmpDir,
+	}
+	if buildLogFlag {
+		execOpt.BuildLog = ".kati_log"
 	}
 	ex, err := kati.NewExecutor(execOpt)
 	if err != nil {
 		return err
 	}
-	err = ex.Exec(g, req.Targets)
+	err = ex.ExecContext(ctx, g, req.Targets)
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+func writeStarlark(filename string, g *kati.DepGraph) (err error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cerr := f.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+	return kati.ExportStarlark(f, g)
+}
+
+func writeHTMLReport(filename string, g *kati.DepGraph) (err error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cerr := f.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+	return kati.WriteHTMLReport(f, g)
+}
@@ -0,0 +1,134 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadMakefileList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kati_main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	err = os.Mkdir("foo", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		list    string
+		want    []string
+		wantErr string
+	}{
+		{
+			list: "# comment\n\nfoo\n  bar/Android.mk  \n./foo/Android.mk\nbaz.mk",
+			want: []string{"foo/Android.mk", "bar/Android.mk", "baz.mk"},
+		},
+		{
+			list:    "",
+			wantErr: "list: no makefiles",
+		},
+		{
+			list:    "# comment only\n\n",
+			wantErr: "list: no makefiles",
+		},
+	} {
+		err := ioutil.WriteFile("list", []byte(tc.list), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := readMakefileList("list")
+		if tc.wantErr != "" {
+			if err == nil || err.Error() != tc.wantErr {
+				t.Errorf("readMakefileList(%q)=%q, %v; want error %q", tc.list, got, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("readMakefileList(%q)=%q, %v; want %q", tc.list, got, err, tc.want)
+		}
+	}
+
+	_, err = readMakefileList("nosuchlist")
+	if !os.IsNotExist(err) {
+		t.Errorf("readMakefileList(nosuchlist)=_, %v; want not exist error", err)
+	}
+}
+
+func TestOneShotMakefiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kati_main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	list := filepath.Join(dir, "list")
+	err = ioutil.WriteFile(list, []byte("a.mk\nb.mk\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(dir, "empty")
+	err = ioutil.WriteFile(empty, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(s string) { loadMakefileList = s }(loadMakefileList)
+	for _, tc := range []struct {
+		list    string
+		args    []string
+		want    []string
+		wantErr bool
+	}{
+		{},
+		{
+			args: []string{"foo", "bar"},
+			want: []string{"foo/Android.mk"},
+		},
+		{
+			list: list,
+			args: []string{"foo"},
+			want: []string{"a.mk", "b.mk"},
+		},
+		{
+			list:    empty,
+			wantErr: true,
+		},
+		{
+			list:    filepath.Join(dir, "nosuchlist"),
+			wantErr: true,
+		},
+	} {
+		loadMakefileList = tc.list
+		got, err := oneShotMakefiles(tc.args)
+		if (err != nil) != tc.wantErr || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("oneShotMakefiles(%q) with -load_makefile_list=%q: %q, %v; want %q, error %t", tc.args, tc.list, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
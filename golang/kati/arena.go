@@ -0,0 +1,125 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+// arenaBlockSize is the size of blocks allocated by bufArena.
+// Requests larger than a quarter of it are allocated from the heap.
+const arenaBlockSize = 64 << 10
+
+// bufArena allocates backing storage of evalBuffers from large blocks,
+// which are reused in bulk at statement boundaries instead of being
+// collected one by one.
+//
+// Storage is handed only to buffers from newEbuf, whose bytes must not
+// be used after release, so the arena is reset only when all of them
+// are released. bufArena is not safe for concurrent use; it is active
+// only while loading makefiles.
+type bufArena struct {
+	blocks [][]byte
+	cur    int
+	off    int
+	// live is the number of buffers using the arena but not released.
+	// gen is incremented when blocks are discarded, so buffers of an
+	// older generation are not counted when released.
+	live int
+	gen  int
+
+	allocs   int
+	bytes    int
+	resets   int
+	discards int
+}
+
+// ebufArena is the arena used by newEbuf, or nil if disabled.
+var ebufArena *bufArena
+
+func newBufArena() *bufArena {
+	return &bufArena{}
+}
+
+// alloc returns an empty slice with capacity n.
+func (a *bufArena) alloc(n int) []byte {
+	a.allocs++
+	a.bytes += n
+	if n > arenaBlockSize/4 {
+		return make([]byte, 0, n)
+	}
+	for ; a.cur < len(a.blocks); a.cur++ {
+		if a.off+n <= arenaBlockSize {
+			b := a.blocks[a.cur][a.off : a.off : a.off+n]
+			a.off += n
+			return b
+		}
+		a.off = 0
+	}
+	a.blocks = append(a.blocks, make([]byte, arenaBlockSize))
+	a.off = n
+	return a.blocks[a.cur][0:0:n]
+}
+
+// grow returns buf with capacity for n more bytes.
+func (a *bufArena) grow(buf []byte, n int) []byte {
+	size := 2 * cap(buf)
+	if size < len(buf)+n {
+		size = len(buf) + n
+	}
+	if size < 256 {
+		size = 256
+	}
+	return append(a.alloc(size), buf...)
+}
+
+// statementDone is called at the end of each statement. top is true
+// if the statement is not in an include or $(eval). The arena is reset
+// if no buffers are using it. Otherwise, a top-level statement leaked
+// buffers (e.g. on error), so their blocks are left to GC.
+func (a *bufArena) statementDone(top bool) {
+	if a.live > 0 {
+		if !top {
+			return
+		}
+		a.blocks = nil
+		a.live = 0
+		a.gen++
+		a.discards++
+	}
+	if a.cur == 0 && a.off == 0 {
+		return
+	}
+	a.cur = 0
+	a.off = 0
+	a.resets++
+}
+
+// use is called when buf starts using the arena.
+func (a *bufArena) use(buf *evalBuffer) {
+	buf.arena = a
+	buf.arenaGen = a.gen
+	a.live++
+}
+
+// done is called when buf is released. The storage of buf belongs to
+// the arena, so buf gets back its bootstrap storage.
+func (a *bufArena) done(buf *evalBuffer) {
+	if buf.arenaGen == a.gen {
+		a.live--
+	}
+	buf.arena = nil
+	buf.buf = nil
+}
+
+func (a *bufArena) logStats() {
+	logStats("eval arena: %d allocs %s, %d blocks, %d resets, %d discards", a.allocs, human(a.bytes), len(a.blocks), a.resets, a.discards)
+}
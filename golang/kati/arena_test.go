@@ -0,0 +1,59 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBufArena(t *testing.T) {
+	a := newBufArena()
+	ebufArena = a
+	defer func() { ebufArena = nil }()
+
+	long := strings.Repeat("x", 100)
+	buf := newEbuf()
+	buf.WriteString(long)
+	buf.WriteString(long)
+	if got, want := buf.String(), long+long; got != want {
+		t.Errorf("buf=%q; want=%q", got, want)
+	}
+	p := &buf.Bytes()[0]
+	a.statementDone(false)
+	if a.resets != 0 {
+		t.Errorf("arena reset while buffer is live")
+	}
+	buf.release()
+	a.statementDone(false)
+	if a.resets != 1 {
+		t.Errorf("resets=%d; want=1", a.resets)
+	}
+
+	buf = newEbuf()
+	buf.WriteString(long)
+	if &buf.Bytes()[0] != p {
+		t.Errorf("arena storage is not reused after reset")
+	}
+	// buf is leaked, e.g. by an error.
+	a.statementDone(true)
+	if a.discards != 1 || len(a.blocks) != 0 {
+		t.Errorf("discards=%d blocks=%d; want 1, 0", a.discards, len(a.blocks))
+	}
+	buf.release()
+	if a.live != 0 {
+		t.Errorf("live=%d after releasing discarded buffer; want 0", a.live)
+	}
+}
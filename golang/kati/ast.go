@@ -63,19 +63,21 @@ func (ast *assignAST) evalRHS(ev *Evaluator, lhs string) (Var, error) {
 			return &simpleVar{value: []string{buf.String()}, origin: origin}, nil
 		}
 	case "=":
-		return &recursiveVar{expr: ast.rhs, origin: origin}, nil
+		return &recursiveVar{expr: ast.rhs, origin: origin, srcpos: ast.srcpos}, nil
 	case "+=":
 		prev := ev.lookupVarInCurrentScope(lhs)
 		if !prev.IsDefined() {
-			return &recursiveVar{expr: ast.rhs, origin: origin}, nil
+			return &recursiveVar{expr: ast.rhs, origin: origin, srcpos: ast.srcpos}, nil
 		}
-		return prev.AppendVar(ev, ast.rhs)
+		return appendVar(prev, origin, func() (Var, error) {
+			return prev.AppendVar(ev, ast.rhs)
+		})
 	case "?=":
 		prev := ev.lookupVarInCurrentScope(lhs)
 		if prev.IsDefined() {
 			return prev, nil
 		}
-		return &recursiveVar{expr: ast.rhs, origin: origin}, nil
+		return &recursiveVar{expr: ast.rhs, origin: origin, srcpos: ast.srcpos}, nil
 	}
 	return nil, ast.errorf("unknown assign op: %q", ast.op)
 }
@@ -15,39 +15,229 @@
 package kati
 
 import (
+	"bytes"
 	"fmt"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
 const bootstrapMakefileName = "*bootstrap*"
 
-func bootstrapMakefile(targets []string) (makefile, error) {
-	bootstrap := `
-CC?=cc
-CXX?=g++
-AR?=ar
-MAKE?=kati
-# Pretend to be GNU make 3.81, for compatibility.
-MAKE_VERSION?=3.81
-KATI?=kati
-SHELL=/bin/sh
-# TODO: Add more builtin vars.
-
-# http://www.gnu.org/software/make/manual/make.html#Catalogue-of-Rules
-# The document above is actually not correct. See default.c:
-# http://git.savannah.gnu.org/cgit/make.git/tree/default.c?id=4.1
-.c.o:
-	$(CC) $(CFLAGS) $(CPPFLAGS) $(TARGET_ARCH) -c -o $@ $<
-.cc.o:
-	$(CXX) $(CXXFLAGS) $(CPPFLAGS) $(TARGET_ARCH) -c -o $@ $<
-# TODO: Add more builtin rules.
-`
-	bootstrap += fmt.Sprintf("MAKECMDGOALS:=%s\n", strings.Join(targets, " "))
+// BuiltinVar is a variable defined before reading makefiles, with
+// origin "default". It is not defined if it is already defined in the
+// environment or on the command line.
+type BuiltinVar struct {
+	Name  string
+	Value string
+}
+
+// BuiltinRule is a rule defined before reading makefiles, e.g. a
+// suffix rule ".c.o" or a pattern rule "%.o: %.c".
+type BuiltinRule struct {
+	Target  string
+	Prereqs string
+	Recipe  string
+}
+
+// BuiltinVars are builtin variables. It may be modified before Load
+// to add or remove builtin variables.
+// See http://git.savannah.gnu.org/cgit/make.git/tree/default.c?id=4.1
+var BuiltinVars = []BuiltinVar{
+	{"AR", "ar"},
+	{"ARFLAGS", "rv"},
+	{"AS", "as"},
+	{"CC", "cc"},
+	{"CXX", "g++"},
+	{"CPP", "$(CC) -E"},
+	{"RM", "rm -f"},
+	{"COMPILE.c", "$(CC) $(CFLAGS) $(CPPFLAGS) $(TARGET_ARCH) -c"},
+	{"COMPILE.cc", "$(CXX) $(CXXFLAGS) $(CPPFLAGS) $(TARGET_ARCH) -c"},
+	{"COMPILE.C", "$(COMPILE.cc)"},
+	{"COMPILE.cpp", "$(COMPILE.cc)"},
+	{"COMPILE.s", "$(AS) $(ASFLAGS) $(TARGET_MACH)"},
+	{"COMPILE.S", "$(CC) $(ASFLAGS) $(CPPFLAGS) $(TARGET_ARCH) -c"},
+	{"LINK.o", "$(CC) $(LDFLAGS) $(TARGET_ARCH)"},
+	{"LINK.c", "$(CC) $(CFLAGS) $(CPPFLAGS) $(LDFLAGS) $(TARGET_ARCH)"},
+	{"LINK.cc", "$(CXX) $(CXXFLAGS) $(CPPFLAGS) $(LDFLAGS) $(TARGET_ARCH)"},
+	{"LINK.C", "$(LINK.cc)"},
+	{"LINK.cpp", "$(LINK.cc)"},
+	{"OUTPUT_OPTION", "-o $@"},
+}
+
+// BuiltinRules are builtin rules. It may be modified before Load to
+// add or remove builtin rules.
+// The GNU make manual is actually not correct. See default.c:
+// http://git.savannah.gnu.org/cgit/make.git/tree/default.c?id=4.1
+var BuiltinRules = []BuiltinRule{
+	{Target: ".c.o", Recipe: "$(COMPILE.c) $(OUTPUT_OPTION) $<"},
+	{Target: ".cc.o", Recipe: "$(COMPILE.cc) $(OUTPUT_OPTION) $<"},
+	{Target: ".C.o", Recipe: "$(COMPILE.C) $(OUTPUT_OPTION) $<"},
+	{Target: ".cpp.o", Recipe: "$(COMPILE.cpp) $(OUTPUT_OPTION) $<"},
+	{Target: ".s.o", Recipe: "$(COMPILE.s) -o $@ $<"},
+	{Target: ".S.o", Recipe: "$(COMPILE.S) -o $@ $<"},
+}
+
+// BuiltinSuffixes are the default prerequisites of .SUFFIXES, which
+// enable suffix rules. Suffixes of suffix rules in BuiltinRules are
+// added if they are not listed. They are not defined if builtin
+// rules are disabled.
+// See http://git.savannah.gnu.org/cgit/make.git/tree/default.c?id=4.1
+var BuiltinSuffixes = []string{
+	".out", ".a", ".ln", ".o", ".c", ".cc", ".C", ".cpp", ".p", ".f",
+	".F", ".m", ".r", ".y", ".l", ".ym", ".yl", ".s", ".S", ".mod",
+	".sym", ".def", ".h", ".info", ".dvi", ".tex", ".texinfo", ".texi",
+	".txinfo", ".w", ".ch", ".web", ".sh", ".elc", ".el",
+}
+
+// builtinSuffixes returns BuiltinSuffixes with suffixes of suffix
+// rules in BuiltinRules.
+func builtinSuffixes() []string {
+	suffixes := append([]string{}, BuiltinSuffixes...)
+	known := make(map[string]bool)
+	for _, s := range suffixes {
+		known[s] = true
+	}
+	for _, r := range BuiltinRules {
+		in, out, ok := splitSuffixRule(r.Target)
+		if !ok {
+			continue
+		}
+		for _, s := range []string{"." + in, "." + out} {
+			if !known[s] {
+				known[s] = true
+				suffixes = append(suffixes, s)
+			}
+		}
+	}
+	return suffixes
+}
+
+// SetBuiltinVar adds a builtin variable, or replaces its value.
+func SetBuiltinVar(name, value string) {
+	for i, v := range BuiltinVars {
+		if v.Name == name {
+			BuiltinVars[i].Value = value
+			return
+		}
+	}
+	BuiltinVars = append(BuiltinVars, BuiltinVar{Name: name, Value: value})
+}
+
+// SetBuiltinRule adds a builtin rule, or replaces the rule for the
+// same target.
+func SetBuiltinRule(r BuiltinRule) {
+	for i, br := range BuiltinRules {
+		if br.Target == r.Target {
+			BuiltinRules[i] = r
+			return
+		}
+	}
+	BuiltinRules = append(BuiltinRules, r)
+}
+
+// RemoveBuiltin removes the builtin variable and the builtin rule
+// named name.
+func RemoveBuiltin(name string) {
+	var vars []BuiltinVar
+	for _, v := range BuiltinVars {
+		if v.Name != name {
+			vars = append(vars, v)
+		}
+	}
+	BuiltinVars = vars
+	var rules []BuiltinRule
+	for _, r := range BuiltinRules {
+		if r.Target != name {
+			rules = append(rules, r)
+		}
+	}
+	BuiltinRules = rules
+}
+
+func bootstrapMakefile(req LoadReq) (makefile, error) {
+	var buf bytes.Buffer
+	buf.WriteString("MAKE?=kati\n")
+	// Pretend to be GNU make 3.81, for compatibility.
+	buf.WriteString("MAKE_VERSION?=3.81\n")
+	buf.WriteString("KATI?=kati\n")
+	if !req.NoBuiltinVars {
+		for _, v := range BuiltinVars {
+			fmt.Fprintf(&buf, "%s?=%s\n", v.Name, v.Value)
+		}
+	}
+	if !req.NoBuiltinRules && !req.NoBuiltinVars {
+		fmt.Fprintf(&buf, ".SUFFIXES: %s\n", strings.Join(builtinSuffixes(), " "))
+		for _, r := range BuiltinRules {
+			fmt.Fprintf(&buf, "%s: %s\n\t%s\n", r.Target, r.Prereqs, r.Recipe)
+		}
+	}
+	switch {
+	case req.NoBuiltinVars:
+		buf.WriteString("MAKEFLAGS:=rR\nexport MAKEFLAGS\n")
+	case req.NoBuiltinRules:
+		buf.WriteString("MAKEFLAGS:=r\nexport MAKEFLAGS\n")
+	}
+	// GNU make doesn't take SHELL from the environment.
+	buf.WriteString("SHELL=/bin/sh\n")
+	// MAKELEVEL is inherited from the environment, and is exported
+	// incremented by exportValue.
+	buf.WriteString("ifeq ($(origin MAKELEVEL),undefined)\nMAKELEVEL:=0\nendif\nexport MAKELEVEL\n")
+	fmt.Fprintf(&buf, "MAKECMDGOALS:=%s\n", strings.Join(req.Targets, " "))
 	cwd, err := filepath.Abs(".")
 	if err != nil {
 		return makefile{}, err
 	}
-	bootstrap += fmt.Sprintf("CURDIR:=%s\n", cwd)
-	return parseMakefileString(bootstrap, srcpos{bootstrapMakefileName, 0})
+	fmt.Fprintf(&buf, "CURDIR:=%s\n", cwd)
+	return parseMakefileBytes(buf.Bytes(), srcpos{bootstrapMakefileName, 0}, defaultRecipePrefix)
+}
+
+// exportValue returns the value of the exported variable name in the
+// environment of commands. As GNU make, MAKELEVEL is incremented so
+// sub-makes know their depth.
+func exportValue(name, v string) string {
+	if name != "MAKELEVEL" {
+		return v
+	}
+	level, err := strconv.Atoi(strings.TrimSpace(v))
+	if err != nil {
+		return v
+	}
+	return strconv.Itoa(level + 1)
+}
+
+// MakeflagsLetters returns the single letter flags in v, the value of
+// MAKEFLAGS, e.g. "nr" for "nr --no-print-directory" or "-n -r".
+// Variable assignments after "--" are ignored.
+func MakeflagsLetters(v string) string {
+	var letters []string
+	for i, w := range strings.Fields(v) {
+		switch {
+		case w == "--":
+			return strings.Join(letters, "")
+		case strings.HasPrefix(w, "--"), strings.IndexByte(w, '=') >= 0:
+		case strings.HasPrefix(w, "-"):
+			letters = append(letters, w[1:])
+		case i == 0:
+			// GNU make writes the letters without '-' first.
+			letters = append(letters, w)
+		}
+	}
+	return strings.Join(letters, "")
+}
+
+// dryRunMakeflags returns v, the value of MAKEFLAGS, with the flag n
+// for sub-makes run with DryRunFlag.
+func dryRunMakeflags(v string) string {
+	if strings.IndexByte(MakeflagsLetters(v), 'n') >= 0 {
+		return v
+	}
+	if v == "" || v[0] == ' ' {
+		return "n" + v
+	}
+	w := strings.Fields(v)[0]
+	if w[0] != '-' && strings.IndexByte(w, '=') < 0 {
+		return "n" + v
+	}
+	return "n " + v
 }
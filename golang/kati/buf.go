@@ -15,6 +15,7 @@
 package kati
 
 import (
+	"bytes"
 	"io"
 	"sync"
 )
@@ -66,20 +67,32 @@ func (w *ssvWriter) resetSep() {
 type buffer struct {
 	buf       []byte
 	bootstrap [64]byte // memory to hold first slice
+	// arena is used to grow buf if not nil.
+	arena    *bufArena
+	arenaGen int
 }
 
 func (b *buffer) Write(data []byte) (int, error) {
+	if b.arena != nil && len(b.buf)+len(data) > cap(b.buf) {
+		b.buf = b.arena.grow(b.buf, len(data))
+	}
 	b.buf = append(b.buf, data...)
 	return len(data), nil
 }
 
 func (b *buffer) WriteByte(c byte) error {
+	if b.arena != nil && len(b.buf) == cap(b.buf) {
+		b.buf = b.arena.grow(b.buf, 1)
+	}
 	b.buf = append(b.buf, c)
 	return nil
 }
 
 func (b *buffer) WriteString(s string) (int, error) {
-	b.buf = append(b.buf, []byte(s)...)
+	if b.arena != nil && len(b.buf)+len(s) > cap(b.buf) {
+		b.buf = b.arena.grow(b.buf, len(s))
+	}
+	b.buf = append(b.buf, s...)
 	return len(s), nil
 }
 
@@ -103,11 +116,16 @@ type evalBuffer struct {
 func newEbuf() *evalBuffer {
 	buf := ebufFree.Get().(*evalBuffer)
 	buf.Reset()
+	if ebufArena != nil {
+		ebufArena.use(buf)
+	}
 	return buf
 }
 
 func (buf *evalBuffer) release() {
-	if cap(buf.Bytes()) > 1024 {
+	if buf.arena != nil {
+		buf.arena.done(buf)
+	} else if cap(buf.Bytes()) > 1024 {
 		return
 	}
 	buf.Reset()
@@ -146,10 +164,33 @@ func (buf *wordBuffer) release() {
 	wbufFree.Put(buf)
 }
 
+// grow makes room for n more bytes of data, so a large value is
+// written without growing buf and words for each word. Words already
+// written keep referring to the old array, which is never modified.
+func (wb *wordBuffer) grow(data []byte) {
+	n := len(data) + 1
+	if len(wb.buf.buf)+n > cap(wb.buf.buf) {
+		buf := make([]byte, len(wb.buf.buf), 2*cap(wb.buf.buf)+n)
+		copy(buf, wb.buf.buf)
+		wb.buf.buf = buf
+	}
+	// data has at most one word more than separators, and
+	// separators are mostly spaces.
+	nw := bytes.Count(data, []byte{' '}) + 1
+	if len(wb.words)+nw > cap(wb.words) {
+		words := make([][]byte, len(wb.words), 2*cap(wb.words)+nw)
+		copy(words, wb.words)
+		wb.words = words
+	}
+}
+
 func (wb *wordBuffer) Write(data []byte) (int, error) {
 	if len(data) == 0 {
 		return 0, nil
 	}
+	if len(data) > 1024 {
+		wb.grow(data)
+	}
 	off := len(wb.buf.buf)
 	var cont bool
 	if !isWhitespace(rune(data[0])) && len(wb.buf.buf) > 0 {
@@ -158,13 +199,12 @@ func (wb *wordBuffer) Write(data []byte) (int, error) {
 	ws := newWordScanner(data)
 	for ws.Scan() {
 		if cont {
-			word := wb.words[len(wb.words)-1]
-			wb.words = wb.words[:len(wb.words)-1]
-			wb.buf.buf = wb.buf.buf[:len(wb.buf.buf)-len(word)]
-			var w []byte
-			w = append(w, word...)
-			w = append(w, ws.Bytes()...)
-			wb.writeWord(w)
+			// The last word ends at the end of buf, so it's
+			// extended in place.
+			i := len(wb.words) - 1
+			woff := len(wb.buf.buf) - len(wb.words[i])
+			wb.buf.buf = append(wb.buf.buf, ws.Bytes()...)
+			wb.words[i] = wb.buf.buf[woff:]
 			cont = false
 			continue
 		}
@@ -195,12 +235,17 @@ func (wb *wordBuffer) writeWord(word []byte) {
 }
 
 func (wb *wordBuffer) writeWordString(word string) {
-	wb.writeWord([]byte(word))
+	if len(wb.buf.buf) > 0 {
+		wb.buf.buf = append(wb.buf.buf, ' ')
+	}
+	off := len(wb.buf.buf)
+	wb.buf.buf = append(wb.buf.buf, word...)
+	wb.words = append(wb.words, wb.buf.buf[off:off+len(word)])
 }
 
 func (wb *wordBuffer) Reset() {
 	wb.buf.Reset()
-	wb.words = nil
+	wb.words = wb.words[:0]
 }
 
 func (wb *wordBuffer) resetSep() {}
@@ -16,6 +16,7 @@ package kati
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -36,6 +37,14 @@ func TestWordBuffer(t *testing.T) {
 			in:   []string{"  foo bar\tbaz "},
 			want: []string{"foo", "bar", "baz"},
 		},
+		{
+			in:   []string{"foo\n", "bar\v", "baz"},
+			want: []string{"foo", "bar", "baz"},
+		},
+		{
+			in:   []string{"foo", "\fbar"},
+			want: []string{"foo", "bar"},
+		},
 		{
 			in:   []string{"foo", "bar"},
 			want: []string{"foobar"},
@@ -52,6 +61,14 @@ func TestWordBuffer(t *testing.T) {
 			in:   []string{"foo ", " bar"},
 			want: []string{"foo", "bar"},
 		},
+		{
+			in:   []string{"foo", "bar", "baz qux", "quux"},
+			want: []string{"foobarbaz", "quxquux"},
+		},
+		{
+			in:   []string{"a", strings.Repeat("b", 2000) + " c", "d"},
+			want: []string{"a" + strings.Repeat("b", 2000), "cd"},
+		},
 	} {
 		var wb wordBuffer
 		for _, s := range tc.in {
@@ -67,3 +84,19 @@ func TestWordBuffer(t *testing.T) {
 		}
 	}
 }
+
+func TestWordBufferReset(t *testing.T) {
+	wb := newWbuf()
+	wb.Write([]byte(strings.Repeat("foo ", 1000)))
+	wb.Reset()
+	wb.Write([]byte("bar baz"))
+	wb.writeWordString("qux")
+	var got []string
+	for _, word := range wb.words {
+		got = append(got, string(word))
+	}
+	want := []string{"bar", "baz", "qux"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("words after Reset=%q; want %q", got, want)
+	}
+}
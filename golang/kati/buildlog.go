@@ -0,0 +1,171 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+const buildLogHeader = "# kati build log v1"
+
+// buildLog records commands and timestamps of targets built by the
+// Executor, like .ninja_log. Timestamps are in nanoseconds, so a
+// target is rebuilt when an input changes in the same second, and
+// when its commands change.
+//
+// Each line of the file is
+//
+//  <output mtime>\t<inputs mtime>\t<command hash>\t<output>
+type buildLog struct {
+	filename string
+
+	mu      sync.Mutex
+	entries map[string]buildLogEntry
+}
+
+type buildLogEntry struct {
+	// Mtime is the mtime of the output after its recipe ran.
+	Mtime int64
+	// InputsMtime is the latest mtime of inputs when the recipe ran.
+	InputsMtime int64
+	// CmdHash is the digest of the commands, by cmdHash.
+	CmdHash string
+}
+
+// loadBuildLog loads the build log in filename. A missing log, or
+// one in another version, is ignored.
+func loadBuildLog(filename string) (*buildLog, error) {
+	l := &buildLog{
+		filename: filename,
+		entries:  make(map[string]buildLogEntry),
+	}
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	if !s.Scan() || s.Text() != buildLogHeader {
+		glog.Warningf("ignore build log %s: unknown version", filename)
+		return l, nil
+	}
+	for s.Scan() {
+		ws := strings.SplitN(s.Text(), "\t", 4)
+		if len(ws) != 4 {
+			return nil, fmt.Errorf("%s: malformed line %q", filename, s.Text())
+		}
+		mtime, err := strconv.ParseInt(ws[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		inputsMtime, err := strconv.ParseInt(ws[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		l.entries[ws[3]] = buildLogEntry{
+			Mtime:       mtime,
+			InputsMtime: inputsMtime,
+			CmdHash:     ws[2],
+		}
+	}
+	return l, s.Err()
+}
+
+func (l *buildLog) lookup(output string) (buildLogEntry, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.entries[output]
+	return e, ok
+}
+
+func (l *buildLog) record(output string, e buildLogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries[output] = e
+}
+
+// save writes the log, keeping entries of targets not built in this
+// run.
+func (l *buildLog) save() (err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var outputs []string
+	for output := range l.entries {
+		outputs = append(outputs, output)
+	}
+	sort.Strings(outputs)
+	tmp := l.filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	fmt.Fprintln(w, buildLogHeader)
+	for _, output := range outputs {
+		e := l.entries[output]
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\n", e.Mtime, e.InputsMtime, e.CmdHash, output)
+	}
+	err = w.Flush()
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, l.filename)
+}
+
+// cmdHash returns the digest of commands run by rr.
+func cmdHash(rr []runner) string {
+	h := sha256.New()
+	writeCacheKeyInt(h, len(rr))
+	for _, r := range rr {
+		writeCacheKeyField(h, r.cmd)
+		writeCacheKeyField(h, r.shell)
+		writeCacheKeyField(h, r.shellFlags)
+		writeCacheKeyField(h, strconv.FormatBool(r.ignoreError))
+		// Commands without exported variables keep their digests.
+		for _, e := range r.env {
+			writeCacheKeyField(h, e)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// mtimeNano returns the mtime of filename in nanoseconds, or -1 if
+// it doesn't exist.
+func mtimeNano(filename string) int64 {
+	st, err := os.Stat(filename)
+	if err != nil {
+		return -1
+	}
+	return st.ModTime().UnixNano()
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"os"
+	"sort"
+)
+
+// cacheKeyEntry is the cache key of a ninja build edge.
+type cacheKeyEntry struct {
+	output string
+	key    string
+}
+
+// cacheKey returns the hex digest of a build edge, which runs cmd with
+// inputs under env. env is a sorted list of "name=value" of exported
+// variables.
+func cacheKey(cmd string, inputs, env []string) string {
+	h := sha256.New()
+	writeCacheKeyField(h, cmd)
+	writeCacheKeyInt(h, len(inputs))
+	for _, in := range inputs {
+		writeCacheKeyField(h, in)
+	}
+	writeCacheKeyInt(h, len(env))
+	for _, e := range env {
+		writeCacheKeyField(h, e)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeCacheKeyField writes s with its length, so fields can't be
+// confused with each other.
+func writeCacheKeyField(h hash.Hash, s string) {
+	writeCacheKeyInt(h, len(s))
+	h.Write([]byte(s))
+}
+
+func writeCacheKeyInt(h hash.Hash, n int) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(n))
+	h.Write(b[:])
+}
+
+func (n *NinjaGenerator) cacheKeysName() string {
+	return fmt.Sprintf("build%s.cache_keys", n.Suffix)
+}
+
+// exportedEnv returns the environment of commands run by ninja, as
+// set up by ninja.sh.
+func (n *NinjaGenerator) exportedEnv() ([]string, error) {
+	var env []string
+	for name, export := range n.exports {
+		if !export {
+			env = append(env, name)
+			continue
+		}
+		v, err := n.ctx.ev.EvaluateVar(name)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, name+"="+v)
+	}
+	sort.Strings(env)
+	return env, nil
+}
+
+// generateCacheKeys writes the cache keys of build edges, one
+// "output<TAB>key" line per edge.
+func (n *NinjaGenerator) generateCacheKeys() (err error) {
+	f, err := os.Create(n.cacheKeysName())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cerr := f.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+	for _, e := range n.cacheKeys {
+		fmt.Fprintf(f, "%s\t%s\n", e.output, e.key)
+	}
+	return nil
+}
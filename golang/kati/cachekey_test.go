@@ -0,0 +1,46 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import "testing"
+
+func TestCacheKey(t *testing.T) {
+	type edge struct {
+		cmd    string
+		inputs []string
+		env    []string
+	}
+	base := edge{
+		cmd:    "cc -c a.c -o a.o",
+		inputs: []string{"a.c", "a.h"},
+		env:    []string{"PATH=/bin"},
+	}
+	baseKey := cacheKey(base.cmd, base.inputs, base.env)
+	if got := cacheKey(base.cmd, base.inputs, base.env); got != baseKey {
+		t.Errorf("cacheKey is not stable: %s != %s", got, baseKey)
+	}
+	for _, e := range []edge{
+		{cmd: "cc -O2 -c a.c -o a.o", inputs: base.inputs, env: base.env},
+		{cmd: base.cmd, inputs: []string{"a.c"}, env: base.env},
+		{cmd: base.cmd, inputs: []string{"a.c a.h"}, env: base.env},
+		{cmd: base.cmd, inputs: base.inputs, env: []string{"PATH=/usr/bin"}},
+		{cmd: base.cmd, inputs: base.inputs},
+		{cmd: base.cmd, inputs: append(base.inputs, base.env...)},
+	} {
+		if got := cacheKey(e.cmd, e.inputs, e.env); got == baseKey {
+			t.Errorf("cacheKey(%q, %q, %q)=%s; same as %+v", e.cmd, e.inputs, e.env, got, base)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ConformanceCase is a makefile to run under both GNU make and kati.
+type ConformanceCase struct {
+	Name     string
+	Makefile []byte
+	// Targets are built one by one in the same directory.
+	// If empty, the default target is built.
+	Targets []string
+	// Vars are command line variables, e.g. "SHELL=/bin/bash".
+	Vars []string
+}
+
+// ConformanceResult is the outcome of running make or kati once.
+type ConformanceResult struct {
+	Output   string
+	Files    []string
+	ExitCode int
+}
+
+var conformanceNormalizations = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile("([`'\"]|\xe2\x80\x98|\xe2\x80\x99)"), `"`},
+	{regexp.MustCompile(`make(?:\[\d+\])?: (Entering|Leaving) directory[^\n]*\n`), ""},
+	{regexp.MustCompile(`(?:make(?:\[\d+\])?|kati): `), ""},
+	{regexp.MustCompile(" recipe for target "), " commands for target "},
+	{regexp.MustCompile(" recipe commences "), " commands commence "},
+	{regexp.MustCompile("missing rule before recipe."), "missing rule before commands."},
+	{regexp.MustCompile(" (did you mean TAB instead of 8 spaces?)"), ""},
+	{regexp.MustCompile("Extraneous text after"), "extraneous text after"},
+	{regexp.MustCompile(`\s+Stop\.`), ""},
+	{regexp.MustCompile(`/bin/(ba)?sh: (line 0: )?`), ""},
+	{regexp.MustCompile(`\*kati\*[^\n]*`), ""},
+	{regexp.MustCompile(`.*: warning for parse error in an unevaluated line: [^\n]*`), ""},
+	{regexp.MustCompile(`\[\S+:\d+: (\S+)\] Error 127 \([^\n]*`), "[$1] Error 127"},
+	// kati doesn't remake missing makefiles.
+	{regexp.MustCompile(`(: )open (\S+): n(o such file or directory)\nNOTE:[^\n]*`), "${1}${2}: N${3}"},
+	{regexp.MustCompile(`(: \S+: No such file or directory)\n\*\*\* No rule to make target "[^"]+".`), "$1"},
+	{regexp.MustCompile(`\[\S+:\d+: `), "["},
+	{regexp.MustCompile(`Makefile:\d+: (commands|recipe) for target ".*?" failed\n`), ""},
+}
+
+// circular dependency messages may be printed at different timing.
+var conformanceCircularRE = regexp.MustCompile(`(Circular .* dropped\.\n)`)
+
+func normalizeConformanceOutput(out []byte) string {
+	var circ []byte
+	for _, m := range conformanceCircularRE.FindAllSubmatch(out, -1) {
+		circ = append(circ, m[1]...)
+	}
+	out = append(circ, conformanceCircularRE.ReplaceAll(out, nil)...)
+	for _, n := range conformanceNormalizations {
+		out = n.re.ReplaceAll(out, []byte(n.repl))
+	}
+	return string(out)
+}
+
+func conformanceFiles(dir string) ([]string, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, fi := range fis {
+		if fi.Name() == "Makefile" {
+			continue
+		}
+		files = append(files, fi.Name())
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// RunMake runs GNU make found in $PATH in dir.
+func RunMake(dir string, target string, vars []string) (*ConformanceResult, error) {
+	args := append([]string{}, vars...)
+	if target != "" {
+		args = append(args, target)
+	}
+	cmd := exec.Command("make", args...)
+	cmd.Dir = dir
+	cmd.Env = conformanceEnv()
+	out, err := cmd.CombinedOutput()
+	exit := exitStatus(err)
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		return nil, err
+	}
+	files, err := conformanceFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &ConformanceResult{
+		Output:   normalizeConformanceOutput(out),
+		Files:    files,
+		ExitCode: exit,
+	}, nil
+}
+
+func conformanceEnv() []string {
+	var env []string
+	for _, e := range os.Environ() {
+		// suppress GNU make jobserver magic.
+		if strings.HasPrefix(e, "MAKEFLAGS=") || strings.HasPrefix(e, "MAKELEVEL=") {
+			continue
+		}
+		env = append(env, e)
+	}
+	return env
+}
+
+// Diff returns differences between a result of make and a result of kati.
+func (r *ConformanceResult) Diff(k *ConformanceResult) []string {
+	var diffs []string
+	if r.Output != k.Output {
+		diffs = append(diffs, fmt.Sprintf("output differs:\nmake:\n%s\nkati:\n%s", r.Output, k.Output))
+	}
+	if strings.Join(r.Files, " ") != strings.Join(k.Files, " ") {
+		diffs = append(diffs, fmt.Sprintf("files differ: make=%q kati=%q", r.Files, k.Files))
+	}
+	if r.ExitCode != k.ExitCode {
+		diffs = append(diffs, fmt.Sprintf("exit code differs: make=%d kati=%d", r.ExitCode, k.ExitCode))
+	}
+	return diffs
+}
+
+var conformanceTODORE = regexp.MustCompile(`^# TODO(?:\(([-a-z|]+)(?:/[-a-z0-9|]+)?\))?`)
+
+// KnownDeviation reports whether the makefile is annotated as a known
+// deviation for Go kati, i.e. "# TODO", "# TODO(go)" or "# TODO(all)"
+// in its leading comment lines.
+func KnownDeviation(mk []byte) bool {
+	for _, line := range bytes.Split(mk, []byte("\n")) {
+		if !bytes.HasPrefix(line, []byte("#!")) && !bytes.HasPrefix(line, []byte("# TODO")) {
+			break
+		}
+		m := conformanceTODORE.FindSubmatch(line)
+		if m == nil {
+			continue
+		}
+		if len(m[1]) == 0 {
+			return true
+		}
+		for _, v := range strings.Split(string(m[1]), "|") {
+			if v == "go" || v == "all" {
+				return true
+			}
+		}
+	}
+	return false
+}
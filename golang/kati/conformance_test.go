@@ -0,0 +1,241 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var conformance = flag.String("conformance", "", "glob of testcase makefiles to diff against GNU make, e.g. ../../testcase/*.mk")
+
+var conformanceTargetRE = regexp.MustCompile(`(?m)^(test\d*)`)
+
+func TestConformance(t *testing.T) {
+	if *conformance == "" {
+		t.Skip("-conformance is not set")
+	}
+	if _, err := exec.LookPath("make"); err != nil {
+		t.Skip(err)
+	}
+	files, err := filepath.Glob(*conformance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpdir, err := ioutil.TempDir("", "kati_conformance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	for _, fn := range files {
+		fn := fn
+		t.Run(filepath.Base(fn), func(t *testing.T) {
+			mk, err := ioutil.ReadFile(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if KnownDeviation(mk) {
+				t.Skip("known deviation")
+			}
+			c := ConformanceCase{
+				Name:     filepath.Base(fn),
+				Makefile: mk,
+				Vars:     []string{"SHELL=/bin/bash"},
+			}
+			seen := make(map[string]bool)
+			for _, m := range conformanceTargetRE.FindAllSubmatch(mk, -1) {
+				tc := string(m[1])
+				if !seen[tc] {
+					seen[tc] = true
+					c.Targets = append(c.Targets, tc)
+				}
+			}
+			diffs, err := runConformance(tmpdir, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, d := range diffs {
+				t.Error(d)
+			}
+		})
+	}
+}
+
+func TestKnownDeviation(t *testing.T) {
+	for _, tc := range []struct {
+		mk   string
+		want bool
+	}{
+		{mk: "test:\n", want: false},
+		{mk: "# TODO\ntest:\n", want: true},
+		{mk: "# TODO(go)\ntest:\n", want: true},
+		{mk: "# TODO(c)\ntest:\n", want: false},
+		{mk: "# TODO(c|go)\ntest:\n", want: true},
+		{mk: "# TODO(go/test2)\ntest:\n", want: true},
+		{mk: "#!/bin/bash\n# TODO(all)\n", want: true},
+		{mk: "a := 1\n# TODO(go)\n", want: false},
+	} {
+		if got := KnownDeviation([]byte(tc.mk)); got != tc.want {
+			t.Errorf("KnownDeviation(%q)=%t; want=%t", tc.mk, got, tc.want)
+		}
+	}
+}
+
+// runKati loads Makefile in dir and executes target with Executor
+// in this process. It changes the working directory, environment
+// variables, os.Stdout and os.Stderr while running, so it must not be
+// called concurrently.
+func runKati(dir string, target string, vars []string) (res *ConformanceResult, err error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	env := os.Environ()
+	ofsCache, omakefileCache := fsCache, makefileCache
+	ostdout, ostderr := os.Stdout, os.Stderr
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	outc := make(chan []byte)
+	go func() {
+		b, _ := ioutil.ReadAll(r)
+		outc <- b
+	}()
+	defer func() {
+		os.Stdout, os.Stderr = ostdout, ostderr
+		fsCache, makefileCache = ofsCache, omakefileCache
+		os.Clearenv()
+		for _, e := range env {
+			kv := strings.SplitN(e, "=", 2)
+			os.Setenv(kv[0], kv[1])
+		}
+		cerr := os.Chdir(wd)
+		if err == nil {
+			err = cerr
+		}
+	}()
+
+	err = os.Chdir(dir)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	fsCache = newFsCache()
+	fsCache.readdir(".", unknownFileid)
+	makefileCache = &makefileCacheT{
+		mk: make(map[string]mkCacheEntry),
+	}
+	os.Stdout, os.Stderr = w, w
+	exitCode := 0
+	func() {
+		defer func() {
+			if p := recover(); p != nil {
+				fmt.Printf("panic: %v\n", p)
+				exitCode = 2
+			}
+		}()
+		kerr := runKatiInProcess(target, vars)
+		if kerr != nil {
+			// same as cmd/kati.
+			fmt.Println(kerr)
+			exitCode = 2
+		}
+	}()
+	w.Close()
+	out := <-outc
+	r.Close()
+	files, err := conformanceFiles(".")
+	if err != nil {
+		return nil, err
+	}
+	return &ConformanceResult{
+		Output:   normalizeConformanceOutput(out),
+		Files:    files,
+		ExitCode: exitCode,
+	}, nil
+}
+
+func runKatiInProcess(target string, vars []string) error {
+	req := FromCommandLine(vars)
+	if target != "" {
+		req.Targets = []string{target}
+	}
+	req.EnvironmentVars = conformanceEnv()
+	g, err := Load(req)
+	if err != nil {
+		return err
+	}
+	ex, err := NewExecutor(nil)
+	if err != nil {
+		return err
+	}
+	return ex.Exec(g, req.Targets)
+}
+
+// runConformance runs c under GNU make and kati in fresh directories
+// under tmpdir, and returns differences for each target.
+func runConformance(tmpdir string, c ConformanceCase) ([]string, error) {
+	var dirs [2]string
+	for i, name := range []string{"make", "kati"} {
+		dir := filepath.Join(tmpdir, c.Name, name)
+		err := os.RemoveAll(dir)
+		if err != nil {
+			return nil, err
+		}
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			return nil, err
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, "Makefile"), c.Makefile, 0666)
+		if err != nil {
+			return nil, err
+		}
+		dirs[i], err = filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	targets := c.Targets
+	if len(targets) == 0 {
+		targets = []string{""}
+	}
+	var diffs []string
+	for _, t := range targets {
+		m, err := RunMake(dirs[0], t, c.Vars)
+		if err != nil {
+			return nil, err
+		}
+		k, err := runKati(dirs[1], t, c.Vars)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range m.Diff(k) {
+			if t != "" {
+				d = t + ": " + d
+			}
+			diffs = append(diffs, d)
+		}
+	}
+	return diffs, nil
+}
@@ -23,15 +23,29 @@ import (
 	"github.com/golang/glog"
 )
 
+// waitTarget in a prerequisite list, e.g. "all: clean .WAIT build",
+// makes prerequisites after it wait for ones before it, as GNU make
+// 4.4 does. It is not a prerequisite itself.
+const waitTarget = ".WAIT"
+
 // DepNode represents a makefile rule for an output.
 type DepNode struct {
-	Output             string
-	Cmds               []string
-	Deps               []*DepNode
-	OrderOnlys         []*DepNode
-	Parents            []*DepNode
-	HasRule            bool
-	IsPhony            bool
+	Output     string
+	Cmds       []string
+	Deps       []*DepNode
+	OrderOnlys []*DepNode
+	Parents    []*DepNode
+	HasRule    bool
+	IsPhony    bool
+	// IsIntermediate is true if the output is listed in .INTERMEDIATE
+	// or .SECONDARY.
+	IsIntermediate bool
+	// IsPrecious is true if the output is listed in .PRECIOUS or
+	// .SECONDARY, so kati never deletes it.
+	IsPrecious bool
+	// IsPatternRule is true if the commands come from a pattern rule,
+	// a static pattern rule or a suffix rule, i.e. $* is the stem.
+	IsPatternRule      bool
 	ActualInputs       []string
 	TargetSpecificVars Vars
 	Filename           string
@@ -49,13 +63,34 @@ type depBuilder struct {
 
 	implicitRules *ruleTrie
 
+	// suffixRules are suffix rules keyed by the output suffix, in
+	// the order of input suffixes in .SUFFIXES.
 	suffixRules map[string][]*rule
-	firstRule   *rule
-	vars        Vars
-	ev          *Evaluator
-	vpaths      searchPaths
-	done        map[string]*DepNode
-	phony       map[string]bool
+	// suffixes are prerequisites of .SUFFIXES, i.e. known suffixes.
+	suffixes  []string
+	firstRule *rule
+	vars      Vars
+	ev        *Evaluator
+	vpaths    searchPaths
+	done      map[string]*DepNode
+	phony     map[string]bool
+	// phonyPatterns are patterns in .PHONY, e.g. "%-clean", which
+	// make targets matching them phony.
+	phonyPatterns []pattern
+	// intermediate and precious are targets listed in .INTERMEDIATE,
+	// .SECONDARY and .PRECIOUS. "" is in both if .SECONDARY has no
+	// inputs, which makes all targets secondary.
+	intermediate map[string]bool
+	precious     map[string]bool
+	// conflicts are rules whose commands were overridden.
+	conflicts []RuleConflict
+	// exportAll is true if .EXPORT_ALL_VARIABLES is a target.
+	exportAll bool
+	// deleteOnError is true if .DELETE_ON_ERROR is a target.
+	deleteOnError bool
+	// globs are files matched by wildcards in prerequisites, keyed
+	// by the pattern.
+	globs map[string][]string
 
 	trace                         []string
 	nodeCnt                       int
@@ -118,6 +153,27 @@ func (rt *ruleTrie) lookup(name string) []*rule {
 	return rules
 }
 
+// all returns all rules in rt, in the order lookup would return
+// them if they all matched.
+func (rt *ruleTrie) all() []*rule {
+	if rt == nil {
+		return nil
+	}
+	var rules []*rule
+	for _, entry := range rt.rules {
+		rules = append(rules, entry.rule)
+	}
+	var keys []byte
+	for c := range rt.children {
+		keys = append(keys, c)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	for _, c := range keys {
+		rules = append(rules, rt.children[c].all()...)
+	}
+	return rules
+}
+
 func (rt *ruleTrie) size() int {
 	if rt == nil {
 		return 0
@@ -141,22 +197,40 @@ func (db *depBuilder) exists(target string) bool {
 	if present {
 		return true
 	}
-	if db.phony[target] {
+	if db.isPhony(target) {
 		return true
 	}
 	_, ok := db.vpaths.exists(target)
 	return ok
 }
 
+// isPhony reports whether target is listed in .PHONY, or matches a
+// pattern in it.
+func (db *depBuilder) isPhony(target string) bool {
+	if db.phony[target] {
+		return true
+	}
+	for _, pat := range db.phonyPatterns {
+		if pat.match(target) {
+			return true
+		}
+	}
+	return false
+}
+
 func (db *depBuilder) canPickImplicitRule(r *rule, output string) bool {
 	outputPattern := r.outputPatterns[0]
 	if !outputPattern.match(output) {
 		return false
 	}
 	for _, input := range r.inputs {
-		input = outputPattern.subst(input, output)
-		if !db.exists(input) {
-			return false
+		if input == waitTarget {
+			continue
+		}
+		for _, input := range db.expandWildcard(outputPattern.subst(input, output)) {
+			if !db.exists(input) {
+				return false
+			}
 		}
 	}
 	return true
@@ -197,9 +271,31 @@ func (db *depBuilder) pickRule(output string) (*rule, Vars, bool) {
 		db.pickExplicitRuleWithoutCmdCnt++
 	}
 
+	// Builtin pattern rules are tried after suffix rules, as GNU
+	// make installs them after converting suffix rules to pattern
+	// rules.
 	irules := db.implicitRules.lookup(output)
+	if ir, vars, ok := db.pickImplicitRule(irules, r, vars, output, false); ok {
+		return ir, vars, true
+	}
+	if sr, vars, ok := db.pickSuffixRule(r, vars, output); ok {
+		return sr, vars, true
+	}
+	if ir, vars, ok := db.pickImplicitRule(irules, r, vars, output, true); ok {
+		return ir, vars, true
+	}
+	return r, vars, r != nil
+}
+
+// pickImplicitRule picks a pattern rule in irules for output. It
+// picks only builtin rules if builtin is true, or only rules in
+// makefiles otherwise.
+func (db *depBuilder) pickImplicitRule(irules []*rule, r *rule, vars Vars, output string, builtin bool) (*rule, Vars, bool) {
 	for i := len(irules) - 1; i >= 0; i-- {
 		irule := irules[i]
+		if (irule.filename == bootstrapMakefileName) != builtin {
+			continue
+		}
 		if !db.canPickImplicitRule(irule, output) {
 			glog.Infof("ignore implicit rule %q %s", output, irule)
 			continue
@@ -227,14 +323,18 @@ func (db *depBuilder) pickRule(output string) (*rule, Vars, bool) {
 		// TODO(ukai): check len(irule.cmd) ?
 		return irule, vars, true
 	}
+	return nil, vars, false
+}
 
+// pickSuffixRule picks a suffix rule for output.
+func (db *depBuilder) pickSuffixRule(r *rule, vars Vars, output string) (*rule, Vars, bool) {
 	outputSuffix := filepath.Ext(output)
 	if !strings.HasPrefix(outputSuffix, ".") {
-		return r, vars, r != nil
+		return nil, vars, false
 	}
 	rules, present := db.suffixRules[outputSuffix[1:]]
 	if !present {
-		return r, vars, r != nil
+		return nil, vars, false
 	}
 	for _, irule := range rules {
 		if len(irule.inputs) != 1 {
@@ -261,12 +361,52 @@ func (db *depBuilder) pickRule(output string) (*rule, Vars, bool) {
 		// TODO(ukai): check len(irule.cmd) ?
 		return irule, vars, true
 	}
-	return r, vars, r != nil
+	return nil, vars, false
+}
+
+// expandWildcard returns files matching input, sorted as GNU make
+// does, if input has wildcard characters. input is kept if no file
+// matches.
+func (db *depBuilder) expandWildcard(input string) []string {
+	if !hasWildcardMeta(input) {
+		return []string{input}
+	}
+	m, ok := db.globs[input]
+	if !ok {
+		// The pattern is recorded in the stamp by stampGlobs.
+		files, _ := fsCache.untracedGlob(input)
+		for _, f := range files {
+			m = append(m, intern(trimLeadingCurdir(f)))
+		}
+		sort.Strings(m)
+		db.globs[input] = m
+	}
+	if len(m) == 0 {
+		return []string{input}
+	}
+	return m
+}
+
+// stampGlobs returns wildcards expanded in prerequisites, sorted by
+// the pattern.
+func (db *depBuilder) stampGlobs() []StampGlob {
+	var globs []StampGlob
+	for pat, files := range db.globs {
+		globs = append(globs, StampGlob{Pattern: pat, Files: files})
+	}
+	sort.Slice(globs, func(i, j int) bool {
+		return globs[i].Pattern < globs[j].Pattern
+	})
+	return globs
 }
 
-func expandInputs(rule *rule, output string) []string {
+func (db *depBuilder) expandInputs(rule *rule, output string) []string {
 	var inputs []string
 	for _, input := range rule.inputs {
+		if input == waitTarget {
+			inputs = append(inputs, input)
+			continue
+		}
 		if len(rule.outputPatterns) > 0 {
 			if len(rule.outputPatterns) != 1 {
 				panic(fmt.Sprintf("FIXME: multiple output pattern is not supported yet"))
@@ -275,11 +415,61 @@ func expandInputs(rule *rule, output string) []string {
 		} else if rule.isSuffixRule {
 			input = intern(replaceSuffix(output, input))
 		}
-		inputs = append(inputs, input)
+		inputs = append(inputs, db.expandWildcard(input)...)
 	}
 	return inputs
 }
 
+// addWaits makes deps after each .WAIT, at indexes waits, order-only
+// dependent on deps before it, so the Executor and ninja don't start
+// them earlier. Unlike GNU make, the order holds wherever the nodes
+// are needed, as ninja has no order local to a parent: see
+// testcase/wait_cross_rule.sh. Dependencies making a cycle are not
+// added.
+func addWaits(deps []*DepNode, waits []int) {
+	for _, w := range waits {
+		for _, b := range deps[:w] {
+			// b depends on nodes in reached, which can't wait for b.
+			reached := make(map[*DepNode]bool)
+			reachNodes(b, reached)
+			for _, d := range deps[w:] {
+				if b == d || containsNode(d.Deps, b) || containsNode(d.OrderOnlys, b) {
+					continue
+				}
+				if reached[d] {
+					glog.Warningf("%s .WAIT %s: dependency cycle dropped", b.Output, d.Output)
+					continue
+				}
+				d.OrderOnlys = append(d.OrderOnlys, b)
+				b.Parents = append(b.Parents, d)
+			}
+		}
+	}
+}
+
+// reachNodes adds n and all nodes n depends on to reached.
+func reachNodes(n *DepNode, reached map[*DepNode]bool) {
+	if reached[n] {
+		return
+	}
+	reached[n] = true
+	for _, d := range n.Deps {
+		reachNodes(d, reached)
+	}
+	for _, d := range n.OrderOnlys {
+		reachNodes(d, reached)
+	}
+}
+
+func containsNode(nodes []*DepNode, n *DepNode) bool {
+	for _, d := range nodes {
+		if d == n {
+			return true
+		}
+	}
+	return false
+}
+
 func (db *depBuilder) buildPlan(output string, neededBy string, tsvs Vars) (*DepNode, error) {
 	glog.V(1).Infof("Evaluating command: %s", output)
 	db.nodeCnt++
@@ -291,7 +481,12 @@ func (db *depBuilder) buildPlan(output string, neededBy string, tsvs Vars) (*Dep
 		return n, nil
 	}
 
-	n := &DepNode{Output: output, IsPhony: db.phony[output]}
+	n := &DepNode{
+		Output:         output,
+		IsPhony:        db.isPhony(output),
+		IsIntermediate: db.intermediate[output] || db.intermediate[""],
+		IsPrecious:     db.precious[output] || db.precious[""],
+	}
 	db.done[output] = n
 
 	// create depnode for phony targets?
@@ -338,9 +533,16 @@ func (db *depBuilder) buildPlan(output string, neededBy string, tsvs Vars) (*Dep
 		}()
 	}
 
-	inputs := expandInputs(rule, output)
+	inputs := db.expandInputs(rule, output)
 	glog.Infof("Evaluating command: %s inputs:%q => %q", output, rule.inputs, inputs)
+	var actualInputs []string
+	var waits []int
 	for _, input := range inputs {
+		if input == waitTarget {
+			waits = append(waits, len(n.Deps))
+			continue
+		}
+		actualInputs = append(actualInputs, input)
 		db.trace = append(db.trace, input)
 		ni, err := db.buildPlan(input, output, tsvs)
 		db.trace = db.trace[0 : len(db.trace)-1]
@@ -352,8 +554,18 @@ func (db *depBuilder) buildPlan(output string, neededBy string, tsvs Vars) (*Dep
 			ni.Parents = append(ni.Parents, n)
 		}
 	}
+	addWaits(n.Deps, waits)
 
+	var orderOnlys []string
 	for _, input := range rule.orderOnlyInputs {
+		orderOnlys = append(orderOnlys, db.expandWildcard(input)...)
+	}
+	waits = nil
+	for _, input := range orderOnlys {
+		if input == waitTarget {
+			waits = append(waits, len(n.OrderOnlys))
+			continue
+		}
 		db.trace = append(db.trace, input)
 		ni, err := db.buildPlan(input, output, tsvs)
 		db.trace = db.trace[0 : len(db.trace)-1]
@@ -365,10 +577,12 @@ func (db *depBuilder) buildPlan(output string, neededBy string, tsvs Vars) (*Dep
 			ni.Parents = append(ni.Parents, n)
 		}
 	}
+	addWaits(n.OrderOnlys, waits)
 
 	n.HasRule = true
 	n.Cmds = rule.cmds
-	n.ActualInputs = inputs
+	n.IsPatternRule = rule != db.rules[output] || rule.isStaticPattern
+	n.ActualInputs = actualInputs
 	n.TargetSpecificVars = make(Vars)
 	for k, v := range tsvs {
 		if glog.V(1) {
@@ -387,36 +601,67 @@ func (db *depBuilder) buildPlan(output string, neededBy string, tsvs Vars) (*Dep
 	return n, nil
 }
 
-func (db *depBuilder) populateSuffixRule(r *rule, output string) bool {
+// splitSuffixRule returns the input and output suffixes, without
+// dots, if output looks like a suffix rule, e.g. ".c.o".
+func splitSuffixRule(output string) (string, string, bool) {
 	if len(output) == 0 || output[0] != '.' {
-		return false
+		return "", "", false
 	}
 	rest := output[1:]
 	dotIndex := strings.IndexByte(rest, '.')
 	// If there is only a single dot or the third dot, this is not a
 	// suffix rule.
 	if dotIndex < 0 || strings.IndexByte(rest[dotIndex+1:], '.') >= 0 {
-		return false
+		return "", "", false
 	}
+	return rest[:dotIndex], rest[dotIndex+1:], true
+}
 
-	// This is a suffix rule.
-	inputSuffix := rest[:dotIndex]
-	outputSuffix := rest[dotIndex+1:]
-	sr := &rule{}
-	*sr = *r
-	sr.inputs = []string{inputSuffix}
-	sr.isSuffixRule = true
-	db.suffixRules[outputSuffix] = append([]*rule{sr}, db.suffixRules[outputSuffix]...)
-	return true
+// populateSuffixRules registers rules like ".c.o" as suffix rules
+// after all rules are read. As in GNU make, they are suffix rules
+// only if both suffixes are in .SUFFIXES, and rules for an output
+// suffix are tried in the order of input suffixes in .SUFFIXES. So
+// ".SUFFIXES:" without prerequisites disables all suffix rules,
+// including builtin ones.
+func (db *depBuilder) populateSuffixRules() {
+	known := make(map[string]bool)
+	var suffixes []string
+	for _, s := range db.suffixes {
+		if !strings.HasPrefix(s, ".") || known[s[1:]] {
+			continue
+		}
+		known[s[1:]] = true
+		suffixes = append(suffixes, s[1:])
+	}
+	for _, inputSuffix := range suffixes {
+		for _, outputSuffix := range suffixes {
+			r, present := db.rules["."+inputSuffix+"."+outputSuffix]
+			if !present {
+				continue
+			}
+			sr := &rule{}
+			*sr = *r
+			sr.inputs = []string{inputSuffix}
+			sr.isSuffixRule = true
+			db.suffixRules[outputSuffix] = append(db.suffixRules[outputSuffix], sr)
+		}
+	}
 }
 
-func mergeRules(oldRule, r *rule, output string, isSuffixRule bool) (*rule, error) {
+func (db *depBuilder) mergeRules(oldRule, r *rule, output string, isSuffixRule bool) (*rule, error) {
 	if oldRule.isDoubleColon != r.isDoubleColon {
 		return nil, r.errorf("*** target file %q has both : and :: entries.", output)
 	}
 	if len(oldRule.cmds) > 0 && len(r.cmds) > 0 && !isSuffixRule && !r.isDoubleColon {
 		warn(r.cmdpos(), "overriding commands for target %q", output)
 		warn(oldRule.cmdpos(), "ignoring old commands for target %q", output)
+		db.conflicts = append(db.conflicts, RuleConflict{
+			Target:      output,
+			Filename:    r.filename,
+			Lineno:      r.cmdLineno,
+			OldFilename: oldRule.filename,
+			OldLineno:   oldRule.cmdLineno,
+		})
 	}
 
 	mr := &rule{}
@@ -425,6 +670,7 @@ func mergeRules(oldRule, r *rule, output string, isSuffixRule bool) (*rule, erro
 		mr.cmds = append(oldRule.cmds, mr.cmds...)
 	} else if len(oldRule.cmds) > 0 && len(r.cmds) == 0 {
 		mr.cmds = oldRule.cmds
+		mr.isStaticPattern = oldRule.isStaticPattern
 	}
 	// If the latter rule has a command (regardless of the
 	// commands in oldRule), inputs in the latter rule has a
@@ -456,6 +702,7 @@ func expandPattern(r *rule) []*rule {
 		*nr = *r
 		nr.outputs = []string{output}
 		nr.outputPatterns = nil
+		nr.isStaticPattern = true
 		nr.inputs = nil
 		for _, input := range r.inputs {
 			nr.inputs = append(nr.inputs, intern(pat.subst(input, output)))
@@ -474,10 +721,16 @@ func (db *depBuilder) populateExplicitRule(r *rule) error {
 	for _, output := range r.outputs {
 		output = trimLeadingCurdir(output)
 
-		isSuffixRule := db.populateSuffixRule(r, output)
+		_, _, isSuffixRule := splitSuffixRule(output)
+		if output == ".SUFFIXES" {
+			if len(r.inputs) == 0 {
+				db.suffixes = nil
+			}
+			db.suffixes = append(db.suffixes, r.inputs...)
+		}
 
 		if oldRule, present := db.rules[output]; present {
-			mr, err := mergeRules(oldRule, r, output, isSuffixRule)
+			mr, err := db.mergeRules(oldRule, r, output, isSuffixRule)
 			if err != nil {
 				return err
 			}
@@ -545,18 +798,48 @@ func newDepBuilder(er *evalResult, vars Vars) (*depBuilder, error) {
 		vpaths:        er.vpaths,
 		done:          make(map[string]*DepNode),
 		phony:         make(map[string]bool),
+		intermediate:  make(map[string]bool),
+		precious:      make(map[string]bool),
+		globs:         make(map[string][]string),
 	}
 
 	err := db.populateRules(er)
 	if err != nil {
 		return nil, err
 	}
+	db.populateSuffixRules()
 	rule, present := db.rules[".PHONY"]
 	if present {
 		for _, input := range rule.inputs {
+			if pat, ok := isPatternRule([]byte(input)); ok {
+				db.phonyPatterns = append(db.phonyPatterns, pat)
+				continue
+			}
 			db.phony[input] = true
 		}
 	}
+	if rule, present := db.rules[".INTERMEDIATE"]; present {
+		for _, input := range rule.inputs {
+			db.intermediate[input] = true
+		}
+	}
+	if rule, present := db.rules[".SECONDARY"]; present {
+		inputs := rule.inputs
+		if len(inputs) == 0 {
+			inputs = []string{""}
+		}
+		for _, input := range inputs {
+			db.intermediate[input] = true
+			db.precious[input] = true
+		}
+	}
+	if rule, present := db.rules[".PRECIOUS"]; present {
+		for _, input := range rule.inputs {
+			db.precious[input] = true
+		}
+	}
+	_, db.exportAll = db.rules[".EXPORT_ALL_VARIABLES"]
+	_, db.deleteOnError = db.rules[".DELETE_ON_ERROR"]
 	return db, nil
 }
 
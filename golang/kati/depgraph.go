@@ -15,10 +15,13 @@
 package kati
 
 import (
+	"context"
 	"crypto/sha1"
 	"fmt"
 	"io/ioutil"
+	"runtime"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/glog"
@@ -26,18 +29,131 @@ import (
 
 // DepGraph represents rules defined in makefiles.
 type DepGraph struct {
-	nodes       []*DepNode
-	vars        Vars
-	accessedMks []*accessedMakefile
-	exports     map[string]bool
-	vpaths      searchPaths
+	nodes        []*DepNode
+	vars         Vars
+	accessedMks  []*accessedMakefile
+	accessedDirs []string
+	exports      map[string]bool
+	vpaths       searchPaths
+	stderrs      []ShellStderr
+	shells       []StampShell
+	// globs are wildcards expanded in prerequisites and by
+	// $(sort $(wildcard)).
+	globs     []StampGlob
+	conflicts []RuleConflict
+	// exportAll is true if exports has all variables because of
+	// .EXPORT_ALL_VARIABLES.
+	exportAll bool
+	// deleteOnError is true if .DELETE_ON_ERROR is a target.
+	deleteOnError bool
+	// usedEnvs are variables read from the environment, or read
+	// while undefined, while loading.
+	usedEnvs map[string]bool
+	// envHash is the digest of values of usedEnvs not ignored for
+	// the cache, to validate the cache.
+	envHash [sha1.Size]byte
+	// parts are the graphs merged by MergeGraphs, and partOf is the
+	// index in parts of the graph each node came from.
+	parts  []*DepGraph
+	partOf map[*DepNode]int
+	// db is kept if LoadReq.KeepRules is set.
+	db *depBuilder
+	// serializedVars are global variables of a graph loaded by a
+	// LoadSaver, deserialized to vars by loadVars when they are
+	// needed first.
+	serializedVars map[string]serializableVar
 }
 
 // Nodes returns all rules.
 func (g *DepGraph) Nodes() []*DepNode { return g.nodes }
 
-// Vars returns all variables.
-func (g *DepGraph) Vars() Vars { return g.vars }
+// Vars returns all variables. Variables of a graph loaded by a
+// LoadSaver are deserialized by the first call, and nil is returned
+// if it fails. Call LoadVars first to get the error.
+func (g *DepGraph) Vars() Vars {
+	err := g.loadVars()
+	if err != nil {
+		glog.Errorf("%v", err)
+		return nil
+	}
+	return g.vars
+}
+
+// LoadVars deserializes variables of a graph loaded by a LoadSaver,
+// which is done lazily by Vars otherwise. It does nothing for other
+// graphs, or if variables are already deserialized.
+func (g *DepGraph) LoadVars() error {
+	return g.loadVars()
+}
+
+// ShellStderr is stderr of $(shell) captured while loading makefiles
+// when ShellStderrMode is "capture".
+type ShellStderr struct {
+	Filename string
+	Lineno   int
+	Command  string
+	Output   string
+}
+
+func (s ShellStderr) String() string {
+	return fmt.Sprintf("%s:%d: $(shell %s): %s", s.Filename, s.Lineno, s.Command, strings.TrimRight(s.Output, "\n"))
+}
+
+// RuleConflict is a target whose commands are overridden by another
+// rule, i.e. "warning: overriding commands for target".
+type RuleConflict struct {
+	Target string `json:"target"`
+	// Filename and Lineno are the location of the commands used.
+	Filename string `json:"filename"`
+	Lineno   int    `json:"lineno"`
+	// OldFilename and OldLineno are the location of the commands
+	// ignored.
+	OldFilename string `json:"old_filename"`
+	OldLineno   int    `json:"old_lineno"`
+}
+
+// RuleConflicts returns targets whose commands are overridden, in
+// the order they were found. It is not kept in the cache.
+func (g *DepGraph) RuleConflicts() []RuleConflict { return g.conflicts }
+
+// ShellStderrs returns stderr of $(shell) captured while loading.
+func (g *DepGraph) ShellStderrs() []ShellStderr { return g.stderrs }
+
+// AccessedFile is a file or a directory read while loading makefiles.
+type AccessedFile struct {
+	Name   string
+	IsDir  bool
+	Exists bool
+	// Hash is sha1 of the contents for a makefile, or sha1 of
+	// sorted entry names for a directory.
+	Hash [sha1.Size]byte
+}
+
+// AccessedFiles returns makefiles read by include directives and
+// directories read by the find emulator. Patterns of $(wildcard) are
+// recorded in the stamp with their matches instead.
+// Directories are available only if LoadReq.TraceFileAccess is set.
+// Files read by commands in $(shell) are not tracked.
+func (g *DepGraph) AccessedFiles() []AccessedFile {
+	var files []AccessedFile
+	for _, mk := range g.accessedMks {
+		files = append(files, AccessedFile{
+			Name:   mk.Filename,
+			Exists: mk.State != fileNotExists,
+			Hash:   mk.Hash,
+		})
+	}
+	for _, dir := range g.accessedDirs {
+		hash, ok := fsCache.dirHash(dir)
+		files = append(files, AccessedFile{
+			Name:   dir,
+			IsDir:  true,
+			Exists: ok,
+			Hash:   hash,
+		})
+	}
+	return files
+}
 
 func (g *DepGraph) resolveVPATH() {
 	seen := make(map[*DepNode]bool)
@@ -76,6 +192,27 @@ type LoadReq struct {
 	EnvironmentVars  []string
 	UseCache         bool
 	EagerEvalCommand bool
+	// TraceFileAccess records all files read while loading.
+	// See DepGraph.AccessedFiles.
+	TraceFileAccess bool
+	// NoBuiltinRules disables BuiltinRules and BuiltinSuffixes, like
+	// -r of GNU make. Makefiles can also disable builtin suffix
+	// rules by ".SUFFIXES:" without prerequisites.
+	NoBuiltinRules bool
+	// NoBuiltinVars disables BuiltinVars and BuiltinRules, like -R
+	// of GNU make.
+	// The cache is not used if NoBuiltinRules or NoBuiltinVars is set.
+	NoBuiltinVars bool
+	// Evals are makefile texts evaluated before Makefile, like
+	// --eval of GNU make. The cache is not used if Evals is set.
+	Evals []string
+	// KeepRules keeps rules in the graph for "whynorule:" queries.
+	// The cache is not used if KeepRules is set.
+	KeepRules bool
+	// CacheIgnoreEnvs are environment variables whose values don't
+	// invalidate the cache even if makefiles read them, in addition
+	// to TMPDIR.
+	CacheIgnoreEnvs []string
 }
 
 // FromCommandLine creates LoadReq from given command line.
@@ -108,8 +245,9 @@ func initVars(vars Vars, kvlist []string, origin string) error {
 			return fmt.Errorf("A weird %s variable %q", origin, kv)
 		}
 		vars.Assign(kv[0], &recursiveVar{
-			expr:   literal(kv[1]),
-			origin: origin,
+			expr:     literal(kv[1]),
+			origin:   origin,
+			unparsed: true,
 		})
 	}
 	return nil
@@ -117,6 +255,12 @@ func initVars(vars Vars, kvlist []string, origin string) error {
 
 // Load loads makefile.
 func Load(req LoadReq) (*DepGraph, error) {
+	return LoadContext(context.Background(), req)
+}
+
+// LoadContext loads makefile. Evaluation stops with an EvalError
+// wrapping ctx.Err() when ctx is done.
+func LoadContext(ctx context.Context, req LoadReq) (*DepGraph, error) {
 	startTime := time.Now()
 	var err error
 	if req.Makefile == "" {
@@ -126,14 +270,22 @@ func Load(req LoadReq) (*DepGraph, error) {
 		}
 	}
 
+	if len(req.Evals) > 0 || req.NoBuiltinRules || req.NoBuiltinVars || req.KeepRules {
+		req.UseCache = false
+	}
 	if req.UseCache {
-		g, err := loadCache(req.Makefile, req.Targets)
+		g, err := loadCache(req)
 		if err == nil {
 			return g, nil
 		}
 	}
 
-	bmk, err := bootstrapMakefile(req.Targets)
+	if req.TraceFileAccess {
+		fsCache.startTrace()
+		defer fsCache.stopTrace()
+	}
+
+	bmk, err := bootstrapMakefile(req)
 	if err != nil {
 		return nil, err
 	}
@@ -142,7 +294,7 @@ func Load(req LoadReq) (*DepGraph, error) {
 	if err != nil {
 		return nil, err
 	}
-	mk, err := parseMakefile(content, req.Makefile)
+	mk, err := parseMakefileCached(content, sha1.Sum(content), req.Makefile, defaultRecipePrefix)
 	if err != nil {
 		return nil, err
 	}
@@ -151,7 +303,15 @@ func Load(req LoadReq) (*DepGraph, error) {
 		stmt.show()
 	}
 
-	mk.stmts = append(bmk.stmts, mk.stmts...)
+	stmts := bmk.stmts
+	for _, e := range req.Evals {
+		emk, err := parseMakefileString(e, srcpos{"--eval", 1}, defaultRecipePrefix)
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, emk.stmts...)
+	}
+	mk.stmts = append(stmts, mk.stmts...)
 
 	vars := make(Vars)
 	err = initVars(vars, req.EnvironmentVars, "environment")
@@ -162,28 +322,60 @@ func Load(req LoadReq) (*DepGraph, error) {
 	if err != nil {
 		return nil, err
 	}
-	er, err := eval(mk, vars, req.UseCache)
+	var ms runtime.MemStats
+	if StatsFlag {
+		runtime.ReadMemStats(&ms)
+	}
+	endPhase := startPhase(phaseEval)
+	er, err := eval(ctx, mk, vars, req.UseCache || req.TraceFileAccess)
+	endPhase()
 	if err != nil {
 		return nil, err
 	}
 	vars.Merge(er.vars)
 
 	logStats("eval time: %q", time.Since(startTime))
+	if StatsFlag {
+		alloc, numGC := ms.TotalAlloc, ms.NumGC
+		runtime.ReadMemStats(&ms)
+		logStats("eval heap alloc: %s, %d GCs", human(int(ms.TotalAlloc-alloc)), ms.NumGC-numGC)
+	}
 	logStats("shell func time: %q %d", shellStats.Duration(), shellStats.Count())
+	if ParseCacheDir != "" {
+		logStats("parse cache: %d hits, %d misses", atomic.LoadInt64(&parseCacheStats.hits), atomic.LoadInt64(&parseCacheStats.misses))
+	}
 
 	startTime = time.Now()
+	endPhase = startPhase(phaseDepBuild)
 	db, err := newDepBuilder(er, vars)
+	endPhase()
 	if err != nil {
 		return nil, err
 	}
 	logStats("dep build prepare time: %q", time.Since(startTime))
 
+	if len(er.missingIncludes) > 0 {
+		err = remakeIncludes(ctx, er, db, vars)
+		if err != nil {
+			return nil, err
+		}
+		// Like GNU make re-executing itself, load the makefiles
+		// again with the remade makefiles.
+		return LoadContext(ctx, req)
+	}
+
 	startTime = time.Now()
+	endPhase = startPhase(phaseDepBuild)
 	nodes, err := db.Eval(req.Targets)
+	endPhase()
 	if err != nil {
 		return nil, err
 	}
 	logStats("dep build time: %q", time.Since(startTime))
+	var accessedDirs []string
+	if req.TraceFileAccess {
+		accessedDirs = fsCache.stopTrace()
+	}
 	var accessedMks []*accessedMakefile
 	// Always put the root Makefile as the first element.
 	accessedMks = append(accessedMks, &accessedMakefile{
@@ -192,16 +384,40 @@ func Load(req LoadReq) (*DepGraph, error) {
 		State:    fileExists,
 	})
 	accessedMks = append(accessedMks, er.accessedMks...)
+	exports := er.exports
+	if db.exportAll {
+		exports = exportAllVars(vars, exports)
+	}
+	usedEnvs := er.usedEnvs
+	for name := range db.ev.usedEnvs {
+		usedEnvs[name] = true
+	}
+	for pat, files := range er.globs {
+		if _, ok := db.globs[pat]; !ok {
+			db.globs[pat] = files
+		}
+	}
 	gd := &DepGraph{
-		nodes:       nodes,
-		vars:        vars,
-		accessedMks: accessedMks,
-		exports:     er.exports,
-		vpaths:      er.vpaths,
+		nodes:         nodes,
+		vars:          vars,
+		accessedMks:   accessedMks,
+		accessedDirs:  accessedDirs,
+		exports:       exports,
+		vpaths:        er.vpaths,
+		stderrs:       er.stderrs,
+		shells:        er.shells,
+		globs:         db.stampGlobs(),
+		conflicts:     db.conflicts,
+		exportAll:     db.exportAll,
+		deleteOnError: db.deleteOnError,
+		usedEnvs:      usedEnvs,
+	}
+	if req.KeepRules {
+		gd.db = db
 	}
 	if req.EagerEvalCommand {
 		startTime := time.Now()
-		err = evalCommands(nodes, vars)
+		err = evalCommands(nodes, vars, gd.exports, gd.exportAll)
 		if err != nil {
 			return nil, err
 		}
@@ -209,12 +425,47 @@ func Load(req LoadReq) (*DepGraph, error) {
 	}
 	if req.UseCache {
 		startTime := time.Now()
+		gd.envHash = envHash(cacheEnvs(req, gd.usedEnvs), req.EnvironmentVars)
 		saveCache(gd, req.Targets)
 		logStats("serialize time: %q", time.Since(startTime))
 	}
 	return gd, nil
 }
 
+// exportAllVars returns exports with all variables in vars exported
+// for .EXPORT_ALL_VARIABLES, as GNU make: variables which are not
+// default or automatic, and whose names are letters, numbers and
+// underscores. SHELL and variables unexported by exports are not.
+func exportAllVars(vars Vars, exports map[string]bool) map[string]bool {
+	all := make(map[string]bool)
+	for name, v := range vars {
+		switch v.Origin() {
+		case "default", "automatic", "undefined":
+			continue
+		}
+		if name == "SHELL" || !isExportableName(name) {
+			continue
+		}
+		all[name] = true
+	}
+	for name, export := range exports {
+		all[name] = export
+	}
+	return all
+}
+
+func isExportableName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c != '_' && !('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z') && !('0' <= c && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
 // Loader is the interface that loads DepGraph.
 type Loader interface {
 	Load(string) (*DepGraph, error)
@@ -0,0 +1,252 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadContextTimeout(t *testing.T) {
+	dir := chdirTemp(t, map[string]string{
+		"Makefile": "f = $(foreach i,1 2,$(call f))\nx := $(call f)\n",
+	})
+	mk := filepath.Join(dir, "Makefile")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := LoadContext(ctx, LoadReq{Makefile: mk})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("LoadContext()=_, %v; want %v", err, context.DeadlineExceeded)
+	}
+	var eerr EvalError
+	if !errors.As(err, &eerr) || eerr.Filename != mk || eerr.Lineno != 2 {
+		t.Errorf("LoadContext()=_, %#v; want EvalError at %s:2", err, mk)
+	}
+}
+
+func TestLoadRuleConflicts(t *testing.T) {
+	dir := chdirTemp(t, map[string]string{
+		"Makefile": "all: a b\na:\n\techo 1\nb:\n\techo b\na:\n\techo 2\nb: c\n",
+	})
+	mk := filepath.Join(dir, "Makefile")
+	g := mustLoad(t, LoadReq{Makefile: mk})
+	want := []RuleConflict{
+		{
+			Target:      "a",
+			Filename:    mk,
+			Lineno:      7,
+			OldFilename: mk,
+			OldLineno:   3,
+		},
+	}
+	if got := g.RuleConflicts(); !reflect.DeepEqual(got, want) {
+		t.Errorf("g.RuleConflicts()=%#v; want %#v", got, want)
+	}
+}
+
+func TestLoadShellStderrCapture(t *testing.T) {
+	dir := chdirTemp(t, map[string]string{
+		"Makefile": "x := 1\ny := $(shell echo out; echo err >&2)\nall:\n",
+	})
+	mk := filepath.Join(dir, "Makefile")
+
+	defer func(mode string) { ShellStderrMode = mode }(ShellStderrMode)
+	ShellStderrMode = "capture"
+	g := mustLoad(t, LoadReq{Makefile: mk})
+	want := []ShellStderr{
+		{
+			Filename: mk,
+			Lineno:   2,
+			Command:  "echo out; echo err >&2",
+			Output:   "err\n",
+		},
+	}
+	if got := g.ShellStderrs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("g.ShellStderrs()=%#v; want %#v", got, want)
+	}
+}
+
+func TestLoadErrorBacktrace(t *testing.T) {
+	dir := chdirTemp(t, nil)
+	mk := filepath.Join(dir, "Makefile")
+	sub := filepath.Join(dir, "sub.mk")
+	err := ioutil.WriteFile(mk, []byte("check = $(if $(1),,$(error $(0): empty))\nx := 1\ninclude "+sub+"\nall:\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(sub, []byte("f = $(call check,$(1))\n$(call f,)\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(d int) { BacktraceDepth = d }(BacktraceDepth)
+	for _, tc := range []struct {
+		depth int
+		want  string
+	}{
+		{
+			depth: 0,
+			want:  sub + ":2: *** check: empty.",
+		},
+		{
+			depth: 2,
+			want: sub + ":2: *** check: empty." +
+				"\n  " + sub + ":2: in $(call check)" +
+				"\n  " + sub + ":2: in $(call f)" +
+				"\n  ... 1 more",
+		},
+		{
+			depth: 3,
+			want: sub + ":2: *** check: empty." +
+				"\n  " + sub + ":2: in $(call check)" +
+				"\n  " + sub + ":2: in $(call f)" +
+				"\n  " + mk + ":3: in included file " + sub,
+		},
+	} {
+		BacktraceDepth = tc.depth
+		_, err = Load(LoadReq{Makefile: mk})
+		if err == nil || err.Error() != tc.want {
+			t.Errorf("Load() with BacktraceDepth=%d: %v; want %q", tc.depth, err, tc.want)
+		}
+	}
+}
+
+func TestLoadPatternRule(t *testing.T) {
+	dir := chdirTemp(t, map[string]string{
+		"Makefile": `all: a.o b.o c.x d.y
+%.o: %.c
+	echo $*
+b.o: %.o: %.s
+	echo $*
+c.x:
+	echo $*
+d.y: c.x
+%.y:
+	echo $*
+`,
+		"a.c": "",
+	})
+	mk := filepath.Join(dir, "Makefile")
+	g := mustLoad(t, LoadReq{Makefile: mk, Targets: []string{"all"}})
+	got := make(map[string]bool)
+	var walk func(nodes []*DepNode)
+	walk = func(nodes []*DepNode) {
+		for _, n := range nodes {
+			got[n.Output] = n.IsPatternRule
+			walk(n.Deps)
+		}
+	}
+	walk(g.Nodes())
+	want := map[string]bool{
+		"all": false,
+		"a.o": true,
+		"a.c": false,
+		"b.o": true,
+		"b.s": false,
+		"c.x": false,
+		"d.y": true,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("IsPatternRule=%v; want %v", got, want)
+	}
+}
+
+func TestLoadPhonyPattern(t *testing.T) {
+	dir := chdirTemp(t, map[string]string{
+		"Makefile": `.PHONY: %-clean all
+all: foo-clean bar-clean.o foo
+%-clean:
+	rm -rf out/$*
+bar-clean.o:
+foo:
+`,
+	})
+	mk := filepath.Join(dir, "Makefile")
+	g := mustLoad(t, LoadReq{Makefile: mk, Targets: []string{"all"}})
+	got := make(map[string]bool)
+	var walk func(nodes []*DepNode)
+	walk = func(nodes []*DepNode) {
+		for _, n := range nodes {
+			got[n.Output] = n.IsPhony
+			walk(n.Deps)
+		}
+	}
+	walk(g.Nodes())
+	want := map[string]bool{
+		"all":         true,
+		"foo-clean":   true,
+		"bar-clean.o": false,
+		"foo":         false,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("IsPhony=%v; want %v", got, want)
+	}
+}
+
+func TestLoadBuiltinPatternRule(t *testing.T) {
+	chdirTemp(t, map[string]string{
+		"Makefile": `all: a.o b.o
+.c.o:
+	echo suffix
+`,
+	})
+	for _, f := range []string{"a.c", "b.s"} {
+		err := ioutil.WriteFile(f, nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(rules []BuiltinRule) { BuiltinRules = rules }(BuiltinRules)
+	BuiltinRules = []BuiltinRule{
+		{Target: "%.o", Prereqs: "%.c", Recipe: "echo builtin"},
+		{Target: "%.o", Prereqs: "%.s", Recipe: "echo builtin"},
+	}
+	g := mustLoad(t, LoadReq{Makefile: "Makefile", Targets: []string{"all"}})
+	got := make(map[string][]string)
+	for _, n := range g.Nodes()[0].Deps {
+		got[n.Output] = n.Cmds
+	}
+	// Suffix rules in makefiles win over builtin pattern rules.
+	want := map[string][]string{
+		"a.o": {"echo suffix"},
+		"b.o": {"echo builtin"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Cmds=%q; want %q", got, want)
+	}
+}
+
+func TestLoadObsoleteVar(t *testing.T) {
+	dir := chdirTemp(t, map[string]string{
+		"Makefile": "A := 1\ny := $(origin A)\nx := $(A)\n",
+	})
+	mk := filepath.Join(dir, "Makefile")
+	ObsoleteVar("A", "Use B instead.")
+	defer delete(obsoleteVars, "A")
+	_, err := Load(LoadReq{Makefile: mk})
+	var eerr EvalError
+	if !errors.As(err, &eerr) || eerr.Lineno != 3 {
+		t.Fatalf("Load()=_, %#v; want EvalError at %s:3", err, mk)
+	}
+	if got, want := eerr.Err.Error(), "*** A is obsolete. Use B instead."; got != want {
+		t.Errorf("Load()=_, %q; want %q", got, want)
+	}
+}
@@ -16,6 +16,7 @@ package kati
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"fmt"
 	"os"
@@ -23,6 +24,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/golang/glog"
 )
@@ -107,6 +109,20 @@ type evalResult struct {
 	accessedMks []*accessedMakefile
 	exports     map[string]bool
 	vpaths      searchPaths
+	stderrs     []ShellStderr
+	shells      []StampShell
+	globs       map[string][]string
+	usedEnvs    map[string]bool
+	// missingIncludes are makefiles not found by include directives.
+	missingIncludes []missingInclude
+}
+
+// missingInclude is a makefile not found by the include directive at
+// srcpos, which may be remade by its rule.
+type missingInclude struct {
+	srcpos
+	filename string
+	err      error
 }
 
 type srcpos struct {
@@ -129,6 +145,11 @@ func (e EvalError) Error() string {
 	return fmt.Sprintf("%s:%d: %v", e.Filename, e.Lineno, e.Err)
 }
 
+// Unwrap returns the underlying error.
+func (e EvalError) Unwrap() error {
+	return e.Err
+}
+
 func (p srcpos) errorf(f string, args ...interface{}) error {
 	return EvalError{
 		Filename: p.filename,
@@ -160,16 +181,88 @@ type Evaluator struct {
 	cache        *accessCache
 	exports      map[string]bool
 	vpaths       []vpath
+	// included is hash of makefiles evaluated by include directives.
+	included map[string][sha1.Size]byte
+	// missingIncludes are makefiles not found by include directives,
+	// which are remade after loading if they have rules.
+	missingIncludes []missingInclude
 
 	avoidIO bool
 	hasIO   bool
 	// delayedOutputs are commands which should run at ninja-time
 	// (i.e., info, warning, and error).
 	delayedOutputs []string
+	// deferred is functions left to run at ninja-time, since the
+	// last call of createRunners.
+	deferred []DeferredConstruct
+
+	// loading is true while loading makefiles. Captured stderr and
+	// results of $(shell) are kept in stderrs and shells, and files
+	// matched by $(sort $(wildcard)) in globs, only then.
+	loading bool
+	stderrs []ShellStderr
+	shells  []StampShell
+	globs   map[string][]string
+
+	// usedEnvs are variables read from the environment, or read
+	// while undefined, which would come from the environment if it
+	// is set later. A change of them would change the result.
+	usedEnvs map[string]bool
+
+	// context is used to cancel evaluation. done is context.Done().
+	context context.Context
+	done    <-chan struct{}
+
+	// budget is set while loading makefiles with MemBudget.
+	budget *memBudget
+	// progress is set while loading makefiles with Progress.
+	progress *evalProgress
+	// stmtCnt is the number of statements evaluated, for periodic
+	// stats.
+	stmtCnt int
+
+	// stack is includes and $(call)s being evaluated, innermost last.
+	stack []evalFrame
+	// depth is the nesting of statements being evaluated, used to
+	// find statement boundaries for ebufArena.
+	depth int
+
+	srcpos
+}
 
+// evalFrame is an include or $(call) being evaluated.
+type evalFrame struct {
+	// call is true for $(call name), false for include of name.
+	call bool
+	name string
+	// srcpos is where the include or $(call) is.
 	srcpos
 }
 
+func (f evalFrame) String() string {
+	if f.call {
+		return fmt.Sprintf("%s: in $(call %s)", f.srcpos, f.name)
+	}
+	return fmt.Sprintf("%s: in included file %s", f.srcpos, f.name)
+}
+
+// backtrace returns the innermost BacktraceDepth frames of ev.stack,
+// one frame per line, each line starting with a newline.
+func (ev *Evaluator) backtrace() string {
+	if BacktraceDepth <= 0 || len(ev.stack) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	for i := len(ev.stack) - 1; i >= 0; i-- {
+		if len(ev.stack)-i > BacktraceDepth {
+			fmt.Fprintf(&sb, "\n  ... %d more", i+1)
+			break
+		}
+		fmt.Fprintf(&sb, "\n  %s", ev.stack[i])
+	}
+	return sb.String()
+}
+
 // NewEvaluator creates new Evaluator.
 func NewEvaluator(vars map[string]Var) *Evaluator {
 	return &Evaluator{
@@ -177,6 +270,7 @@ func NewEvaluator(vars map[string]Var) *Evaluator {
 		vars:        vars,
 		outRuleVars: make(map[string]Vars),
 		exports:     make(map[string]bool),
+		usedEnvs:    make(map[string]bool),
 	}
 }
 
@@ -255,7 +349,18 @@ func (ev *Evaluator) setTargetSpecificVar(assign *assignAST, output string) erro
 	if glog.V(1) {
 		glog.Infof("rule outputs:%q assign:%q%s%q (flavor:%q)", output, lhs, assign.op, rhs, rhs.Flavor())
 	}
-	vars.Assign(lhs, &targetSpecificVar{v: rhs, op: assign.op})
+	export := assign.opt == "export"
+	if tsv, ok := rhs.(*targetSpecificVar); ok {
+		// += or ?= to the variable already defined for this target.
+		// keep the original op, so "foo: A = x" and "foo: A += y"
+		// won't append to global A.
+		if export && !tsv.export {
+			tsv = &targetSpecificVar{v: tsv.v, op: tsv.op, export: true}
+		}
+		vars.Assign(lhs, tsv)
+	} else {
+		vars.Assign(lhs, &targetSpecificVar{v: rhs, op: assign.op, export: export})
+	}
 	ev.currentScope = nil
 	return nil
 }
@@ -373,7 +478,7 @@ func (ev *Evaluator) evalCommand(ast *commandAST) error {
 		// assign_after_tab.mk.
 		if strings.IndexByte(ast.cmd, '=') >= 0 {
 			line := trimLeftSpace(ast.cmd)
-			mk, err := parseMakefileString(line, ast.srcpos)
+			mk, err := parseMakefileString(line, ast.srcpos, ev.recipePrefix())
 			if err != nil {
 				return ast.errorf("parse failed: %q: %v", line, err)
 			}
@@ -412,6 +517,76 @@ func (ev *Evaluator) paramVar(name string) (Var, error) {
 	return &automaticVar{value: []byte(ev.paramVars[i])}, nil
 }
 
+var (
+	// deprecatedVars and obsoleteVars are variables which warn or
+	// fail when they are read, with the message to show.
+	deprecatedVars = make(map[string]string)
+	obsoleteVars   = make(map[string]string)
+
+	// undefinedVarAllowlist is patterns of variables which are not
+	// reported by WarnUndefinedVars.
+	undefinedVarAllowlist []string
+)
+
+// AllowUndefinedVar makes WarnUndefinedVars not report variables
+// matching pat, which may contain a %.
+func AllowUndefinedVar(pat string) {
+	undefinedVarAllowlist = append(undefinedVarAllowlist, pat)
+}
+
+func (ev *Evaluator) warnUndefinedVar(name string) {
+	for _, pat := range undefinedVarAllowlist {
+		if matchPattern(pat, name) {
+			return
+		}
+	}
+	warn(ev.srcpos, "undefined variable '%s'", name)
+}
+
+// DeprecateVar makes reads of the variable name warn with msg.
+func DeprecateVar(name, msg string) {
+	deprecatedVars[name] = msg
+}
+
+// ObsoleteVar makes reads of the variable name an error with msg.
+func ObsoleteVar(name, msg string) {
+	obsoleteVars[name] = msg
+}
+
+// checkVarUse warns if the variable name is deprecated, and fails if
+// it is obsolete. It is called for $(name), $(value name) and
+// $(call name), but not for $(origin) or $(flavor) which don't read
+// the variable.
+func (ev *Evaluator) checkVarUse(name string) error {
+	if msg, ok := obsoleteVars[name]; ok {
+		return ev.errorf("*** %s is obsolete.%s", name, withSpace(msg))
+	}
+	if msg, ok := deprecatedVars[name]; ok {
+		warn(ev.srcpos, "%s has been deprecated.%s", name, withSpace(msg))
+	}
+	return nil
+}
+
+func withSpace(msg string) string {
+	if msg == "" {
+		return ""
+	}
+	return " " + msg
+}
+
+// deferIO marks the function fn with the argument arg is left to run
+// at ninja-time, for reason.
+func (ev *Evaluator) deferIO(fn, arg, reason string) {
+	ev.hasIO = true
+	ev.deferred = append(ev.deferred, DeferredConstruct{
+		Filename: ev.filename,
+		Lineno:   ev.lineno,
+		Func:     fn,
+		Arg:      arg,
+		Reason:   reason,
+	})
+}
+
 // LookupVar looks up named variable.
 func (ev *Evaluator) LookupVar(name string) Var {
 	if ev.currentScope != nil {
@@ -428,7 +603,62 @@ func (ev *Evaluator) LookupVar(name string) Var {
 	if err == nil {
 		return v
 	}
-	return ev.vars.Lookup(name)
+	return ev.lookupGlobalVar(name)
+}
+
+// lookupGlobalVar looks up name in global variables, and records it
+// in usedEnvs if it is from the environment or undefined.
+func (ev *Evaluator) lookupGlobalVar(name string) Var {
+	v := ev.vars.Lookup(name)
+	if !v.IsDefined() || strings.HasPrefix(v.Origin(), "environment") {
+		ev.usedEnvs[name] = true
+	}
+	return v
+}
+
+// captureStderr records stderr of $(shell cmd) with the current srcpos.
+// Outside of loading, there is nowhere to keep it, so it is reported
+// to stderr right away.
+func (ev *Evaluator) captureStderr(cmd, out string) {
+	s := ShellStderr{
+		Filename: ev.filename,
+		Lineno:   ev.lineno,
+		Command:  cmd,
+		Output:   out,
+	}
+	if !ev.loading {
+		fmt.Fprintln(os.Stderr, s)
+		return
+	}
+	ev.stderrs = append(ev.stderrs, s)
+}
+
+// evalVarRef evaluates v referenced as $(name). Like GNU make, it is
+// an error if a recursive variable references itself, but $(call)
+// may recurse as it doesn't use evalVarRef.
+func (ev *Evaluator) evalVarRef(w evalWriter, name string, v Var) error {
+	err := ev.checkVarUse(name)
+	if err != nil {
+		return err
+	}
+	if WarnUndefinedVars && !v.IsDefined() {
+		ev.warnUndefinedVar(name)
+	}
+	rv, ok := v.(*recursiveVar)
+	if !ok {
+		return v.Eval(w, ev)
+	}
+	if rv.expanding {
+		pos := rv.srcpos
+		if pos.filename == "" {
+			pos = ev.srcpos
+		}
+		return pos.errorf("*** Recursive variable %q references itself (eventually).", name)
+	}
+	rv.expanding = true
+	err = rv.Eval(w, ev)
+	rv.expanding = false
+	return err
 }
 
 func (ev *Evaluator) lookupVarInCurrentScope(name string) Var {
@@ -444,7 +674,7 @@ func (ev *Evaluator) lookupVarInCurrentScope(name string) Var {
 	if err == nil {
 		return v
 	}
-	return ev.vars.Lookup(name)
+	return ev.lookupGlobalVar(name)
 }
 
 // EvaluateVar evaluates variable named name.
@@ -473,15 +703,39 @@ func (ev *Evaluator) evalIncludeFile(fname string, mk makefile) error {
 	}
 	ev.outVars.Assign("MAKEFILE_LIST", makefileList)
 
+	ev.stack = append(ev.stack, evalFrame{name: fname, srcpos: ev.srcpos})
 	for _, stmt := range mk.stmts {
 		err = ev.eval(stmt)
 		if err != nil {
 			return err
 		}
 	}
+	ev.stack = ev.stack[:len(ev.stack)-1]
 	return nil
 }
 
+// includeOnce reports whether fn should be evaluated at most once,
+// i.e. IncludeOnce is set or fn matches a pattern in KATI_INCLUDE_ONCE.
+func (ev *Evaluator) includeOnce(fn string) (bool, error) {
+	if IncludeOnce {
+		return true, nil
+	}
+	v := ev.LookupVar("KATI_INCLUDE_ONCE")
+	if !v.IsDefined() {
+		return false, nil
+	}
+	pats, err := ev.EvaluateVar("KATI_INCLUDE_ONCE")
+	if err != nil {
+		return false, err
+	}
+	for _, pat := range splitSpaces(pats) {
+		if matchPattern(pat, fn) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 func (ev *Evaluator) evalInclude(ast *includeAST) error {
 	ev.lastRule = nil
 	ev.srcpos = ast.srcpos
@@ -518,10 +772,16 @@ func (ev *Evaluator) evalInclude(ast *includeAST) error {
 		if IgnoreOptionalInclude != "" && ast.op == "-include" && matchPattern(fn, IgnoreOptionalInclude) {
 			continue
 		}
-		mk, hash, err := makefileCache.parse(fn)
+		prefix := ev.recipePrefix()
+		mk, hash, err := makefileCache.parse(fn, prefix)
 		if os.IsNotExist(err) {
 			if ast.op == "include" {
-				return ev.errorf("%v\nNOTE: kati does not support generating missing makefiles", err)
+				ev.missingIncludes = append(ev.missingIncludes, missingInclude{
+					srcpos:   ev.srcpos,
+					filename: fn,
+					err:      err,
+				})
+				continue
 			}
 			msg := ev.cache.update(fn, hash, fileNotExists)
 			if msg != "" {
@@ -533,14 +793,45 @@ func (ev *Evaluator) evalInclude(ast *includeAST) error {
 		if msg != "" {
 			warn(ev.srcpos, "%s", msg)
 		}
+		once, err := ev.includeOnce(fn)
+		if err != nil {
+			return err
+		}
+		if once {
+			if h, ok := ev.included[fn]; ok && h == hash {
+				glog.V(1).Infof("%s include %q: already included", ev.srcpos, fn)
+				continue
+			}
+		}
+		if ev.included == nil {
+			ev.included = make(map[string][sha1.Size]byte)
+		}
+		ev.included[fn] = hash
 		err = ev.evalIncludeFile(fn, mk)
 		if err != nil {
 			return err
 		}
+		// The including makefile is already parsed.
+		if ev.recipePrefix() != prefix {
+			warn(ev.srcpos, ".RECIPEPREFIX set in %s doesn't apply to the rest of %s", fn, ev.srcpos.filename)
+		}
 	}
 	return nil
 }
 
+// recipePrefix returns the recipe prefix given by .RECIPEPREFIX, to
+// parse makefiles included or evaluated from now.
+func (ev *Evaluator) recipePrefix() byte {
+	if !ev.LookupVar(".RECIPEPREFIX").IsDefined() {
+		return defaultRecipePrefix
+	}
+	s, err := ev.EvaluateVar(".RECIPEPREFIX")
+	if err != nil || s == "" {
+		return defaultRecipePrefix
+	}
+	return s[0]
+}
+
 func (ev *Evaluator) evalIf(iast *ifAST) error {
 	var isTrue bool
 	switch iast.op {
@@ -669,15 +960,77 @@ func (ev *Evaluator) evalVpath(ast *vpathAST) error {
 	return nil
 }
 
+func (ev *Evaluator) setContext(ctx context.Context) {
+	ev.context = ctx
+	ev.done = ctx.Done()
+}
+
+// checkCancel returns an error with the current position if
+// evaluation is cancelled.
+func (ev *Evaluator) checkCancel() error {
+	select {
+	case <-ev.done:
+		return ev.srcpos.error(ev.context.Err())
+	default:
+		return nil
+	}
+}
+
 func (ev *Evaluator) eval(stmt ast) error {
-	return stmt.eval(ev)
+	err := ev.checkCancel()
+	if err != nil {
+		return err
+	}
+	if ev.budget != nil {
+		ev.budget.check(ev.srcpos)
+	}
+	ev.stmtCnt++
+	if ev.stmtCnt%100 == 0 {
+		ev.reportStats()
+	}
+	if ebufArena == nil {
+		return stmt.eval(ev)
+	}
+	ev.depth++
+	err = stmt.eval(ev)
+	ev.depth--
+	ebufArena.statementDone(ev.depth == 0)
+	return err
 }
 
-func eval(mk makefile, vars Vars, useCache bool) (er *evalResult, err error) {
+// reportStats reports the number of statements evaluated, and
+// progress with Progress.
+func (ev *Evaluator) reportStats() {
+	if ev.progress != nil {
+		ev.progress.check(ev.srcpos, ev.stmtCnt, time.Now())
+	}
+	if !PeriodicStatsFlag {
+		return
+	}
+	logStats("stmt=%d at %s", ev.stmtCnt, ev.srcpos)
+}
+
+func eval(ctx context.Context, mk makefile, vars Vars, useCache bool) (er *evalResult, err error) {
 	ev := NewEvaluator(vars)
+	ev.setContext(ctx)
+	ev.loading = true
 	if useCache {
 		ev.cache = newAccessCache()
 	}
+	if MemBudget > 0 {
+		ev.budget = startMemBudget(MemBudget)
+		defer ev.budget.stop()
+	}
+	if Progress {
+		ev.progress = newEvalProgress(ctx, os.Stderr)
+	}
+	if EvalArena {
+		ebufArena = newBufArena()
+		defer func() {
+			ebufArena.logStats()
+			ebufArena = nil
+		}()
+	}
 
 	makefileList := vars.Lookup("MAKEFILE_LIST")
 	if !makefileList.IsDefined() {
@@ -723,5 +1076,11 @@ func eval(mk makefile, vars Vars, useCache bool) (er *evalResult, err error) {
 		accessedMks: ev.cache.Slice(),
 		exports:     ev.exports,
 		vpaths:      vpaths,
+		stderrs:     ev.stderrs,
+		shells:      ev.shells,
+		globs:       ev.globs,
+		usedEnvs:    ev.usedEnvs,
+
+		missingIncludes: ev.missingIncludes,
 	}, nil
 }
@@ -15,22 +15,38 @@
 package kati
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"os"
 	"os/exec"
+	"sort"
 	"strings"
 	"sync"
+	"syscall"
 
 	"github.com/golang/glog"
 )
 
 type execContext struct {
 	shell string
+	// shellFlags is .SHELLFLAGS, "-c" by default.
+	shellFlags string
 
 	mu     sync.Mutex
 	ev     *Evaluator
 	vpaths searchPaths
 	output string
 	inputs []string
+	// isPatternRule is true if $* of output is the stem.
+	isPatternRule bool
+	// warned is automatic variables already warned for output
+	// with WarnEmptyAutoVars.
+	warned map[string]bool
+	// exports and exportAll are the ones of the DepGraph, to tell
+	// target specific variables in the environment of commands.
+	exports   map[string]bool
+	exportAll bool
 }
 
 func newExecContext(vars Vars, vpaths searchPaths, avoidIO bool) *execContext {
@@ -56,16 +72,47 @@ func newExecContext(vars Vars, vpaths searchPaths, avoidIO bool) *execContext {
 		ev.vars[k+"F"] = suffixFVar(k)
 	}
 
-	// TODO: We should move this to somewhere around evalCmd so that
-	// we can handle SHELL in target specific variables.
+	// SHELL and .SHELLFLAGS in target specific variables are handled
+	// in createRunners.
 	shell, err := ev.EvaluateVar("SHELL")
 	if err != nil {
 		shell = "/bin/sh"
 	}
 	ctx.shell = shell
+	ctx.shellFlags = "-c"
+	if ev.LookupVar(".SHELLFLAGS").IsDefined() {
+		flags, err := ev.EvaluateVar(".SHELLFLAGS")
+		if err == nil {
+			ctx.shellFlags = flags
+		}
+	}
 	return ctx
 }
 
+// resolveShell returns the path of the shell used to run recipes.
+// It fails if SHELL isn't an executable, so a broken SHELL is reported
+// once before any recipe runs instead of as an opaque error per recipe.
+func resolveShell(shell string) (string, error) {
+	path, err := exec.LookPath(shell)
+	if err != nil {
+		return "", fmt.Errorf("*** SHELL %q is not executable: %v", shell, err)
+	}
+	return path, nil
+}
+
+// warnUnset warns once per target that the automatic variable name
+// is used where it isn't set.
+func (ec *execContext) warnUnset(ev *Evaluator, name, reason string) {
+	if !WarnEmptyAutoVars || ec.warned[name] {
+		return
+	}
+	if ec.warned == nil {
+		ec.warned = make(map[string]bool)
+	}
+	ec.warned[name] = true
+	warn(ev.srcpos, "$%s is used %s for target %q", name, reason, ec.output)
+}
+
 func (ec *execContext) uniqueInputs() []string {
 	var uniqueInputs []string
 	seen := make(map[string]bool)
@@ -80,7 +127,7 @@ func (ec *execContext) uniqueInputs() []string {
 
 type autoVar struct{ ctx *execContext }
 
-func (v autoVar) Flavor() string  { return "undefined" }
+func (v autoVar) Flavor() string  { return "simple" }
 func (v autoVar) Origin() string  { return "automatic" }
 func (v autoVar) IsDefined() bool { return true }
 func (v autoVar) Append(*Evaluator, string) (Var, error) {
@@ -107,6 +154,9 @@ func (v autoAtVar) String() string { return v.ctx.output }
 type autoLessVar struct{ autoVar }
 
 func (v autoLessVar) Eval(w evalWriter, ev *Evaluator) error {
+	if len(v.ctx.inputs) == 0 {
+		v.ctx.warnUnset(ev, "<", "in a rule without prerequisites")
+	}
 	fmt.Fprint(w, v.String())
 	return nil
 }
@@ -120,6 +170,9 @@ func (v autoLessVar) String() string {
 type autoHatVar struct{ autoVar }
 
 func (v autoHatVar) Eval(w evalWriter, ev *Evaluator) error {
+	if len(v.ctx.inputs) == 0 {
+		v.ctx.warnUnset(ev, "^", "in a rule without prerequisites")
+	}
 	fmt.Fprint(w, v.String())
 	return nil
 }
@@ -130,6 +183,9 @@ func (v autoHatVar) String() string {
 type autoPlusVar struct{ autoVar }
 
 func (v autoPlusVar) Eval(w evalWriter, ev *Evaluator) error {
+	if len(v.ctx.inputs) == 0 {
+		v.ctx.warnUnset(ev, "+", "in a rule without prerequisites")
+	}
 	fmt.Fprint(w, v.String())
 	return nil
 }
@@ -138,7 +194,11 @@ func (v autoPlusVar) String() string { return strings.Join(v.ctx.inputs, " ") }
 type autoStarVar struct{ autoVar }
 
 func (v autoStarVar) Eval(w evalWriter, ev *Evaluator) error {
-	fmt.Fprint(w, v.String())
+	s := v.String()
+	if s == "" && !v.ctx.isPatternRule {
+		v.ctx.warnUnset(ev, "*", "outside pattern rules")
+	}
+	fmt.Fprint(w, s)
 	return nil
 }
 
@@ -194,7 +254,13 @@ type runner struct {
 	cmd         string
 	echo        bool
 	ignoreError bool
-	shell       string
+	// force is true if the command runs even with DryRunFlag, i.e.
+	// it is prefixed with '+' or refers $(MAKE).
+	force      bool
+	shell      string
+	shellFlags string
+	// env is "NAME=value" of exported target specific variables.
+	env []string
 }
 
 func (r runner) String() string {
@@ -205,6 +271,9 @@ func (r runner) String() string {
 	if r.ignoreError {
 		cmd = "-" + cmd
 	}
+	if r.force {
+		cmd = "+" + cmd
+	}
 	return cmd
 }
 
@@ -225,6 +294,10 @@ func (r runner) forCmd(s string) runner {
 			r.ignoreError = true
 			s = s[1:]
 			continue
+		case '+':
+			r.force = true
+			s = s[1:]
+			continue
 		}
 		break
 	}
@@ -232,8 +305,17 @@ func (r runner) forCmd(s string) runner {
 	return r
 }
 
+// refersMake reports whether cmd, which is not expanded yet, refers
+// $(MAKE) or ${MAKE}, i.e. it is a recursive make invocation.
+func refersMake(cmd string) bool {
+	return strings.Contains(cmd, "$(MAKE)") || strings.Contains(cmd, "${MAKE}")
+}
+
 func (r runner) eval(ev *Evaluator, s string) ([]runner, error) {
 	r = r.forCmd(s)
+	if refersMake(r.cmd) {
+		r.force = true
+	}
 	if strings.IndexByte(r.cmd, '$') < 0 {
 		// fast path
 		return []runner{r}, nil
@@ -263,44 +345,87 @@ func (r runner) eval(ev *Evaluator, s string) ([]runner, error) {
 	return runners, nil
 }
 
-func (r runner) run(output string) error {
+// run runs the command, and returns its combined output, which is
+// also printed. When ctx is done, killSig is sent to the process
+// group of the command.
+func (r runner) run(ctx context.Context, output string, killSig func() syscall.Signal) ([]byte, error) {
 	if r.echo || DryRunFlag {
-		fmt.Printf("%s\n", r.cmd)
+		newDiag(os.Stdout).echo(r.cmd)
 	}
 	s := cmdline(r.cmd)
 	glog.Infof("sh:%q", s)
-	if DryRunFlag {
-		return nil
+	if DryRunFlag && !r.force {
+		return nil, nil
 	}
-	args := []string{r.shell, "-c", s}
+	// SHELL may be a target specific variable, which is not
+	// resolved yet.
+	path, err := exec.LookPath(r.shell)
+	if err != nil {
+		return nil, err
+	}
+	args := append([]string{r.shell}, strings.Fields(r.shellFlags)...)
+	args = append(args, s)
+	var out bytes.Buffer
 	cmd := exec.Cmd{
-		Path: args[0],
-		Args: args,
+		Path:   path,
+		Args:   args,
+		Stdout: &out,
+		Stderr: &out,
+		// Run in its own process group, so signals are sent
+		// to the command and its children.
+		SysProcAttr: &syscall.SysProcAttr{Setpgid: true},
+	}
+	env := r.env
+	if DryRunFlag {
+		// Only forced commands run with DryRunFlag. They are
+		// sub-makes, which must not run their commands either.
+		makeflags := os.Getenv("MAKEFLAGS")
+		for _, e := range env {
+			if strings.HasPrefix(e, "MAKEFLAGS=") {
+				makeflags = strings.TrimPrefix(e, "MAKEFLAGS=")
+			}
+		}
+		env = append(env[:len(env):len(env)], "MAKEFLAGS="+dryRunMakeflags(makeflags))
+	}
+	if len(env) > 0 {
+		// The last value is used for duplicated names.
+		cmd.Env = append(os.Environ(), env...)
 	}
-	out, err := cmd.CombinedOutput()
-	fmt.Printf("%s", out)
+	err = cmd.Start()
+	if err == nil {
+		// kill the command when ctx is done.
+		stop := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				syscall.Kill(-cmd.Process.Pid, killSig())
+			case <-stop:
+			}
+		}()
+		err = cmd.Wait()
+		close(stop)
+	}
+	fmt.Printf("%s", out.Bytes())
 	exit := exitStatus(err)
 	if r.ignoreError && exit != 0 {
 		fmt.Printf("[%s] Error %d (ignored)\n", output, exit)
 		err = nil
 	}
-	return err
+	return out.Bytes(), err
 }
 
-func createRunners(ctx *execContext, n *DepNode) ([]runner, bool, error) {
-	var runners []runner
-	if len(n.Cmds) == 0 {
-		return runners, false, nil
-	}
-
-	ctx.mu.Lock()
-	defer ctx.mu.Unlock()
+// enterTarget sets automatic variables and target specific variables
+// of n in ctx.ev, and returns a function to restore the variables.
+// ctx.mu must be held.
+func (ctx *execContext) enterTarget(n *DepNode) func() {
 	// For automatic variables.
 	ctx.output = n.Output
 	ctx.inputs = n.ActualInputs
+	ctx.isPatternRule = n.IsPatternRule
+	ctx.warned = nil
+	var restores []func()
 	for k, v := range n.TargetSpecificVars {
-		restore := ctx.ev.vars.save(k)
-		defer restore()
+		restores = append(restores, ctx.ev.vars.save(k))
 		ctx.ev.vars[k] = v
 		if glog.V(1) {
 			glog.Infof("set tsv: %s=%s", k, v)
@@ -309,11 +434,49 @@ func createRunners(ctx *execContext, n *DepNode) ([]runner, bool, error) {
 
 	ctx.ev.filename = n.Filename
 	ctx.ev.lineno = n.Lineno
+	return func() {
+		for _, restore := range restores {
+			restore()
+		}
+	}
+}
+
+func createRunners(ctx *execContext, n *DepNode) ([]runner, bool, error) {
+	var runners []runner
+	if len(n.Cmds) == 0 {
+		return runners, false, nil
+	}
+
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	defer ctx.enterTarget(n)()
+
+	shell, shellFlags := ctx.shell, ctx.shellFlags
+	if _, ok := n.TargetSpecificVars["SHELL"]; ok {
+		var err error
+		shell, err = ctx.ev.EvaluateVar("SHELL")
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	if _, ok := n.TargetSpecificVars[".SHELLFLAGS"]; ok {
+		var err error
+		shellFlags, err = ctx.ev.EvaluateVar(".SHELLFLAGS")
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	env, err := ctx.targetEnv(n)
+	if err != nil {
+		return nil, false, err
+	}
 	glog.Infof("Building: %s cmds:%q", n.Output, n.Cmds)
 	r := runner{
-		output: n.Output,
-		echo:   true,
-		shell:  ctx.shell,
+		output:     n.Output,
+		echo:       true,
+		shell:      shell,
+		shellFlags: shellFlags,
+		env:        env,
 	}
 	for _, cmd := range n.Cmds {
 		rr, err := r.eval(ctx.ev, cmd)
@@ -329,8 +492,10 @@ func createRunners(ctx *execContext, n *DepNode) ([]runner, bool, error) {
 	if len(ctx.ev.delayedOutputs) > 0 {
 		var nrunners []runner
 		r := runner{
-			output: n.Output,
-			shell:  ctx.shell,
+			output:     n.Output,
+			shell:      shell,
+			shellFlags: shellFlags,
+			env:        env,
 		}
 		for _, o := range ctx.ev.delayedOutputs {
 			nrunners = append(nrunners, r.forCmd(o))
@@ -342,9 +507,86 @@ func createRunners(ctx *execContext, n *DepNode) ([]runner, bool, error) {
 	return runners, ctx.ev.hasIO, nil
 }
 
-func evalCommands(nodes []*DepNode, vars Vars) error {
+// targetEnv returns "NAME=value" of target specific variables of n
+// to be in the environment of its commands, i.e. ones defined with
+// "export", and ones of exported variables. They must be set in
+// ctx.ev.vars.
+func (ctx *execContext) targetEnv(n *DepNode) ([]string, error) {
+	names := ctx.targetEnvNames(n)
+	var env []string
+	for _, name := range names {
+		v, err := ctx.ev.EvaluateVar(name)
+		if err != nil {
+			return nil, err
+		}
+		env = append(env, name+"="+exportValue(name, v))
+	}
+	return env, nil
+}
+
+// targetEnvNames returns sorted names of target specific variables
+// of n in the environment of its commands.
+func (ctx *execContext) targetEnvNames(n *DepNode) []string {
+	var names []string
+	for name, v := range n.TargetSpecificVars {
+		if !isExportableName(name) {
+			continue
+		}
+		export, present := ctx.exports[name]
+		if tsv, ok := v.(*targetSpecificVar); ok && tsv.export {
+			export = true
+		} else if !present && ctx.exportAll && name != "SHELL" {
+			export = true
+		}
+		if export {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// keptTargetVars is target specific variables evalCommands keeps,
+// as they are used to run the commands rather than in them.
+var keptTargetVars = []string{
+	"SHELL",
+	".SHELLFLAGS",
+	".KATI_NINJA_POOL",
+	"KATI_RETRY",
+	"KATI_WORKER",
+	"KATI_WORKER_PROTOCOL",
+}
+
+// evalTargetEnv returns exported target specific variables of n as
+// simple variables, so they no longer refer to other target specific
+// variables evalCommands drops.
+func (ctx *execContext) evalTargetEnv(n *DepNode) (Vars, error) {
+	names := ctx.targetEnvNames(n)
+	if len(names) == 0 {
+		return nil, nil
+	}
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	defer ctx.enterTarget(n)()
+	vars := make(Vars)
+	for _, name := range names {
+		v, err := ctx.ev.EvaluateVar(name)
+		if err != nil {
+			return nil, err
+		}
+		vars[name] = &targetSpecificVar{
+			v:      &simpleVar{value: []string{v}, origin: n.TargetSpecificVars[name].Origin()},
+			op:     ":=",
+			export: true,
+		}
+	}
+	return vars, nil
+}
+
+func evalCommands(nodes []*DepNode, vars Vars, exports map[string]bool, exportAll bool) error {
 	ioCnt := 0
 	ectx := newExecContext(vars, searchPaths{}, true)
+	ectx.exports, ectx.exportAll = exports, exportAll
 	for i, n := range nodes {
 		runners, hasIO, err := createRunners(ectx, n)
 		if err != nil {
@@ -358,10 +600,26 @@ func evalCommands(nodes []*DepNode, vars Vars) error {
 			continue
 		}
 
+		tsvs, err := ectx.evalTargetEnv(n)
+		if err != nil {
+			return err
+		}
+		if tsvs == nil {
+			tsvs = make(Vars)
+		}
+		for _, name := range keptTargetVars {
+			if _, ok := tsvs[name]; ok {
+				continue
+			}
+			if v, ok := n.TargetSpecificVars[name]; ok {
+				tsvs[name] = v
+			}
+		}
 		n.Cmds = []string{}
-		n.TargetSpecificVars = make(Vars)
+		n.TargetSpecificVars = tsvs
 		for _, r := range runners {
-			n.Cmds = append(n.Cmds, r.String())
+			// Commands are evaluated again when they run.
+			n.Cmds = append(n.Cmds, strings.Replace(r.String(), "$", "$$", -1))
 		}
 	}
 	logStats("%d/%d rules have IO", ioCnt, len(nodes))
@@ -15,8 +15,14 @@
 package kati
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
@@ -33,7 +39,54 @@ type Executor struct {
 
 	wm *workerManager
 
-	ctx *execContext
+	// ctxs are contexts to evaluate recipes, one for each graph
+	// merged by MergeGraphs. partOf is the index in ctxs for nodes.
+	ctxs   []*execContext
+	partOf map[*DepNode]int
+	// context is used to cancel execution.
+	context context.Context
+
+	// sandboxWarnings reports files written by recipes but not
+	// declared as outputs. Recipes are serialized by sandboxMu, so
+	// files are attributed to the right target.
+	sandboxWarnings bool
+	sandboxMu       sync.Mutex
+
+	retries []RetryPattern
+
+	// buildLog is the build log, if ExecutorOpt.BuildLog is set.
+	buildLog *buildLog
+
+	// workers are persistent workers, if
+	// ExecutorOpt.PersistentWorkers is set.
+	workers *workerPool
+
+	// deleteFailedOutputs is set by ExecutorOpt.DeleteFailedOutputs
+	// or .DELETE_ON_ERROR.
+	deleteFailedOutputs bool
+
+	// failureOutputTail is ExecutorOpt.FailureOutputTail.
+	failureOutputTail int
+
+	// recipeTmpDir is ExecutorOpt.RecipeTmpDir.
+	recipeTmpDir bool
+
+	// criticalPath is the critical path length of nodes, used as
+	// priorities of jobs. nil unless ExecutorOpt.CriticalPath is set.
+	criticalPath map[*DepNode]int
+	numJobs      int
+	// recipeTime is the total time running recipes in nanoseconds.
+	recipeTime int64
+
+	// handleSignals stops the execution on SIGINT or SIGTERM. The
+	// received signal is kept in signal, guarded by sigMu.
+	handleSignals bool
+	sigMu         sync.Mutex
+	signal        syscall.Signal
+
+	// recipeRan is set once a recipe has been run, after which
+	// the dirents cached by fsCache may be stale.
+	recipeRan int32
 
 	trace          []string
 	buildCnt       int
@@ -44,7 +97,7 @@ type Executor struct {
 }
 
 func (ex *Executor) makeJobs(n *DepNode, neededBy *job) error {
-	output, _ := ex.ctx.vpaths.exists(n.Output)
+	output, _ := ex.contextOf(n).vpaths.exists(n.Output)
 	if neededBy != nil {
 		glog.V(1).Infof("MakeJob: %s for %s", output, neededBy.n.Output)
 	}
@@ -74,10 +127,11 @@ func (ex *Executor) makeJobs(n *DepNode, neededBy *job) error {
 	}
 
 	j = &job{
-		n:       n,
-		ex:      ex,
-		numDeps: len(n.Deps) + len(n.OrderOnlys),
-		depsTs:  int64(-1),
+		n:        n,
+		ex:       ex,
+		numDeps:  len(n.Deps) + len(n.OrderOnlys),
+		depsTs:   int64(-1),
+		priority: ex.criticalPath[n],
 	}
 	if neededBy != nil {
 		j.parents = append(j.parents, neededBy)
@@ -92,7 +146,7 @@ func (ex *Executor) makeJobs(n *DepNode, neededBy *job) error {
 		deps = append(deps, d)
 	}
 	for _, d := range n.OrderOnlys {
-		if _, ok := ex.ctx.vpaths.exists(d.Output); ok {
+		if _, ok := ex.contextOf(d).vpaths.exists(d.Output); ok {
 			j.numDeps--
 			continue
 		}
@@ -113,6 +167,78 @@ func (ex *Executor) makeJobs(n *DepNode, neededBy *job) error {
 	return ex.wm.PostJob(j)
 }
 
+// criticalPaths returns the number of recipes on the longest chain
+// from each node to any of roots, including the node itself.
+func criticalPaths(roots []*DepNode) map[*DepNode]int {
+	// Sort nodes so that each node comes after nodes depending on
+	// it. Dependency cycles are broken at the first visit.
+	visited := make(map[*DepNode]bool)
+	var order []*DepNode
+	var visit func(n *DepNode)
+	visit = func(n *DepNode) {
+		if visited[n] {
+			return
+		}
+		visited[n] = true
+		for _, d := range n.Deps {
+			visit(d)
+		}
+		for _, d := range n.OrderOnlys {
+			visit(d)
+		}
+		order = append(order, n)
+	}
+	for _, root := range roots {
+		visit(root)
+	}
+	weight := func(n *DepNode) int {
+		if len(n.Cmds) > 0 {
+			return 1
+		}
+		return 0
+	}
+	cp := make(map[*DepNode]int)
+	for i := len(order) - 1; i >= 0; i-- {
+		n := order[i]
+		if _, ok := cp[n]; !ok {
+			cp[n] = weight(n)
+		}
+		for _, ds := range [][]*DepNode{n.Deps, n.OrderOnlys} {
+			for _, d := range ds {
+				if l := cp[n] + weight(d); l > cp[d] {
+					cp[d] = l
+				}
+			}
+		}
+	}
+	return cp
+}
+
+// removeIntermediates removes intermediate files made in this run
+// unless they are precious, as GNU make does.
+func (ex *Executor) removeIntermediates() {
+	var files []string
+	for _, j := range ex.wm.jobs {
+		if !j.ran || !j.n.IsIntermediate || j.n.IsPrecious || j.n.IsPhony {
+			continue
+		}
+		if _, err := os.Stat(j.n.Output); err != nil {
+			continue
+		}
+		files = append(files, j.n.Output)
+	}
+	if len(files) == 0 {
+		return
+	}
+	fmt.Printf("rm %s\n", strings.Join(files, " "))
+	for _, f := range files {
+		err := os.Remove(f)
+		if err != nil {
+			glog.Warningf("failed to remove intermediate file: %v", err)
+		}
+	}
+}
+
 func (ex *Executor) reportStats() {
 	if !PeriodicStatsFlag {
 		return
@@ -128,6 +254,92 @@ func (ex *Executor) reportStats() {
 // ExecutorOpt is an option for Executor.
 type ExecutorOpt struct {
 	NumJobs int
+
+	// SandboxWarnings warns about targets whose recipes write files
+	// under the current directory other than the target itself,
+	// which are unsafe to cache remotely. Files are compared before
+	// and after each recipe, so recipes run one at a time.
+	SandboxWarnings bool
+
+	// Retries are how many times failing recipes are retried, for
+	// targets matching patterns. The first matching one is used.
+	// The target specific variable KATI_RETRY overrides them.
+	Retries []RetryPattern
+
+	// CriticalPath runs ready jobs on longer chains of recipes to
+	// the targets first, which may shorten the build with many
+	// jobs. Each recipe is assumed to take the same time.
+	CriticalPath bool
+
+	// HandleSignals stops launching recipes on SIGINT or SIGTERM,
+	// forwards the signal to running recipes, and removes targets
+	// they were making unless the targets are precious. The
+	// execution then fails with InterruptError.
+	HandleSignals bool
+
+	// DeleteFailedOutputs removes targets modified by failed recipes
+	// unless the targets are precious, so they are not considered
+	// up to date by later builds, as .DELETE_ON_ERROR does.
+	DeleteFailedOutputs bool
+
+	// BuildLog is the file to record commands and timestamps of
+	// built targets, e.g. ".kati_log". With it, a target is rebuilt
+	// if its commands change, and timestamps are compared in
+	// nanoseconds. Recipes are evaluated even for targets which
+	// turn out to be up to date.
+	BuildLog string
+
+	// PersistentWorkers runs commands of recipes by persistent
+	// worker processes for targets with the target specific
+	// variable KATI_WORKER, which is the command to start a worker.
+	// Each command of the recipe must be a simple command, whose
+	// words are sent to an idle worker using the protocol named by
+	// KATI_WORKER_PROTOCOL (see RegisterWorkerProtocol). Workers
+	// run until the execution ends. Otherwise KATI_WORKER is
+	// ignored and commands run by the shell.
+	PersistentWorkers bool
+
+	// FailureOutputTail is the number of bytes at the end of the
+	// output of a failed command included in the error, with the
+	// target, the srcpos of the recipe and the command. The output
+	// is still printed when the command finishes. 0 disables it.
+	FailureOutputTail int
+
+	// MaxLoad holds back new jobs while other jobs are running and
+	// the load average is at least MaxLoad, as -l of GNU make. It
+	// is ignored if 0, or where the load average is unknown.
+	MaxLoad float64
+
+	// RecipeTmpDir runs each recipe with TMPDIR set to a new
+	// directory, so recipes writing temporary files with fixed names
+	// don't race with -j. The directory is removed when the recipe
+	// succeeds, and kept for inspection when it fails. TMPDIR is
+	// ignored by the cache and stamps, so sub-makes run by recipes
+	// aren't regenerated because of it.
+	RecipeTmpDir bool
+}
+
+// InterruptError is the error when the execution is interrupted by
+// a signal.
+type InterruptError struct {
+	Signal syscall.Signal
+}
+
+func (e InterruptError) Error() string {
+	return fmt.Sprintf("*** %v", e.Signal)
+}
+
+// ExitStatus returns the conventional exit status for the signal,
+// 128 plus the signal number.
+func (e InterruptError) ExitStatus() int {
+	return 128 + int(e.Signal)
+}
+
+// RetryPattern retries failing recipes of targets matching Pattern,
+// which may contain a %, up to Count times.
+type RetryPattern struct {
+	Pattern string
+	Count   int
 }
 
 // NewExecutor creates new Executor.
@@ -138,7 +350,7 @@ func NewExecutor(opt *ExecutorOpt) (*Executor, error) {
 	if opt.NumJobs < 1 {
 		opt.NumJobs = 1
 	}
-	wm, err := newWorkerManager(opt.NumJobs)
+	wm, err := newWorkerManager(opt.NumJobs, opt.MaxLoad)
 	if err != nil {
 		return nil, err
 	}
@@ -147,25 +359,77 @@ func NewExecutor(opt *ExecutorOpt) (*Executor, error) {
 		suffixRules: make(map[string][]*rule),
 		done:        make(map[string]*job),
 		wm:          wm,
+
+		sandboxWarnings: opt.SandboxWarnings,
+		retries:         opt.Retries,
+		numJobs:         opt.NumJobs,
+		handleSignals:   opt.HandleSignals,
+
+		deleteFailedOutputs: opt.DeleteFailedOutputs,
+		failureOutputTail:   opt.FailureOutputTail,
+		recipeTmpDir:        opt.RecipeTmpDir,
+	}
+	if opt.PersistentWorkers {
+		ex.workers = newWorkerPool()
+	}
+	if opt.BuildLog != "" {
+		ex.buildLog, err = loadBuildLog(opt.BuildLog)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if opt.CriticalPath {
+		ex.criticalPath = make(map[*DepNode]int)
 	}
 	return ex, nil
 }
 
 // Exec executes to build targets, or first target in DepGraph.
 func (ex *Executor) Exec(g *DepGraph, targets []string) error {
-	ex.ctx = newExecContext(g.vars, g.vpaths, false)
+	return ex.ExecContext(context.Background(), g, targets)
+}
 
-	// TODO: Handle target specific variables.
-	for name, export := range g.exports {
-		if export {
-			v, err := ex.ctx.ev.EvaluateVar(name)
+// ExecContext executes to build targets, or first target in DepGraph.
+// It stops running new commands and kills running commands when ctx
+// is done.
+func (ex *Executor) ExecContext(ctx context.Context, g *DepGraph, targets []string) error {
+	defer startPhase(phaseExec)()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if ex.handleSignals {
+		stop := ex.notifySignals(cancel)
+		defer stop()
+	}
+	if ex.workers != nil {
+		defer ex.workers.close()
+	}
+	ex.context = ctx
+	ex.ctxs = nil
+	ex.partOf = g.partOf
+	for _, p := range g.partGraphs() {
+		err := p.loadVars()
+		if err != nil {
+			return err
+		}
+		ectx := newExecContext(p.vars, p.vpaths, false)
+		ectx.ev.setContext(ctx)
+		ectx.exports, ectx.exportAll = p.exports, p.exportAll
+		if !DryRunFlag {
+			shell, err := resolveShell(ectx.shell)
 			if err != nil {
 				return err
 			}
-			os.Setenv(name, v)
-		} else {
-			os.Unsetenv(name)
+			ectx.shell = shell
 		}
+		ex.ctxs = append(ex.ctxs, ectx)
+	}
+	if g.deleteOnError {
+		ex.deleteFailedOutputs = true
+	}
+
+	err := ex.exportVars(g)
+	if err != nil {
+		return err
 	}
 
 	startTime := time.Now()
@@ -186,6 +450,9 @@ func (ex *Executor) Exec(g *DepGraph, targets []string) error {
 			}
 		}
 	}
+	if ex.criticalPath != nil {
+		ex.criticalPath = criticalPaths(nodes)
+	}
 	for _, root := range nodes {
 		err := ex.makeJobs(root, nil)
 		if err != nil {
@@ -193,7 +460,28 @@ func (ex *Executor) Exec(g *DepGraph, targets []string) error {
 		}
 	}
 	n, err := ex.wm.Wait()
-	logStats("exec time: %q", time.Since(startTime))
+	ex.removeIntermediates()
+	if ex.buildLog != nil && !DryRunFlag {
+		lerr := ex.buildLog.save()
+		if err == nil {
+			err = lerr
+		}
+	}
+	execTime := time.Since(startTime)
+	logStats("exec time: %q", execTime)
+	var longest int
+	for _, l := range ex.criticalPath {
+		if l > longest {
+			longest = l
+		}
+	}
+	recipeTime := time.Duration(atomic.LoadInt64(&ex.recipeTime))
+	logStats("recipe time: %q, parallelism %.2f of %d jobs, critical path priority=%t (%d recipes)", recipeTime, float64(recipeTime)/float64(execTime), ex.numJobs, ex.criticalPath != nil, longest)
+	cached, stats := timestampStats.Counts()
+	logStats("timestamp: %d from dirent cache, %d stat calls", cached, stats)
+	if sig := ex.interrupted(); sig != 0 {
+		return InterruptError{Signal: sig}
+	}
 	if n == 0 {
 		for _, root := range nodes {
 			fmt.Printf("kati: Nothing to be done for `%s'.\n", root.Output)
@@ -201,3 +489,80 @@ func (ex *Executor) Exec(g *DepGraph, targets []string) error {
 	}
 	return err
 }
+
+// contextOf returns the context to evaluate the recipe of n.
+func (ex *Executor) contextOf(n *DepNode) *execContext {
+	return ex.ctxs[ex.partOf[n]]
+}
+
+// exportVars sets exported variables in the environment of commands.
+// Graphs merged by MergeGraphs must not export different values.
+func (ex *Executor) exportVars(g *DepGraph) error {
+	type export struct {
+		export bool
+		value  string
+	}
+	exports := make(map[string]export)
+	// TODO: Handle target specific variables.
+	for i, p := range g.partGraphs() {
+		for name, e := range p.exports {
+			var v string
+			if e {
+				var err error
+				v, err = ex.ctxs[i].ev.EvaluateVar(name)
+				if err != nil {
+					return err
+				}
+			}
+			if old, ok := exports[name]; ok && old != (export{e, v}) {
+				return fmt.Errorf("*** variable %q is exported differently by merged makefiles", name)
+			}
+			exports[name] = export{e, v}
+			if e {
+				os.Setenv(name, exportValue(name, v))
+			} else {
+				os.Unsetenv(name)
+			}
+		}
+	}
+	return nil
+}
+
+// notifySignals cancels the execution on SIGINT or SIGTERM. It
+// returns a function to stop handling signals.
+func (ex *Executor) notifySignals(cancel context.CancelFunc) func() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-ch:
+			ex.sigMu.Lock()
+			ex.signal = sig.(syscall.Signal)
+			ex.sigMu.Unlock()
+			cancel()
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(ch)
+		close(done)
+	}
+}
+
+// interrupted returns the signal which interrupted the execution, or
+// 0 if not interrupted.
+func (ex *Executor) interrupted() syscall.Signal {
+	ex.sigMu.Lock()
+	defer ex.sigMu.Unlock()
+	return ex.signal
+}
+
+// killSignal returns the signal sent to running recipes when the
+// execution is cancelled: the signal which interrupted it, or SIGKILL.
+func (ex *Executor) killSignal() syscall.Signal {
+	if sig := ex.interrupted(); sig != 0 {
+		return sig
+	}
+	return syscall.SIGKILL
+}
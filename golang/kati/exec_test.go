@@ -0,0 +1,513 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"container/heap"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestExecutorRetry(t *testing.T) {
+	// Each recipe fails until it has run 3 times.
+	chdirTemp(t, map[string]string{
+		"Makefile": `
+a.out: KATI_RETRY := 2
+e.out: KATI_RETRY := 2
+%.out:
+	@echo x >> $@.tries
+	@test $$(wc -l < $@.tries) -ge 3
+	@touch $@
+`,
+	})
+	defer func(d time.Duration) { retryBackoff = d }(retryBackoff)
+	retryBackoff = time.Millisecond
+
+	for _, tc := range []struct {
+		target  string
+		retries []RetryPattern
+		eager   bool
+		wantErr bool
+	}{
+		{target: "a.out"},
+		{target: "b.out", wantErr: true},
+		{target: "c.out", retries: []RetryPattern{{Pattern: "c.%", Count: 2}}},
+		{target: "d.out", retries: []RetryPattern{{Pattern: "%.out", Count: 1}}, wantErr: true},
+		{target: "e.out", eager: true},
+	} {
+		g := mustLoad(t, LoadReq{Makefile: "Makefile", Targets: []string{tc.target}, EagerEvalCommand: tc.eager})
+		ex, err := NewExecutor(&ExecutorOpt{NumJobs: 1, Retries: tc.retries})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ex.Exec(g, []string{tc.target})
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("Exec(%q)=%v; want error %t", tc.target, err, tc.wantErr)
+		}
+		b, err := ioutil.ReadFile(tc.target + ".tries")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 3
+		if tc.wantErr {
+			want = 1
+			for _, r := range tc.retries {
+				want += r.Count
+			}
+		}
+		if got := strings.Count(string(b), "\n"); got != want {
+			t.Errorf("%s ran %d times; want %d", tc.target, got, want)
+		}
+	}
+}
+
+func TestCriticalPaths(t *testing.T) {
+	cmds := []string{"true"}
+	c := &DepNode{Output: "c", Cmds: cmds}
+	b := &DepNode{Output: "b", Cmds: cmds, Deps: []*DepNode{c}}
+	// a has no recipe, so it's not on the critical path.
+	a := &DepNode{Output: "a", Deps: []*DepNode{b}}
+	d := &DepNode{Output: "d", Cmds: cmds, OrderOnlys: []*DepNode{c}}
+	all := &DepNode{Output: "all", Deps: []*DepNode{d, a}}
+	got := criticalPaths([]*DepNode{all})
+	for n, want := range map[*DepNode]int{all: 0, a: 0, b: 1, c: 2, d: 1} {
+		if got[n] != want {
+			t.Errorf("critical path of %s=%d; want %d", n.Output, got[n], want)
+		}
+	}
+
+	var jq jobQueue
+	heap.Init(&jq)
+	for _, j := range []*job{
+		{id: 1, priority: 1},
+		{id: 2, priority: 2},
+		{id: 3, priority: 1},
+		{id: 4, priority: 2},
+	} {
+		heap.Push(&jq, j)
+	}
+	var ids []int
+	for jq.Len() > 0 {
+		ids = append(ids, heap.Pop(&jq).(*job).id)
+	}
+	if want := []int{2, 4, 1, 3}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("jobs run in %v; want %v", ids, want)
+	}
+}
+
+func TestExecutorInterrupt(t *testing.T) {
+	chdirTemp(t, map[string]string{
+		"Makefile": `
+.PRECIOUS: keep.out
+all: partial.out keep.out
+%.out:
+	@echo partial > $@; touch $@.started; sleep 10; echo done >> $@
+`,
+	})
+	g := mustLoad(t, LoadReq{Makefile: "Makefile"})
+	ex, err := NewExecutor(&ExecutorOpt{NumJobs: 2, HandleSignals: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			_, err1 := os.Stat("partial.out.started")
+			_, err2 := os.Stat("keep.out.started")
+			if err1 == nil && err2 == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		syscall.Kill(os.Getpid(), syscall.SIGINT)
+	}()
+	start := time.Now()
+	err = ex.Exec(g, nil)
+	if ierr, ok := err.(InterruptError); !ok || ierr.Signal != syscall.SIGINT {
+		t.Errorf("Exec()=%v; want InterruptError for SIGINT", err)
+	} else if got, want := ierr.ExitStatus(), 130; got != want {
+		t.Errorf("ExitStatus()=%d; want %d", got, want)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Exec took %v; recipes were not interrupted", d)
+	}
+	if _, err := os.Stat("partial.out"); !os.IsNotExist(err) {
+		t.Errorf("partial.out is not removed: %v", err)
+	}
+	if _, err := os.Stat("keep.out"); err != nil {
+		t.Errorf("precious keep.out is removed: %v", err)
+	}
+}
+
+func TestExecutorDeleteFailedOutputs(t *testing.T) {
+	chdirTemp(t, nil)
+
+	for _, tc := range []struct {
+		mk      string
+		opt     ExecutorOpt
+		wantDel bool
+	}{
+		{},
+		{opt: ExecutorOpt{DeleteFailedOutputs: true}, wantDel: true},
+		{mk: ".DELETE_ON_ERROR:\n", wantDel: true},
+		{mk: ".PRECIOUS: a.out\n", opt: ExecutorOpt{DeleteFailedOutputs: true}},
+	} {
+		os.Remove("a.out")
+		err := ioutil.WriteFile("Makefile", []byte(tc.mk+`
+a.out:
+	@echo partial > $@
+	@false
+`), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := mustLoad(t, LoadReq{Makefile: "Makefile"})
+		ex, err := NewExecutor(&tc.opt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ex.Exec(g, nil)
+		if err == nil {
+			t.Errorf("Exec()=nil for %q %+v; want error", tc.mk, tc.opt)
+		}
+		_, err = os.Stat("a.out")
+		if gotDel := os.IsNotExist(err); gotDel != tc.wantDel {
+			t.Errorf("a.out removed=%t for %q %+v; want %t", gotDel, tc.mk, tc.opt, tc.wantDel)
+		}
+	}
+}
+
+func TestExecutorFailureOutputTail(t *testing.T) {
+	chdirTemp(t, map[string]string{
+		"Makefile": `
+all:
+	@echo ok
+	@echo first; echo second; exit 3
+`,
+	})
+	for _, tc := range []struct {
+		tail int
+		want string
+	}{
+		{
+			want: "*** [all] Error 3",
+		},
+		{
+			tail: 7,
+			want: `*** [all] Error 3
+Makefile:3: recipe for target "all" failed running: echo first; echo second; exit 3
+last 7 bytes of 13 bytes of output:
+second`,
+		},
+		{
+			tail: 100,
+			want: `*** [all] Error 3
+Makefile:3: recipe for target "all" failed running: echo first; echo second; exit 3
+output:
+first
+second`,
+		},
+	} {
+		g := mustLoad(t, LoadReq{Makefile: "Makefile"})
+		ex, err := NewExecutor(&ExecutorOpt{FailureOutputTail: tc.tail})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ex.Exec(g, nil)
+		if err == nil || err.Error() != tc.want {
+			t.Errorf("Exec() with tail %d=%v; want %q", tc.tail, err, tc.want)
+			continue
+		}
+		if tc.tail > 0 {
+			if uerr := errors.Unwrap(err); uerr == nil || uerr.Error() != "*** [all] Error 3" {
+				t.Errorf("errors.Unwrap(Exec()) with tail %d=%v; want the recipe error", tc.tail, uerr)
+			}
+		}
+	}
+}
+
+type fakeLoadAverage float64
+
+func (l fakeLoadAverage) loadAverage() (float64, bool) {
+	return float64(l), true
+}
+
+func TestExecutorMaxLoad(t *testing.T) {
+	chdirTemp(t, nil)
+	defer func(l loadAverager, d time.Duration) {
+		systemLoadAverage, loadRecheckInterval = l, d
+	}(systemLoadAverage, loadRecheckInterval)
+	loadRecheckInterval = 10 * time.Millisecond
+
+	// A recipe fails if another one is running.
+	err := ioutil.WriteFile("Makefile", []byte(`
+all: a b c d
+a b c d:
+	@mkdir running 2>/dev/null
+	@sleep 0.1
+	@rmdir running
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		load    float64
+		maxLoad float64
+		wantErr bool
+	}{
+		{load: 8, maxLoad: 4},
+		{load: 1, maxLoad: 4, wantErr: true},
+		{load: 8, wantErr: true},
+	} {
+		os.Remove("running")
+		systemLoadAverage = fakeLoadAverage(tc.load)
+		g := mustLoad(t, LoadReq{Makefile: "Makefile"})
+		ex, err := NewExecutor(&ExecutorOpt{NumJobs: 4, MaxLoad: tc.maxLoad})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ex.Exec(g, nil)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("Exec() with load %g max %g=%v; want error=%t", tc.load, tc.maxLoad, err, tc.wantErr)
+		}
+	}
+}
+
+func TestExecutorBuildLog(t *testing.T) {
+	chdirTemp(t, map[string]string{
+		"in": "",
+	})
+	runs := 0
+	build := func(desc, cmd string, wantRun bool) {
+		t.Helper()
+		err := ioutil.WriteFile("Makefile", []byte(`
+a.out: in
+	@`+cmd+` > $@
+	@echo x >> runs
+`), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fsCache = newFsCache()
+		g := mustLoad(t, LoadReq{Makefile: "Makefile"})
+		ex, err := NewExecutor(&ExecutorOpt{BuildLog: ".kati_log"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ex.Exec(g, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile("runs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := strings.Count(string(b), "\n")
+		if gotRun := n > runs; gotRun != wantRun {
+			t.Errorf("%s: ran=%t; want %t", desc, gotRun, wantRun)
+		}
+		runs = n
+	}
+	build("first build", "echo 1", true)
+	build("no change", "echo 1", false)
+	build("command changed", "echo 2", true)
+
+	// Modify the input within the same second as the output.
+	st, err := os.Stat("a.out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := st.ModTime()
+	err = os.Chtimes("in", mtime, mtime.Add(time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getTimestamp("in") != getTimestamp("a.out") {
+		t.Skip("the input is modified in another second")
+	}
+	build("input modified in the same second", "echo 2", true)
+	build("no change after input modified", "echo 2", false)
+}
+
+func TestExecutorWait(t *testing.T) {
+	chdirTemp(t, map[string]string{
+		"Makefile": `
+all: a b .WAIT c d
+	@echo $^ > inputs
+a b:
+	@sleep 0.1
+	@echo $@ >> log
+c d:
+	@echo $@ >> log
+.PHONY: all a b c d
+`,
+	})
+	g := mustLoad(t, LoadReq{Makefile: "Makefile"})
+	ex, err := NewExecutor(&ExecutorOpt{NumJobs: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ex.Exec(g, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile("log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := strings.Fields(string(b))
+	if len(log) != 4 || !contains(log[:2], "a") || !contains(log[:2], "b") {
+		t.Errorf("recipes ran in %q; want a and b before c and d", log)
+	}
+	b, err = ioutil.ReadFile("inputs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.TrimSpace(string(b)), "a b c d"; got != want {
+		t.Errorf("$^=%q; want %q", got, want)
+	}
+}
+
+func TestExecutorRecipeTmpDir(t *testing.T) {
+	// Recipes write the same temporary file.
+	chdirTemp(t, map[string]string{
+		"Makefile": `
+all: a b
+a b:
+	@echo $@ > $$TMPDIR/tmp
+	@sleep 0.1
+	@test $$(cat $$TMPDIR/tmp) = $@
+	@echo $$TMPDIR > $@
+fail:
+	@touch $$TMPDIR/tmp
+	@false
+`,
+	})
+
+	exec := func(target string) error {
+		g := mustLoad(t, LoadReq{Makefile: "Makefile", Targets: []string{target}})
+		ex, err := NewExecutor(&ExecutorOpt{NumJobs: 2, RecipeTmpDir: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ex.Exec(g, []string{target})
+	}
+	err := exec("all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tmpDirs []string
+	for _, f := range []string{"a", "b"} {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpDir := strings.TrimSpace(string(b))
+		if _, err := os.Stat(tmpDir); !os.IsNotExist(err) {
+			t.Errorf("TMPDIR of %s %s is not removed: %v", f, tmpDir, err)
+		}
+		tmpDirs = append(tmpDirs, tmpDir)
+	}
+	if tmpDirs[0] == tmpDirs[1] {
+		t.Errorf("a and b ran with the same TMPDIR %s", tmpDirs[0])
+	}
+
+	before, err := filepath.Glob(filepath.Join(os.TempDir(), "kati-recipe*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = exec("fail")
+	if err == nil {
+		t.Fatal("Exec(fail)=nil; want error")
+	}
+	after, err := filepath.Glob(filepath.Join(os.TempDir(), "kati-recipe*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before)+1 {
+		t.Fatalf("TMPDIR of the failed recipe is not kept: %q => %q", before, after)
+	}
+	for _, d := range after {
+		if !contains(before, d) {
+			os.RemoveAll(d)
+		}
+	}
+}
+
+func TestExecutorDryRunSubMake(t *testing.T) {
+	chdirTemp(t, map[string]string{
+		"Makefile": `
+MAKE := echo
+all:
+	touch not_run
+	$(MAKE) $$MAKEFLAGS > makeflags
+`,
+	})
+	DryRunFlag = true
+	defer func() { DryRunFlag = false }()
+	// The executor exports MAKEFLAGS in the environment.
+	makeflags, ok := os.LookupEnv("MAKEFLAGS")
+	defer func() {
+		if ok {
+			os.Setenv("MAKEFLAGS", makeflags)
+		} else {
+			os.Unsetenv("MAKEFLAGS")
+		}
+	}()
+	g := mustLoad(t, LoadReq{Makefile: "Makefile", NoBuiltinRules: true})
+	ex, err := NewExecutor(&ExecutorOpt{NumJobs: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ex.Exec(g, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat("not_run"); !os.IsNotExist(err) {
+		t.Errorf("not_run exists: %v", err)
+	}
+	b, err := ioutil.ReadFile("makeflags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.TrimSpace(string(b)), "nr"; got != want {
+		t.Errorf("MAKEFLAGS=%q; want %q", got, want)
+	}
+}
+
+func TestDryRunMakeflags(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{in: "", want: "n"},
+		{in: "rR", want: "nrR"},
+		{in: "n", want: "n"},
+		{in: "-r -n", want: "-r -n"},
+		{in: " --no-print-directory", want: "n --no-print-directory"},
+		{in: "-r", want: "n -r"},
+		{in: "r -- A=n", want: "nr -- A=n"},
+		{in: "A=b", want: "n A=b"},
+	} {
+		if got := dryRunMakeflags(tc.in); got != tc.want {
+			t.Errorf("dryRunMakeflags(%q)=%q; want %q", tc.in, got, tc.want)
+		}
+	}
+}
@@ -160,9 +160,10 @@ func (v *varref) Eval(w evalWriter, ev *Evaluator) error {
 	if err != nil {
 		return err
 	}
-	vv := ev.LookupVar(buf.String())
+	vname := buf.String()
 	buf.release()
-	err = vv.Eval(w, ev)
+	vv := ev.LookupVar(vname)
+	err = ev.evalVarRef(w, vname, vv)
 	if err != nil {
 		return err
 	}
@@ -246,7 +247,7 @@ func (v varsubst) Eval(w evalWriter, ev *Evaluator) error {
 	subst := string(params[2])
 	buf.Reset()
 	vv := ev.LookupVar(vname)
-	err = vv.Eval(buf, ev)
+	err = ev.evalVarRef(buf, vname, vv)
 	if err != nil {
 		return err
 	}
@@ -638,7 +639,7 @@ func parseFunc(f mkFunc, in []byte, s int, term []byte, funcName string, alloc b
 		v, n, err := parseExpr(in[i:], term, op)
 		if err != nil {
 			if err == errEndOfInput {
-				return nil, 0, fmt.Errorf("*** unterminated call to function `%s': missing `)'.", funcName)
+				return nil, 0, fmt.Errorf("*** unterminated call to function `%s': missing `%c'.", funcName, term[0])
 			}
 			return nil, 0, err
 		}
@@ -659,19 +660,36 @@ func parseFunc(f mkFunc, in []byte, s int, term []byte, funcName string, alloc b
 			break
 		}
 	}
+	return compactFunc(f), i, nil
+}
+
+// compactFunc returns f compacted if possible, which is wrapped to
+// record stats if needed.
+func compactFunc(f mkFunc) Value {
 	var fv Value
 	fv = f
 	if compactor, ok := f.(compactor); ok {
 		fv = compactor.Compact()
 	}
-	if EvalStatsFlag || traceEvent.enabled() {
+	if EvalStatsFlag || FuncStatsFlag || traceEvent.enabled() {
 		fv = funcstats{
 			Value: fv,
 			str:   fv.String(),
+			name:  funcName(f.String()),
 		}
 
 	}
-	return fv, i, nil
+	return fv
+}
+
+// funcName returns the name of the function call s, e.g. "subst" for
+// "$(subst a,b,$(x))".
+func funcName(s string) string {
+	s = strings.TrimLeft(s, "$({")
+	if i := strings.IndexAny(s, " \t)}"); i >= 0 {
+		s = s[:i]
+	}
+	return s
 }
 
 type compactor interface {
@@ -680,7 +698,8 @@ type compactor interface {
 
 type funcstats struct {
 	Value
-	str string
+	str  string
+	name string
 }
 
 func (f funcstats) Eval(w evalWriter, ev *Evaluator) error {
@@ -689,8 +708,8 @@ func (f funcstats) Eval(w evalWriter, ev *Evaluator) error {
 	if err != nil {
 		return err
 	}
-	// TODO(ukai): per functype?
 	traceEvent.end(te)
+	funcStats.add(f.name, ev.srcpos, te.t)
 	return nil
 }
 
@@ -267,6 +267,28 @@ func TestParseExpr(t *testing.T) {
 				rhs: literal("$(bar)"),
 			},
 		},
+		{
+			in: `$(eval export foo = bar)`,
+			val: &funcEval{
+				fclosure: fclosure{
+					args: []Value{
+						literal("(eval"),
+						literal("export foo = bar"),
+					},
+				},
+			},
+		},
+		{
+			in: `$(eval foo = a\#b)`,
+			val: &funcEval{
+				fclosure: fclosure{
+					args: []Value{
+						literal("(eval"),
+						literal(`foo = a\#b`),
+					},
+				},
+			},
+		},
 		{
 			in: `$(strip $1)`,
 			val: &funcStrip{
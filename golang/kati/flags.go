@@ -20,10 +20,83 @@ var (
 	PeriodicStatsFlag bool
 	EvalStatsFlag     bool
 
+	// FuncStatsFlag records the number and the duration of
+	// evaluations of each function, written by WriteFuncStats.
+	// EvalStatsFlag also records them. FuncStatsSrcpos records them
+	// for each srcpos of calls too.
+	FuncStatsFlag   bool
+	FuncStatsSrcpos bool
+
+	// PhaseStatsFlag records the wall and CPU time of each phase,
+	// written by WritePhaseStats.
+	PhaseStatsFlag bool
+
 	DryRunFlag bool
 
 	UseFindEmulator  bool
 	UseShellBuiltins bool
 
 	IgnoreOptionalInclude string
+
+	// IncludeOnce skips re-evaluation of a makefile which is already
+	// in MAKEFILE_LIST with the same content.
+	IncludeOnce bool
+
+	// ShellStderrMode controls stderr of $(shell). It is "inherit" (the
+	// default, same as GNU make), "discard" or "capture". Captured
+	// stderr of $(shell) run while loading is available from
+	// DepGraph.ShellStderrs.
+	ShellStderrMode string
+
+	// Globstar makes "**" in $(wildcard) match zero or more
+	// directories. GNU make treats it same as "*".
+	Globstar bool
+
+	// OverlayDirs are directories overlaid on the working directory,
+	// in order of precedence. $(wildcard), wildcards in prerequisites
+	// and the find emulator see the union of them and the working
+	// directory, and return a file in the overlay of the highest
+	// precedence, e.g. "vendor/foo/res/a.xml" for "foo/res/*.xml" if
+	// "vendor" is an overlay dir and has it.
+	OverlayDirs []string
+
+	// BacktraceDepth is the max number of includes and $(call)s
+	// shown for $(error) and $(warning). 0 shows none, as GNU make.
+	BacktraceDepth int
+
+	// ColorMode controls colors of warnings, errors and recipe
+	// echo. It is "auto" (colored if written to a terminal),
+	// "always" or "never" (the default).
+	ColorMode string
+
+	// Progress reports progress of loading makefiles to stderr
+	// every second: the statement being evaluated, the number of
+	// statements evaluated, the elapsed time and the time left
+	// until the deadline of the context, if any.
+	Progress bool
+
+	// MemBudget is the heap size in bytes which loading makefiles
+	// should stay within. When the heap nears it, the makefile cache
+	// and the directory cache of $(wildcard) and the find emulator
+	// are dropped, and GC runs. 0 means no budget.
+	MemBudget uint64
+
+	// EvalArena allocates buffers used while loading makefiles from
+	// an arena, which is reused after each statement.
+	EvalArena bool
+
+	// WarnEmptyAutoVars warns when a recipe uses $<, $^ or $+ of a
+	// rule without prerequisites, or $* outside pattern rules.
+	WarnEmptyAutoVars bool
+
+	// ParseCacheDir is a directory to keep parsed makefiles, shared
+	// by kati processes. Makefiles are looked up by their contents,
+	// so unchanged makefiles are not parsed again, even by other
+	// processes or at other paths. kati never removes files in it.
+	ParseCacheDir string
+
+	// WarnUndefinedVars warns on each reference to an undefined
+	// variable, same as --warn-undefined-variables of GNU make.
+	// Variables added by AllowUndefinedVar are not reported.
+	WarnUndefinedVars bool
 )
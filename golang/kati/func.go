@@ -24,6 +24,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
@@ -84,6 +85,10 @@ var (
 		"call":    func() mkFunc { return &funcCall{} },
 		"foreach": func() mkFunc { return &funcForeach{} },
 
+		"KATI_let":     func() mkFunc { return &funcLet{} },
+		"KATI_uniq":    func() mkFunc { return &funcUniq{} },
+		"KATI_reverse": func() mkFunc { return &funcReverse{} },
+
 		"origin":  func() mkFunc { return &funcOrigin{} },
 		"flavor":  func() mkFunc { return &funcFlavor{} },
 		"info":    func() mkFunc { return &funcInfo{} },
@@ -216,10 +221,11 @@ func (f *funcPatsubst) Eval(w evalWriter, ev *Evaluator) error {
 	t := time.Now()
 	pat := fargs[0]
 	repl := fargs[1]
+	// writeWord copies the word, so sword is reused for all words.
+	var sword []byte
 	for _, word := range wb.words {
 		pre, subst, post := substPatternBytes(pat, repl, word)
-		var sword []byte
-		sword = append(sword, pre...)
+		sword = append(sword[:0], pre...)
 		if subst != nil {
 			sword = append(sword, subst...)
 			sword = append(sword, post...)
@@ -347,6 +353,57 @@ Loop:
 type funcSort struct{ fclosure }
 
 func (f *funcSort) Arity() int { return 1 }
+
+// Compact fuses $(sort $(wildcard ...)), a common idiom to list files
+// deterministically, into funcSortWildcard.
+func (f *funcSort) Compact() Value {
+	if len(f.args) != 2 {
+		return f
+	}
+	wc, ok := f.args[1].(*funcWildcard)
+	if !ok || len(wc.args) != 2 {
+		return f
+	}
+	return &funcSortWildcard{funcSort: f, pat: wc.args[1]}
+}
+
+// funcSortWildcard is $(sort $(wildcard pat)). Files matching pat are
+// globbed from fsCache and sorted at once. While loading makefiles,
+// the patterns are recorded for the stamp, instead of directories
+// read to glob them.
+type funcSortWildcard struct {
+	*funcSort
+	pat Value
+}
+
+func (f *funcSortWildcard) Eval(w evalWriter, ev *Evaluator) error {
+	wb := newWbuf()
+	err := f.pat.Eval(wb, ev)
+	if err != nil {
+		return err
+	}
+	te := traceEvent.begin("wildcard", tmpval(wb.Bytes()), traceEventMain)
+	t := time.Now()
+	var files []string
+	for _, word := range wb.words {
+		m, err := ev.glob(string(word))
+		if err != nil {
+			return err
+		}
+		files = append(files, m...)
+	}
+	wb.release()
+	sort.Strings(files)
+	for i, file := range files {
+		if i > 0 && file == files[i-1] {
+			continue
+		}
+		w.writeWordString(file)
+	}
+	traceEvent.end(te)
+	stats.add("funcbody", "sort-wildcard", t)
+	return nil
+}
 func (f *funcSort) Eval(w evalWriter, ev *Evaluator) error {
 	err := assertArity("sort", 1, len(f.args))
 	if err != nil {
@@ -544,8 +601,9 @@ func (f *funcJoin) Eval(w evalWriter, ev *Evaluator) error {
 		return err
 	}
 	t := time.Now()
+	var word []byte
 	for i := 0; i < len(wb1.words) || i < len(wb2.words); i++ {
-		var word []byte
+		word = word[:0]
 		if i < len(wb1.words) {
 			word = append(word, wb1.words[i]...)
 		}
@@ -578,11 +636,13 @@ func (f *funcWildcard) Eval(w evalWriter, ev *Evaluator) error {
 	// do not need to check avoid_io here.
 	t := time.Now()
 	for _, word := range wb.words {
-		pat := string(word)
-		err = wildcard(w, pat)
+		files, err := ev.glob(string(word))
 		if err != nil {
 			return err
 		}
+		for _, file := range files {
+			w.writeWordString(file)
+		}
 	}
 	wb.release()
 	traceEvent.end(te)
@@ -773,7 +833,7 @@ func (f *funcRealpath) Eval(w evalWriter, ev *Evaluator) error {
 	}
 	if ev.avoidIO {
 		fmt.Fprintf(w, "$(realpath %s 2>/dev/null)", string(wb.Bytes()))
-		ev.hasIO = true
+		ev.deferIO("realpath", string(wb.Bytes()), "the files may not exist until ninja runs")
 		wb.release()
 		return nil
 	}
@@ -938,7 +998,7 @@ func (f *funcShell) Eval(w evalWriter, ev *Evaluator) error {
 	}
 	if ev.avoidIO && !hasNoIoInShellScript(abuf.Bytes()) {
 		te := traceEvent.begin("shell", tmpval(abuf.Bytes()), traceEventMain)
-		ev.hasIO = true
+		ev.deferIO("shell", abuf.String(), "the command may read files generated by ninja")
 		io.WriteString(w, "$(")
 		w.Write(abuf.Bytes())
 		writeByte(w, ')')
@@ -955,6 +1015,7 @@ func (f *funcShell) Eval(w evalWriter, ev *Evaluator) error {
 		glog.V(2).Infof("builtin command: %#v", bc)
 		te := traceEvent.begin("sh-builtin", literal(arg), traceEventMain)
 		bc.run(w)
+		ev.setShellStatus(0)
 		traceEvent.end(te)
 		return nil
 	}
@@ -968,9 +1029,16 @@ func (f *funcShell) Eval(w evalWriter, ev *Evaluator) error {
 		glog.Infof("shell %q", cmdline)
 	}
 	cmd := exec.Cmd{
-		Path:   cmdline[0],
-		Args:   cmdline,
-		Stderr: os.Stderr,
+		Path: cmdline[0],
+		Args: cmdline,
+	}
+	var stderr bytes.Buffer
+	switch ShellStderrMode {
+	case "discard":
+	case "capture":
+		cmd.Stderr = &stderr
+	default:
+		cmd.Stderr = os.Stderr
 	}
 	te := traceEvent.begin("shell", literal(arg), traceEventMain)
 	out, err := cmd.Output()
@@ -978,11 +1046,47 @@ func (f *funcShell) Eval(w evalWriter, ev *Evaluator) error {
 	if err != nil {
 		glog.Warningf("$(shell %q) failed: %q", arg, err)
 	}
+	ev.setShellStatus(shellStatus(err))
+	if stderr.Len() > 0 {
+		ev.captureStderr(arg, stderr.String())
+	}
+	if ev.loading {
+		ev.shells = append(ev.shells, StampShell{
+			Shell:   shellVar,
+			Command: arg,
+			Output:  string(out),
+		})
+	}
 	w.Write(formatCommandOutput(out))
 	traceEvent.end(te)
 	return nil
 }
 
+// shellStatus returns the exit status of $(shell) for .SHELLSTATUS.
+// As GNU make, it is 128+signal if the shell is killed by a signal,
+// and 127 if the shell can't run.
+func shellStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	if err, ok := err.(*exec.ExitError); ok {
+		if w, ok := err.ProcessState.Sys().(syscall.WaitStatus); ok && w.Signaled() {
+			return 128 + int(w.Signal())
+		}
+		return err.ExitCode()
+	}
+	return 127
+}
+
+// setShellStatus sets .SHELLSTATUS after $(shell), as GNU make 4.2
+// or later.
+func (ev *Evaluator) setShellStatus(status int) {
+	ev.outVars.Assign(".SHELLSTATUS", &simpleVar{
+		value:  []string{strconv.Itoa(status)},
+		origin: "override",
+	})
+}
+
 func (f *funcShell) Compact() Value {
 	if len(f.args)-1 < 1 {
 		return f
@@ -1011,23 +1115,78 @@ func (f *funcShell) Compact() Value {
 	return f
 }
 
+// glob returns files matching pat. While loading, pat and the files
+// are kept in globs for the stamp.
+func (ev *Evaluator) glob(pat string) ([]string, error) {
+	if !ev.loading {
+		return fsCache.Glob(pat)
+	}
+	files, err := fsCache.untracedGlob(pat)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := ev.globs[pat]; !ok {
+		// As Stamp.Diff compares them.
+		var m []string
+		for _, f := range files {
+			m = append(m, trimLeadingCurdir(f))
+		}
+		sort.Strings(m)
+		if ev.globs == nil {
+			ev.globs = make(map[string][]string)
+		}
+		ev.globs[pat] = m
+	}
+	return files, nil
+}
+
 // https://www.gnu.org/software/make/manual/html_node/Call-Function.html#Call-Function
 type funcCall struct{ fclosure }
 
+// callBuiltin calls the built-in function name with args of $(call),
+// which are already expanded. As GNU make, the built-in function is
+// called even if a variable of the same name exists, and args beyond
+// its arity are ignored.
+func callBuiltin(w evalWriter, ev *Evaluator, name string, f mkFunc, args [][]byte) error {
+	f.AddArg(literal("(" + name))
+	for i, arg := range args {
+		if arity := f.Arity(); arity > 0 && i >= arity {
+			break
+		}
+		f.AddArg(literal(arg))
+	}
+	return f.Eval(w, ev)
+}
+
 func (f *funcCall) Arity() int { return 0 }
 
 func (f *funcCall) Eval(w evalWriter, ev *Evaluator) error {
+	err := ev.checkCancel()
+	if err != nil {
+		return err
+	}
 	abuf := newEbuf()
 	fargs, err := ev.args(abuf, f.args[1:]...)
 	if err != nil {
 		return err
 	}
-	varname := fargs[0]
+	// The name may be computed, e.g. $(call $(fn) ,x), and GNU make
+	// strips whitespaces around it.
+	varname := bytes.TrimSpace(fargs[0])
 	variable := string(varname)
+	if mkf, ok := funcMap[variable]; ok {
+		err = callBuiltin(w, ev, variable, mkf(), fargs[1:])
+		abuf.release()
+		return err
+	}
 	te := traceEvent.begin("call", literal(variable), traceEventMain)
 	if glog.V(1) {
 		glog.Infof("call %q variable %q", f.args[1], variable)
 	}
+	err = ev.checkVarUse(variable)
+	if err != nil {
+		return err
+	}
 	v := ev.LookupVar(variable)
 	// Evalualte all arguments first before we modify the table.
 	// An omitted argument should be blank, even if it's nested inside
@@ -1043,9 +1202,6 @@ func (f *funcCall) Eval(w evalWriter, ev *Evaluator) error {
 	args := make([]tmpval, arglen)
 	// $0 is variable.
 	args[0] = tmpval(varname)
-	// TODO(ukai): If variable is the name of a built-in function,
-	// the built-in function is always invoked (even if a make variable
-	// by that name also exists).
 
 	for i, arg := range fargs[1:] {
 		// f.args[2]=>args[1] will be $1.
@@ -1061,10 +1217,12 @@ func (f *funcCall) Eval(w evalWriter, ev *Evaluator) error {
 	if glog.V(1) {
 		w = &ssvWriter{Writer: io.MultiWriter(w, &buf)}
 	}
+	ev.stack = append(ev.stack, evalFrame{call: true, name: variable, srcpos: ev.srcpos})
 	err = v.Eval(w, ev)
 	if err != nil {
 		return err
 	}
+	ev.stack = ev.stack[:len(ev.stack)-1]
 	ev.paramVars = oldParams
 	traceEvent.end(te)
 	if glog.V(1) {
@@ -1088,8 +1246,13 @@ func (f *funcValue) Eval(w evalWriter, ev *Evaluator) error {
 	if err != nil {
 		return err
 	}
-	v := ev.LookupVar(abuf.String())
+	name := abuf.String()
 	abuf.release()
+	err = ev.checkVarUse(name)
+	if err != nil {
+		return err
+	}
+	v := ev.LookupVar(name)
 	io.WriteString(w, v.String())
 	return nil
 }
@@ -1110,18 +1273,26 @@ func (f *funcEval) Eval(w evalWriter, ev *Evaluator) error {
 	}
 	s := abuf.Bytes()
 	glog.V(1).Infof("eval %v=>%q at %s", f.args[1], s, ev.srcpos)
-	mk, err := parseMakefileBytes(trimSpaceBytes(s), ev.srcpos)
+	err = ev.evalText(s)
 	if err != nil {
-		return ev.errorf("%v", err)
+		return err
 	}
+	abuf.release()
+	return nil
+}
 
+// evalText parses s as a makefile and evaluates it, as $(eval s).
+func (ev *Evaluator) evalText(s []byte) error {
+	mk, err := parseMakefileBytes(trimSpaceBytes(s), ev.srcpos, ev.recipePrefix())
+	if err != nil {
+		return ev.errorf("%v", err)
+	}
 	for _, stmt := range mk.stmts {
 		err = ev.eval(stmt)
 		if err != nil {
 			return err
 		}
 	}
-	abuf.release()
 	return nil
 }
 
@@ -1159,6 +1330,10 @@ func (f *funcEval) Compact() Value {
 		return f
 	}
 	arg := f.args[1].String()
+	if strings.IndexByte(arg, '\\') >= 0 {
+		// backslash may escape # or newline.
+		return f
+	}
 	arg = stripComment(arg)
 	if arg == "" || strings.TrimSpace(arg) == "" {
 		return &funcNop{expr: f.String()}
@@ -1203,7 +1378,14 @@ func (f *funcNop) dump(d *dumpbuf) {
 	d.Byte(valueTypeNop)
 }
 
+// parseAssignLiteral parses s as "lhs op rhs" for funcEvalAssign.
+// s must be a single line assignment without directives such as
+// export and override, so evaluating it as an assignment has the same
+// semantics as parsing it as a makefile.
 func parseAssignLiteral(s string) (lhs, op string, rhs Value, ok bool) {
+	if strings.ContainsAny(s, "\n#\\") {
+		return "", "", nil, false
+	}
 	eq := strings.Index(s, "=")
 	if eq < 0 {
 		return "", "", nil, false
@@ -1216,8 +1398,8 @@ func parseAssignLiteral(s string) (lhs, op string, rhs Value, ok bool) {
 		op = s[eq-1 : eq+1]
 	}
 	lhs = strings.TrimSpace(lhs)
-	if strings.IndexAny(lhs, ":$") >= 0 {
-		// target specific var, or need eval.
+	if lhs == "" || strings.IndexAny(lhs, ":$ \t") >= 0 {
+		// target specific var, directive, or need eval.
 		return "", "", nil, false
 	}
 	r := strings.TrimLeft(s[eq+1:], " \t")
@@ -1244,6 +1426,11 @@ func (f *funcEvalAssign) Eval(w evalWriter, ev *Evaluator) error {
 	}
 	rhs := trimLeftSpaceBytes(abuf.Bytes())
 	glog.V(1).Infof("evalAssign: lhs=%q rhs=%s %q", f.lhs, f.rhs, rhs)
+	if bytes.IndexAny(rhs, "\n#") >= 0 {
+		// rhs has other lines or a comment, so it is not a
+		// simple assignment.
+		return ev.evalText([]byte(fmt.Sprintf("%s %s %s", f.lhs, f.op, rhs)))
+	}
 	var rvalue Var
 	switch f.op {
 	case ":=":
@@ -1261,23 +1448,25 @@ func (f *funcEvalAssign) Eval(w evalWriter, ev *Evaluator) error {
 		rvalue = &simpleVar{value: []string{vbuf.String()}, origin: "file"}
 		vbuf.release()
 	case "=":
-		rvalue = &recursiveVar{expr: tmpval(rhs), origin: "file"}
+		rvalue = &recursiveVar{expr: tmpval(rhs), origin: "file", unparsed: true}
 	case "+=":
 		prev := ev.LookupVar(f.lhs)
 		if prev.IsDefined() {
-			rvalue, err = prev.Append(ev, string(rhs))
+			rvalue, err = appendVar(prev, "file", func() (Var, error) {
+				return prev.Append(ev, string(rhs))
+			})
 			if err != nil {
 				return err
 			}
 		} else {
-			rvalue = &recursiveVar{expr: tmpval(rhs), origin: "file"}
+			rvalue = &recursiveVar{expr: tmpval(rhs), origin: "file", unparsed: true}
 		}
 	case "?=":
 		prev := ev.LookupVar(f.lhs)
 		if prev.IsDefined() {
 			return nil
 		}
-		rvalue = &recursiveVar{expr: tmpval(rhs), origin: "file"}
+		rvalue = &recursiveVar{expr: tmpval(rhs), origin: "file", unparsed: true}
 	}
 	if glog.V(1) {
 		glog.Infof("Eval ASSIGN: %s=%q (flavor:%q)", f.lhs, rvalue, rvalue.Flavor())
@@ -1361,7 +1550,7 @@ func (f *funcInfo) Eval(w evalWriter, ev *Evaluator) error {
 	if ev.avoidIO {
 		ev.delayedOutputs = append(ev.delayedOutputs,
 			fmt.Sprintf("echo %q", abuf.String()))
-		ev.hasIO = true
+		ev.deferIO("info", abuf.String(), "the message is printed when the rule runs")
 		abuf.release()
 		return nil
 	}
@@ -1386,11 +1575,11 @@ func (f *funcWarning) Eval(w evalWriter, ev *Evaluator) error {
 	if ev.avoidIO {
 		ev.delayedOutputs = append(ev.delayedOutputs,
 			fmt.Sprintf("echo '%s: %s' 1>&2", ev.srcpos, abuf.String()))
-		ev.hasIO = true
+		ev.deferIO("warning", abuf.String(), "the message is printed when the rule runs")
 		abuf.release()
 		return nil
 	}
-	fmt.Printf("%s: %s\n", ev.srcpos, abuf.String())
+	warnNoPrefix(ev.srcpos, "%s%s", abuf.String(), ev.backtrace())
 	abuf.release()
 	return nil
 }
@@ -1412,11 +1601,11 @@ func (f *funcError) Eval(w evalWriter, ev *Evaluator) error {
 	if ev.avoidIO {
 		ev.delayedOutputs = append(ev.delayedOutputs,
 			fmt.Sprintf("echo '%s: *** %s.' 1>&2 && false", ev.srcpos, abuf.String()))
-		ev.hasIO = true
+		ev.deferIO("error", abuf.String(), "the rule fails when it runs, not when generating ninja")
 		abuf.release()
 		return nil
 	}
-	return ev.errorf("*** %s.", abuf.String())
+	return ev.errorf("*** %s.%s", abuf.String(), ev.backtrace())
 }
 
 // http://www.gnu.org/software/make/manual/make.html#Foreach-Function
@@ -1441,11 +1630,27 @@ func (f *funcForeach) Eval(w evalWriter, ev *Evaluator) error {
 	if err != nil {
 		return err
 	}
+	defer wb.release()
 	text := f.args[3]
-	ov := ev.LookupVar(varname)
+	// Restore the loop variable unless it was reassigned by $(eval)
+	// in the last iteration. Compare with the var assigned by this
+	// loop, so that a nested foreach over the same variable doesn't
+	// clobber or leak into the outer one.
+	restore := ev.outVars.save(varname)
+	var av Var
+	defer func() {
+		if av != nil && ev.outVars[varname] == av {
+			restore()
+		}
+	}()
 	space := false
 	for _, word := range wb.words {
-		ev.outVars.Assign(varname, &automaticVar{value: word})
+		err = ev.checkCancel()
+		if err != nil {
+			return err
+		}
+		av = &automaticVar{value: word}
+		ev.outVars.Assign(varname, av)
 		if space {
 			writeByte(w, ' ')
 		}
@@ -1455,10 +1660,101 @@ func (f *funcForeach) Eval(w evalWriter, ev *Evaluator) error {
 		}
 		space = true
 	}
+	return nil
+}
+
+// funcLet is $(KATI_let var,value,text), a kati extension. It expands
+// text with var set to value, and restores var afterwards. It's like
+// $(foreach) with a single word, but value isn't split into words.
+type funcLet struct{ fclosure }
+
+func (f *funcLet) Arity() int { return 3 }
+
+func (f *funcLet) Eval(w evalWriter, ev *Evaluator) error {
+	err := assertArity("KATI_let", 3, len(f.args))
+	if err != nil {
+		return err
+	}
+	abuf := newEbuf()
+	err = f.args[1].Eval(abuf, ev)
+	if err != nil {
+		return err
+	}
+	varname := string(trimSpaceBytes(abuf.Bytes()))
+	abuf.release()
+	vbuf := newEbuf()
+	err = f.args[2].Eval(vbuf, ev)
+	if err != nil {
+		return err
+	}
+	value := append([]byte(nil), vbuf.Bytes()...)
+	vbuf.release()
+	// Restore the variable unless it was reassigned by $(eval) in
+	// text, same as $(foreach).
+	restore := ev.outVars.save(varname)
+	av := &automaticVar{value: value}
+	defer func() {
+		if ev.outVars[varname] == av {
+			restore()
+		}
+	}()
+	ev.outVars.Assign(varname, av)
+	return f.args[3].Eval(w, ev)
+}
+
+// funcUniq is $(KATI_uniq list), a kati extension. It returns words
+// of list without duplicates, in order of their first occurrence,
+// e.g. "b a c" for "b a b c a".
+type funcUniq struct{ fclosure }
+
+func (f *funcUniq) Arity() int { return 1 }
+
+func (f *funcUniq) Eval(w evalWriter, ev *Evaluator) error {
+	err := assertArity("KATI_uniq", 1, len(f.args))
+	if err != nil {
+		return err
+	}
+	wb := newWbuf()
+	err = f.args[1].Eval(wb, ev)
+	if err != nil {
+		return err
+	}
+	t := time.Now()
+	seen := make(map[string]bool, len(wb.words))
+	for _, word := range wb.words {
+		// The conversion doesn't allocate for the lookup.
+		if seen[string(word)] {
+			continue
+		}
+		seen[string(word)] = true
+		w.writeWord(word)
+	}
 	wb.release()
-	av := ev.LookupVar(varname)
-	if _, ok := av.(*automaticVar); ok {
-		ev.outVars.Assign(varname, ov)
+	stats.add("funcbody", "KATI_uniq", t)
+	return nil
+}
+
+// funcReverse is $(KATI_reverse list), a kati extension. It returns
+// words of list in reverse order.
+type funcReverse struct{ fclosure }
+
+func (f *funcReverse) Arity() int { return 1 }
+
+func (f *funcReverse) Eval(w evalWriter, ev *Evaluator) error {
+	err := assertArity("KATI_reverse", 1, len(f.args))
+	if err != nil {
+		return err
 	}
+	wb := newWbuf()
+	err = f.args[1].Eval(wb, ev)
+	if err != nil {
+		return err
+	}
+	t := time.Now()
+	for i := len(wb.words) - 1; i >= 0; i-- {
+		w.writeWord(wb.words[i])
+	}
+	wb.release()
+	stats.add("funcbody", "KATI_reverse", t)
 	return nil
 }
@@ -14,7 +14,136 @@
 
 package kati
 
-import "testing"
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestFuncLet(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{
+			in:   "$(KATI_let x,a b,[$(x)])",
+			want: "[a b]",
+		},
+		{
+			in:   "$(KATI_let x,a,$(x),$(x))",
+			want: "a,a",
+		},
+		{
+			in:   "$(KATI_let x,in,$(KATI_let x,$(x)ner,$(x)) $(x)) $(x)",
+			want: "inner in out",
+		},
+		{
+			in:   "$(KATI_let x,a,$(eval x:=b))$(x)",
+			want: "b",
+		},
+	} {
+		val, _, err := parseExpr([]byte(tc.in), nil, parseOp{alloc: true})
+		if err != nil {
+			t.Fatalf("parseExpr(%q)=_, _, %v", tc.in, err)
+		}
+		// Values are deserialized from the cache with -use_cache.
+		dv, err := deserializeVar(val.serialize())
+		if err != nil {
+			t.Fatalf("deserializeVar(%q)=_, %v", tc.in, err)
+		}
+		for _, v := range []Value{val, dv} {
+			ev := NewEvaluator(Vars{"x": &simpleVar{value: []string{"out"}, origin: "file"}})
+			var buf evalBuffer
+			err = v.Eval(&buf, ev)
+			if err != nil {
+				t.Errorf("%q.Eval()=%v", tc.in, err)
+				continue
+			}
+			if got := buf.String(); got != tc.want {
+				t.Errorf("%q.Eval()=%q; want %q", tc.in, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestFuncUniqReverse(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{
+			in:   "$(KATI_uniq b a  b c\ta)",
+			want: "b a c",
+		},
+		{
+			in:   "$(KATI_uniq $(x) $(x),b,y)",
+			want: "a b b,b,y",
+		},
+		{
+			in:   "[$(KATI_uniq )]",
+			want: "[]",
+		},
+		{
+			in:   "$(KATI_reverse a b  c)",
+			want: "c b a",
+		},
+		{
+			in:   "$(KATI_reverse $(KATI_uniq $(x) c $(x)))",
+			want: "c b a",
+		},
+		{
+			in:   "$(call KATI_uniq,$(x) a)",
+			want: "a b",
+		},
+	} {
+		val, _, err := parseExpr([]byte(tc.in), nil, parseOp{alloc: true})
+		if err != nil {
+			t.Fatalf("parseExpr(%q)=_, _, %v", tc.in, err)
+		}
+		dv, err := deserializeVar(val.serialize())
+		if err != nil {
+			t.Fatalf("deserializeVar(%q)=_, %v", tc.in, err)
+		}
+		for _, v := range []Value{val, dv} {
+			ev := NewEvaluator(Vars{"x": &simpleVar{value: []string{"a b"}, origin: "file"}})
+			var buf evalBuffer
+			buf.Reset()
+			err = v.Eval(&buf, ev)
+			if err != nil {
+				t.Errorf("%q.Eval()=%v", tc.in, err)
+				continue
+			}
+			if got := buf.String(); got != tc.want {
+				t.Errorf("%q.Eval()=%q; want %q", tc.in, got, tc.want)
+			}
+		}
+	}
+}
+
+func TestFuncSortWildcardCompact(t *testing.T) {
+	for _, tc := range []struct {
+		in    string
+		fused bool
+	}{
+		{in: "$(sort $(wildcard *.c))", fused: true},
+		{in: "$(sort $(wildcard $(x)/*.c $(x)/*.h))", fused: true},
+		{in: "$(sort $(wildcard *.c) a.c)"},
+		{in: "$(sort $(filter %.c,$(wildcard *)))"},
+		{in: "$(wildcard $(sort *.c))"},
+	} {
+		val, _, err := parseExpr([]byte(tc.in), nil, parseOp{alloc: true})
+		if err != nil {
+			t.Fatalf("parseExpr(%q)=_, _, %v", tc.in, err)
+		}
+		_, fused := val.(*funcSortWildcard)
+		if fused != tc.fused {
+			t.Errorf("parseExpr(%q)=%T; fused=%t, want %t", tc.in, val, fused, tc.fused)
+		}
+		if got := val.String(); got != tc.in {
+			t.Errorf("parseExpr(%q).String()=%q", tc.in, got)
+		}
+	}
+}
 
 func BenchmarkFuncStrip(b *testing.B) {
 	strip := &funcStrip{
@@ -74,3 +203,87 @@ func BenchmarkFuncPatsubst(b *testing.B) {
 		patsubst.Eval(&buf, ev)
 	}
 }
+
+// largeWordList returns a value like a long list of product packages.
+func largeWordList(n int) literal {
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		fmt.Fprintf(&sb, "out/target/product/generic/obj/JAVA_LIBRARIES/lib%d_intermediates/classes.java", i)
+	}
+	return literal(sb.String())
+}
+
+func benchmarkLargeFunc(b *testing.B, f mkFunc) {
+	ev := NewEvaluator(make(map[string]Var))
+	var buf evalBuffer
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		f.Eval(&buf, ev)
+	}
+}
+
+func BenchmarkFuncPatsubstLarge(b *testing.B) {
+	benchmarkLargeFunc(b, &funcPatsubst{
+		fclosure: fclosure{
+			args: []Value{
+				literal("(patsubst"),
+				literal("%.java"),
+				literal("%.class"),
+				largeWordList(100000),
+			},
+		},
+	})
+}
+
+func BenchmarkFuncSubstLarge(b *testing.B) {
+	benchmarkLargeFunc(b, &funcSubst{
+		fclosure: fclosure{
+			args: []Value{
+				literal("(subst"),
+				literal("JAVA_LIBRARIES"),
+				literal("APPS"),
+				largeWordList(100000),
+			},
+		},
+	})
+}
+
+func BenchmarkFuncFilterLarge(b *testing.B) {
+	benchmarkLargeFunc(b, &funcFilter{
+		fclosure: fclosure{
+			args: []Value{
+				literal("(filter"),
+				literal("%9_intermediates/classes.java"),
+				largeWordList(100000),
+			},
+		},
+	})
+}
+
+func BenchmarkFuncJoinLarge(b *testing.B) {
+	benchmarkLargeFunc(b, &funcJoin{
+		fclosure: fclosure{
+			args: []Value{
+				literal("(join"),
+				largeWordList(100000),
+				largeWordList(100000),
+			},
+		},
+	})
+}
+
+func BenchmarkFuncUniqLarge(b *testing.B) {
+	benchmarkLargeFunc(b, &funcUniq{
+		fclosure: fclosure{
+			args: []Value{
+				literal("(KATI_uniq"),
+				largeWordList(100000) + " " + largeWordList(100000),
+			},
+		},
+	})
+}
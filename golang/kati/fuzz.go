@@ -0,0 +1,57 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build gofuzz
+// +build gofuzz
+
+package kati
+
+// Fuzz functions for go-fuzz (https://github.com/dvyukov/go-fuzz).
+// Generate corpus with
+//
+//  $ go run testcase/gen_testcase_parse_benchmark.go -fuzz_corpus=out/fuzz
+//
+// and run, e.g.
+//
+//  $ go-fuzz-build -func FuzzParseExpr ./golang/kati
+//  $ go-fuzz -bin kati-fuzz.zip -workdir out/fuzz/expr
+//
+// Use go-fuzz-build -libfuzzer to build a libFuzzer harness.
+
+// FuzzParseExpr parses data as a makefile expression.
+func FuzzParseExpr(data []byte) int {
+	_, _, err := parseExpr(data, nil, parseOp{alloc: true})
+	if err != nil {
+		return 0
+	}
+	return 1
+}
+
+// FuzzParseDollar parses data as a variable reference or a function call.
+func FuzzParseDollar(data []byte) int {
+	_, _, err := parseDollar(data, true)
+	if err != nil {
+		return 0
+	}
+	return 1
+}
+
+// FuzzParseMakefile parses data as a makefile.
+func FuzzParseMakefile(data []byte) int {
+	_, err := parseMakefileBytes(data, srcpos{filename: "Makefile"}, defaultRecipePrefix)
+	if err != nil {
+		return 0
+	}
+	return 1
+}
@@ -0,0 +1,58 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// loadAverager returns the load average of the system over the last
+// minute, or false if it's not available.
+type loadAverager interface {
+	loadAverage() (float64, bool)
+}
+
+// loadRecheckInterval is how often the load average is checked again
+// while jobs are held back by ExecutorOpt.MaxLoad.
+var loadRecheckInterval = time.Second
+
+// loadTooHigh reports whether the load average is at or above
+// maxLoad, so no more jobs should start. As the load average lags,
+// jobs started in the last second are added to it, like GNU make.
+func (wm *workerManager) loadTooHigh() bool {
+	if wm.maxLoad <= 0 {
+		return false
+	}
+	load, ok := wm.loadavg.loadAverage()
+	if !ok {
+		return false
+	}
+	now := time.Now()
+	recent := wm.recentStarts[:0]
+	for _, t := range wm.recentStarts {
+		if now.Sub(t) < time.Second {
+			recent = append(recent, t)
+		}
+	}
+	wm.recentStarts = recent
+	load += float64(len(recent))
+	if load < wm.maxLoad {
+		return false
+	}
+	glog.V(1).Infof("load %.2f >= %.2f: hold %d ready jobs", load, wm.maxLoad, wm.readyQueue.Len())
+	return true
+}
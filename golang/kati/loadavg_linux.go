@@ -0,0 +1,42 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// procLoadAverage reads the load average from /proc/loadavg.
+type procLoadAverage struct{}
+
+func (procLoadAverage) loadAverage() (float64, bool) {
+	b, err := ioutil.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, false
+	}
+	ws := strings.Fields(string(b))
+	if len(ws) == 0 {
+		return 0, false
+	}
+	load, err := strconv.ParseFloat(ws[0], 64)
+	if err != nil {
+		return 0, false
+	}
+	return load, true
+}
+
+var systemLoadAverage loadAverager = procLoadAverage{}
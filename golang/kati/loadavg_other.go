@@ -0,0 +1,28 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package kati
+
+// noLoadAverage is used where the load average is not available, so
+// jobs are never throttled by ExecutorOpt.MaxLoad.
+type noLoadAverage struct{}
+
+func (noLoadAverage) loadAverage() (float64, bool) {
+	return 0, false
+}
+
+var systemLoadAverage loadAverager = noLoadAverage{}
@@ -15,7 +15,11 @@
 package kati
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"strings"
 
 	"github.com/golang/glog"
 )
@@ -28,12 +32,115 @@ func logStats(f string, a ...interface{}) {
 	glog.Infof(f, a...)
 }
 
+// warn writes a warning at loc to stdout, and to the glog log.
 func warn(loc srcpos, f string, a ...interface{}) {
-	f = fmt.Sprintf("%s: warning: %s\n", loc, f)
-	fmt.Printf(f, a...)
+	msg := fmt.Sprintf(f, a...)
+	newDiag(os.Stdout).warn(loc, msg)
+	glogDiag.warn(loc, msg)
 }
 
 func warnNoPrefix(loc srcpos, f string, a ...interface{}) {
-	f = fmt.Sprintf("%s: %s\n", loc, f)
-	fmt.Printf(f, a...)
+	msg := fmt.Sprintf(f, a...)
+	newDiag(os.Stdout).message(loc, msg)
+	glogDiag.message(loc, msg)
+}
+
+// ANSI escape sequences for colored diagnostics.
+const (
+	colorReset   = "\x1b[0m"
+	colorBold    = "\x1b[1m"
+	colorDim     = "\x1b[2m"
+	colorRed     = "\x1b[1;31m"
+	colorMagenta = "\x1b[1;35m"
+)
+
+// useColor reports whether diagnostics are colored, according to
+// ColorMode. "auto" colors them if stderr is a terminal, as stdout
+// may be redirected to a log while a user watches stderr.
+func useColor() bool {
+	switch ColorMode {
+	case "always":
+		return true
+	case "auto":
+		return os.Getenv("TERM") != "dumb" && IsTerminal(os.Stderr)
+	}
+	return false
+}
+
+// IsTerminal reports whether f is a terminal.
+func IsTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// diag writes diagnostics to w. Diagnostics are colored if color is
+// true, so a diag for a terminal and one for a plain file or glog
+// share the same code.
+type diag struct {
+	w     io.Writer
+	color bool
+}
+
+// newDiag returns diag for f, colored if useColor().
+func newDiag(f *os.File) diag {
+	return diag{w: f, color: useColor()}
+}
+
+// glogDiag writes diagnostics to the glog log, never colored.
+var glogDiag = diag{w: glogWriter{}}
+
+// glogWriter writes each line to glog at the INFO level.
+type glogWriter struct{}
+
+func (glogWriter) Write(b []byte) (int, error) {
+	glog.InfoDepth(4, strings.TrimSuffix(string(b), "\n"))
+	return len(b), nil
+}
+
+func (d diag) paint(color, s string) string {
+	if !d.color || s == "" {
+		return s
+	}
+	return color + s + colorReset
+}
+
+func (d diag) pos(loc srcpos) string {
+	return d.paint(colorBold, loc.String()+":")
+}
+
+// message writes msg at loc.
+func (d diag) message(loc srcpos, msg string) {
+	fmt.Fprintf(d.w, "%s %s\n", d.pos(loc), msg)
+}
+
+// warn writes warning msg at loc.
+func (d diag) warn(loc srcpos, msg string) {
+	fmt.Fprintf(d.w, "%s %s %s\n", d.pos(loc), d.paint(colorMagenta, "warning:"), msg)
+}
+
+// echo writes a recipe line to be run.
+func (d diag) echo(cmd string) {
+	fmt.Fprintf(d.w, "%s\n", d.paint(colorDim, cmd))
+}
+
+// error returns err as a message, with the location and the rest
+// painted differently.
+func (d diag) error(err error) string {
+	var eerr EvalError
+	if !d.color || !errors.As(err, &eerr) {
+		return d.paint(colorRed, err.Error())
+	}
+	loc := srcpos{filename: eerr.Filename, lineno: eerr.Lineno}
+	msg := err.Error()
+	prefix := loc.String() + ": "
+	if len(msg) >= len(prefix) && msg[:len(prefix)] == prefix {
+		msg = msg[len(prefix):]
+	}
+	return d.pos(loc) + " " + d.paint(colorRed, msg)
+}
+
+// FormatError formats err to be written to f, colored according to
+// ColorMode.
+func FormatError(f *os.File, err error) string {
+	return newDiag(f).error(err)
 }
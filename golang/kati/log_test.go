@@ -0,0 +1,79 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestDiag(t *testing.T) {
+	loc := srcpos{filename: "Makefile", lineno: 3}
+	for _, color := range []bool{false, true} {
+		var buf bytes.Buffer
+		d := diag{w: &buf, color: color}
+		d.warn(loc, "overriding commands")
+		d.message(loc, "msg")
+		d.echo("cc -c a.c")
+		want := "Makefile:3: warning: overriding commands\nMakefile:3: msg\ncc -c a.c\n"
+		if color {
+			want = "\x1b[1mMakefile:3:\x1b[0m \x1b[1;35mwarning:\x1b[0m overriding commands\n" +
+				"\x1b[1mMakefile:3:\x1b[0m msg\n" +
+				"\x1b[2mcc -c a.c\x1b[0m\n"
+		}
+		if got := buf.String(); got != want {
+			t.Errorf("diag(color=%t) wrote %q; want %q", color, got, want)
+		}
+
+		for _, tc := range []struct {
+			err       error
+			want      string
+			wantColor string
+		}{
+			{
+				err:       loc.errorf("*** boom."),
+				want:      "Makefile:3: *** boom.",
+				wantColor: "\x1b[1mMakefile:3:\x1b[0m \x1b[1;31m*** boom.\x1b[0m",
+			},
+			{
+				err:       errors.New("*** no makefile."),
+				want:      "*** no makefile.",
+				wantColor: "\x1b[1;31m*** no makefile.\x1b[0m",
+			},
+		} {
+			want := tc.want
+			if color {
+				want = tc.wantColor
+			}
+			if got := d.error(tc.err); got != want {
+				t.Errorf("diag(color=%t).error(%v)=%q; want %q", color, tc.err, got, want)
+			}
+		}
+	}
+}
+
+func TestUseColor(t *testing.T) {
+	defer func(m string) { ColorMode = m }(ColorMode)
+	defer os.Setenv("TERM", os.Getenv("TERM"))
+	os.Setenv("TERM", "dumb")
+	for mode, want := range map[string]bool{"always": true, "auto": false, "never": false} {
+		ColorMode = mode
+		if got := useColor(); got != want {
+			t.Errorf("useColor() with ColorMode=%q=%t; want %t", mode, got, want)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// memBudgetInterval is the interval to read the heap size.
+	memBudgetInterval = 100 * time.Millisecond
+	// memBudgetRatio is the ratio of MemBudget at which the heap is
+	// considered near the budget.
+	memBudgetRatio = 0.9
+)
+
+// memBudget watches the heap while loading makefiles. When the heap
+// nears MemBudget, the evaluator drops optional caches once, and runs
+// GC each time it nears the budget again.
+//
+// The heap is read by a goroutine, as runtime.ReadMemStats stops the
+// world, but caches are dropped by the evaluator between statements.
+type memBudget struct {
+	limit uint64
+	// near is 1 if the heap was near the limit since the last check.
+	near int32
+	done chan struct{}
+
+	shed bool
+	gcs  int
+}
+
+func startMemBudget(limit uint64) *memBudget {
+	b := &memBudget{
+		limit: limit,
+		done:  make(chan struct{}),
+	}
+	go b.watch()
+	return b
+}
+
+func (b *memBudget) watch() {
+	t := time.NewTicker(memBudgetInterval)
+	defer t.Stop()
+	var ms runtime.MemStats
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-t.C:
+		}
+		runtime.ReadMemStats(&ms)
+		if float64(ms.HeapAlloc) >= float64(b.limit)*memBudgetRatio {
+			atomic.StoreInt32(&b.near, 1)
+		}
+	}
+}
+
+func (b *memBudget) stop() {
+	close(b.done)
+	logStats("memory budget: %d GCs", b.gcs)
+}
+
+// check drops caches and runs GC if the heap was near the budget.
+// loc is reported in the warning about dropped caches.
+func (b *memBudget) check(loc srcpos) {
+	if !atomic.CompareAndSwapInt32(&b.near, 1, 0) {
+		return
+	}
+	if !b.shed {
+		b.shed = true
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		mks := makefileCache.drop()
+		dirs, files := fsCache.drop()
+		warn(loc, "heap %s is near the memory budget %s: dropped makefile cache (%d makefiles), wildcard and find cache (%d dirs, %d files)", human(int(ms.HeapAlloc)), human(int(b.limit)), mks, dirs, files)
+	}
+	b.gcs++
+	glog.Infof("memory budget: GC")
+	// FreeOSMemory also runs GC.
+	debug.FreeOSMemory()
+}
@@ -0,0 +1,71 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestMemBudgetCheck(t *testing.T) {
+	dir := chdirTemp(t, map[string]string{
+		"Makefile": "all:\n",
+	})
+	mkfile := filepath.Join(dir, "Makefile")
+
+	savedMakefileCache, savedFsCache := makefileCache, fsCache
+	defer func() {
+		makefileCache, fsCache = savedMakefileCache, savedFsCache
+	}()
+	makefileCache = &makefileCacheT{mk: make(map[string]mkCacheEntry)}
+	fsCache = newFsCache()
+
+	_, _, err := makefileCache.parse(mkfile, defaultRecipePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsCache.readdir(dir, unknownFileid)
+
+	b := &memBudget{limit: 1 << 20}
+	b.check(srcpos{})
+	if b.shed || len(makefileCache.mk) != 1 || fsCache.dirs() != 2 {
+		t.Fatalf("check() dropped caches while the heap is not near the budget")
+	}
+
+	b.near = 1
+	b.check(srcpos{})
+	if !b.shed || b.gcs != 1 {
+		t.Errorf("check()=shed:%t gcs:%d; want shed:true gcs:1", b.shed, b.gcs)
+	}
+	if n := len(makefileCache.mk); n != 0 {
+		t.Errorf("makefile cache has %d makefiles; want 0", n)
+	}
+	if n := fsCache.dirs(); n != 1 {
+		t.Errorf("fs cache has %d dirs; want 1 for the invalid dir", n)
+	}
+
+	// Dropped caches are not filled again.
+	_, _, err = makefileCache.parse(mkfile, defaultRecipePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ents := fsCache.readdir(dir, unknownFileid)
+	if len(ents) != 1 || ents[0].name != "Makefile" {
+		t.Errorf("readdir(%q)=%v; want Makefile", dir, ents)
+	}
+	if n, m := len(makefileCache.mk), fsCache.dirs(); n != 0 || m != 1 {
+		t.Errorf("caches have %d makefiles and %d dirs after drop; want 0 and 1", n, m)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errMergedGraph is returned for graphs made by MergeGraphs where
+// they are not supported.
+var errMergedGraph = errors.New("graphs made by MergeGraphs are not supported")
+
+// MergeGraphs merges graphs loaded from independent makefiles, to
+// build them together. Recipes are evaluated with variables of the
+// makefile they came from.
+//
+// A target may be made by only one of graphs; it's an error if rules
+// in two graphs have commands for the same target. Prerequisites of
+// rules without commands are merged, e.g. for "all". Targets are the
+// roots of graphs in order, so the default target is the one of the
+// first graph.
+//
+// Nodes of graphs are shared with the merged graph, and modified.
+// Merged graphs can be executed, but can't be saved or used to
+// generate ninja files yet.
+func MergeGraphs(graphs ...*DepGraph) (*DepGraph, error) {
+	if len(graphs) == 0 {
+		return nil, errors.New("no graphs to merge")
+	}
+	if len(graphs) == 1 {
+		return graphs[0], nil
+	}
+	err := graphs[0].loadVars()
+	if err != nil {
+		return nil, err
+	}
+	m := &DepGraph{
+		vars:     graphs[0].vars,
+		vpaths:   graphs[0].vpaths,
+		exports:  make(map[string]bool),
+		usedEnvs: make(map[string]bool),
+		partOf:   make(map[*DepNode]int),
+	}
+	// outputs is the node used for each output, and absorbed is
+	// nodes for the same output in other graphs, whose
+	// prerequisites are merged to it.
+	outputs := make(map[string]*DepNode)
+	absorbed := make(map[*DepNode][]*DepNode)
+	var all []*DepNode
+	for _, g := range graphs {
+		base := len(m.parts)
+		if g.parts != nil {
+			m.parts = append(m.parts, g.parts...)
+		} else {
+			m.parts = append(m.parts, g)
+		}
+		seen := make(map[*DepNode]bool)
+		var walk func(nodes []*DepNode) error
+		walk = func(nodes []*DepNode) error {
+			for _, n := range nodes {
+				if seen[n] {
+					continue
+				}
+				seen[n] = true
+				m.partOf[n] = base + g.partOf[n]
+				all = append(all, n)
+				o, ok := outputs[n.Output]
+				switch {
+				case !ok:
+					outputs[n.Output] = n
+				case len(o.Cmds) > 0 && len(n.Cmds) > 0:
+					return fmt.Errorf("%s:%d: *** target %q is also made by %s:%d", n.Filename, n.Lineno, n.Output, o.Filename, o.Lineno)
+				case len(n.Cmds) > 0 || (n.HasRule && !o.HasRule):
+					outputs[n.Output] = n
+					absorbed[n] = append(absorbed[o], o)
+					delete(absorbed, o)
+				default:
+					absorbed[o] = append(absorbed[o], n)
+				}
+				err := walk(n.Deps)
+				if err != nil {
+					return err
+				}
+				err = walk(n.OrderOnlys)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		err := walk(g.nodes)
+		if err != nil {
+			return nil, err
+		}
+
+		m.accessedMks = append(m.accessedMks, g.accessedMks...)
+		m.accessedDirs = append(m.accessedDirs, g.accessedDirs...)
+		m.stderrs = append(m.stderrs, g.stderrs...)
+		m.shells = append(m.shells, g.shells...)
+		m.globs = append(m.globs, g.globs...)
+		m.conflicts = append(m.conflicts, g.conflicts...)
+		for name, export := range g.exports {
+			m.exports[name] = m.exports[name] || export
+		}
+		for name := range g.usedEnvs {
+			m.usedEnvs[name] = true
+		}
+		m.deleteOnError = m.deleteOnError || g.deleteOnError
+	}
+
+	unify := func(nodes []*DepNode) []*DepNode {
+		var r []*DepNode
+		seen := make(map[*DepNode]bool)
+		for _, n := range nodes {
+			if u, ok := outputs[n.Output]; ok {
+				n = u
+			}
+			if seen[n] {
+				continue
+			}
+			seen[n] = true
+			r = append(r, n)
+		}
+		return r
+	}
+	for _, n := range all {
+		if outputs[n.Output] != n {
+			continue
+		}
+		deps, orderOnlys, parents := n.Deps, n.OrderOnlys, n.Parents
+		for _, a := range absorbed[n] {
+			deps = append(deps, a.Deps...)
+			orderOnlys = append(orderOnlys, a.OrderOnlys...)
+			parents = append(parents, a.Parents...)
+			n.HasRule = n.HasRule || a.HasRule
+			n.IsPhony = n.IsPhony || a.IsPhony
+			n.IsPrecious = n.IsPrecious || a.IsPrecious
+		}
+		n.Deps = unify(deps)
+		n.OrderOnlys = unify(orderOnlys)
+		n.Parents = unify(parents)
+	}
+	for _, g := range graphs {
+		m.nodes = append(m.nodes, g.nodes...)
+	}
+	m.nodes = unify(m.nodes)
+	return m, nil
+}
+
+// partGraphs returns graphs whose variables are used to evaluate
+// recipes of nodes in g, i.e. g itself unless g is merged.
+func (g *DepGraph) partGraphs() []*DepGraph {
+	if g.parts != nil {
+		return g.parts
+	}
+	return []*DepGraph{g}
+}
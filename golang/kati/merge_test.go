@@ -0,0 +1,90 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestMergeGraphs(t *testing.T) {
+	chdirTemp(t, nil)
+
+	for name, mk := range map[string]string{
+		"a.mk": `
+FLAGS := a
+all: a.out
+a.out: shared
+	@echo $(FLAGS) > $@
+shared:
+	@echo x >> $@
+`,
+		"b.mk": `
+FLAGS := b
+all: b.out
+b.out: shared
+	@echo $(FLAGS) > $@
+`,
+		"c.mk": `
+a.out:
+	@echo c > $@
+`,
+	} {
+		err := ioutil.WriteFile(name, []byte(mk), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	load := func(names ...string) (*DepGraph, error) {
+		var graphs []*DepGraph
+		for _, name := range names {
+			g := mustLoad(t, LoadReq{Makefile: name})
+			graphs = append(graphs, g)
+		}
+		return MergeGraphs(graphs...)
+	}
+
+	_, err := load("a.mk", "c.mk")
+	if err == nil || !strings.Contains(err.Error(), `target "a.out" is also made by a.mk:5`) {
+		t.Errorf("MergeGraphs(a.mk, c.mk)=%v; want conflict of a.out", err)
+	}
+
+	g, err := load("a.mk", "b.mk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex, err := NewExecutor(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ex.Exec(g, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"a.out":  "a\n",
+		"b.out":  "b\n",
+		"shared": "x\n",
+	} {
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != want {
+			t.Errorf("%s=%q; want %q", name, got, want)
+		}
+	}
+}
@@ -16,7 +16,10 @@ package kati
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -66,25 +69,221 @@ type NinjaGenerator struct {
 	Suffix string
 	// GomaDir is goma directory.  If empty, goma will not be used.
 	GomaDir string
+	// LocalPoolDepth is the depth of local_pool, which runs
+	// commands not using goma if GomaDir is set. 0 means the number
+	// of CPUs.
+	LocalPoolDepth int
+	// GomaPoolDepth is the depth of goma_pool, which runs commands
+	// using goma, and the number of jobs in ninja.sh. 0 means 500.
+	GomaPoolDepth int
 	// DetectAndroidEcho detects echo as description.
 	DetectAndroidEcho bool
+	// MkdirOutputDirs creates the output directory in commands
+	// that don't seem to create it by themselves.
+	MkdirOutputDirs bool
+	// PhonyMissingPatterns are patterns (with %) of missing inputs
+	// that will be emitted as phony placeholders, e.g. for files
+	// produced by other build systems.
+	PhonyMissingPatterns []string
+	// CacheKeys writes build<Suffix>.cache_keys, which maps the
+	// output of each build edge to a digest of its command, inputs
+	// and exported variables, for external content-addressed caches.
+	CacheKeys bool
+	// EnvFile writes exported variables to env<Suffix>.sh, which
+	// ninja.sh and each command source, so build.ninja can be run
+	// without ninja.sh.
+	EnvFile bool
+	// NinjaDir is the directory ninja will run in, if it differs
+	// from the current directory. Relative paths in the ninja file
+	// are rewritten against it, and commands cd back to the current
+	// directory. Paths in depfiles written by commands are not
+	// rewritten, so they must be absolute.
+	NinjaDir string
+	// Incremental reuses commands generated by the last run for
+	// build edges whose recipes and the variables they reference
+	// are unchanged. They are kept in .kati_ninja_cache<Suffix>.
+	// Warnings from evaluating reused recipes are not shown again.
+	// Commands are cached per build edge, not per makefile: all
+	// makefiles are still parsed and evaluated, and build.ninja is
+	// written in full.
+	Incremental bool
+	// DeferredReport writes build<Suffix>.deferred.json, which lists
+	// functions in recipes that can't be evaluated when generating
+	// ninja and run at ninja-time instead, e.g. $(shell).
+	DeferredReport bool
+	// ExpandDirInputs makes build edges whose commands create
+	// archives with tar, zip or jar depend on all files under their
+	// directory inputs, listed at generation time, with restat.
+	// Directories listed are recorded in the stamp, so adding or
+	// removing files regenerates the ninja file.
+	ExpandDirInputs bool
+	// Stamp writes the stamp next to build<Suffix>.ninja, which
+	// records inputs used to generate it, so NeedsRegen and
+	// Stamp.Diff can tell whether it needs to be regenerated. The
+	// DepGraph should be loaded with LoadReq.TraceFileAccess.
+	Stamp bool
+	// StampArgs are the arguments of kati recorded in the stamp, so
+	// NeedsRegen regenerates the ninja file if they change.
+	StampArgs []string
+	// TargetsOnly emits build edges only for the transitive closure
+	// of the targets given to Save, or of the default goal if none
+	// is given, even if the graph has more, e.g. all phony targets.
+	TargetsOnly bool
+	// MSVCDepsPrefix is msvc_deps_prefix of rules with deps = msvc,
+	// i.e. the prefix of lines with included files written by
+	// cl.exe /showIncludes, which is localized. If empty, ninja's
+	// default "Note: including file: " is used.
+	MSVCDepsPrefix string
+	// ToolInputs adds tools run by commands as implicit inputs of
+	// their build edges, so e.g. updating prebuilts/clang rebuilds
+	// objects compiled by it. A tool is the first word of a command,
+	// or the word after wrappers in ToolWrappers, which are inputs
+	// too. Only paths with a slash which exist or are targets are
+	// added, not commands found in PATH.
+	ToolInputs bool
+	// ToolWrappers are base names of commands running the next word
+	// as the tool, e.g. "ccache".
+	ToolWrappers []string
 
 	f       *os.File
 	nodes   []*DepNode
 	exports map[string]bool
+	// exportAll is true if exports has all variables because of
+	// .EXPORT_ALL_VARIABLES.
+	exportAll bool
+	stderrs   []ShellStderr
 
 	ctx *execContext
 
-	ruleID     int
-	done       map[string]nodeState
+	ruleID int
+	// rules maps a rule body to its name, to share a rule between
+	// build edges with the same commands.
+	rules map[string]string
+	done  map[string]nodeState
+
+	// cacheKeyEnv is the environment for cacheKeys.
+	cacheKeyEnv []string
+	cacheKeys   []cacheKeyEntry
+
+	// toKati is the current directory relative to NinjaDir.
+	toKati string
+
+	// cache is the state of Incremental.
+	cache *ninjaCacheState
+	// deferred is functions left to run at ninja-time in emitted
+	// build edges.
+	deferred []DeferredConstruct
+	// dirInputs is directories listed for ExpandDirInputs.
+	dirInputs map[string]bool
+	// usedEnvs are variables read from the environment, or read
+	// while undefined, while loading and evaluating recipes.
+	usedEnvs map[string]bool
+	// targets are outputs of all nodes, with ToolInputs.
+	targets map[string]bool
+}
+
+// DeferredConstruct is a function in a recipe which is left to run
+// at ninja-time, as it can't be evaluated when generating ninja.
+type DeferredConstruct struct {
+	Target string `json:"target"`
+	// Filename and Lineno are where the recipe starts.
+	Filename string `json:"filename"`
+	Lineno   int    `json:"lineno"`
+	// Func is the name of the function, e.g. "shell".
+	Func   string `json:"func"`
+	Arg    string `json:"arg"`
+	Reason string `json:"reason"`
+}
+
+// recipeCommand returns cmd of a recipe, which runs in the current
+// directory with the environment in EnvFile.
+func (n *NinjaGenerator) recipeCommand(cmd string) string {
+	if n.EnvFile {
+		cmd = fmt.Sprintf(". ./%s && %s", escapeNinja(n.envShName()), cmd)
+	}
+	return n.command(cmd)
+}
+
+// initNinjaDir computes toKati from NinjaDir.
+func (n *NinjaGenerator) initNinjaDir() error {
+	if n.NinjaDir == "" {
+		return nil
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	dir, err := filepath.Abs(n.NinjaDir)
+	if err != nil {
+		return err
+	}
+	n.toKati, err = filepath.Rel(dir, wd)
+	return err
+}
+
+// path returns p relative to the directory ninja runs in.
+func (n *NinjaGenerator) path(p string) string {
+	if n.toKati == "" || n.toKati == "." || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(n.toKati, p)
+}
+
+// escapePath is escapeNinjaPath of path(p).
+func (n *NinjaGenerator) escapePath(p string) (string, error) {
+	return escapeNinjaPath(n.path(p))
+}
+
+// command returns cmd to run in the current directory.
+func (n *NinjaGenerator) command(cmd string) string {
+	if n.toKati == "" || n.toKati == "." {
+		return cmd
+	}
+	return fmt.Sprintf("cd %s && %s", escapeNinja(shellQuote(n.toKati)), cmd)
 }
 
 func (n *NinjaGenerator) init(g *DepGraph) {
 	g.resolveVPATH()
 	n.nodes = g.nodes
 	n.exports = g.exports
+	n.exportAll = g.exportAll
+	n.stderrs = g.stderrs
 	n.ctx = newExecContext(g.vars, g.vpaths, true)
+	n.ctx.exports, n.ctx.exportAll = g.exports, g.exportAll
+	n.rules = make(map[string]string)
 	n.done = make(map[string]nodeState)
+	n.dirInputs = make(map[string]bool)
+	n.usedEnvs = make(map[string]bool)
+	for name := range g.usedEnvs {
+		n.usedEnvs[name] = true
+	}
+	if n.ToolInputs {
+		n.targets = make(map[string]bool)
+		var walk func(nodes []*DepNode)
+		walk = func(nodes []*DepNode) {
+			for _, d := range nodes {
+				if n.targets[d.Output] {
+					continue
+				}
+				n.targets[d.Output] = true
+				walk(d.Deps)
+				walk(d.OrderOnlys)
+			}
+		}
+		walk(n.nodes)
+	}
+}
+
+// definedEnvs returns usedEnvs defined in the environment, sorted.
+func (n *NinjaGenerator) definedEnvs() []string {
+	var names []string
+	for name := range n.usedEnvs {
+		if strings.HasPrefix(n.ctx.ev.vars.Lookup(name).Origin(), "environment") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
 }
 
 func getDepfileImpl(ss string) (string, error) {
@@ -122,6 +321,22 @@ func getDepfileImpl(ss string) (string, error) {
 	return stripExt(out) + ".d", nil
 }
 
+var (
+	// msvcCmdRE matches commands which run cl.exe or clang-cl,
+	// natively or via wine.
+	msvcCmdRE = regexp.MustCompile(`(?i)(^|[\s;&|("])(\S*[/\\])?(cl|clang-cl)(\.exe)?"?(\s|$)`)
+	// msvcShowIncludesRE matches /showIncludes, which makes cl.exe
+	// write included files to stdout.
+	msvcShowIncludesRE = regexp.MustCompile(`\s[/-]showIncludes(:user)?(\s|$)`)
+)
+
+// isMSVCCommand reports whether cmdline runs cl.exe with
+// /showIncludes, whose dependencies ninja reads by deps = msvc
+// instead of a depfile.
+func isMSVCCommand(cmdline string) bool {
+	return msvcCmdRE.MatchString(cmdline) && msvcShowIncludesRE.MatchString(cmdline)
+}
+
 // getDepfile gets depfile from cmdline, and returns cmdline and depfile.
 func getDepfile(cmdline string) (string, string, error) {
 	// A hack for Android - llvm-rs-cc seems not to emit a dep file.
@@ -243,6 +458,10 @@ Loop:
 	return buf.String()
 }
 
+// archiveCmdRE matches commands which create archives, whose
+// contents are files under directory inputs.
+var archiveCmdRE = regexp.MustCompile(`(^|[\s;&|(])(\S*/)?(tar|zip|jar)(\s|$)`)
+
 var ccRE = regexp.MustCompile(`^prebuilts/(gcc|clang)/.*(gcc|g\+\+|clang|clang\+\+) .* ?-c `)
 
 func gomaCmdForAndroidCompileCmd(cmd string) (string, bool) {
@@ -298,10 +517,26 @@ func descriptionFromCmd(cmd string) (string, bool) {
 	return buf.String(), true
 }
 
-func (n *NinjaGenerator) genShellScript(runners []runner) (cmd string, desc string, useLocalPool bool) {
-	const defaultDesc = "build $out"
+// defaultNinjaDesc is the description of build edges whose commands
+// don't give one.
+const defaultNinjaDesc = "build $out"
+
+func (n *NinjaGenerator) genShellScript(runners []runner) (cmd string, desc string, useLocalPool bool, err error) {
 	var useGomacc bool
 	var buf bytes.Buffer
+	if len(runners) > 0 && len(runners[0].env) > 0 {
+		// Exported target specific variables.
+		var exports []string
+		for _, e := range runners[0].env {
+			i := strings.IndexByte(e, '=')
+			exports = append(exports, e[:i+1]+shellQuote(e[i+1:]))
+		}
+		prefix, err := escapeNinjaValue("export " + strings.Join(exports, " ") + " && ")
+		if err != nil {
+			return "", "", false, err
+		}
+		buf.WriteString(prefix)
+	}
 	for i, r := range runners {
 		if i > 0 {
 			if runners[i-1].ignoreError {
@@ -316,7 +551,10 @@ func (n *NinjaGenerator) genShellScript(runners []runner) (cmd string, desc stri
 		cmd = strings.Replace(cmd, "\\\n\t", "", -1)
 		cmd = strings.Replace(cmd, "\\\n", "", -1)
 		cmd = strings.TrimRight(cmd, " \t\n;")
-		cmd = escapeNinja(cmd)
+		cmd, err = escapeNinjaValue(cmd)
+		if err != nil {
+			return "", "", false, err
+		}
 		if cmd == "" {
 			cmd = "true"
 		}
@@ -352,9 +590,26 @@ func (n *NinjaGenerator) genShellScript(runners []runner) (cmd string, desc stri
 		}
 	}
 	if desc == "" {
-		desc = defaultDesc
+		desc = defaultNinjaDesc
 	}
-	return buf.String(), desc, n.GomaDir != "" && !useGomacc
+	return buf.String(), desc, n.GomaDir != "" && !useGomacc, nil
+}
+
+// mkdirOutputDir prepends "mkdir -p" of the output directory to the
+// ninja-escaped command ss, unless ss seems to create it already.
+func mkdirOutputDir(ss, output string) (string, error) {
+	dir := filepath.Dir(output)
+	if dir == "." || dir == "/" {
+		return ss, nil
+	}
+	d, err := escapeNinjaValue(dir)
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(ss, "mkdir") && strings.Contains(ss, d) {
+		return ss, nil
+	}
+	return fmt.Sprintf("mkdir -p %s && %s", shellQuote(d), ss), nil
 }
 
 func (n *NinjaGenerator) genRuleName() string {
@@ -363,14 +618,42 @@ func (n *NinjaGenerator) genRuleName() string {
 	return ruleName
 }
 
-func (n *NinjaGenerator) emitBuild(output, rule, inputs, orderOnlys string) {
-	fmt.Fprintf(n.f, "build %s: %s", escapeBuildTarget(output), rule)
+func (n *NinjaGenerator) emitBuild(output, rule, inputs, orderOnlys string) error {
+	o, err := n.escapePath(output)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(n.f, "build %s: %s", o, rule)
 	if inputs != "" {
 		fmt.Fprintf(n.f, " %s", inputs)
 	}
 	if orderOnlys != "" {
 		fmt.Fprintf(n.f, " || %s", orderOnlys)
 	}
+	return nil
+}
+
+// Ninja escaping:
+//  paths (outputs, inputs and default targets) need "$", " " and ":"
+//  escaped as "$$", "$ " and "$:".
+//  values (commands etc) need "$" escaped as "$$".
+// Newlines can't be represented in either, nor can "|" in paths, as
+// ninja has no escape for them.
+
+// escapeNinjaPath escapes a make target name for a path in ninja.
+func escapeNinjaPath(s string) (string, error) {
+	if strings.ContainsAny(s, "\n\r|") {
+		return "", fmt.Errorf("*** target %q cannot be represented in ninja.", s)
+	}
+	return escapeBuildTarget(s), nil
+}
+
+// escapeNinjaValue escapes s for a value of a ninja variable.
+func escapeNinjaValue(s string) (string, error) {
+	if strings.ContainsAny(s, "\n\r") {
+		return "", fmt.Errorf("*** newline in %q cannot be represented in ninja.", s)
+	}
+	return escapeNinja(s), nil
 }
 
 func escapeBuildTarget(s string) string {
@@ -403,11 +686,14 @@ func escapeBuildTarget(s string) string {
 	return buf.String()
 }
 
-func (n *NinjaGenerator) dependency(node *DepNode) (string, string) {
+func (n *NinjaGenerator) dependency(node *DepNode) (string, string, error) {
 	var deps []string
 	seen := make(map[string]bool)
 	for _, d := range node.Deps {
-		t := escapeBuildTarget(d.Output)
+		t, err := n.escapePath(d.Output)
+		if err != nil {
+			return "", "", err
+		}
 		if seen[t] {
 			continue
 		}
@@ -416,14 +702,91 @@ func (n *NinjaGenerator) dependency(node *DepNode) (string, string) {
 	}
 	var orderOnlys []string
 	for _, d := range node.OrderOnlys {
-		t := escapeBuildTarget(d.Output)
+		t, err := n.escapePath(d.Output)
+		if err != nil {
+			return "", "", err
+		}
 		if seen[t] {
 			continue
 		}
 		orderOnlys = append(orderOnlys, t)
 		seen[t] = true
 	}
-	return strings.Join(deps, " "), strings.Join(orderOnlys, " ")
+	return strings.Join(deps, " "), strings.Join(orderOnlys, " "), nil
+}
+
+// dirInputFiles returns files under directory inputs of node, as
+// implicit inputs of its build edge.
+func (n *NinjaGenerator) dirInputFiles(node *DepNode) (string, error) {
+	seen := make(map[string]bool)
+	for _, d := range node.Deps {
+		seen[filepath.Clean(d.Output)] = true
+	}
+	var files []string
+	for _, d := range node.Deps {
+		if !fsCache.isDir(d.Output) {
+			continue
+		}
+		fs, dirs := fsCache.listFiles(d.Output)
+		for _, dir := range dirs {
+			n.dirInputs[dir] = true
+		}
+		for _, f := range fs {
+			if seen[f] {
+				continue
+			}
+			seen[f] = true
+			t, err := n.escapePath(f)
+			if err != nil {
+				return "", err
+			}
+			files = append(files, t)
+		}
+	}
+	return strings.Join(files, " "), nil
+}
+
+// commandTools returns the tool run by cmd, i.e. its first word after
+// variable assignments, and wrappers running it, whose base names are
+// in wrappers.
+func commandTools(cmd string, wrappers []string) []string {
+	var tools []string
+	for _, word := range splitSpaces(trimLeftSpace(cmd)) {
+		if len(tools) == 0 && strings.IndexByte(word, '=') > 0 {
+			continue
+		}
+		tools = append(tools, word)
+		if !contains(wrappers, filepath.Base(word)) {
+			break
+		}
+	}
+	return tools
+}
+
+// toolInputs returns tools of node, escaped as implicit inputs of its
+// build edge. Tools are skipped if they are not paths, are inputs
+// already, or neither exist nor are targets.
+func (n *NinjaGenerator) toolInputs(node *DepNode, tools []string) ([]string, error) {
+	seen := map[string]bool{node.Output: true}
+	for _, d := range node.Deps {
+		seen[d.Output] = true
+	}
+	var inputs []string
+	for _, tool := range tools {
+		if seen[tool] || !strings.Contains(tool, "/") {
+			continue
+		}
+		seen[tool] = true
+		if !n.targets[tool] && !exists(tool) {
+			continue
+		}
+		t, err := n.escapePath(tool)
+		if err != nil {
+			return nil, err
+		}
+		inputs = append(inputs, t)
+	}
+	return inputs, nil
 }
 
 func escapeNinja(s string) string {
@@ -503,54 +866,153 @@ func (n *NinjaGenerator) emitNode(node *DepNode) error {
 		return nil
 	}
 
-	runners, _, err := createRunners(n.ctx, node)
+	script, err := n.nodeScript(node)
 	if err != nil {
 		return err
 	}
 	ruleName := "phony"
-	useLocalPool := false
-	inputs, orderOnlys := n.dependency(node)
-	if len(runners) > 0 {
-		ruleName = n.genRuleName()
-		fmt.Fprintf(n.f, "\n# rule for %q\n", node.Output)
-		fmt.Fprintf(n.f, "rule %s\n", ruleName)
-
-		ss, desc, ulp := n.genShellScript(runners)
-		if ulp {
-			useLocalPool = true
+	var pool string
+	inputs, orderOnlys, err := n.dependency(node)
+	if err != nil {
+		return err
+	}
+	// buildInputs may have implicit inputs, which are not in $in.
+	buildInputs := inputs
+	var desc, depfile, deps string
+	var restat bool
+	if script != nil {
+		n.deferred = append(n.deferred, script.Deferred...)
+		ss := script.Script
+		desc = script.Desc
+		if script.UseLocalPool {
+			pool = "local_pool"
+		} else if n.GomaDir != "" {
+			pool = "goma_pool"
 		}
-		fmt.Fprintf(n.f, " description = %s\n", desc)
-		cmdline, depfile, err := getDepfile(ss)
-		if err != nil {
-			return err
+		if n.MkdirOutputDirs && !node.IsPhony {
+			ss, err = mkdirOutputDir(ss, output)
+			if err != nil {
+				return err
+			}
 		}
-		if depfile != "" {
-			fmt.Fprintf(n.f, " depfile = %s\n", depfile)
-			fmt.Fprintf(n.f, " deps = gcc\n")
+		var cmdline string
+		if isMSVCCommand(ss) {
+			// cl.exe's options, e.g. -MD, may look like gcc's.
+			cmdline, deps = ss, "msvc"
+		} else {
+			cmdline, depfile, err = getDepfile(ss)
+			if err != nil {
+				return err
+			}
+			if depfile != "" {
+				deps = "gcc"
+			}
+		}
+		var implicits []string
+		if n.ExpandDirInputs && archiveCmdRE.MatchString(cmdline) {
+			files, err := n.dirInputFiles(node)
+			if err != nil {
+				return err
+			}
+			if files != "" {
+				restat = true
+				implicits = append(implicits, files)
+			}
+		}
+		if n.ToolInputs {
+			tools, err := n.toolInputs(node, script.Tools)
+			if err != nil {
+				return err
+			}
+			implicits = append(implicits, tools...)
+		}
+		if len(implicits) > 0 {
+			buildInputs = strings.TrimPrefix(inputs+" | "+strings.Join(implicits, " "), " ")
+		}
+		if n.CacheKeys {
+			var ins []string
+			for _, d := range node.Deps {
+				ins = append(ins, d.Output)
+			}
+			n.cacheKeys = append(n.cacheKeys, cacheKeyEntry{
+				output: output,
+				key:    cacheKey(ss, ins, n.cacheKeyEnv),
+			})
+		}
+		// The rule body is shared by build edges with the same
+		// commands. Differences among them, i.e. $in, $out, a
+		// description and a depfile, are given by build edges.
+		var rule bytes.Buffer
+		if desc == defaultNinjaDesc {
+			fmt.Fprintf(&rule, " description = %s\n", desc)
+		}
+		if deps != "" {
+			fmt.Fprintf(&rule, " deps = %s\n", deps)
+		}
+		if deps == "msvc" && n.MSVCDepsPrefix != "" {
+			fmt.Fprintf(&rule, " msvc_deps_prefix = %s\n", escapeNinja(n.MSVCDepsPrefix))
 		}
 		nv := [][]string{
 			[]string{"${in}", inputs},
 			[]string{"${out}", escapeNinja(output)},
 		}
+		if n.toKati != "" && n.toKati != "." {
+			// $in and $out are relative to NinjaDir.
+			nv = nil
+		}
 		// It seems Linux is OK with ~130kB.
 		// TODO: Find this number automatically.
 		ArgLenLimit := 100 * 1000
 		if len(cmdline) > ArgLenLimit {
-			fmt.Fprintf(n.f, " rspfile = $out.rsp\n")
+			fmt.Fprintf(&rule, " rspfile = $out.rsp\n")
 			cmdline = n.ninjaVars(cmdline, nv, nil)
-			fmt.Fprintf(n.f, " rspfile_content = %s\n", cmdline)
-			fmt.Fprintf(n.f, " command = %s $out.rsp\n", n.ctx.shell)
+			fmt.Fprintf(&rule, " rspfile_content = %s\n", cmdline)
+			rsp := "$out.rsp"
+			if n.toKati != "" && n.toKati != "." {
+				rsp = escapeNinja(shellQuote(output + ".rsp"))
+			}
+			shell := script.Shell
+			if flags := scriptShellFlags(script.ShellFlags); flags != "" {
+				shell += " " + escapeNinja(flags)
+			}
+			fmt.Fprintf(&rule, " command = %s\n", n.recipeCommand(fmt.Sprintf("%s %s", shell, rsp)))
 		} else {
 			cmdline = escapeShell(cmdline)
 			cmdline = n.ninjaVars(cmdline, nv, escapeShell)
-			fmt.Fprintf(n.f, " command = %s -c \"%s\"\n", n.ctx.shell, cmdline)
+			fmt.Fprintf(&rule, " command = %s\n", n.recipeCommand(fmt.Sprintf("%s %s \"%s\"", script.Shell, escapeNinja(script.ShellFlags), cmdline)))
+		}
+		body := rule.String()
+		var ok bool
+		ruleName, ok = n.rules[body]
+		if !ok {
+			ruleName = n.genRuleName()
+			n.rules[body] = ruleName
+			fmt.Fprintf(n.f, "\n# rule for %q\n", node.Output)
+			fmt.Fprintf(n.f, "rule %s\n%s", ruleName, body)
 		}
 	}
-	n.emitBuild(output, ruleName, inputs, orderOnlys)
-	if useLocalPool {
-		fmt.Fprintf(n.f, " pool = local_pool\n")
+	err = n.emitBuild(output, ruleName, buildInputs, orderOnlys)
+	if err != nil {
+		return err
 	}
 	fmt.Fprintf(n.f, "\n")
+	if desc != "" && desc != defaultNinjaDesc {
+		fmt.Fprintf(n.f, " description = %s\n", desc)
+	}
+	if depfile != "" {
+		fmt.Fprintf(n.f, " depfile = %s\n", n.path(depfile))
+	}
+	if restat {
+		fmt.Fprintf(n.f, " restat = 1\n")
+	}
+	if p, ok, err := n.ninjaPool(node); err != nil {
+		return err
+	} else if ok {
+		pool = p
+	}
+	if pool != "" && pool != "none" {
+		fmt.Fprintf(n.f, " pool = %s\n", pool)
+	}
 	n.done[output] = nodeBuild
 
 	for _, d := range node.Deps {
@@ -583,17 +1045,43 @@ rule regen_ninja
  description = Regenerate ninja files due to dependency
  generator=1
  command=%s
-`, strings.Join(n.Args, " "))
-	fmt.Fprintf(n.f, "build %s: regen_ninja %s", n.ninjaName(), mkfiles)
+`, n.command(strings.Join(n.Args, " ")))
+	fmt.Fprintf(n.f, "build %s: regen_ninja", n.path(n.ninjaName()))
+	ws := newWordScanner([]byte(mkfiles))
+	for ws.Scan() {
+		mk, err := n.escapePath(string(ws.Bytes()))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(n.f, " %s", mk)
+	}
 	// TODO: Add dependencies to directories read by $(wildcard) or
 	// $(shell find).
-	if len(usedEnvs) > 0 {
-		fmt.Fprintf(n.f, " %s", n.envlistName())
+	if len(n.definedEnvs()) > 0 {
+		fmt.Fprintf(n.f, " %s", n.path(n.envlistName()))
 	}
 	fmt.Fprintf(n.f, "\n\n")
 	return nil
 }
 
+// scriptShellFlags returns .SHELLFLAGS to run a script file instead
+// of a command string, i.e. without -c, e.g. "-e" for "-ec".
+func scriptShellFlags(flags string) string {
+	fields := strings.Fields(flags)
+	if len(fields) == 0 {
+		return ""
+	}
+	last := fields[len(fields)-1]
+	if strings.HasPrefix(last, "-") && strings.HasSuffix(last, "c") {
+		last = strings.TrimSuffix(last, "c")
+		fields = fields[:len(fields)-1]
+		if last != "-" {
+			fields = append(fields, last)
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
 func (n *NinjaGenerator) shName() string {
 	return fmt.Sprintf("ninja%s.sh", n.Suffix)
 }
@@ -602,12 +1090,14 @@ func (n *NinjaGenerator) ninjaName() string {
 	return fmt.Sprintf("build%s.ninja", n.Suffix)
 }
 
-func (n *NinjaGenerator) envlistName() string {
-	return fmt.Sprintf(".kati_env%s", n.Suffix)
+func (n *NinjaGenerator) envShName() string {
+	return fmt.Sprintf("env%s.sh", n.Suffix)
 }
 
-func (n *NinjaGenerator) generateEnvlist() (err error) {
-	f, err := os.Create(n.envlistName())
+// generateEnvSh writes exported variables to envShName, in the order
+// of names.
+func (n *NinjaGenerator) generateEnvSh() (err error) {
+	f, err := os.Create(n.envShName())
 	if err != nil {
 		return err
 	}
@@ -617,18 +1107,39 @@ func (n *NinjaGenerator) generateEnvlist() (err error) {
 			err = cerr
 		}
 	}()
-	for k := range usedEnvs {
-		v, err := n.ctx.ev.EvaluateVar(k)
+	fmt.Fprintf(f, "# Generated by kati %s\n", gitVersion)
+	if n.exportAll {
+		fmt.Fprintln(f, "# All variables are exported by .EXPORT_ALL_VARIABLES.")
+	}
+	var names []string
+	for name := range n.exports {
+		if !isExportableName(name) {
+			glog.V(1).Infof("ignore export %q", name)
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !n.exports[name] {
+			fmt.Fprintf(f, "unset %s\n", name)
+			continue
+		}
+		v, err := n.ctx.ev.EvaluateVar(name)
 		if err != nil {
 			return err
 		}
-		fmt.Fprintf(f, "%q=%q\n", k, v)
+		fmt.Fprintf(f, "export %s=%s\n", name, shellQuote(exportValue(name, v)))
 	}
 	return nil
 }
 
-func (n *NinjaGenerator) generateShell() (err error) {
-	f, err := os.Create(n.shName())
+func (n *NinjaGenerator) envlistName() string {
+	return fmt.Sprintf(".kati_env%s", n.Suffix)
+}
+
+func (n *NinjaGenerator) generateEnvlist() (err error) {
+	f, err := os.Create(n.envlistName())
 	if err != nil {
 		return err
 	}
@@ -638,13 +1149,20 @@ func (n *NinjaGenerator) generateShell() (err error) {
 			err = cerr
 		}
 	}()
+	for _, k := range n.definedEnvs() {
+		v, err := n.ctx.ev.EvaluateVar(k)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(f, "%q=%q\n", k, v)
+	}
+	return nil
+}
 
-	fmt.Fprintf(f, "#!/bin/bash\n")
-	fmt.Fprintf(f, "# Generated by kati %s\n", gitVersion)
-	fmt.Fprintln(f)
-	fmt.Fprintln(f, `cd $(dirname "$0")`)
-	if n.Suffix != "" {
-		fmt.Fprintf(f, "if [ -f %s ]; then\n export $(cat %s)\nfi\n", n.envlistName(), n.envlistName())
+// writeExports writes shell commands to export variables to f.
+func (n *NinjaGenerator) writeExports(f io.Writer) error {
+	if n.exportAll {
+		fmt.Fprintln(f, "# All variables are exported by .EXPORT_ALL_VARIABLES.")
 	}
 	for name, export := range n.exports {
 		// export "a b"=c will error on bash
@@ -658,15 +1176,50 @@ func (n *NinjaGenerator) generateShell() (err error) {
 			if err != nil {
 				return err
 			}
-			fmt.Fprintf(f, "export %q=%q\n", name, v)
+			// Quote with '...', as the value may have newlines,
+			// e.g. by "export define".
+			fmt.Fprintf(f, "export %q=%s\n", name, shellQuote(exportValue(name, v)))
 		} else {
 			fmt.Fprintf(f, "unset %q\n", name)
 		}
 	}
+	return nil
+}
+
+func (n *NinjaGenerator) generateShell() (err error) {
+	f, err := os.Create(n.shName())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cerr := f.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+
+	fmt.Fprintf(f, "#!/bin/bash\n")
+	fmt.Fprintf(f, "# Generated by kati %s\n", gitVersion)
+	fmt.Fprintln(f)
+	fmt.Fprintln(f, `cd $(dirname "$0")`)
+	if n.Suffix != "" {
+		fmt.Fprintf(f, "if [ -f %s ]; then\n export $(cat %s)\nfi\n", n.envlistName(), n.envlistName())
+	}
+	if n.EnvFile {
+		fmt.Fprintf(f, ". ./%s\n", n.envShName())
+	} else {
+		err = n.writeExports(f)
+		if err != nil {
+			return err
+		}
+	}
+	if n.NinjaDir != "" {
+		fmt.Fprintf(f, "cd %s\n", shellQuote(n.NinjaDir))
+	}
 	if n.GomaDir == "" {
-		fmt.Fprintf(f, `exec ninja -f %s "$@"`+"\n", n.ninjaName())
+		fmt.Fprintf(f, `exec ninja -f %s "$@"`+"\n", n.path(n.ninjaName()))
 	} else {
-		fmt.Fprintf(f, `exec ninja -f %s -j500 "$@"`+"\n", n.ninjaName())
+		fmt.Fprintf(f, `exec ninja -f %s -j%d "$@"`+"\n", n.path(n.ninjaName()), n.gomaPoolDepth())
 	}
 
 	return f.Chmod(0755)
@@ -688,13 +1241,8 @@ func (n *NinjaGenerator) generateNinja(defaultTarget string) (err error) {
 	fmt.Fprintf(n.f, "# Generated by kati %s\n", gitVersion)
 	fmt.Fprintf(n.f, "\n")
 
-	if len(usedEnvs) > 0 {
+	if names := n.definedEnvs(); len(names) > 0 {
 		fmt.Fprintln(n.f, "# Environment variables used:")
-		var names []string
-		for name := range usedEnvs {
-			names = append(names, name)
-		}
-		sort.Strings(names)
 		for _, name := range names {
 			v, err := n.ctx.ev.EvaluateVar(name)
 			if err != nil {
@@ -705,9 +1253,21 @@ func (n *NinjaGenerator) generateNinja(defaultTarget string) (err error) {
 		fmt.Fprintf(n.f, "\n")
 	}
 
+	if len(n.stderrs) > 0 {
+		fmt.Fprintln(n.f, "# Stderr of $(shell):")
+		for _, e := range n.stderrs {
+			for _, line := range strings.Split(e.String(), "\n") {
+				fmt.Fprintf(n.f, "# %s\n", line)
+			}
+		}
+		fmt.Fprintf(n.f, "\n")
+	}
+
 	if n.GomaDir != "" {
 		fmt.Fprintf(n.f, "pool local_pool\n")
-		fmt.Fprintf(n.f, " depth = %d\n\n", runtime.NumCPU())
+		fmt.Fprintf(n.f, " depth = %d\n\n", n.localPoolDepth())
+		fmt.Fprintf(n.f, "pool goma_pool\n")
+		fmt.Fprintf(n.f, " depth = %d\n\n", n.gomaPoolDepth())
 	}
 
 	err = n.emitRegenRules()
@@ -728,8 +1288,14 @@ func (n *NinjaGenerator) generateNinja(defaultTarget string) (err error) {
 	// emit phony targets for visited nodes that are
 	//  - not existing file
 	//  - not alias for other targets.
+	// and placeholders for missing nodes matched with PhonyMissingPatterns.
 	var nodes []string
 	for node, state := range n.done {
+		if state == nodeMissing && n.phonyMissing(node) {
+			glog.V(1).Infof("node %s is missing. emit phony placeholder", node)
+			nodes = append(nodes, node)
+			continue
+		}
 		if state != nodeVisit {
 			continue
 		}
@@ -739,7 +1305,10 @@ func (n *NinjaGenerator) generateNinja(defaultTarget string) (err error) {
 		fmt.Fprintln(n.f)
 		sort.Strings(nodes)
 		for _, node := range nodes {
-			n.emitBuild(node, "phony", "", "")
+			err := n.emitBuild(node, "phony", "", "")
+			if err != nil {
+				return err
+			}
 			fmt.Fprintln(n.f)
 			n.done[node] = nodeBuild
 		}
@@ -747,19 +1316,136 @@ func (n *NinjaGenerator) generateNinja(defaultTarget string) (err error) {
 
 	// emit default if the target was emitted.
 	if defaultTarget != "" && n.done[defaultTarget] == nodeBuild {
-		fmt.Fprintf(n.f, "\ndefault %s\n", escapeNinja(defaultTarget))
+		t, err := n.escapePath(defaultTarget)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(n.f, "\ndefault %s\n", t)
 	}
 	return nil
 }
 
+func (n *NinjaGenerator) deferredReportName() string {
+	return fmt.Sprintf("build%s.deferred.json", n.Suffix)
+}
+
+// generateDeferredReport writes deferred as a JSON array.
+func (n *NinjaGenerator) generateDeferredReport() error {
+	deferred := n.deferred
+	if deferred == nil {
+		deferred = []DeferredConstruct{}
+	}
+	b, err := json.MarshalIndent(deferred, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(n.deferredReportName(), append(b, '\n'), 0644)
+}
+
+func (n *NinjaGenerator) localPoolDepth() int {
+	if n.LocalPoolDepth > 0 {
+		return n.LocalPoolDepth
+	}
+	return runtime.NumCPU()
+}
+
+func (n *NinjaGenerator) gomaPoolDepth() int {
+	if n.GomaPoolDepth > 0 {
+		return n.GomaPoolDepth
+	}
+	return 500
+}
+
+// ninjaPool returns the pool given by the target specific variable
+// .KATI_NINJA_POOL of node, if it is not empty. "none" means no pool.
+// The pool must be defined in a ninja file including the generated one.
+func (n *NinjaGenerator) ninjaPool(node *DepNode) (string, bool, error) {
+	v, ok := node.TargetSpecificVars[".KATI_NINJA_POOL"]
+	if !ok {
+		return "", false, nil
+	}
+	var buf evalBuffer
+	buf.resetSep()
+	err := v.Eval(&buf, n.ctx.ev)
+	if err != nil {
+		return "", false, err
+	}
+	pool := strings.TrimSpace(buf.String())
+	return pool, pool != "", nil
+}
+
+func (n *NinjaGenerator) phonyMissing(output string) bool {
+	for _, pat := range n.PhonyMissingPatterns {
+		if matchPattern(pat, output) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestedNodes returns nodes of targets in the graph of roots, or
+// the first root, which is the default goal, if targets are empty.
+func requestedNodes(roots []*DepNode, targets []string) ([]*DepNode, error) {
+	if len(targets) == 0 {
+		if len(roots) == 0 {
+			return nil, nil
+		}
+		return roots[:1], nil
+	}
+	var nodes []*DepNode
+	seen := make(map[*DepNode]bool)
+	for _, target := range targets {
+		n := findNode(roots, target, make(map[*DepNode]bool))
+		if n == nil {
+			return nil, fmt.Errorf("*** target %q is not in the graph.", target)
+		}
+		if seen[n] {
+			continue
+		}
+		seen[n] = true
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
 // Save generates build.ninja from DepGraph.
 func (n *NinjaGenerator) Save(g *DepGraph, name string, targets []string) error {
+	if g.parts != nil {
+		return errMergedGraph
+	}
+	defer startPhase(phaseNinja)()
 	startTime := time.Now()
+	err := g.loadVars()
+	if err != nil {
+		return err
+	}
+	// A ninja file left by a failure must not be taken as up to date.
+	err = os.Remove(StampFilename(n.Suffix))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
 	n.init(g)
-	err := n.generateEnvlist()
+	if n.TargetsOnly {
+		n.nodes, err = requestedNodes(g.nodes, targets)
+		if err != nil {
+			return err
+		}
+		logStats("ninja targets only: %d of %d roots", len(n.nodes), len(g.nodes))
+	}
+	err = n.initNinjaDir()
+	if err != nil {
+		return err
+	}
+	err = n.generateEnvlist()
 	if err != nil {
 		return err
 	}
+	if n.EnvFile {
+		err = n.generateEnvSh()
+		if err != nil {
+			return err
+		}
+	}
 	err = n.generateShell()
 	if err != nil {
 		return err
@@ -768,10 +1454,74 @@ func (n *NinjaGenerator) Save(g *DepGraph, name string, targets []string) error
 	if len(targets) == 0 && len(g.nodes) > 0 {
 		defaultTarget = g.nodes[0].Output
 	}
+	if n.CacheKeys {
+		n.cacheKeyEnv, err = n.exportedEnv()
+		if err != nil {
+			return err
+		}
+	}
+	if n.Incremental {
+		err = n.loadNinjaCache()
+		if err != nil {
+			return err
+		}
+	}
 	err = n.generateNinja(defaultTarget)
 	if err != nil {
 		return err
 	}
+	if n.Incremental {
+		err = n.saveNinjaCache()
+		if err != nil {
+			return err
+		}
+	}
+	logStats("%d functions are deferred to ninja-time", len(n.deferred))
+	if n.DeferredReport {
+		err = n.generateDeferredReport()
+		if err != nil {
+			return err
+		}
+	}
+	if n.CacheKeys {
+		err = n.generateCacheKeys()
+		if err != nil {
+			return err
+		}
+	}
+	if n.Stamp {
+		err = n.saveStamp(g)
+		if err != nil {
+			return err
+		}
+	}
 	logStats("generate ninja time: %q", time.Since(startTime))
 	return nil
 }
+
+// saveStamp writes the stamp of the ninja file generated from g.
+func (n *NinjaGenerator) saveStamp(g *DepGraph) error {
+	// Recipes may read more variables from the environment.
+	for name := range n.ctx.ev.usedEnvs {
+		n.usedEnvs[name] = true
+	}
+	stamp := NewStamp(g)
+	stamp.Envs = newStampEnvs(n.usedEnvs)
+	stamp.Version = gitVersion
+	stamp.Args = n.StampArgs
+	var dirs []string
+	for dir := range n.dirInputs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		h, exists := fsCache.dirHash(dir)
+		stamp.Files = append(stamp.Files, AccessedFile{
+			Name:   dir,
+			IsDir:  true,
+			Exists: exists,
+			Hash:   h,
+		})
+	}
+	return stamp.Save(StampFilename(n.Suffix))
+}
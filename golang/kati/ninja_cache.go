@@ -0,0 +1,422 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// ninjaScript is the shell script of a build edge, evaluated from
+// the recipe of a node.
+type ninjaScript struct {
+	Script       string
+	Desc         string
+	UseLocalPool bool
+	Shell        string
+	ShellFlags   string
+	// Deferred is functions in the recipe left to run at ninja-time.
+	Deferred []DeferredConstruct
+	// Tools are tools run by the commands, with ToolInputs.
+	Tools []string
+}
+
+type ninjaCacheEntry struct {
+	Key string
+	// Script is nil if the recipe evaluated to no commands.
+	Script *ninjaScript
+}
+
+// ninjaCache is the scripts of build edges generated by the last
+// run with Incremental, keyed by the output.
+type ninjaCache struct {
+	// Header is the digest of settings which affect all scripts.
+	Header  string
+	Entries map[string]ninjaCacheEntry
+}
+
+// varRefs is variables referenced by a value, or a variable.
+type varRefs struct {
+	// digest is the serialized variable, for a variable.
+	digest string
+	names  []string
+	// dynamic is true if the value references a variable whose
+	// name is computed, or calls a function not in pureFuncs.
+	dynamic bool
+}
+
+// ninjaCacheState is the state of Incremental.
+type ninjaCacheState struct {
+	header string
+	old    map[string]ninjaCacheEntry
+	new    map[string]ninjaCacheEntry
+	// vars is varRefs of global variables.
+	vars map[string]*varRefs
+
+	reused, evaluated, uncacheable int
+}
+
+func (n *NinjaGenerator) ninjaCacheName() string {
+	return fmt.Sprintf(".kati_ninja_cache%s", n.Suffix)
+}
+
+// cacheHeader returns the digest of settings which affect all scripts.
+func (n *NinjaGenerator) cacheHeader() (string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	for _, s := range []string{
+		buildID(),
+		wd,
+		n.ctx.shell,
+		n.ctx.shellFlags,
+		n.GomaDir,
+		strconv.FormatBool(n.DetectAndroidEcho),
+		strconv.FormatBool(UseFindEmulator),
+		strconv.FormatBool(UseShellBuiltins),
+		strings.Join(OverlayDirs, "\x00"),
+		strconv.FormatBool(n.ToolInputs),
+		strings.Join(n.ToolWrappers, "\x00"),
+	} {
+		writeCacheKeyField(h, s)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// loadNinjaCache loads the cache written by the last run. A missing
+// or unreadable cache, or one with other settings, is ignored.
+func (n *NinjaGenerator) loadNinjaCache() error {
+	header, err := n.cacheHeader()
+	if err != nil {
+		return err
+	}
+	n.cache = &ninjaCacheState{
+		header: header,
+		new:    make(map[string]ninjaCacheEntry),
+		vars:   make(map[string]*varRefs),
+	}
+	f, err := os.Open(n.ninjaCacheName())
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var c ninjaCache
+	err = gob.NewDecoder(f).Decode(&c)
+	if err != nil {
+		glog.Warningf("ignore ninja cache %s: %v", n.ninjaCacheName(), err)
+		return nil
+	}
+	if c.Header == header {
+		n.cache.old = c.Entries
+	}
+	return nil
+}
+
+// saveNinjaCache writes scripts of build edges generated by this run.
+func (n *NinjaGenerator) saveNinjaCache() (err error) {
+	f, err := os.Create(n.ninjaCacheName())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cerr := f.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+	c := n.cache
+	logStats("incremental ninja: %d reused, %d evaluated, %d uncacheable", c.reused, c.evaluated, c.uncacheable)
+	return gob.NewEncoder(f).Encode(ninjaCache{
+		Header:  c.header,
+		Entries: c.new,
+	})
+}
+
+// nodeScript returns the shell script of node, or nil if its recipe
+// has no commands. With Incremental, the script generated by the last
+// run is reused if the recipe and variables it references are same.
+func (n *NinjaGenerator) nodeScript(node *DepNode) (*ninjaScript, error) {
+	if n.cache == nil {
+		return n.genNodeScript(node)
+	}
+	c := n.cache
+	key, ok := n.nodeCacheKey(node)
+	if !ok {
+		c.uncacheable++
+		return n.genNodeScript(node)
+	}
+	if e, ok := c.old[node.Output]; ok && e.Key == key {
+		c.reused++
+		c.new[node.Output] = e
+		return e.Script, nil
+	}
+	c.evaluated++
+	s, err := n.genNodeScript(node)
+	if err != nil {
+		return nil, err
+	}
+	c.new[node.Output] = ninjaCacheEntry{Key: key, Script: s}
+	return s, nil
+}
+
+func (n *NinjaGenerator) genNodeScript(node *DepNode) (*ninjaScript, error) {
+	n.ctx.ev.deferred = nil
+	runners, _, err := createRunners(n.ctx, node)
+	if err != nil {
+		return nil, err
+	}
+	if len(runners) == 0 {
+		return nil, nil
+	}
+	ss, desc, ulp, err := n.genShellScript(runners)
+	if err != nil {
+		return nil, err
+	}
+	deferred := n.ctx.ev.deferred
+	for i := range deferred {
+		deferred[i].Target = node.Output
+	}
+	var tools []string
+	if n.ToolInputs {
+		for _, r := range runners {
+			tools = append(tools, commandTools(r.cmd, n.ToolWrappers)...)
+		}
+	}
+	return &ninjaScript{
+		Script:       ss,
+		Desc:         desc,
+		UseLocalPool: ulp,
+		Shell:        runners[0].shell,
+		ShellFlags:   runners[0].shellFlags,
+		Deferred:     deferred,
+		Tools:        tools,
+	}, nil
+}
+
+// nodeCacheKey returns the digest of the recipe of node and all
+// variables it may reference. It returns false if the recipe can't
+// be cached, e.g. it uses $(wildcard).
+func (n *NinjaGenerator) nodeCacheKey(node *DepNode) (string, bool) {
+	h := sha256.New()
+	writeCacheKeyField(h, node.Output)
+	writeCacheKeyField(h, node.Filename)
+	writeCacheKeyInt(h, node.Lineno)
+	writeCacheKeyField(h, strconv.FormatBool(node.IsPatternRule))
+	writeCacheKeyInt(h, len(node.ActualInputs))
+	for _, in := range node.ActualInputs {
+		writeCacheKeyField(h, in)
+	}
+
+	var pending []string
+	writeCacheKeyInt(h, len(node.Cmds))
+	for _, cmd := range node.Cmds {
+		writeCacheKeyField(h, cmd)
+		v, _, err := parseExpr([]byte(cmd), nil, parseOp{})
+		if err != nil {
+			return "", false
+		}
+		refs := valueRefs(v.serialize())
+		if refs.dynamic {
+			return "", false
+		}
+		pending = append(pending, refs.names...)
+	}
+
+	var tsvs []string
+	for name := range node.TargetSpecificVars {
+		tsvs = append(tsvs, name)
+	}
+	sort.Strings(tsvs)
+	// Whether the variables are exported depends on global exports
+	// and .EXPORT_ALL_VARIABLES too.
+	writeCacheKeyField(h, strings.Join(n.ctx.targetEnvNames(node), " "))
+	for _, name := range tsvs {
+		refs, ok := newVarRefs(node.TargetSpecificVars[name])
+		if !ok {
+			return "", false
+		}
+		writeCacheKeyField(h, name)
+		writeCacheKeyField(h, refs.digest)
+		pending = append(pending, refs.names...)
+	}
+
+	// Global variables referenced by the recipe, directly or through
+	// other variables.
+	seen := make(map[string]bool)
+	var names []string
+	for len(pending) > 0 {
+		name := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		refs := n.globalVarRefs(name)
+		if refs.dynamic {
+			return "", false
+		}
+		names = append(names, name)
+		pending = append(pending, refs.names...)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeCacheKeyField(h, name)
+		writeCacheKeyField(h, n.cache.vars[name].digest)
+	}
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+func (n *NinjaGenerator) globalVarRefs(name string) *varRefs {
+	if refs, ok := n.cache.vars[name]; ok {
+		return refs
+	}
+	// Look up through the evaluator to record variables from the
+	// environment even if the recipe is not evaluated again.
+	refs, ok := newVarRefs(n.ctx.ev.lookupGlobalVar(name))
+	if !ok {
+		refs = &varRefs{dynamic: true}
+	}
+	n.cache.vars[name] = refs
+	return refs
+}
+
+func newVarRefs(v Var) (*varRefs, bool) {
+	sv := v.serialize()
+	b, err := json.Marshal(sv)
+	if err != nil {
+		return nil, false
+	}
+	refs := valueRefs(sv)
+	if refs.dynamic {
+		return nil, false
+	}
+	refs.digest = string(b)
+	return refs, true
+}
+
+// valueRefs returns variables referenced by the serialized value sv.
+func valueRefs(sv serializableVar) *varRefs {
+	refs := &varRefs{}
+	refs.walk(sv)
+	return refs
+}
+
+// literalName returns the name given by sv, if it's not computed.
+func literalName(sv serializableVar) (string, bool) {
+	switch sv.Type {
+	case "literal", "tmpval":
+		return sv.V, true
+	}
+	return "", false
+}
+
+// pureFuncs is functions whose results depend only on their
+// arguments and variables. Other functions, such as $(shell),
+// $(wildcard), $(realpath) or $(eval), may read files or have side
+// effects, so recipes using them are evaluated again on every run.
+var pureFuncs = map[string]bool{
+	"patsubst":     true,
+	"strip":        true,
+	"subst":        true,
+	"findstring":   true,
+	"filter":       true,
+	"filter-out":   true,
+	"sort":         true,
+	"word":         true,
+	"wordlist":     true,
+	"words":        true,
+	"firstword":    true,
+	"lastword":     true,
+	"join":         true,
+	"dir":          true,
+	"notdir":       true,
+	"suffix":       true,
+	"basename":     true,
+	"addsuffix":    true,
+	"addprefix":    true,
+	"if":           true,
+	"and":          true,
+	"or":           true,
+	"value":        true,
+	"call":         true,
+	"foreach":      true,
+	"origin":       true,
+	"flavor":       true,
+	"KATI_let":     true,
+	"KATI_uniq":    true,
+	"KATI_reverse": true,
+}
+
+func (r *varRefs) walk(sv serializableVar) {
+	if r.dynamic {
+		return
+	}
+	switch sv.Type {
+	case "varref", "varsubst":
+		name, ok := literalName(sv.Children[0])
+		if !ok {
+			r.dynamic = true
+			return
+		}
+		r.names = append(r.names, name)
+		for _, c := range sv.Children[1:] {
+			r.walk(c)
+		}
+		return
+	case "func":
+		fname, ok := literalName(sv.Children[0])
+		if !ok || fname == "" {
+			r.dynamic = true
+			return
+		}
+		if !pureFuncs[fname[1:]] {
+			r.dynamic = true
+			return
+		}
+		switch fname[1:] {
+		case "call", "value", "origin", "flavor":
+			if len(sv.Children) < 2 {
+				break
+			}
+			name, ok := literalName(sv.Children[1])
+			if !ok {
+				r.dynamic = true
+				return
+			}
+			r.names = append(r.names, name)
+		}
+		for _, c := range sv.Children[1:] {
+			r.walk(c)
+		}
+		return
+	case "funcEvalAssign":
+		r.dynamic = true
+		return
+	}
+	for _, c := range sv.Children {
+		r.walk(c)
+	}
+}
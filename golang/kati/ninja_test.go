@@ -14,7 +14,16 @@
 
 package kati
 
-import "testing"
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
 
 func TestStripShellComment(t *testing.T) {
 	for _, tc := range []struct {
@@ -167,6 +176,39 @@ func TestGetDepFile(t *testing.T) {
 	}
 }
 
+func TestIsMSVCCommand(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want bool
+	}{
+		{
+			in:   `cl.exe /nologo /showIncludes /c foo.c /Fofoo.obj`,
+			want: true,
+		},
+		{
+			in:   `wine "C:/Program Files/MSVC/bin/CL.EXE" -showIncludes -MD -c foo.c`,
+			want: true,
+		},
+		{
+			in:   `mkdir -p out && prebuilts/bin/clang-cl /showIncludes:user /c foo.c`,
+			want: true,
+		},
+		{
+			in: `cl.exe /nologo /c foo.c`,
+		},
+		{
+			in: `cc -showIncludes -c foo.c`,
+		},
+		{
+			in: `tools/cl.sh /showIncludes /c foo.c`,
+		},
+	} {
+		if got := isMSVCCommand(tc.in); got != tc.want {
+			t.Errorf("isMSVCCommand(%q)=%t; want %t", tc.in, got, tc.want)
+		}
+	}
+}
+
 func TestGomaCmdForAndroidCompileCmd(t *testing.T) {
 	for _, tc := range []struct {
 		in   string
@@ -200,3 +242,851 @@ func TestGomaCmdForAndroidCompileCmd(t *testing.T) {
 		}
 	}
 }
+
+func TestEscapeNinjaPath(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want string
+		err  bool
+	}{
+		{
+			in:   "foo/bar.o",
+			want: "foo/bar.o",
+		},
+		{
+			in:   "foo bar",
+			want: "foo$ bar",
+		},
+		{
+			in:   `foo\ bar`,
+			want: "foo$ bar",
+		},
+		{
+			in:   "c:foo",
+			want: "c$:foo",
+		},
+		{
+			in:   "$foo",
+			want: "$$foo",
+		},
+		{
+			in:  "foo|bar",
+			err: true,
+		},
+		{
+			in:  "foo\nbar",
+			err: true,
+		},
+	} {
+		got, err := escapeNinjaPath(tc.in)
+		if tc.err {
+			if err == nil {
+				t.Errorf("escapeNinjaPath(%q)=%q, _; want error", tc.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Errorf("escapeNinjaPath(%q)=%q, %v; want=%q, <nil>", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+func TestMkdirOutputDir(t *testing.T) {
+	for _, tc := range []struct {
+		ss     string
+		output string
+		want   string
+	}{
+		{
+			ss:     "touch foo",
+			output: "foo",
+			want:   "touch foo",
+		},
+		{
+			ss:     "touch out/foo",
+			output: "out/foo",
+			want:   "mkdir -p 'out' && touch out/foo",
+		},
+		{
+			ss:     "mkdir -p out/a && touch out/a/foo",
+			output: "out/a/foo",
+			want:   "mkdir -p out/a && touch out/a/foo",
+		},
+		{
+			ss:     "touch out$$/foo",
+			output: "out$/foo",
+			want:   "mkdir -p 'out$$' && touch out$$/foo",
+		},
+	} {
+		got, err := mkdirOutputDir(tc.ss, tc.output)
+		if err != nil || got != tc.want {
+			t.Errorf("mkdirOutputDir(%q, %q)=%q, %v; want=%q, <nil>", tc.ss, tc.output, got, err, tc.want)
+		}
+	}
+}
+
+func TestPhonyMissing(t *testing.T) {
+	n := &NinjaGenerator{
+		PhonyMissingPatterns: []string{"out/gen/%", "prebuilt.a"},
+	}
+	for _, tc := range []struct {
+		in   string
+		want bool
+	}{
+		{in: "out/gen/foo.h", want: true},
+		{in: "out/foo.h", want: false},
+		{in: "prebuilt.a", want: true},
+		{in: "lib/prebuilt.a", want: false},
+	} {
+		if got := n.phonyMissing(tc.in); got != tc.want {
+			t.Errorf("phonyMissing(%q)=%t; want=%t", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestNinjaSharedRules(t *testing.T) {
+	chdirTemp(t, map[string]string{
+		"a.c": "",
+		"b.c": "",
+		"c.c": "",
+		"Makefile": `all: a.o b.o c.o d.txt
+%.o: %.c
+	cc -c $< -MD -MF $@.d -o $@
+c.o: c.c
+	cc -O2 -c $< -o $@
+d.txt:
+	echo d > $@
+`,
+	})
+	g := mustLoad(t, LoadReq{Makefile: "Makefile"})
+	n := &NinjaGenerator{}
+	err := n.Save(g, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile("build.ninja")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ninja := string(b)
+	for _, want := range []string{
+		"rule rule0\n description = build $out\n deps = gcc\n command = /bin/sh -c \"cc -c ${in} -MD -MF ${out}.d -o ${out} && cp ${out}.d ${out}.d.tmp\"\n",
+		"build a.o: rule0 a.c\n depfile = a.o.d.tmp\n",
+		"build b.o: rule0 b.c\n depfile = b.o.d.tmp\n",
+		"rule rule1\n description = build $out\n command = /bin/sh -c \"cc -O2 -c ${in} -o ${out}\"\n",
+		"build c.o: rule1 c.c\n",
+		"rule rule2\n description = build $out\n command = /bin/sh -c \"echo d > ${out}\"\n",
+	} {
+		if !strings.Contains(ninja, want) {
+			t.Errorf("build.ninja doesn't contain %q:\n%s", want, ninja)
+		}
+	}
+	if got, want := strings.Count(ninja, "\nrule rule"), 3; got != want {
+		t.Errorf("%d rules in build.ninja; want %d:\n%s", got, want, ninja)
+	}
+}
+
+func TestNinjaDir(t *testing.T) {
+	dir := chdirTemp(t, nil)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(dir, "src")
+	err = os.Mkdir(src, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	err = ioutil.WriteFile("a.c", nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile("Makefile", []byte(`a.o: a.c /abs/b.h
+	cc -c $< -MD -MF $@.d -o $@
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := mustLoad(t, LoadReq{Makefile: "Makefile"})
+	n := &NinjaGenerator{NinjaDir: ".."}
+	err = n.Save(g, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile("build.ninja")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ninja := string(b)
+	for _, want := range []string{
+		" command = cd 'src' && /bin/sh -c \"cc -c a.c -MD -MF a.o.d -o a.o && cp a.o.d a.o.d.tmp\"\n",
+		"build src/a.o: rule0 src/a.c /abs/b.h\n depfile = src/a.o.d.tmp\n",
+		"default src/a.o\n",
+	} {
+		if !strings.Contains(ninja, want) {
+			t.Errorf("build.ninja doesn't contain %q:\n%s", want, ninja)
+		}
+	}
+	b, err = ioutil.ReadFile("ninja.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "cd '..'\nexec ninja -f src/build.ninja"; !strings.Contains(string(b), want) {
+		t.Errorf("ninja.sh doesn't contain %q:\n%s", want, b)
+	}
+}
+
+func TestNinjaPools(t *testing.T) {
+	chdirTemp(t, map[string]string{
+		"Makefile": `all: a.o b.txt c.txt d.txt
+a.o:
+	prebuilts/clang/bin/clang -O2 -c a.c -o $@
+b.txt:
+	echo b > $@
+c.txt: .KATI_NINJA_POOL := test_pool
+c.txt:
+	echo c > $@
+d.txt: .KATI_NINJA_POOL := none
+d.txt:
+	echo d > $@
+`,
+	})
+	for _, eager := range []bool{false, true} {
+		g, err := Load(LoadReq{
+			Makefile: "Makefile",
+			// Commands of the targets to build are evaluated eagerly.
+			Targets:          []string{"a.o", "b.txt", "c.txt", "d.txt"},
+			EagerEvalCommand: eager,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := &NinjaGenerator{
+			GomaDir:        "/goma",
+			LocalPoolDepth: 4,
+			GomaPoolDepth:  100,
+		}
+		err = n.Save(g, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile("build.ninja")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ninja := string(b)
+		for _, want := range []string{
+			"pool local_pool\n depth = 4\n",
+			"pool goma_pool\n depth = 100\n",
+			"build a.o: rule0\n pool = goma_pool\n",
+			"build b.txt: rule1\n pool = local_pool\n",
+			"build c.txt: rule2\n pool = test_pool\n",
+			"build d.txt: rule3\n\n",
+		} {
+			if !strings.Contains(ninja, want) {
+				t.Errorf("EagerEvalCommand=%t: build.ninja doesn't contain %q:\n%s", eager, want, ninja)
+			}
+		}
+		b, err = ioutil.ReadFile("ninja.sh")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "exec ninja -f build.ninja -j100 "; !strings.Contains(string(b), want) {
+			t.Errorf("ninja.sh doesn't contain %q:\n%s", want, b)
+		}
+	}
+}
+
+func TestScriptShellFlags(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{in: "-c", want: ""},
+		{in: "-ec", want: "-e"},
+		{in: "-o pipefail -c", want: "-o pipefail"},
+		{in: "-eu -o pipefail -c", want: "-eu -o pipefail"},
+		{in: "", want: ""},
+	} {
+		if got := scriptShellFlags(tc.in); got != tc.want {
+			t.Errorf("scriptShellFlags(%q)=%q; want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestNinjaRspFile(t *testing.T) {
+	chdirTemp(t, nil)
+
+	// Commands longer than the limit of arguments are run from
+	// response files.
+	err := ioutil.WriteFile("Makefile", []byte(`.SHELLFLAGS := -ec
+all:
+	echo `+strings.Repeat("x", 100*1000)+`
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := mustLoad(t, LoadReq{Makefile: "Makefile"})
+	n := &NinjaGenerator{}
+	err = n.Save(g, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile("build.ninja")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := " command = /bin/sh -e $out.rsp\n"; !strings.Contains(string(b), want) {
+		t.Errorf("build.ninja doesn't contain %q", want)
+	}
+}
+
+func TestNinjaEnvFile(t *testing.T) {
+	chdirTemp(t, map[string]string{
+		"Makefile": `export FOO := it's $$HOME
+export BAR = $(FOO)!
+unexport BAZ
+all:
+	echo $$FOO
+`,
+	})
+	g := mustLoad(t, LoadReq{Makefile: "Makefile"})
+	n := &NinjaGenerator{EnvFile: true}
+	err := n.Save(g, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile("env.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "# Generated by kati " + gitVersion + "\n" +
+		`export BAR='it'\''s $HOME!'` + "\n" +
+		"unset BAZ\n" +
+		`export FOO='it'\''s $HOME'` + "\n" +
+		"export MAKELEVEL='1'\n"
+	if got := string(b); got != want {
+		t.Errorf("env.sh=%q; want %q", got, want)
+	}
+	out, err := exec.Command("/bin/sh", "-c", ". ./env.sh && echo \"$BAR\"").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(out), "it's $HOME!\n"; got != want {
+		t.Errorf("BAR=%q after sourcing env.sh; want %q", got, want)
+	}
+
+	b, err = ioutil.ReadFile("build.ninja")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := ` command = . ./env.sh && /bin/sh -c "echo \$$FOO"` + "\n"; !strings.Contains(string(b), want) {
+		t.Errorf("build.ninja doesn't contain %q:\n%s", want, b)
+	}
+	b, err = ioutil.ReadFile("ninja.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "\n. ./env.sh\nexec ninja"; !strings.Contains(string(b), want) {
+		t.Errorf("ninja.sh doesn't contain %q:\n%s", want, b)
+	}
+}
+
+func TestNinjaTargetSpecificExport(t *testing.T) {
+	chdirTemp(t, map[string]string{
+		"Makefile": `export BAR := global
+all: foo
+foo: export FOO := it's $$HOME
+foo: BAR := local
+foo:
+	echo $$FOO $$BAR
+`,
+	})
+	for _, eager := range []bool{false, true} {
+		g, err := Load(LoadReq{
+			Makefile: "Makefile",
+			// Commands of the targets to build are evaluated eagerly.
+			Targets:          []string{"foo"},
+			EagerEvalCommand: eager,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := &NinjaGenerator{}
+		err = n.Save(g, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile("build.ninja")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := ` command = /bin/sh -c "export BAR='local' FOO='it'\\''s \$$HOME' && echo \$$FOO \$$BAR"` + "\n"
+		if !strings.Contains(string(b), want) {
+			t.Errorf("EagerEvalCommand=%t: build.ninja doesn't contain %q:\n%s", eager, want, b)
+		}
+	}
+}
+
+func TestNinjaTargetsOnly(t *testing.T) {
+	chdirTemp(t, map[string]string{
+		"Makefile": `.PHONY: all clean tests
+all: a
+a: b
+	cp b a
+b:
+	touch b
+clean:
+	rm -f a b
+tests: t
+t:
+	touch t
+`,
+	})
+	g := mustLoad(t, LoadReq{Makefile: "Makefile"})
+	for _, tc := range []struct {
+		targets []string
+		want    []string
+		notWant []string
+	}{
+		{
+			want:    []string{"build all:", "build a:", "build b:"},
+			notWant: []string{"build clean:", "build tests:", "build t:"},
+		},
+		{
+			targets: []string{"b", "t"},
+			want:    []string{"build b:", "build t:"},
+			notWant: []string{"build all:", "build a:", "build clean:", "build tests:"},
+		},
+	} {
+		n := &NinjaGenerator{TargetsOnly: true}
+		err := n.Save(g, "", tc.targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile("build.ninja")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(string(b), want) {
+				t.Errorf("targets=%q: build.ninja doesn't contain %q:\n%s", tc.targets, want, b)
+			}
+		}
+		for _, notWant := range tc.notWant {
+			if strings.Contains(string(b), notWant) {
+				t.Errorf("targets=%q: build.ninja contains %q:\n%s", tc.targets, notWant, b)
+			}
+		}
+	}
+
+	n := &NinjaGenerator{TargetsOnly: true}
+	err := n.Save(g, "", []string{"nosuchtarget"})
+	if err == nil {
+		t.Errorf("Save(nosuchtarget)=nil; want error")
+	}
+}
+
+func TestNinjaIncremental(t *testing.T) {
+	chdirTemp(t, nil)
+
+	gen := func(cflags string, incremental bool) (string, *ninjaCacheState) {
+		t.Helper()
+		err := ioutil.WriteFile("Makefile", []byte(`CC = gcc
+CFLAGS := `+cflags+`
+COMPILE = $(CC) $(CFLAGS) -c $< -o $@
+all: a.o b.o c.o
+a.o: a.c
+	$(COMPILE)
+b.o: PRIVATE_FLAGS := -g
+b.o: b.c
+	$(CC) $(PRIVATE_FLAGS) -c $< -o $@
+c.o: c.c
+	echo $(wildcard *.c)
+`), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := mustLoad(t, LoadReq{Makefile: "Makefile"})
+		n := &NinjaGenerator{Incremental: incremental}
+		err = n.Save(g, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadFile("build.ninja")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b), n.cache
+	}
+
+	for _, tc := range []struct {
+		cflags                         string
+		reused, evaluated, uncacheable int
+	}{
+		{cflags: "-O2", evaluated: 3, uncacheable: 1},
+		{cflags: "-O2", reused: 3, uncacheable: 1},
+		{cflags: "-O3", reused: 2, evaluated: 1, uncacheable: 1},
+	} {
+		got, c := gen(tc.cflags, true)
+		if c.reused != tc.reused || c.evaluated != tc.evaluated || c.uncacheable != tc.uncacheable {
+			t.Errorf("CFLAGS=%s: reused=%d evaluated=%d uncacheable=%d; want %d %d %d", tc.cflags, c.reused, c.evaluated, c.uncacheable, tc.reused, tc.evaluated, tc.uncacheable)
+		}
+		want, _ := gen(tc.cflags, false)
+		if got != want {
+			t.Errorf("CFLAGS=%s: incremental build.ninja=%q; want %q", tc.cflags, got, want)
+		}
+	}
+}
+
+func TestNinjaIncrementalExports(t *testing.T) {
+	chdirTemp(t, nil)
+
+	for _, tc := range []struct {
+		global    string
+		evaluated int
+		want      string
+	}{
+		{global: "", evaluated: 1, want: `"echo \$$BAR"`},
+		{global: "", evaluated: 0, want: `"echo \$$BAR"`},
+		{global: "export BAR", evaluated: 1, want: `"export BAR='local' && echo \$$BAR"`},
+		{global: ".EXPORT_ALL_VARIABLES:", evaluated: 0, want: `"export BAR='local' && echo \$$BAR"`},
+	} {
+		err := ioutil.WriteFile("Makefile", []byte(tc.global+`
+foo: BAR := local
+foo:
+	echo $$BAR
+`), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := mustLoad(t, LoadReq{Makefile: "Makefile"})
+		n := &NinjaGenerator{Incremental: true}
+		err = n.Save(g, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.cache.evaluated != tc.evaluated {
+			t.Errorf("%q: evaluated=%d; want %d", tc.global, n.cache.evaluated, tc.evaluated)
+		}
+		b, err := ioutil.ReadFile("build.ninja")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(b), tc.want) {
+			t.Errorf("%q: build.ninja doesn't contain %q:\n%s", tc.global, tc.want, b)
+		}
+	}
+}
+
+func TestValueRefsDynamic(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		dynamic bool
+	}{
+		{in: "$(CC) $(CFLAGS) -c $< -o $@"},
+		{in: "$(patsubst %.c,%.o,$(filter %.c,$(SRCS)))"},
+		{in: "$(call compile,$(CC))"},
+		{in: "$(foreach f,$(SRCS),$(notdir $(f)))"},
+		{in: "$($(NAME))", dynamic: true},
+		{in: "$(wildcard *.c)", dynamic: true},
+		{in: "$(sort $(wildcard *.c))", dynamic: true},
+		{in: "$(eval FOO := 1)", dynamic: true},
+		{in: "$(shell date)", dynamic: true},
+		{in: "$(realpath a)", dynamic: true},
+		{in: "$(abspath a)", dynamic: true},
+		{in: "$(file <a)", dynamic: true},
+		{in: "$(info $(CC))", dynamic: true},
+		{in: "$(strip $(shell cat a))", dynamic: true},
+	} {
+		v, _, err := parseExpr([]byte(tc.in), nil, parseOp{alloc: true})
+		if err != nil {
+			t.Fatalf("parseExpr(%q)=%v", tc.in, err)
+		}
+		refs := valueRefs(v.serialize())
+		if refs.dynamic != tc.dynamic {
+			t.Errorf("valueRefs(%q).dynamic=%t; want %t", tc.in, refs.dynamic, tc.dynamic)
+		}
+	}
+}
+
+func TestNinjaDeferredReport(t *testing.T) {
+	chdirTemp(t, map[string]string{
+		"Makefile": `all: a b
+a:
+	echo $(shell cat gen.txt) > $@
+b:
+	$(info building b)
+	echo $(realpath a) > $@
+`,
+	})
+	g := mustLoad(t, LoadReq{Makefile: "Makefile"})
+	n := &NinjaGenerator{DeferredReport: true}
+	err := n.Save(g, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile("build.deferred.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []DeferredConstruct
+	err = json.Unmarshal(b, &got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []DeferredConstruct{
+		{
+			Target:   "a",
+			Filename: "Makefile",
+			Lineno:   3,
+			Func:     "shell",
+			Arg:      "cat gen.txt",
+			Reason:   "the command may read files generated by ninja",
+		},
+		{
+			Target:   "b",
+			Filename: "Makefile",
+			Lineno:   5,
+			Func:     "info",
+			Arg:      "building b",
+			Reason:   "the message is printed when the rule runs",
+		},
+		{
+			Target:   "b",
+			Filename: "Makefile",
+			Lineno:   5,
+			Func:     "realpath",
+			Arg:      "a",
+			Reason:   "the files may not exist until ninja runs",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("build.deferred.json=%s; want %#v", b, want)
+	}
+}
+
+func TestNinjaExpandDirInputs(t *testing.T) {
+	chdirTemp(t, nil)
+	fsCache = newFsCache()
+
+	for _, f := range []string{"src/a.txt", "src/sub/b.txt"} {
+		err := os.MkdirAll(filepath.Dir(f), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(f, nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := ioutil.WriteFile("Makefile", []byte(`all: out.tar out.txt
+out.tar: src
+	tar cf $@ $<
+out.txt: src
+	ls $< > $@
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := mustLoad(t, LoadReq{Makefile: "Makefile"})
+	n := &NinjaGenerator{ExpandDirInputs: true, Stamp: true}
+	err = n.Save(g, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile("build.ninja")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ninja := string(b)
+	for _, want := range []string{
+		"build out.tar: rule0 src | src/a.txt src/sub/b.txt\n restat = 1\n",
+		"build out.txt: rule1 src\n",
+	} {
+		if !strings.Contains(ninja, want) {
+			t.Errorf("build.ninja doesn't have %q\n%s", want, ninja)
+		}
+	}
+
+	s, err := LoadStamp(StampFilename(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dirs []string
+	for _, f := range s.Files {
+		if f.IsDir {
+			dirs = append(dirs, f.Name)
+		}
+	}
+	if want := []string{"src", "src/sub"}; !reflect.DeepEqual(dirs, want) {
+		t.Errorf("directories in stamp=%q; want=%q", dirs, want)
+	}
+	err = ioutil.WriteFile("src/sub/c.txt", nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsCache = newFsCache()
+	diff, err := s.Diff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "directory src/sub: entries sha1 "; !strings.HasPrefix(diff, want) {
+		t.Errorf("s.Diff()=%q; want %q", diff, want)
+	}
+}
+
+func TestNinjaMSVCDeps(t *testing.T) {
+	chdirTemp(t, map[string]string{
+		"a.c": "",
+		"b.c": "",
+		"Makefile": `all: a.obj b.o
+a.obj: a.c
+	wine cl.exe /nologo /showIncludes -MD -c $< /Fo$@
+b.o: b.c
+	cc -c $< -MD -o $@
+`,
+	})
+	g := mustLoad(t, LoadReq{Makefile: "Makefile"})
+	n := &NinjaGenerator{MSVCDepsPrefix: "Remarque : inclusion du fichier :"}
+	err := n.Save(g, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile("build.ninja")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ninja := string(b)
+	for _, want := range []string{
+		"rule rule0\n description = build $out\n deps = msvc\n msvc_deps_prefix = Remarque : inclusion du fichier :\n command = /bin/sh -c \"wine cl.exe /nologo /showIncludes -MD -c ${in} /Fo${out}\"\n",
+		"build a.obj: rule0 a.c\n\n",
+		"rule rule1\n description = build $out\n deps = gcc\n",
+		"build b.o: rule1 b.c\n depfile = b.d.tmp\n",
+	} {
+		if !strings.Contains(ninja, want) {
+			t.Errorf("build.ninja doesn't contain %q:\n%s", want, ninja)
+		}
+	}
+}
+
+func TestCommandTools(t *testing.T) {
+	wrappers := []string{"ccache", "time"}
+	for _, tc := range []struct {
+		in   string
+		want []string
+	}{
+		{
+			in:   "prebuilts/clang/bin/clang -c a.c -o a.o",
+			want: []string{"prebuilts/clang/bin/clang"},
+		},
+		{
+			in:   "  CCACHE_DIR=/tmp/cc LANG=C prebuilts/misc/ccache prebuilts/clang/bin/clang -c a.c",
+			want: []string{"prebuilts/misc/ccache", "prebuilts/clang/bin/clang"},
+		},
+		{
+			in:   "time ccache cc -c a.c",
+			want: []string{"time", "ccache", "cc"},
+		},
+		{
+			in: "",
+		},
+	} {
+		if got := commandTools(tc.in, wrappers); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("commandTools(%q)=%q; want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestNinjaToolInputs(t *testing.T) {
+	chdirTemp(t, nil)
+
+	for _, f := range []string{"a.c", "b.c", "prebuilts/clang", "prebuilts/ccache"} {
+		err := os.MkdirAll(filepath.Dir(f), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(f, nil, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := ioutil.WriteFile("Makefile", []byte(`all: a.o b.o c.txt d.txt e.txt
+a.o: a.c
+	@prebuilts/ccache prebuilts/clang -c $< -o $@
+b.o: b.c out/gen
+	mkdir -p out && out/gen $< > $@ && prebuilts/clang -c $< -o $@
+out/gen:
+	cp prebuilts/clang $@
+c.txt:
+	cc -o $@ && missing/tool $@
+d.txt: prebuilts/clang
+	$< > $@
+e.txt:
+	out/gen > $@
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := mustLoad(t, LoadReq{Makefile: "Makefile"})
+	n := &NinjaGenerator{ToolInputs: true, ToolWrappers: []string{"ccache"}}
+	err = n.Save(g, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile("build.ninja")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ninja := string(b)
+	for _, want := range []string{
+		"build a.o: rule0 a.c | prebuilts/ccache prebuilts/clang\n",
+		"build b.o: rule1 b.c out/gen\n",
+		"build out/gen: rule2\n",
+		"build c.txt: rule3\n",
+		"build d.txt: rule4 prebuilts/clang\n",
+		"build e.txt: rule5 | out/gen\n",
+	} {
+		if !strings.Contains(ninja, want) {
+			t.Errorf("build.ninja doesn't contain %q:\n%s", want, ninja)
+		}
+	}
+}
+
+func TestNinjaWait(t *testing.T) {
+	// a.txt depends on c.txt, so c.txt can't wait for it.
+	chdirTemp(t, map[string]string{
+		"Makefile": `all: a.txt b.txt .WAIT c.txt .WAIT d.txt
+a.txt: c.txt
+	touch $@
+b.txt c.txt d.txt:
+	touch $@
+`,
+	})
+
+	g := mustLoad(t, LoadReq{Makefile: "Makefile"})
+	n := &NinjaGenerator{}
+	err := n.Save(g, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile("build.ninja")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ninja := string(b)
+	for _, want := range []string{
+		"build all: phony a.txt b.txt c.txt d.txt\n",
+		"build c.txt: rule0 || b.txt\n",
+		"build d.txt: rule0 || a.txt b.txt c.txt\n",
+	} {
+		if !strings.Contains(ninja, want) {
+			t.Errorf("build.ninja doesn't contain %q:\n%s", want, ninja)
+		}
+	}
+}
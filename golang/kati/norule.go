@@ -0,0 +1,195 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Reason codes of "whynorule:" queries.
+const (
+	// The target has an explicit rule with commands.
+	ruleExplicit = "EXPLICIT_RULE"
+	// The target has commands from a pattern or suffix rule.
+	ruleImplicit = "IMPLICIT_RULE"
+	// The target has an explicit rule, but no commands.
+	ruleNoCommands = "EXPLICIT_RULE_WITHOUT_COMMANDS"
+	// The target has no rule, but the file exists.
+	ruleSourceFile = "SOURCE_FILE"
+	// No rule has the target, or a pattern matching it.
+	ruleNoRule = "NO_RULE"
+	// Pattern or suffix rules match the target, but their
+	// prerequisites don't exist.
+	ruleNoMatchingImplicitRule = "NO_MATCHING_IMPLICIT_RULE"
+)
+
+// errNoRules is returned by "whynorule:" queries for graphs loaded
+// without LoadReq.KeepRules.
+var errNoRules = errors.New("*** rules are not kept. Load with KeepRules")
+
+// explainRule writes why target has or has no rule, as a reason code
+// followed by details: implicit rules nearly matched with the
+// prerequisite which doesn't exist, and paths searched by vpath.
+func (db *depBuilder) explainRule(w io.Writer, target string) {
+	target = trimLeadingCurdir(target)
+	r, hasExplicit := db.rules[target]
+	if hasExplicit && len(r.cmds) > 0 {
+		fmt.Fprintf(w, "%s: %s\n", target, ruleExplicit)
+		fmt.Fprintf(w, "  %s: explicit rule\n", rulePos(r))
+		return
+	}
+
+	var notes []string
+	var code string
+	// Pattern rules, then suffix rules, then builtin pattern rules,
+	// as pickRule.
+	irules := db.implicitRules.all()
+	var ordered []*rule
+	for _, builtin := range []bool{false, true} {
+		for i := len(irules) - 1; i >= 0; i-- {
+			if (irules[i].filename == bootstrapMakefileName) == builtin {
+				ordered = append(ordered, irules[i])
+			}
+		}
+		if !builtin {
+			ordered = append(ordered, db.suffixRules[strings.TrimPrefix(filepath.Ext(target), ".")]...)
+		}
+	}
+	for _, ir := range ordered {
+		name, inputs, ok := db.implicitRuleInputs(ir, target)
+		if !ok {
+			continue
+		}
+		missing := ""
+		for _, input := range inputs {
+			if !db.exists(input) {
+				missing = input
+				break
+			}
+		}
+		if missing == "" {
+			fmt.Fprintf(w, "%s: %s\n", target, ruleImplicit)
+			fmt.Fprintf(w, "  %s: %s\n", rulePos(ir), name)
+			return
+		}
+		note := fmt.Sprintf("%s: %s: prerequisite %q doesn't exist and has no explicit rule", rulePos(ir), name, missing)
+		if db.matchesImplicitRule(missing) {
+			note += " (kati doesn't chain implicit rules)"
+		}
+		notes = append(notes, note)
+		notes = append(notes, db.vpathNotes(missing)...)
+	}
+	for _, ir := range irules {
+		p := ir.outputPatterns[0]
+		if p.match(target) || p.suffix == "" || !strings.HasSuffix(target, p.suffix) {
+			continue
+		}
+		notes = append(notes, fmt.Sprintf("%s: %s: target doesn't match the pattern", rulePos(ir), p))
+	}
+
+	path, exists := db.vpaths.exists(target)
+	switch {
+	case hasExplicit:
+		code = ruleNoCommands
+		notes = append([]string{fmt.Sprintf("%s: explicit rule without commands", rulePos(r))}, notes...)
+	case exists:
+		code = ruleSourceFile
+		notes = append([]string{fmt.Sprintf("found as %s", path)}, notes...)
+	case len(notes) > 0:
+		code = ruleNoMatchingImplicitRule
+		notes = append(notes, db.vpathNotes(target)...)
+	default:
+		code = ruleNoRule
+		notes = append(notes, db.vpathNotes(target)...)
+	}
+	fmt.Fprintf(w, "%s: %s\n", target, code)
+	for _, note := range notes {
+		fmt.Fprintf(w, "  %s\n", note)
+	}
+}
+
+func rulePos(r *rule) string {
+	if r.filename == bootstrapMakefileName {
+		return "<builtin>"
+	}
+	return fmt.Sprintf("%s:%d", r.filename, r.lineno)
+}
+
+// implicitRuleInputs returns the name and the prerequisites of
+// pattern or suffix rule r for target, if r matches target.
+func (db *depBuilder) implicitRuleInputs(r *rule, target string) (string, []string, bool) {
+	if r.isSuffixRule {
+		in := replaceSuffix(target, r.inputs[0])
+		return fmt.Sprintf("suffix rule .%s%s", r.inputs[0], filepath.Ext(target)), []string{in}, true
+	}
+	p := r.outputPatterns[0]
+	if !p.match(target) {
+		return "", nil, false
+	}
+	var inputs []string
+	for _, input := range r.inputs {
+		inputs = append(inputs, db.expandWildcard(p.subst(input, target))...)
+	}
+	return fmt.Sprintf("pattern rule %s: %s", p, strings.Join(r.inputs, " ")), inputs, true
+}
+
+func (db *depBuilder) matchesImplicitRule(target string) bool {
+	for _, r := range db.implicitRules.lookup(target) {
+		if r.outputPatterns[0].match(target) {
+			return true
+		}
+	}
+	_, present := db.suffixRules[strings.TrimPrefix(filepath.Ext(target), ".")]
+	return present
+}
+
+// vpathNotes returns paths searched for target by vpath and VPATH.
+func (db *depBuilder) vpathNotes(target string) []string {
+	var notes []string
+	for _, vpath := range db.vpaths.vpaths {
+		if !matchPattern(vpath.pattern, target) {
+			continue
+		}
+		for _, dir := range vpath.dirs {
+			notes = append(notes, fmt.Sprintf("vpath %s: %s doesn't exist", vpath.pattern, filepath.Join(dir, target)))
+		}
+	}
+	for _, dir := range db.vpaths.dirs {
+		notes = append(notes, fmt.Sprintf("VPATH: %s doesn't exist", filepath.Join(dir, target)))
+	}
+	return notes
+}
+
+// whyNoRule explains why target has no rule in each graph merged to
+// g.
+func (g *DepGraph) whyNoRule(w io.Writer, target string) error {
+	parts := g.partGraphs()
+	for _, p := range parts {
+		if p.db == nil {
+			return errNoRules
+		}
+	}
+	for _, p := range parts {
+		if len(parts) > 1 {
+			fmt.Fprintf(w, "in %s:\n", p.accessedMks[0].Filename)
+		}
+		p.db.explainRule(w, target)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// overlayRoots returns OverlayDirs and the working directory, in
+// order of precedence.
+func overlayRoots() []string {
+	roots := make([]string, 0, len(OverlayDirs)+1)
+	for _, dir := range OverlayDirs {
+		roots = append(roots, filepath.Clean(dir))
+	}
+	return append(roots, ".")
+}
+
+// overlayJoin returns path relative to the working directory for
+// path in root.
+func overlayJoin(root, path string) string {
+	switch {
+	case root == ".":
+		return path
+	case path == "":
+		return root
+	}
+	return filepathJoin(root, path)
+}
+
+// overlayName returns the path in the union view of file in root.
+func overlayName(root, file string) string {
+	if root == "." {
+		return file
+	}
+	return strings.TrimPrefix(file, root+string(filepath.Separator))
+}
+
+// overlayIsDir reports whether dir exists in any of overlay roots.
+func (c *fsCacheT) overlayIsDir(dir string) bool {
+	for _, root := range overlayRoots() {
+		if filepath.IsAbs(dir) && root != "." {
+			continue
+		}
+		id, _ := c.readdir(filepathClean(overlayJoin(root, dir)), unknownFileid)
+		if id != invalidFileid {
+			return true
+		}
+	}
+	return false
+}
+
+// overlayGlob globs pat in each overlay root. A file shadowed by the
+// same name in a root of higher precedence is dropped.
+func (c *fsCacheT) overlayGlob(pat string) ([]string, error) {
+	var matches []string
+	seen := make(map[string]bool)
+	for _, root := range overlayRoots() {
+		m, err := c.globPath(overlayJoin(root, pat))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range m {
+			name := overlayName(root, file)
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			matches = append(matches, file)
+		}
+	}
+	return matches, nil
+}
+
+// runOverlay runs find in each overlay root. Paths are printed
+// relative to the directory find runs in, so one in an overlay has
+// the relative path of the overlay in its prefix, e.g. find in "foo"
+// prints "../vendor/foo/a" for "a" in the overlay "vendor".
+func (fc findCommand) runOverlay(w evalWriter) {
+	seen := make(map[string]bool)
+	for _, root := range overlayRoots() {
+		rfc := fc
+		rfc.chdir = overlayJoin(root, fc.chdir)
+		rfc.finddirs = nil
+		for _, dir := range fc.finddirs {
+			if fsCache.isDirIn(rfc.chdir, dir) {
+				rfc.finddirs = append(rfc.finddirs, dir)
+			}
+		}
+		if len(rfc.finddirs) == 0 {
+			continue
+		}
+		prefix := overlayFindPrefix(root, fc.chdir)
+		glog.V(2).Infof("find in overlay %s: prefix %q", root, prefix)
+		wb := newWbuf()
+		rfc.runDir(wb)
+		for _, word := range wb.words {
+			name := string(word)
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			switch {
+			case prefix == "":
+				w.writeWordString(name)
+			case name == ".":
+				w.writeWordString(prefix)
+			default:
+				w.writeWordString(filepath.Join(prefix, name))
+			}
+		}
+		wb.release()
+	}
+}
+
+// isDirIn reports whether dir in chdir exists.
+func (c *fsCacheT) isDirIn(chdir, dir string) bool {
+	id, _ := c.readdir(filepathClean(filepathJoin(chdir, dir)), unknownFileid)
+	return id != invalidFileid
+}
+
+// overlayFindPrefix returns the path of chdir in root, relative to
+// chdir.
+func overlayFindPrefix(root, chdir string) string {
+	switch {
+	case root == ".":
+		return ""
+	case chdir == "":
+		return root
+	case filepath.IsAbs(root):
+		return filepathJoin(root, chdir)
+	}
+	rel, err := filepath.Rel(chdir, filepath.Join(root, chdir))
+	if err != nil {
+		abs, err := filepath.Abs(filepath.Join(root, chdir))
+		if err != nil {
+			return filepathJoin(root, chdir)
+		}
+		return abs
+	}
+	return rel
+}
+
+// runOverlay runs findleaves in each overlay root. As in the union
+// view, a file under a directory having the file in another root is
+// dropped.
+func (fc findleavesCommand) runOverlay(w evalWriter) {
+	var files []struct{ file, name string }
+	seen := make(map[string]bool)
+	leafDirs := make(map[string]bool)
+	for _, root := range overlayRoots() {
+		rfc := fc
+		rfc.dirs = nil
+		for _, dir := range fc.dirs {
+			if filepath.IsAbs(dir) && root != "." {
+				continue
+			}
+			rfc.dirs = append(rfc.dirs, overlayJoin(root, dir))
+		}
+		wb := newWbuf()
+		rfc.runDir(wb)
+		for _, word := range wb.words {
+			file := string(word)
+			name := overlayName(root, file)
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			leafDirs[filepath.Dir(name)] = true
+			files = append(files, struct{ file, name string }{file, name})
+		}
+		wb.release()
+	}
+	for _, f := range files {
+		if hasLeafAncestor(leafDirs, filepath.Dir(f.name)) {
+			glog.V(2).Infof("findleaves overlay: drop %s", f.file)
+			continue
+		}
+		w.writeWordString(f.file)
+	}
+}
+
+// hasLeafAncestor reports whether a parent directory of dir is in
+// leafDirs.
+func hasLeafAncestor(leafDirs map[string]bool, dir string) bool {
+	for {
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return false
+		}
+		if leafDirs[parent] {
+			return true
+		}
+		dir = parent
+	}
+}
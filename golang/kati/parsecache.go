@@ -0,0 +1,337 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+)
+
+// parseCacheVersion is the version of the format of parse cache
+// files. Bump it when ASTs or serialized values change, including
+// any change of what the parser produces for the same makefile.
+// Cache files are also keyed by buildID, so a directory shared by
+// different kati binaries never returns ASTs of another parser.
+const parseCacheVersion = 5
+
+var parseCacheStats struct {
+	hits, misses int64
+}
+
+type serializableMakefile struct {
+	Stmts    []serializableAST
+	Warnings []serializableWarning
+}
+
+type serializableWarning struct {
+	Lineno   int
+	NoPrefix bool
+	Msg      string
+}
+
+type serializableAST struct {
+	Kind   string
+	Lineno int
+	// Op is the operator of assignAST, the directive of includeAST
+	// and ifAST.
+	Op string
+	// Opt is the option of assignAST.
+	Opt string
+	// Str is the command of commandAST, and the expression of
+	// includeAST.
+	Str string
+	// Bytes are the expression of exportAST, and the text after
+	// ';' of maybeRuleAST.
+	Bytes []byte
+	// Flag is isRule of maybeRuleAST, hasEqual of exportAST.
+	Flag   bool
+	Export bool
+	// HasSemi is true if maybeRuleAST has ';'.
+	HasSemi bool
+	Values  []serializableVar
+	Assign  *serializableAST
+	True    []serializableAST
+	False   []serializableAST
+}
+
+func serializeValue(v Value) serializableVar {
+	if v == nil {
+		return serializableVar{Type: "nil"}
+	}
+	return v.serialize()
+}
+
+func deserializeValue(sv serializableVar) (Value, error) {
+	if sv.Type == "nil" {
+		return nil, nil
+	}
+	return deserializeVar(sv)
+}
+
+func serializeASTs(stmts []ast) ([]serializableAST, error) {
+	var r []serializableAST
+	for _, stmt := range stmts {
+		s, err := serializeAST(stmt)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, s)
+	}
+	return r, nil
+}
+
+func serializeAST(stmt ast) (serializableAST, error) {
+	var s serializableAST
+	var err error
+	switch a := stmt.(type) {
+	case *assignAST:
+		s = serializableAST{
+			Kind:   "assign",
+			Lineno: a.lineno,
+			Op:     a.op,
+			Opt:    a.opt,
+			Values: []serializableVar{serializeValue(a.lhs), serializeValue(a.rhs)},
+		}
+	case *maybeRuleAST:
+		s = serializableAST{
+			Kind:    "rule",
+			Lineno:  a.lineno,
+			Bytes:   a.semi,
+			Flag:    a.isRule,
+			HasSemi: a.semi != nil,
+			Values:  []serializableVar{serializeValue(a.expr)},
+		}
+		if a.assign != nil {
+			as, err := serializeAST(a.assign)
+			if err != nil {
+				return s, err
+			}
+			s.Assign = &as
+		}
+	case *commandAST:
+		s = serializableAST{Kind: "command", Lineno: a.lineno, Str: a.cmd}
+	case *includeAST:
+		s = serializableAST{Kind: "include", Lineno: a.lineno, Op: a.op, Str: a.expr}
+	case *ifAST:
+		s = serializableAST{
+			Kind:   "if",
+			Lineno: a.lineno,
+			Op:     a.op,
+			Values: []serializableVar{serializeValue(a.lhs), serializeValue(a.rhs)},
+		}
+		s.True, err = serializeASTs(a.trueStmts)
+		if err != nil {
+			return s, err
+		}
+		s.False, err = serializeASTs(a.falseStmts)
+		if err != nil {
+			return s, err
+		}
+	case *exportAST:
+		s = serializableAST{
+			Kind:   "export",
+			Lineno: a.lineno,
+			Bytes:  a.expr,
+			Flag:   a.hasEqual,
+			Export: a.export,
+		}
+	case *vpathAST:
+		s = serializableAST{
+			Kind:   "vpath",
+			Lineno: a.lineno,
+			Values: []serializableVar{serializeValue(a.expr)},
+		}
+	default:
+		return s, fmt.Errorf("unknown ast %T", stmt)
+	}
+	return s, nil
+}
+
+func deserializeASTs(filename string, ss []serializableAST) ([]ast, error) {
+	var r []ast
+	for _, s := range ss {
+		stmt, err := deserializeAST(filename, s)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, stmt)
+	}
+	return r, nil
+}
+
+func deserializeAST(filename string, s serializableAST) (ast, error) {
+	pos := srcpos{filename: filename, lineno: s.Lineno}
+	var vals []Value
+	for _, sv := range s.Values {
+		v, err := deserializeValue(sv)
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, v)
+	}
+	nvals := map[string]int{
+		"assign": 2,
+		"rule":   1,
+		"if":     2,
+		"vpath":  1,
+	}[s.Kind]
+	if len(vals) != nvals {
+		return nil, fmt.Errorf("unexpected number of values of %s: %d", s.Kind, len(vals))
+	}
+	switch s.Kind {
+	case "assign":
+		return &assignAST{srcpos: pos, lhs: vals[0], rhs: vals[1], op: s.Op, opt: s.Opt}, nil
+	case "rule":
+		a := &maybeRuleAST{srcpos: pos, isRule: s.Flag, expr: vals[0]}
+		if s.HasSemi {
+			a.semi = s.Bytes
+			if a.semi == nil {
+				a.semi = []byte{}
+			}
+		}
+		if s.Assign != nil {
+			as, err := deserializeAST(filename, *s.Assign)
+			if err != nil {
+				return nil, err
+			}
+			assign, ok := as.(*assignAST)
+			if !ok {
+				return nil, fmt.Errorf("target specific variable is not assign: %T", as)
+			}
+			a.assign = assign
+		}
+		return a, nil
+	case "command":
+		return &commandAST{srcpos: pos, cmd: s.Str}, nil
+	case "include":
+		return &includeAST{srcpos: pos, expr: s.Str, op: s.Op}, nil
+	case "if":
+		a := &ifAST{srcpos: pos, op: s.Op, lhs: vals[0], rhs: vals[1]}
+		var err error
+		a.trueStmts, err = deserializeASTs(filename, s.True)
+		if err != nil {
+			return nil, err
+		}
+		a.falseStmts, err = deserializeASTs(filename, s.False)
+		if err != nil {
+			return nil, err
+		}
+		return a, nil
+	case "export":
+		return &exportAST{srcpos: pos, expr: s.Bytes, hasEqual: s.Flag, export: s.Export}, nil
+	case "vpath":
+		return &vpathAST{srcpos: pos, expr: vals[0]}, nil
+	}
+	return nil, fmt.Errorf("unknown ast kind %q", s.Kind)
+}
+
+// parseCacheFile returns the file in ParseCacheDir for a makefile
+// whose content has hash, parsed starting with recipePrefix.
+func parseCacheFile(hash [sha1.Size]byte, recipePrefix byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%d\x00%s\x00%x\x00%c", parseCacheVersion, buildID(), hash, recipePrefix)
+	return filepath.Join(ParseCacheDir, fmt.Sprintf("%x.mkast", h.Sum(nil)))
+}
+
+// parseMakefileCached parses c, the content of filename whose hash is
+// hash, or loads it from ParseCacheDir. Errors of the cache are
+// ignored, as the makefile can be parsed anyway.
+func parseMakefileCached(c []byte, hash [sha1.Size]byte, filename string, recipePrefix byte) (makefile, error) {
+	defer startPhase(phaseParse)()
+	if ParseCacheDir == "" {
+		return parseMakefile(c, filename, recipePrefix)
+	}
+	cacheFile := parseCacheFile(hash, recipePrefix)
+	if b, err := ioutil.ReadFile(cacheFile); err == nil {
+		var sm serializableMakefile
+		err = gob.NewDecoder(bytes.NewReader(b)).Decode(&sm)
+		if err == nil {
+			mk := makefile{filename: filename}
+			mk.stmts, err = deserializeASTs(filename, sm.Stmts)
+			if err == nil {
+				atomic.AddInt64(&parseCacheStats.hits, 1)
+				glog.V(1).Infof("parse cache hit for %q: %s", filename, cacheFile)
+				for _, sw := range sm.Warnings {
+					w := parseWarning{lineno: sw.Lineno, noPrefix: sw.NoPrefix, msg: sw.Msg}
+					w.show(filename)
+					mk.warnings = append(mk.warnings, w)
+				}
+				return mk, nil
+			}
+		}
+		glog.Warningf("parse cache %s for %q: %v", cacheFile, filename, err)
+	}
+	atomic.AddInt64(&parseCacheStats.misses, 1)
+	mk, err := parseMakefile(c, filename, recipePrefix)
+	if err != nil {
+		return mk, err
+	}
+	err = saveParseCache(cacheFile, mk)
+	if err != nil {
+		glog.Warningf("parse cache %s for %q: %v", cacheFile, filename, err)
+	}
+	return mk, nil
+}
+
+// saveParseCache writes mk to cacheFile. It's written to a temporary
+// file and renamed, so other processes never read a partial file.
+func saveParseCache(cacheFile string, mk makefile) error {
+	var sm serializableMakefile
+	var err error
+	sm.Stmts, err = serializeASTs(mk.stmts)
+	if err != nil {
+		return err
+	}
+	for _, w := range mk.warnings {
+		sm.Warnings = append(sm.Warnings, serializableWarning{
+			Lineno:   w.lineno,
+			NoPrefix: w.noPrefix,
+			Msg:      w.msg,
+		})
+	}
+	var buf bytes.Buffer
+	err = gob.NewEncoder(&buf).Encode(sm)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(ParseCacheDir, 0755)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(ParseCacheDir, ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	cerr := f.Close()
+	if err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), cacheFile)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
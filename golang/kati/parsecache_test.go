@@ -0,0 +1,174 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseCacheRoundTrip(t *testing.T) {
+	mks, err := filepath.Glob("../../testcase/*.mk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mks) == 0 {
+		t.Fatal("no makefiles in testcase")
+	}
+	for _, mk := range mks {
+		c, err := ioutil.ReadFile(mk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := parseMakefileNoPanic(c, mk)
+		if err != nil {
+			// Parse errors are not cached.
+			continue
+		}
+		ss, err := serializeASTs(want.stmts)
+		if err != nil {
+			t.Errorf("%s: serializeASTs: %v", mk, err)
+			continue
+		}
+		got, err := deserializeASTs(mk, ss)
+		if err != nil {
+			t.Errorf("%s: deserializeASTs: %v", mk, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want.stmts) {
+			t.Errorf("%s: ASTs differ after round trip", mk)
+		}
+	}
+}
+
+// parseMakefileNoPanic parses c, and returns an error if the parser
+// panics, as it does for a few broken makefiles in testcase.
+func parseMakefileNoPanic(c []byte, filename string) (mk makefile, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return parseMakefile(c, filename, defaultRecipePrefix)
+}
+
+func TestParseCacheDir(t *testing.T) {
+	dir := chdirTemp(t, nil)
+	defer func(d string) { ParseCacheDir = d }(ParseCacheDir)
+	ParseCacheDir = dir
+	defer func(hits, misses int64) {
+		parseCacheStats.hits, parseCacheStats.misses = hits, misses
+	}(parseCacheStats.hits, parseCacheStats.misses)
+	parseCacheStats.hits, parseCacheStats.misses = 0, 0
+
+	c := []byte("A := $(shell echo a)\nall: ; echo $(A)\n")
+	hash := sha1.Sum(c)
+	want, err := parseMakefile(c, "a.mk", defaultRecipePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, filename := range []string{"a.mk", "a.mk", "b.mk"} {
+		mk, err := parseMakefileCached(c, hash, filename, defaultRecipePrefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mk.filename != filename {
+			t.Errorf("%d: filename=%q; want %q", i, mk.filename, filename)
+		}
+		if filename == "a.mk" && !reflect.DeepEqual(mk, want) {
+			t.Errorf("%d: parseMakefileCached(%q)=%#v; want %#v", i, filename, mk, want)
+		}
+	}
+	if parseCacheStats.hits != 2 || parseCacheStats.misses != 1 {
+		t.Errorf("hits=%d misses=%d; want 2 and 1", parseCacheStats.hits, parseCacheStats.misses)
+	}
+
+	// A broken cache file is ignored.
+	err = ioutil.WriteFile(parseCacheFile(hash, defaultRecipePrefix), []byte("broken"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mk, err := parseMakefileCached(c, hash, "a.mk", defaultRecipePrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(mk, want) {
+		t.Errorf("parseMakefileCached with broken cache=%#v; want %#v", mk, want)
+	}
+}
+
+func TestMakefileCacheHash(t *testing.T) {
+	dir := chdirTemp(t, nil)
+	filename := filepath.Join(dir, "a.mk")
+	mc := &makefileCacheT{
+		mk: make(map[string]mkCacheEntry),
+	}
+	parse := func(content string, mtime time.Time) makefile {
+		t.Helper()
+		err := ioutil.WriteFile(filename, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.Chtimes(filename, mtime, mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mk, _, err := mc.parse(filename, defaultRecipePrefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mk
+	}
+
+	past := time.Unix(946684800, 0)
+	first := parse("A := 1\n", past)
+	// Same contents with a newer mtime.
+	mk := parse("A := 1\n", time.Now().Add(time.Hour))
+	if &mk.stmts[0] != &first.stmts[0] {
+		t.Errorf("makefile with the same contents was parsed again")
+	}
+	// Other contents with the old mtime.
+	mk = parse("A := 2\n", past)
+	if got, want := mk.stmts[0].(*assignAST).rhs.String(), "2"; got != want {
+		t.Errorf("rhs=%q; want %q", got, want)
+	}
+}
+
+func TestParseCacheFileBuildID(t *testing.T) {
+	defer func(v string) {
+		gitVersion = v
+		buildIDOnce = sync.Once{}
+	}(gitVersion)
+	var hash [sha1.Size]byte
+	files := make(map[string]bool)
+	for _, v := range []string{"v1", "v2", ""} {
+		gitVersion = v
+		buildIDOnce = sync.Once{}
+		if buildID() == "" {
+			t.Errorf("buildID()=%q with gitVersion=%q", "", v)
+		}
+		files[parseCacheFile(hash, defaultRecipePrefix)] = true
+	}
+	if len(files) != 3 {
+		t.Errorf("parseCacheFile is shared by different builds: %v", files)
+	}
+}
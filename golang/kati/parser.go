@@ -29,7 +29,6 @@ import (
 	"io/ioutil"
 	"strings"
 	"sync"
-	"time"
 
 	"github.com/golang/glog"
 )
@@ -37,6 +36,15 @@ import (
 type makefile struct {
 	filename string
 	stmts    []ast
+	// warnings are shown while parsing, kept to show them again
+	// when the makefile is loaded from ParseCacheDir.
+	warnings []parseWarning
+}
+
+type parseWarning struct {
+	lineno   int
+	noPrefix bool
+	msg      string
 }
 
 type ifState struct {
@@ -62,11 +70,31 @@ type parser struct {
 	defOpt    string
 	numIfNest int
 	err       error
+
+	// recipePrefix is the first character of command lines, given by
+	// .RECIPEPREFIX. It is tab if .RECIPEPREFIX is empty.
+	recipePrefix    byte
+	recipePrefixSet bool
 }
 
-func newParser(rd io.Reader, filename string) *parser {
+// defaultRecipePrefix is the recipe prefix when .RECIPEPREFIX is
+// empty.
+const defaultRecipePrefix = '\t'
+
+// utf8BOM is skipped at the beginning of makefiles, as GNU make does.
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// newParser returns a parser of filename. recipePrefix is the recipe
+// prefix when the parser starts, as .RECIPEPREFIX is global in GNU
+// make, and applies to included and evaluated makefiles.
+func newParser(rd io.Reader, filename string, recipePrefix byte) *parser {
 	p := &parser{
-		rd: bufio.NewReader(rd),
+		rd:              bufio.NewReader(rd),
+		recipePrefix:    recipePrefix,
+		recipePrefixSet: recipePrefix != defaultRecipePrefix,
+	}
+	if b, err := p.rd.Peek(len(utf8BOM)); err == nil && bytes.Equal(b, utf8BOM) {
+		p.rd.Discard(len(utf8BOM))
 	}
 	p.mk.filename = filename
 	p.outStmts = &p.mk.stmts
@@ -106,6 +134,11 @@ func (p *parser) readLine() []byte {
 			p.err = fmt.Errorf("readline %s: %v", p.srcpos(), err)
 			p.done = true
 		}
+		// CRLF is read as LF, also in continued lines, define
+		// bodies and recipes.
+		if bytes.HasSuffix(buf, []byte("\r\n")) {
+			buf = append(buf[:len(buf)-2], '\n')
+		}
 		line = append(line, buf...)
 		buf = bytes.TrimRight(buf, "\r\n")
 		glog.V(4).Infof("buf:%q", buf)
@@ -211,6 +244,47 @@ func (p *parser) parseAssign(line []byte, sep int) {
 	}
 	aast.srcpos = p.srcpos()
 	p.addStatement(aast)
+	if string(lhs) == ".RECIPEPREFIX" {
+		p.setRecipePrefix(string(op), aast.rhs)
+	}
+}
+
+// setRecipePrefix updates recipePrefix by an assignment to
+// .RECIPEPREFIX, which takes effect from the next line as GNU make.
+// Only literal values are supported, as the parser can't evaluate
+// variable references.
+func (p *parser) setRecipePrefix(op string, rhs Value) {
+	var s string
+	switch v := rhs.(type) {
+	case literal:
+		s = string(v)
+	case tmpval:
+		s = string(v)
+	case expr:
+		if len(v) > 0 {
+			p.warn(false, ".RECIPEPREFIX %q is not a literal, ignored", rhs.String())
+			return
+		}
+	default:
+		p.warn(false, ".RECIPEPREFIX %q is not a literal, ignored", rhs.String())
+		return
+	}
+	switch op {
+	case "?=":
+		if p.recipePrefixSet {
+			return
+		}
+	case "+=":
+		if p.recipePrefixSet && p.recipePrefix != defaultRecipePrefix {
+			return
+		}
+	}
+	p.recipePrefixSet = true
+	if s == "" {
+		p.recipePrefix = defaultRecipePrefix
+		return
+	}
+	p.recipePrefix = s[0]
 }
 
 func (p *parser) parseMaybeRule(line, semi []byte) {
@@ -218,7 +292,7 @@ func (p *parser) parseMaybeRule(line, semi []byte) {
 		p.err = p.srcpos().errorf("*** missing rule before commands.")
 		return
 	}
-	if line[0] == '\t' {
+	if line[0] == p.recipePrefix {
 		p.err = p.srcpos().errorf("*** commands commence before first target.")
 		return
 	}
@@ -227,7 +301,8 @@ func (p *parser) parseMaybeRule(line, semi []byte) {
 	if ci >= 0 {
 		eqi := findLiteralChar(line[ci+1:], '=', 0, skipVar)
 		if eqi == 0 {
-			panic(fmt.Sprintf("unexpected eq after colon: %q", line))
+			p.err = p.srcpos().errorf("*** unexpected eq after colon: %q", line)
+			return
 		}
 		if eqi > 0 {
 			var lhsbytes []byte
@@ -241,6 +316,16 @@ func (p *parser) parseMaybeRule(line, semi []byte) {
 			}
 
 			lhsbytes = trimSpaceBytes(lhsbytes)
+			// e.g. "foo: export A := a". "override" makes
+			// the origin of the variable "override".
+			var opt string
+			if w, rest := firstWord(lhsbytes); len(rest) > 0 {
+				switch string(w) {
+				case "export", "override":
+					opt = string(w)
+					lhsbytes = trimSpaceBytes(rest)
+				}
+			}
 			lhs, _, err := parseExpr(lhsbytes, nil, parseOp{})
 			if err != nil {
 				p.err = p.srcpos().error(err)
@@ -260,11 +345,11 @@ func (p *parser) parseMaybeRule(line, semi []byte) {
 				return
 			}
 
-			// TODO(ukai): support override, export in target specific var.
 			assign = &assignAST{
 				lhs: lhs,
 				rhs: rhs,
 				op:  op,
+				opt: opt,
 			}
 			assign.srcpos = p.srcpos()
 			line = line[:ci+1]
@@ -337,6 +422,11 @@ func (p *parser) parseTwoQuotes(s []byte) (string, string, []byte, bool) {
 // parse
 //  "(lhs, rhs)"
 //  "lhs, rhs"
+// As GNU make, only parentheses are counted to find the comma and the
+// closing parenthesis, e.g. "(${f a,b},c)" is split at the first comma.
+// Blanks are trimmed as GNU make does before expansion: after lhs and
+// before rhs, but not before lhs nor after rhs, so "( a , b )"
+// compares " a" with "b ".
 func (p *parser) parseEq(s []byte) (string, string, []byte, bool) {
 	if len(s) == 0 {
 		return "", "", nil, false
@@ -344,23 +434,21 @@ func (p *parser) parseEq(s []byte) (string, string, []byte, bool) {
 	if s[0] == '(' {
 		in := s[1:]
 		glog.V(1).Infof("parseEq ( %q )", in)
-		term := []byte{','}
-		v, n, err := parseExpr(in, term, parseOp{matchParen: true})
-		if err != nil {
-			glog.V(1).Infof("parse eq: %q: %v", in, err)
+		n := eqArgEnd(in, ',')
+		if n < 0 {
+			glog.V(1).Infof("parse eq: %q: no comma", in)
 			return "", "", nil, false
 		}
-		lhs := v.String()
+		lhs := string(bytes.TrimRight(in[:n], " \t"))
 		n++
 		n += skipSpaces(in[n:], nil)
-		term = []byte{')'}
 		in = in[n:]
-		v, n, err = parseExpr(in, term, parseOp{matchParen: true})
-		if err != nil {
-			glog.V(1).Infof("parse eq 2nd: %q: %v", in, err)
+		n = eqArgEnd(in, ')')
+		if n < 0 {
+			glog.V(1).Infof("parse eq 2nd: %q: no close paren", in)
 			return "", "", nil, false
 		}
-		rhs := v.String()
+		rhs := string(in[:n])
 		in = in[n+1:]
 		in = trimSpaceBytes(in)
 		return lhs, rhs, in, true
@@ -368,6 +456,29 @@ func (p *parser) parseEq(s []byte) (string, string, []byte, bool) {
 	return p.parseTwoQuotes(s)
 }
 
+// eqArgEnd returns the index of term ending an argument of "(lhs, rhs)"
+// in s, or -1 if not found. term in nested parentheses is skipped,
+// but a comma after an unbalanced ')' ends lhs, as GNU make.
+func eqArgEnd(s []byte, term byte) int {
+	depth := 0
+	for i, ch := range s {
+		switch ch {
+		case '(':
+			depth++
+		case ')':
+			if term == ')' && depth <= 0 {
+				return i
+			}
+			depth--
+		case ',':
+			if term == ',' && depth <= 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
 func (p *parser) parseIfeq(op string, data []byte) {
 	lhsBytes, rhsBytes, extra, ok := p.parseEq(data)
 	if !ok {
@@ -376,7 +487,7 @@ func (p *parser) parseIfeq(op string, data []byte) {
 	}
 	if len(extra) > 0 {
 		glog.V(1).Infof("extra %q", extra)
-		warnNoPrefix(p.srcpos(), `extraneous text after %q directive`, op)
+		p.warn(true, `extraneous text after %q directive`, op)
 	}
 
 	lhs, _, err := parseExpr([]byte(lhsBytes), nil, parseOp{matchParen: true})
@@ -438,7 +549,7 @@ func (p *parser) parseElse(data []byte) {
 		return
 	}
 	p.numIfNest = 0
-	warnNoPrefix(p.srcpos(), "extraneous text after `else' directive")
+	p.warn(true, "extraneous text after `else' directive")
 	return
 }
 
@@ -463,7 +574,7 @@ func (p *parser) parseEndif(data []byte) {
 		}
 	}
 	if len(trimSpaceBytes(data)) > 0 {
-		warnNoPrefix(p.srcpos(), "extraneous text after `endif' directive")
+		p.warn(true, "extraneous text after `endif' directive")
 	}
 	return
 }
@@ -599,6 +710,10 @@ func exportDirective(p *parser, data []byte) {
 	}
 	glog.V(1).Infof("export define? %q", data)
 	if p.handleDirective(data, defineDirective) {
+		// e.g. export define foo
+		// same as "export foo = ..." with the body of define.
+		_, name := firstWord(data)
+		handleExport(p, name, true)
 		return
 	}
 
@@ -635,8 +750,14 @@ func (p *parser) parse() (mk makefile, err error) {
 		}
 		p.defOpt = ""
 		if p.inRecipe {
-			if len(line) > 0 && line[0] == '\t' {
-				cast := &commandAST{cmd: string(line[1:])}
+			if len(line) > 0 && line[0] == p.recipePrefix {
+				cmd := line[1:]
+				if p.recipePrefix != '\t' {
+					// The prefix after backslash-newline is
+					// removed as tab is.
+					cmd = bytes.Replace(cmd, []byte{'\\', '\n', p.recipePrefix}, []byte("\\\n\t"), -1)
+				}
+				cast := &commandAST{cmd: string(cmd)}
 				cast.srcpos = p.srcpos()
 				p.addStatement(cast)
 				continue
@@ -650,6 +771,27 @@ func (p *parser) parse() (mk makefile, err error) {
 	return p.mk, p.err
 }
 
+// warn shows a warning at the current line, with "warning: " unless
+// noPrefix is true.
+func (p *parser) warn(noPrefix bool, format string, a ...interface{}) {
+	w := parseWarning{
+		lineno:   p.lineno,
+		noPrefix: noPrefix,
+		msg:      fmt.Sprintf(format, a...),
+	}
+	p.mk.warnings = append(p.mk.warnings, w)
+	w.show(p.mk.filename)
+}
+
+func (w parseWarning) show(filename string) {
+	loc := srcpos{filename: filename, lineno: w.lineno}
+	if w.noPrefix {
+		warnNoPrefix(loc, "%s", w.msg)
+		return
+	}
+	warn(loc, "%s", w.msg)
+}
+
 func (p *parser) parseLine(line []byte) {
 	cline := concatline(line)
 	if len(cline) == 0 {
@@ -693,7 +835,7 @@ func (p *parser) processDefine(line []byte) {
 		}
 		return
 	}
-	if p.inDef[len(p.inDef)-1] == '\n' {
+	if len(p.inDef) > 0 && p.inDef[len(p.inDef)-1] == '\n' {
 		p.inDef = p.inDef[:len(p.inDef)-1]
 	}
 	glog.V(1).Infof("multilineAssign %q %q", p.defineVar, p.inDef)
@@ -719,7 +861,7 @@ func (p *parser) isEndef(line []byte) bool {
 		data, _ = removeComment(data)
 		data = trimLeftSpaceBytes(data)
 		if len(data) > 0 {
-			warnNoPrefix(p.srcpos(), `extraneous text after "endef" directive`)
+			p.warn(true, `extraneous text after "endef" directive`)
 		}
 		return true
 	}
@@ -736,86 +878,102 @@ func defaultMakefile() (string, error) {
 	return "", errors.New("no targets specified and no makefile found")
 }
 
-func parseMakefileReader(rd io.Reader, loc srcpos) (makefile, error) {
-	parser := newParser(rd, loc.filename)
+func parseMakefileReader(rd io.Reader, loc srcpos, recipePrefix byte) (makefile, error) {
+	parser := newParser(rd, loc.filename, recipePrefix)
 	parser.lineno = loc.lineno
 	parser.elineno = loc.lineno
 	parser.linenoFixed = true
 	return parser.parse()
 }
 
-func parseMakefileString(s string, loc srcpos) (makefile, error) {
-	return parseMakefileReader(strings.NewReader(s), loc)
+func parseMakefileString(s string, loc srcpos, recipePrefix byte) (makefile, error) {
+	return parseMakefileReader(strings.NewReader(s), loc, recipePrefix)
 }
 
-func parseMakefileBytes(s []byte, loc srcpos) (makefile, error) {
-	return parseMakefileReader(bytes.NewReader(s), loc)
+func parseMakefileBytes(s []byte, loc srcpos, recipePrefix byte) (makefile, error) {
+	return parseMakefileReader(bytes.NewReader(s), loc, recipePrefix)
 }
 
 type mkCacheEntry struct {
-	mk   makefile
-	hash [sha1.Size]byte
-	err  error
-	ts   int64
+	mk           makefile
+	hash         [sha1.Size]byte
+	recipePrefix byte
+	err          error
 }
 
+// makefileCacheT keeps makefiles parsed while kati runs. An entry is
+// valid while the file has the same sha1, as accessed makefiles are
+// validated for the cache, since mtimes may be preserved or skewed by
+// checkout tools.
 type makefileCacheT struct {
 	mu sync.Mutex
 	mk map[string]mkCacheEntry
+	// disabled is true after drop, and parsed makefiles are not
+	// kept any more.
+	disabled bool
 }
 
 var makefileCache = &makefileCacheT{
 	mk: make(map[string]mkCacheEntry),
 }
 
-func (mc *makefileCacheT) lookup(filename string) (makefile, [sha1.Size]byte, bool, error) {
-	var hash [sha1.Size]byte
+func (mc *makefileCacheT) lookup(filename string, hash [sha1.Size]byte, recipePrefix byte) (makefile, bool, error) {
 	mc.mu.Lock()
 	c, present := mc.mk[filename]
 	mc.mu.Unlock()
-	if !present {
-		return makefile{}, hash, false, nil
-	}
-	ts := getTimestamp(filename)
-	if ts < 0 || ts >= c.ts {
-		return makefile{}, hash, false, nil
+	if !present || c.hash != hash || c.recipePrefix != recipePrefix {
+		return makefile{}, false, nil
 	}
-	return c.mk, c.hash, true, c.err
+	return c.mk, true, c.err
 }
 
-func (mc *makefileCacheT) parse(filename string) (makefile, [sha1.Size]byte, error) {
+// parse parses filename, starting with recipePrefix.
+func (mc *makefileCacheT) parse(filename string, recipePrefix byte) (makefile, [sha1.Size]byte, error) {
 	glog.Infof("parse Makefile %q", filename)
-	mk, hash, ok, err := makefileCache.lookup(filename)
-	if ok {
-		if glog.V(1) {
-			glog.Infof("makefile cache hit for %q", filename)
-		}
-		return mk, hash, err
-	}
 	if glog.V(1) {
 		glog.Infof("reading makefile %q", filename)
 	}
 	c, err := ioutil.ReadFile(filename)
 	if err != nil {
-		return makefile{}, hash, err
+		return makefile{}, [sha1.Size]byte{}, err
 	}
-	hash = sha1.Sum(c)
-	mk, err = parseMakefile(c, filename)
+	hash := sha1.Sum(c)
+	mk, ok, err := mc.lookup(filename, hash, recipePrefix)
+	if ok {
+		if glog.V(1) {
+			glog.Infof("makefile cache hit for %q", filename)
+		}
+		return mk, hash, err
+	}
+	mk, err = parseMakefileCached(c, hash, filename, recipePrefix)
 	if err != nil {
 		return makefile{}, hash, err
 	}
-	makefileCache.mu.Lock()
-	makefileCache.mk[filename] = mkCacheEntry{
-		mk:   mk,
-		hash: hash,
-		err:  err,
-		ts:   time.Now().Unix(),
+	mc.mu.Lock()
+	if !mc.disabled {
+		mc.mk[filename] = mkCacheEntry{
+			mk:           mk,
+			hash:         hash,
+			recipePrefix: recipePrefix,
+			err:          err,
+		}
 	}
-	makefileCache.mu.Unlock()
+	mc.mu.Unlock()
 	return mk, hash, err
 }
 
-func parseMakefile(s []byte, filename string) (makefile, error) {
-	parser := newParser(bytes.NewReader(s), filename)
+// drop removes cached makefiles and disables the cache, to save
+// memory. It returns the number of makefiles removed.
+func (mc *makefileCacheT) drop() int {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+	n := len(mc.mk)
+	mc.mk = make(map[string]mkCacheEntry)
+	mc.disabled = true
+	return n
+}
+
+func parseMakefile(s []byte, filename string, recipePrefix byte) (makefile, error) {
+	parser := newParser(bytes.NewReader(s), filename, recipePrefix)
 	return parser.parse()
 }
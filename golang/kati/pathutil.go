@@ -16,11 +16,13 @@ package kati
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -43,6 +45,10 @@ type dirent struct {
 	name  string
 	lmode os.FileMode
 	mode  os.FileMode
+	// mtime is the modification time in unix seconds, following
+	// symlinks. -2 if the file doesn't exist, e.g. a dangling
+	// symlink.
+	mtime int64
 	// add other fields to support more find commands?
 }
 
@@ -50,13 +56,25 @@ type fsCacheT struct {
 	mu      sync.Mutex
 	ids     map[string]fileid
 	dirents map[fileid][]dirent
+
+	// accessed records directories read while tracing.
+	// nil if tracing is not enabled.
+	accessed map[string]bool
+
+	// disabled is true after drop, and directories are read each
+	// time.
+	disabled bool
 }
 
-var fsCache = &fsCacheT{
-	ids: make(map[string]fileid),
-	dirents: map[fileid][]dirent{
-		invalidFileid: nil,
-	},
+var fsCache = newFsCache()
+
+func newFsCache() *fsCacheT {
+	return &fsCacheT{
+		ids: make(map[string]fileid),
+		dirents: map[fileid][]dirent{
+			invalidFileid: nil,
+		},
+	}
 }
 
 func init() {
@@ -79,6 +97,87 @@ func (c *fsCacheT) files() int {
 	return n
 }
 
+// startTrace starts recording directories read, e.g. by the find
+// emulator. Globs recorded by their patterns use untracedGlob.
+func (c *fsCacheT) startTrace() {
+	c.mu.Lock()
+	c.accessed = make(map[string]bool)
+	c.mu.Unlock()
+}
+
+// stopTrace stops recording and returns directories read since
+// startTrace, sorted by name.
+func (c *fsCacheT) stopTrace() []string {
+	c.mu.Lock()
+	accessed := c.accessed
+	c.accessed = nil
+	c.mu.Unlock()
+	var dirs []string
+	for dir := range accessed {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// dirHash returns sha1 of names in dir, and whether dir exists.
+func (c *fsCacheT) dirHash(dir string) ([sha1.Size]byte, bool) {
+	id, ents := c.readdir(dir, unknownFileid)
+	if id == invalidFileid {
+		return [sha1.Size]byte{}, false
+	}
+	var names []string
+	for _, ent := range ents {
+		names = append(names, ent.name)
+	}
+	sort.Strings(names)
+	return sha1.Sum([]byte(strings.Join(names, "\n"))), true
+}
+
+// isDir reports whether path is a directory, following symlinks,
+// using the dirents of its parent directory.
+func (c *fsCacheT) isDir(path string) bool {
+	dir, base := filepath.Split(filepath.Clean(path))
+	if dir == "" {
+		dir = "."
+	}
+	_, ents := c.readdir(filepath.Clean(dir), unknownFileid)
+	for _, ent := range ents {
+		if ent.name == base {
+			return ent.mode.IsDir()
+		}
+	}
+	return false
+}
+
+// listFiles returns files under dir recursively, and directories
+// read to list them, both sorted by name. Symlinks to directories
+// are followed once.
+func (c *fsCacheT) listFiles(dir string) (files, dirs []string) {
+	seen := make(map[fileid]bool)
+	var walk func(dir string)
+	walk = func(dir string) {
+		id, ents := c.readdir(dir, unknownFileid)
+		if id == invalidFileid || seen[id] {
+			return
+		}
+		seen[id] = true
+		dirs = append(dirs, dir)
+		for _, ent := range ents {
+			path := filepath.Join(dir, ent.name)
+			if ent.mode.IsDir() {
+				walk(path)
+				continue
+			}
+			files = append(files, path)
+		}
+	}
+	walk(filepath.Clean(dir))
+	sort.Strings(files)
+	sort.Strings(dirs)
+	return files, dirs
+}
+
 func hasWildcardMeta(pat string) bool {
 	return strings.IndexAny(pat, "*?[") >= 0
 }
@@ -166,6 +265,9 @@ func (c *fsCacheT) fileid(dir string) fileid {
 func (c *fsCacheT) readdir(dir string, id fileid) (fileid, []dirent) {
 	glog.V(3).Infof("readdir: %s [%v]", dir, id)
 	c.mu.Lock()
+	if c.accessed != nil {
+		c.accessed[dir] = true
+	}
 	if id == unknownFileid {
 		id = c.ids[dir]
 	}
@@ -202,11 +304,12 @@ func (c *fsCacheT) readdir(dir string, id fileid) (fileid, []dirent) {
 		fi, err := os.Lstat(path)
 		if err != nil {
 			glog.Warningf("readdir %s: %v", name, err)
-			ents = append(ents, dirent{name: name})
+			ents = append(ents, dirent{name: name, mtime: -2})
 			continue
 		}
 		lmode := fi.Mode()
 		mode := lmode
+		mtime := fi.ModTime().Unix()
 		var id fileid
 		if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
 			id = fileid{dev: uint64(stat.Dev), ino: stat.Ino}
@@ -215,23 +318,76 @@ func (c *fsCacheT) readdir(dir string, id fileid) (fileid, []dirent) {
 			fi, err = os.Stat(path)
 			if err != nil {
 				glog.Warningf("readdir %s: %v", name, err)
+				mtime = -2
 			} else {
 				mode = fi.Mode()
+				mtime = fi.ModTime().Unix()
 				if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
 					id = fileid{dev: uint64(stat.Dev), ino: stat.Ino}
 				}
 			}
 		}
-		ents = append(ents, dirent{id: id, name: name, lmode: lmode, mode: mode})
+		ents = append(ents, dirent{id: id, name: name, lmode: lmode, mode: mode, mtime: mtime})
 	}
 	glog.V(3).Infof("readdir:%s => %v: %v", dir, id, ents)
 	c.mu.Lock()
-	c.ids[dir] = id
-	c.dirents[id] = ents
+	if !c.disabled {
+		c.ids[dir] = id
+		c.dirents[id] = ents
+	}
 	c.mu.Unlock()
 	return id, ents
 }
 
+// drop removes cached directories and disables the cache, to save
+// memory. It returns the numbers of directories and files removed.
+func (c *fsCacheT) drop() (dirs, files int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, ents := range c.dirents {
+		files += len(ents)
+	}
+	dirs = len(c.dirents) - 1
+	c.ids = make(map[string]fileid)
+	c.dirents = map[fileid][]dirent{
+		invalidFileid: nil,
+	}
+	c.disabled = true
+	return dirs, files
+}
+
+// timestamp returns the modification time of filename in unix seconds,
+// or -2 if it doesn't exist. It uses the mtime in the cached dirents
+// of the directory if any, which were read while loading makefiles,
+// and calls stat only if the directory or the file is not cached.
+func (c *fsCacheT) timestamp(filename string) int64 {
+	dir, base := filepath.Split(filename)
+	if dir == "" {
+		dir = "."
+	}
+	c.mu.Lock()
+	id, ok := c.ids[filepathClean(dir)]
+	var ents []dirent
+	if ok {
+		ents, ok = c.dirents[id]
+	}
+	c.mu.Unlock()
+	if ok && id != invalidFileid {
+		for _, ent := range ents {
+			if ent.name == base && ent.mtime >= 0 {
+				timestampStats.add(true)
+				return ent.mtime
+			}
+		}
+	}
+	timestampStats.add(false)
+	st, err := os.Stat(filename)
+	if err != nil {
+		return -2
+	}
+	return st.ModTime().Unix()
+}
+
 // glob searches for files matching pattern in the directory dir
 // and appends them to matches. ignore I/O errors.
 func (c *fsCacheT) glob(dir, pattern string, matches []string) ([]string, error) {
@@ -254,11 +410,40 @@ func (c *fsCacheT) glob(dir, pattern string, matches []string) ([]string, error)
 	return matches, nil
 }
 
+// untracedGlob is Glob without recording directories it reads while
+// tracing, for patterns recorded in the stamp by themselves.
+func (c *fsCacheT) untracedGlob(pat string) ([]string, error) {
+	c.mu.Lock()
+	accessed := c.accessed
+	c.accessed = nil
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.accessed = accessed
+		c.mu.Unlock()
+	}()
+	return c.Glob(pat)
+}
+
+// Glob returns files matching pat, in the union view of OverlayDirs
+// if set.
 func (c *fsCacheT) Glob(pat string) ([]string, error) {
+	if len(OverlayDirs) == 0 || filepath.IsAbs(pat) {
+		return c.globPath(pat)
+	}
+	return c.overlayGlob(pat)
+}
+
+func (c *fsCacheT) globPath(pat string) ([]string, error) {
 	// TODO(ukai): expand ~ to user's home directory.
 	// TODO(ukai): use find cache for glob if exists
 	// or use wildcardCache for find cache.
 	pat = wildcardUnescape(pat)
+	if Globstar {
+		if base, rest, ok := splitGlobstar(pat); ok {
+			return c.globstar(base, rest)
+		}
+	}
 	dir, file := filepath.Split(pat)
 	switch dir {
 	case "", string(filepath.Separator):
@@ -270,7 +455,7 @@ func (c *fsCacheT) Glob(pat string) ([]string, error) {
 		return c.glob(dir, file, nil)
 	}
 
-	m, err := c.Glob(dir)
+	m, err := c.globPath(dir)
 	if err != nil {
 		return nil, err
 	}
@@ -284,15 +469,78 @@ func (c *fsCacheT) Glob(pat string) ([]string, error) {
 	return matches, nil
 }
 
-func wildcard(w evalWriter, pat string) error {
-	files, err := fsCache.Glob(pat)
-	if err != nil {
-		return err
+// splitGlobstar splits pat at the first "**" path component into
+// the base directory and the rest of the pattern.
+func splitGlobstar(pat string) (base, rest string, ok bool) {
+	comps := strings.Split(pat, string(filepath.Separator))
+	for i, comp := range comps {
+		if comp != "**" {
+			continue
+		}
+		base = strings.Join(comps[:i], string(filepath.Separator))
+		if i > 0 && base == "" {
+			base = string(filepath.Separator)
+		}
+		return base, strings.Join(comps[i+1:], string(filepath.Separator)), true
 	}
-	for _, file := range files {
-		w.writeWordString(file)
+	return "", "", false
+}
+
+// globstar returns files matching base/**/rest, where "**" matches
+// zero or more directories. As bash's globstar does, it doesn't follow
+// symlinks nor descend into hidden directories. Trailing "**" matches
+// all files and directories under base.
+func (c *fsCacheT) globstar(base, rest string) ([]string, error) {
+	if rest == "" {
+		rest = "*"
 	}
-	return nil
+	bases := []string{base}
+	if hasWildcardMeta(base) {
+		var err error
+		bases, err = c.globPath(base)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var matches []string
+	for _, b := range bases {
+		for _, d := range c.subdirs(b, nil) {
+			pat := rest
+			switch d {
+			case "":
+			case string(filepath.Separator):
+				pat = d + rest
+			default:
+				pat = d + string(filepath.Separator) + rest
+			}
+			m, err := c.globPath(pat)
+			if err != nil {
+				return nil, err
+			}
+			matches = append(matches, m...)
+		}
+	}
+	return matches, nil
+}
+
+// subdirs appends dir and its subdirectories to dirs recursively.
+func (c *fsCacheT) subdirs(dir string, dirs []string) []string {
+	dirs = append(dirs, dir)
+	_, ents := c.readdir(filepathClean(dir), unknownFileid)
+	for _, ent := range ents {
+		if !ent.lmode.IsDir() || strings.HasPrefix(ent.name, ".") {
+			continue
+		}
+		switch dir {
+		case "":
+			dirs = c.subdirs(ent.name, dirs)
+		case string(filepath.Separator):
+			dirs = c.subdirs(dir+ent.name, dirs)
+		default:
+			dirs = c.subdirs(dir+string(filepath.Separator)+ent.name, dirs)
+		}
+	}
+	return dirs
 }
 
 type findOp interface {
@@ -472,13 +720,11 @@ func parseFindCommand(cmd string) (findCommand, error) {
 	glog.V(3).Infof("find command: %#v", fcp.fc)
 
 	// TODO(ukai): handle this in run() instead of fallback shell.
-	_, ents := fsCache.readdir(filepathClean(fcp.fc.testdir), unknownFileid)
-	if ents == nil {
+	if !fsCache.overlayIsDir(fcp.fc.testdir) {
 		glog.V(1).Infof("find: testdir %s - not dir", fcp.fc.testdir)
 		return fcp.fc, errFindNoSuchDir
 	}
-	_, ents = fsCache.readdir(filepathClean(fcp.fc.chdir), unknownFileid)
-	if ents == nil {
+	if !fsCache.overlayIsDir(fcp.fc.chdir) {
 		glog.V(1).Infof("find: cd %s: No such file or directory", fcp.fc.chdir)
 		return fcp.fc, errFindNoSuchDir
 	}
@@ -487,6 +733,14 @@ func parseFindCommand(cmd string) (findCommand, error) {
 }
 
 func (fc findCommand) run(w evalWriter) {
+	if len(OverlayDirs) > 0 {
+		fc.runOverlay(w)
+		return
+	}
+	fc.runDir(w)
+}
+
+func (fc findCommand) runDir(w evalWriter) {
 	glog.V(3).Infof("find: %#v", fc)
 	for _, dir := range fc.finddirs {
 		seen := make(map[fileid]string)
@@ -835,6 +1089,14 @@ func parseFindleavesCommand(cmd string) (findleavesCommand, error) {
 }
 
 func (fc findleavesCommand) run(w evalWriter) {
+	if len(OverlayDirs) > 0 {
+		fc.runOverlay(w)
+		return
+	}
+	fc.runDir(w)
+}
+
+func (fc findleavesCommand) runDir(w evalWriter) {
 	glog.V(3).Infof("findleaves: %#v", fc)
 	for _, dir := range fc.dirs {
 		seen := make(map[fileid]string)
@@ -844,7 +1106,7 @@ func (fc findleavesCommand) run(w evalWriter) {
 }
 
 func (fc findleavesCommand) walk(w evalWriter, dir string, id fileid, depth int, seen map[fileid]string) {
-	glog.V(3).Infof("findleaves walk: dir:%d id:%v depth:%d", dir, id, depth)
+	glog.V(3).Infof("findleaves walk: dir:%s id:%v depth:%d", dir, id, depth)
 	id, ents := fsCache.readdir(filepathClean(dir), id)
 	var subdirs []dirent
 	for _, ent := range ents {
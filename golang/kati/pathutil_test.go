@@ -18,8 +18,10 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 )
 
 type mockfs struct {
@@ -701,6 +703,208 @@ func TestFind(t *testing.T) {
 	}
 }
 
+func TestFsCacheTrace(t *testing.T) {
+	fs := newFS()
+	defer fs.close()
+	fs.add(fs.file, "Makefile")
+	fs.add(fs.file, "src/a.c")
+	fs.add(fs.file, "src/sub/b.c")
+	fs.add(fs.file, "other/c.c")
+
+	fsCache.startTrace()
+	_, err := fsCache.Glob("src/*.c")
+	if err != nil {
+		t.Fatalf("Glob: %v", err)
+	}
+	_, err = fsCache.untracedGlob("other/*.c")
+	if err != nil {
+		t.Fatalf("untracedGlob: %v", err)
+	}
+	var wb wordBuffer
+	findCommand{
+		finddirs: []string{"src/sub"},
+		ops:      []findOp{findOpPrint{}},
+		depth:    1<<31 - 1,
+	}.run(&wb)
+	got := fsCache.stopTrace()
+	want := []string{"src", "src/sub"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("stopTrace()=%q; want=%q", got, want)
+	}
+	if got := fsCache.stopTrace(); len(got) != 0 {
+		t.Errorf("stopTrace() after stop=%q; want empty", got)
+	}
+}
+
+func TestFsCacheTimestamp(t *testing.T) {
+	dir := chdirTemp(t, map[string]string{
+		"foo": "",
+	})
+	foo := filepath.Join(dir, "foo")
+	mtime := time.Unix(1234567890, 0)
+	err := os.Chtimes(foo, mtime, mtime)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newFsCache()
+	cached0, stats0 := timestampStats.Counts()
+	if got, want := c.timestamp(foo), mtime.Unix(); got != want {
+		t.Errorf("timestamp(%q)=%d; want=%d before readdir", foo, got, want)
+	}
+	c.readdir(dir, unknownFileid)
+	// the cached mtime is used even if the file is changed.
+	err = os.Chtimes(foo, time.Now(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.timestamp(foo), mtime.Unix(); got != want {
+		t.Errorf("timestamp(%q)=%d; want=%d", foo, got, want)
+	}
+	bar := filepath.Join(dir, "bar")
+	if got, want := c.timestamp(bar), int64(-2); got != want {
+		t.Errorf("timestamp(%q)=%d; want=%d", bar, got, want)
+	}
+	cached, stats := timestampStats.Counts()
+	if got, want := cached-cached0, 1; got != want {
+		t.Errorf("cached timestamps=%d; want=%d", got, want)
+	}
+	if got, want := stats-stats0, 2; got != want {
+		t.Errorf("stat calls=%d; want=%d", got, want)
+	}
+}
+
+func TestGlobstar(t *testing.T) {
+	fs := newFS()
+	defer fs.close()
+	fs.add(fs.file, "Makefile")
+	fs.add(fs.file, "top.c")
+	fs.add(fs.file, "src/a.c")
+	fs.add(fs.file, "src/a.h")
+	fs.add(fs.file, "src/sub/b.c")
+	fs.add(fs.file, "src/sub/deep/c.c")
+	fs.add(fs.file, "src/.hidden/d.c")
+	fs.symlink("src/link", fs.dirref("src/sub"))
+	for _, dir := range []string{"src/deep", "src/sub/deep/deep"} {
+		fsCache.ids[dir] = invalidFileid
+	}
+
+	defer func(g bool) { Globstar = g }(Globstar)
+	for _, tc := range []struct {
+		pat      string
+		globstar bool
+		want     []string
+	}{
+		{
+			pat:      "src/sub/*.c",
+			globstar: false,
+			want:     []string{"src/sub/b.c"},
+		},
+		{
+			pat:      "src/**/*.c",
+			globstar: true,
+			want:     []string{"src/a.c", "src/sub/b.c", "src/sub/deep/c.c"},
+		},
+		{
+			pat:      "**/*.c",
+			globstar: true,
+			want:     []string{"top.c", "src/a.c", "src/sub/b.c", "src/sub/deep/c.c"},
+		},
+		{
+			pat:      "src/**/deep/*.c",
+			globstar: true,
+			want:     []string{"src/sub/deep/c.c"},
+		},
+		{
+			pat:      "s*/**/b.c",
+			globstar: true,
+			want:     []string{"src/sub/b.c"},
+		},
+		{
+			pat:      "src/sub/**",
+			globstar: true,
+			want:     []string{"src/sub/b.c", "src/sub/deep", "src/sub/deep/c.c"},
+		},
+	} {
+		Globstar = tc.globstar
+		got, err := fsCache.Glob(tc.pat)
+		if err != nil {
+			t.Errorf("Glob(%q) (globstar=%t): %v", tc.pat, tc.globstar, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("Glob(%q) (globstar=%t)=%q; want=%q", tc.pat, tc.globstar, got, tc.want)
+		}
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	fs := newFS()
+	defer fs.close()
+	fs.add(fs.file, "foo/a.c")
+	fs.add(fs.file, "foo/b.c")
+	fs.add(fs.file, "foo/Android.mk")
+	fs.add(fs.file, "vendor/foo/a.c")
+	fs.add(fs.file, "vendor/foo/c.c")
+	fs.add(fs.file, "vendor/foo/bar/Android.mk")
+	fs.add(fs.file, "vendor/baz/Android.mk")
+
+	defer func(dirs []string) { OverlayDirs = dirs }(OverlayDirs)
+	OverlayDirs = []string{"vendor"}
+
+	got, err := fsCache.Glob("foo/*.c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	if want := []string{"foo/b.c", "vendor/foo/a.c", "vendor/foo/c.c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Glob(foo/*.c)=%q; want %q", got, want)
+	}
+
+	maxdepth := 1<<31 - 1
+	for _, tc := range []struct {
+		fc   buildinCommand
+		want []string
+	}{
+		{
+			fc: findCommand{
+				finddirs: []string{"foo"},
+				ops:      []findOp{findOpName("*.c"), findOpPrint{}},
+				depth:    maxdepth,
+			},
+			want: []string{"foo/b.c", "vendor/foo/a.c", "vendor/foo/c.c"},
+		},
+		{
+			fc: findCommand{
+				chdir:    "foo",
+				finddirs: []string{"."},
+				ops:      []findOp{findOpName("*.c"), findOpPrint{}},
+				depth:    maxdepth,
+			},
+			want: []string{"../vendor/foo/a.c", "../vendor/foo/c.c", "./b.c"},
+		},
+		{
+			fc: findleavesCommand{
+				name:     "Android.mk",
+				dirs:     []string{"foo", "baz"},
+				mindepth: -1,
+			},
+			want: []string{"foo/Android.mk", "vendor/baz/Android.mk"},
+		},
+	} {
+		var wb wordBuffer
+		tc.fc.run(&wb)
+		var got []string
+		for _, w := range wb.words {
+			got = append(got, string(w))
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%#v\n got  %q\n want %q", tc.fc, got, tc.want)
+		}
+	}
+}
+
 func TestParseFindleavesCommand(t *testing.T) {
 	for _, tc := range []struct {
 		cmd  string
@@ -0,0 +1,358 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// WorkRequest is a command sent to a persistent worker.
+type WorkRequest struct {
+	// Arguments are words of the command in the recipe.
+	Arguments []string `json:"arguments"`
+	RequestID int      `json:"requestId"`
+}
+
+// WorkResponse is the result of a WorkRequest.
+type WorkResponse struct {
+	ExitCode  int    `json:"exitCode"`
+	Output    string `json:"output"`
+	RequestID int    `json:"requestId"`
+}
+
+// WorkerProtocol sends requests to and reads responses from persistent
+// worker processes through their stdin and stdout.
+type WorkerProtocol interface {
+	WriteRequest(w io.Writer, req WorkRequest) error
+	ReadResponse(r *bufio.Reader) (WorkResponse, error)
+}
+
+var (
+	workerProtocolsMu sync.Mutex
+	workerProtocols   = map[string]WorkerProtocol{
+		"json": jsonWorkerProtocol{},
+	}
+)
+
+// RegisterWorkerProtocol registers p as the protocol name, which
+// rules select by KATI_WORKER_PROTOCOL. "json" is registered by
+// default.
+func RegisterWorkerProtocol(name string, p WorkerProtocol) {
+	workerProtocolsMu.Lock()
+	defer workerProtocolsMu.Unlock()
+	workerProtocols[name] = p
+}
+
+func lookupWorkerProtocol(name string) (WorkerProtocol, bool) {
+	workerProtocolsMu.Lock()
+	defer workerProtocolsMu.Unlock()
+	p, ok := workerProtocols[name]
+	return p, ok
+}
+
+// jsonWorkerProtocol is the JSON worker protocol of Bazel, with one
+// request or response per line.
+type jsonWorkerProtocol struct{}
+
+func (jsonWorkerProtocol) WriteRequest(w io.Writer, req WorkRequest) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+func (jsonWorkerProtocol) ReadResponse(r *bufio.Reader) (WorkResponse, error) {
+	var resp WorkResponse
+	b, err := r.ReadBytes('\n')
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return resp, err
+	}
+	err = json.Unmarshal(b, &resp)
+	return resp, err
+}
+
+// persistentWorker is a worker process running commands of recipes.
+type persistentWorker struct {
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	stdout   *bufio.Reader
+	protocol WorkerProtocol
+}
+
+// workerPool keeps idle persistent workers for reuse, keyed by the
+// shell and the command to start them.
+type workerPool struct {
+	mu      sync.Mutex
+	idle    map[string][]*persistentWorker
+	all     []*persistentWorker
+	nextID  int
+	started int
+}
+
+func newWorkerPool() *workerPool {
+	return &workerPool{
+		idle: make(map[string][]*persistentWorker),
+	}
+}
+
+func (p *workerPool) get(r runner, command string, protocol WorkerProtocol) (*persistentWorker, string, error) {
+	key := fmt.Sprintf("%s\x00%s\x00%s", r.shell, r.shellFlags, command)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ws := p.idle[key]; len(ws) > 0 {
+		w := ws[len(ws)-1]
+		p.idle[key] = ws[:len(ws)-1]
+		return w, key, nil
+	}
+	args := append([]string{r.shell}, splitSpaces(r.shellFlags)...)
+	path, err := exec.LookPath(r.shell)
+	if err != nil {
+		return nil, "", err
+	}
+	cmd := &exec.Cmd{
+		Path:   path,
+		Args:   append(args, command),
+		Stderr: os.Stderr,
+		// Run in its own process group, so close can kill the
+		// worker and its children.
+		SysProcAttr: &syscall.SysProcAttr{Setpgid: true},
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, "", err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, "", err
+	}
+	glog.Infof("start persistent worker: %q", command)
+	err = cmd.Start()
+	if err != nil {
+		return nil, "", err
+	}
+	w := &persistentWorker{
+		cmd:      cmd,
+		stdin:    stdin,
+		stdout:   bufio.NewReader(stdout),
+		protocol: protocol,
+	}
+	p.all = append(p.all, w)
+	p.started++
+	return w, key, nil
+}
+
+func (p *workerPool) put(key string, w *persistentWorker) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.idle[key] = append(p.idle[key], w)
+}
+
+func (p *workerPool) requestID() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nextID++
+	return p.nextID
+}
+
+// workerCloseTimeout is how long close waits for workers to exit
+// after their stdin is closed. Workers still running are killed.
+var workerCloseTimeout = 10 * time.Second
+
+// close stops all workers by closing their stdin.
+func (p *workerPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, w := range p.all {
+		w.stdin.Close()
+		wg.Add(1)
+		go func(w *persistentWorker) {
+			defer wg.Done()
+			w.wait(workerCloseTimeout)
+		}(w)
+	}
+	wg.Wait()
+	logStats("persistent workers: %d started, %d requests", p.started, p.nextID)
+	p.all = nil
+	p.idle = make(map[string][]*persistentWorker)
+}
+
+// wait waits for the worker to exit, and kills it if it doesn't exit
+// within timeout.
+func (w *persistentWorker) wait(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		w.cmd.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		glog.Warningf("persistent worker %q didn't exit in %s; killing it", w.cmd.Args, timeout)
+		syscall.Kill(-w.cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+	}
+}
+
+// workerExitError is the non-zero exit code of a command run by a
+// persistent worker.
+type workerExitError int
+
+func (e workerExitError) Error() string {
+	return fmt.Sprintf("persistent worker exit code %d", int(e))
+}
+
+// runInWorker runs the command of r by a persistent worker started by
+// command, instead of the shell. The command must be a simple
+// command, whose words are sent to the worker. It returns the output
+// of the command, which is also printed, as runner.run does.
+func (p *workerPool) runInWorker(ctx context.Context, r runner, command string, protocol WorkerProtocol, output string) ([]byte, error) {
+	if r.echo || DryRunFlag {
+		newDiag(os.Stdout).echo(r.cmd)
+	}
+	if DryRunFlag && !r.force {
+		return nil, nil
+	}
+	args, err := commandWords(cmdline(r.cmd))
+	if err != nil {
+		return nil, err
+	}
+	w, key, err := p.get(r, command, protocol)
+	if err != nil {
+		return nil, err
+	}
+	req := WorkRequest{Arguments: args, RequestID: p.requestID()}
+	glog.Infof("worker request %d: %q", req.RequestID, args)
+	// kill the worker when ctx is done.
+	done := make(chan struct{})
+	killed := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			w.cmd.Process.Kill()
+			killed <- true
+		case <-done:
+			killed <- false
+		}
+	}()
+	resp, err := w.request(req)
+	close(done)
+	if <-killed && err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		// The worker is not reused.
+		w.cmd.Process.Kill()
+		return nil, fmt.Errorf("persistent worker %q: %v", command, err)
+	}
+	p.put(key, w)
+	fmt.Printf("%s", resp.Output)
+	if resp.ExitCode != 0 {
+		if r.ignoreError {
+			fmt.Printf("[%s] Error %d (ignored)\n", output, resp.ExitCode)
+			return []byte(resp.Output), nil
+		}
+		return []byte(resp.Output), workerExitError(resp.ExitCode)
+	}
+	return []byte(resp.Output), nil
+}
+
+func (w *persistentWorker) request(req WorkRequest) (WorkResponse, error) {
+	err := w.protocol.WriteRequest(w.stdin, req)
+	if err != nil {
+		return WorkResponse{}, err
+	}
+	resp, err := w.protocol.ReadResponse(w.stdout)
+	if err != nil {
+		return resp, err
+	}
+	if resp.RequestID != req.RequestID {
+		return resp, fmt.Errorf("response for request %d; want %d", resp.RequestID, req.RequestID)
+	}
+	return resp, nil
+}
+
+// commandWords splits a simple command into words, with quotes and
+// backslashes removed. Lists, pipelines and redirections are not
+// allowed, nor are expansions by the shell.
+func commandWords(cmd string) ([]string, error) {
+	var words []string
+	var word []byte
+	inWord := false
+	for i := 0; i < len(cmd); i++ {
+		c := cmd[i]
+		switch {
+		case isWhitespace(rune(c)):
+			if inWord {
+				words = append(words, string(word))
+				word = word[:0]
+				inWord = false
+			}
+			continue
+		case c == '\\':
+			i++
+			if i < len(cmd) {
+				word = append(word, cmd[i])
+			}
+		case c == '\'':
+			j := strings.IndexByte(cmd[i+1:], '\'')
+			if j < 0 {
+				return nil, fmt.Errorf("unbalanced quote: %q", cmd)
+			}
+			word = append(word, cmd[i+1:i+1+j]...)
+			i += j + 1
+		case c == '"':
+			i++
+			for ; i < len(cmd) && cmd[i] != '"'; i++ {
+				if strings.IndexByte("$`", cmd[i]) >= 0 {
+					return nil, fmt.Errorf("not a simple command: %q", cmd)
+				}
+				if cmd[i] == '\\' && i+1 < len(cmd) && strings.IndexByte("\\\"", cmd[i+1]) >= 0 {
+					i++
+				}
+				word = append(word, cmd[i])
+			}
+			if i == len(cmd) {
+				return nil, fmt.Errorf("unbalanced quote: %q", cmd)
+			}
+		case strings.IndexByte(";&|<>()$`*?[~#", c) >= 0:
+			return nil, fmt.Errorf("not a simple command: %q", cmd)
+		default:
+			word = append(word, c)
+		}
+		inWord = true
+	}
+	if inWord {
+		words = append(words, string(word))
+	}
+	return words, nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPersistentWorkers(t *testing.T) {
+	chdirTemp(t, map[string]string{
+		"worker.sh": `
+echo start >> starts
+while read -r line; do
+  echo "$line" >> requests
+  id=$(echo "$line" | sed 's/.*"requestId":\([0-9]*\).*/\1/')
+  case "$line" in *fail*) code=3 out=failed;; *) code=0 out=;; esac
+  echo "{\"exitCode\":$code,\"output\":\"$out\",\"requestId\":$id}"
+done
+`,
+		"Makefile": `
+all: a b
+a b c: KATI_WORKER := sh ./worker.sh
+a b:
+	@compile "$@ x"
+c:
+	@compile fail
+`,
+	})
+	g := mustLoad(t, LoadReq{Makefile: "Makefile"})
+	ex, err := NewExecutor(&ExecutorOpt{NumJobs: 1, PersistentWorkers: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ex.Exec(g, []string{"all"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err = Load(LoadReq{Makefile: "Makefile", Targets: []string{"c"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex, err = NewExecutor(&ExecutorOpt{NumJobs: 1, PersistentWorkers: true, FailureOutputTail: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ex.Exec(g, []string{"c"})
+	if err == nil || !strings.Contains(err.Error(), "[c] Error 3") || !strings.HasSuffix(err.Error(), "output:\nfailed") {
+		t.Errorf("Exec(c)=%v; want Error 3 with the output of the worker", err)
+	}
+	// KATI_WORKER is kept when commands are evaluated eagerly.
+	g, err = Load(LoadReq{Makefile: "Makefile", Targets: []string{"a"}, EagerEvalCommand: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex, err = NewExecutor(&ExecutorOpt{NumJobs: 1, PersistentWorkers: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ex.Exec(g, []string{"a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile("requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(strings.TrimSpace(string(b)), "\n")
+	want := []string{
+		`{"arguments":["compile","a x"],"requestId":1}`,
+		`{"arguments":["compile","b x"],"requestId":2}`,
+		`{"arguments":["compile","fail"],"requestId":1}`,
+		`{"arguments":["compile","a x"],"requestId":1}`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("requests=%q; want %q", got, want)
+	}
+	// A worker is started for each execution.
+	b, err = ioutil.ReadFile("starts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Count(string(b), "start"), 3; got != want {
+		t.Errorf("%d workers started; want %d", got, want)
+	}
+}
+
+func TestPersistentWorkerCloseTimeout(t *testing.T) {
+	// The worker keeps running after its stdin is closed.
+	chdirTemp(t, map[string]string{
+		"worker.sh": `
+read -r line
+echo '{"exitCode":0,"output":"","requestId":1}'
+exec sleep 60
+`,
+		"Makefile": `
+a: KATI_WORKER := sh ./worker.sh
+a:
+	@compile a
+`,
+	})
+	defer func(d time.Duration) { workerCloseTimeout = d }(workerCloseTimeout)
+	workerCloseTimeout = 100 * time.Millisecond
+
+	g := mustLoad(t, LoadReq{Makefile: "Makefile"})
+	ex, err := NewExecutor(&ExecutorOpt{NumJobs: 1, PersistentWorkers: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	err = ex.Exec(g, []string{"a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 10*time.Second {
+		t.Errorf("Exec took %s; want the worker killed after %s", d, workerCloseTimeout)
+	}
+}
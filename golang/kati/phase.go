@@ -0,0 +1,191 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// Phases timed with PhaseStatsFlag, in the order of WritePhaseStats.
+const (
+	phaseParse     = "parse"
+	phaseEval      = "eval"
+	phaseDepBuild  = "dep build"
+	phaseSerialize = "serialize"
+	phaseNinja     = "ninja gen"
+	phaseExec      = "exec"
+)
+
+var phaseOrder = []string{phaseParse, phaseEval, phaseDepBuild, phaseSerialize, phaseNinja, phaseExec}
+
+// phaseStat is the time spent in a phase. Time spent in a phase
+// started inside another, e.g. parsing included makefiles while
+// evaluating, is counted only for the inner phase.
+type phaseStat struct {
+	Name  string        `json:"name"`
+	Count int           `json:"count"`
+	Wall  time.Duration `json:"wall_ns"`
+	CPU   time.Duration `json:"cpu_ns"`
+	// MaxRSS is the peak RSS of the process at the end of the
+	// phase.
+	MaxRSS int64 `json:"max_rss_bytes"`
+}
+
+// phaseRun is a phase being timed.
+type phaseRun struct {
+	stat      *phaseStat
+	wall      time.Time
+	cpu       time.Duration
+	childWall time.Duration
+	childCPU  time.Duration
+}
+
+type phaseStatsT struct {
+	mu    sync.Mutex
+	stats map[string]*phaseStat
+	// stack is phases being timed, innermost last.
+	stack []*phaseRun
+}
+
+var phaseStats = newPhaseStats()
+
+func newPhaseStats() *phaseStatsT {
+	return &phaseStatsT{stats: make(map[string]*phaseStat)}
+}
+
+// startPhase starts timing the phase name if PhaseStatsFlag is set,
+// and returns a function to end it.
+func startPhase(name string) func() {
+	if !PhaseStatsFlag {
+		return func() {}
+	}
+	return phaseStats.start(name)
+}
+
+func (p *phaseStatsT) start(name string) func() {
+	cpu, _ := rusage()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := p.stats[name]
+	if s == nil {
+		s = &phaseStat{Name: name}
+		p.stats[name] = s
+	}
+	r := &phaseRun{stat: s, wall: time.Now(), cpu: cpu}
+	p.stack = append(p.stack, r)
+	return func() {
+		p.end(r)
+	}
+}
+
+func (p *phaseStatsT) end(r *phaseRun) {
+	cpu, maxRSS := rusage()
+	wall := time.Since(r.wall)
+	cpu -= r.cpu
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := len(p.stack) - 1; i >= 0; i-- {
+		if p.stack[i] == r {
+			p.stack = append(p.stack[:i], p.stack[i+1:]...)
+			if i > 0 {
+				p.stack[i-1].childWall += wall
+				p.stack[i-1].childCPU += cpu
+			}
+			break
+		}
+	}
+	s := r.stat
+	s.Count++
+	s.Wall += wall - r.childWall
+	s.CPU += cpu - r.childCPU
+	s.MaxRSS = maxRSS
+}
+
+// rusage returns the user and system CPU time and the peak RSS of
+// the process.
+func rusage() (time.Duration, int64) {
+	var ru syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); err != nil {
+		return 0, 0
+	}
+	cpu := time.Duration(ru.Utime.Nano() + ru.Stime.Nano())
+	maxRSS := int64(ru.Maxrss)
+	if runtime.GOOS != "darwin" {
+		// in kilobytes, except on darwin.
+		maxRSS *= 1024
+	}
+	return cpu, maxRSS
+}
+
+func (p *phaseStatsT) sorted() []phaseStat {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var stats []phaseStat
+	for _, name := range phaseOrder {
+		if s, ok := p.stats[name]; ok {
+			stats = append(stats, *s)
+		}
+	}
+	return stats
+}
+
+// WritePhaseStats writes the time spent in each phase collected with
+// PhaseStatsFlag, i.e. parsing makefiles, evaluating them, building
+// the dependency graph, serializing it, generating ninja and running
+// recipes, with the peak RSS. format is "table" or "json".
+func WritePhaseStats(w io.Writer, format string) error {
+	stats := phaseStats.sorted()
+	var total phaseStat
+	for _, s := range stats {
+		total.Wall += s.Wall
+		total.CPU += s.CPU
+	}
+	_, total.MaxRSS = rusage()
+	switch format {
+	case "json":
+		b, err := json.MarshalIndent(struct {
+			Phases []phaseStat `json:"phases"`
+			Wall   int64       `json:"wall_ns"`
+			CPU    int64       `json:"cpu_ns"`
+			MaxRSS int64       `json:"max_rss_bytes"`
+		}{stats, int64(total.Wall), int64(total.CPU), total.MaxRSS}, "", " ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", b)
+		return err
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(tw, "phase\tcount\twall\tcpu\tmax rss\t\n")
+		for _, s := range stats {
+			fmt.Fprintf(tw, "%s\t%d\t%v\t%v\t%s\t\n", s.Name, s.Count, roundDuration(s.Wall), roundDuration(s.CPU), human(int(s.MaxRSS)))
+		}
+		fmt.Fprintf(tw, "total\t\t%v\t%v\t%s\t\n", roundDuration(total.Wall), roundDuration(total.CPU), human(int(total.MaxRSS)))
+		return tw.Flush()
+	}
+	return fmt.Errorf("unknown phase stats format %q", format)
+}
+
+// roundDuration rounds d for tables.
+func roundDuration(d time.Duration) time.Duration {
+	return d.Round(time.Millisecond)
+}
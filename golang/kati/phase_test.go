@@ -0,0 +1,91 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPhaseStats(t *testing.T) {
+	defer func(f bool, s *phaseStatsT) {
+		PhaseStatsFlag, phaseStats = f, s
+	}(PhaseStatsFlag, phaseStats)
+	PhaseStatsFlag = true
+	phaseStats = newPhaseStats()
+
+	endEval := startPhase(phaseEval)
+	for i := 0; i < 2; i++ {
+		endParse := startPhase(phaseParse)
+		time.Sleep(20 * time.Millisecond)
+		endParse()
+	}
+	endEval()
+	startPhase(phaseExec)()
+
+	stats := phaseStats.sorted()
+	var names []string
+	for _, s := range stats {
+		names = append(names, s.Name)
+	}
+	if got, want := strings.Join(names, ","), "parse,eval,exec"; got != want {
+		t.Fatalf("phases=%q; want %q", got, want)
+	}
+	parse, eval := stats[0], stats[1]
+	if parse.Count != 2 || parse.Wall < 40*time.Millisecond {
+		t.Errorf("parse=%+v; want 2 runs of 40ms or more", parse)
+	}
+	// Time parsing is not counted for eval.
+	if eval.Count != 1 || eval.Wall >= 20*time.Millisecond {
+		t.Errorf("eval=%+v; want 1 run shorter than 20ms", eval)
+	}
+	if parse.MaxRSS <= 0 {
+		t.Errorf("parse.MaxRSS=%d; want > 0", parse.MaxRSS)
+	}
+
+	var buf bytes.Buffer
+	err := WritePhaseStats(&buf, "table")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 5 || !strings.HasPrefix(lines[0], "phase") || !strings.HasPrefix(lines[4], "total") {
+		t.Errorf("table=\n%s", buf.String())
+	}
+
+	buf.Reset()
+	err = WritePhaseStats(&buf, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var js struct {
+		Phases []phaseStat `json:"phases"`
+		Wall   int64       `json:"wall_ns"`
+	}
+	err = json.Unmarshal(buf.Bytes(), &js)
+	if err != nil {
+		t.Fatalf("json.Unmarshal(%q)=%v", buf.String(), err)
+	}
+	if len(js.Phases) != 3 || js.Wall < int64(40*time.Millisecond) {
+		t.Errorf("json=%s", buf.String())
+	}
+
+	if err := WritePhaseStats(&buf, "csv"); err == nil {
+		t.Errorf("WritePhaseStats(_, %q)=nil; want error", "csv")
+	}
+}
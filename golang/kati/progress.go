@@ -0,0 +1,75 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// progressInterval is the interval of progress reports.
+const progressInterval = time.Second
+
+// evalProgress reports progress of loading makefiles with Progress:
+// the statement being evaluated, the number of statements evaluated,
+// the elapsed time and the time left until the deadline of the
+// context, if any.
+//
+// It is checked by the periodic stats of the evaluator, every 100
+// statements, so it needs no timer of its own.
+type evalProgress struct {
+	w        io.Writer
+	start    time.Time
+	deadline time.Time
+	// hasDeadline is true if the context has deadline.
+	hasDeadline bool
+	// last is the time of the last report, or start.
+	last time.Time
+}
+
+func newEvalProgress(ctx context.Context, w io.Writer) *evalProgress {
+	now := time.Now()
+	p := &evalProgress{
+		w:     w,
+		start: now,
+		last:  now,
+	}
+	p.deadline, p.hasDeadline = ctx.Deadline()
+	return p
+}
+
+// check reports progress at loc after stmts statements, if
+// progressInterval has passed since the last report.
+func (p *evalProgress) check(loc srcpos, stmts int, now time.Time) {
+	if now.Sub(p.last) < progressInterval {
+		return
+	}
+	p.last = now
+	p.report(loc, stmts, now)
+}
+
+func (p *evalProgress) report(loc srcpos, stmts int, now time.Time) {
+	msg := fmt.Sprintf("kati: evaluating %s (%d statements, %v elapsed", loc, stmts, now.Sub(p.start).Round(100*time.Millisecond))
+	if p.hasDeadline {
+		left := p.deadline.Sub(now)
+		if left < 0 {
+			left = 0
+		}
+		msg += fmt.Sprintf(", %v left", left.Round(time.Second))
+	}
+	fmt.Fprintf(p.w, "%s)\n", msg)
+}
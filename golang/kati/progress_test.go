@@ -0,0 +1,74 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvalProgress(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	var buf bytes.Buffer
+	p := newEvalProgress(ctx, &buf)
+	p.start = time.Unix(100, 0)
+	p.last = p.start
+	p.deadline = time.Unix(160, 0)
+
+	loc := srcpos{filename: "foo.mk", lineno: 3}
+	p.check(loc, 100, time.Unix(100, 500*1000*1000))
+	if buf.Len() != 0 {
+		t.Errorf("check() reported before due: %q", buf.String())
+	}
+	p.check(loc, 200, time.Unix(112, 300*1000*1000))
+	p.check(loc, 300, time.Unix(112, 900*1000*1000))
+	p.hasDeadline = false
+	p.check(loc, 400, time.Unix(170, 0))
+
+	want := `kati: evaluating foo.mk:3 (200 statements, 12.3s elapsed, 48s left)
+kati: evaluating foo.mk:3 (400 statements, 1m10s elapsed)
+`
+	if got := buf.String(); got != want {
+		t.Errorf("reports=%q; want %q", got, want)
+	}
+}
+
+func TestEvalProgressStatements(t *testing.T) {
+	mk, err := newParser(strings.NewReader(strings.Repeat("X := 1\n", 250)), "foo.mk", defaultRecipePrefix).parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := NewEvaluator(make(Vars))
+	ev.setContext(context.Background())
+	var buf bytes.Buffer
+	ev.progress = newEvalProgress(context.Background(), &buf)
+	ev.progress.last = time.Time{}
+	for _, stmt := range mk.stmts {
+		err := ev.eval(stmt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Progress is checked every 100 statements, and reported once
+	// a second.
+	got := buf.String()
+	if !strings.HasPrefix(got, "kati: evaluating foo.mk:") || !strings.Contains(got, " (100 statements, ") || strings.Count(got, "\n") != 1 {
+		t.Errorf("reports=%q; want one report after 100 statements", got)
+	}
+}
@@ -0,0 +1,526 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+)
+
+// GraphVersion is the version of the graph saved by PROTO. Graphs of
+// newer versions can't be loaded.
+const GraphVersion = 1
+
+// Wire types of protocol buffers.
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+var errProtoTruncated = errors.New("truncated protocol buffer")
+
+// protoBuffer encodes a message of protocol buffers. Fields with the
+// default value are omitted, as proto3 does.
+type protoBuffer struct {
+	b []byte
+}
+
+func (p *protoBuffer) varint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	p.b = append(p.b, buf[:n]...)
+}
+
+func (p *protoBuffer) tag(field, wireType int) {
+	p.varint(uint64(field<<3 | wireType))
+}
+
+func (p *protoBuffer) int(field int, v int) {
+	if v == 0 {
+		return
+	}
+	p.tag(field, protoVarint)
+	p.varint(uint64(int64(v)))
+}
+
+func (p *protoBuffer) bool(field int, v bool) {
+	if v {
+		p.int(field, 1)
+	}
+}
+
+// bytes writes b even if it's empty, for repeated fields.
+func (p *protoBuffer) bytes(field int, b []byte) {
+	p.tag(field, protoBytes)
+	p.varint(uint64(len(b)))
+	p.b = append(p.b, b...)
+}
+
+func (p *protoBuffer) string(field int, s string) {
+	if s == "" {
+		return
+	}
+	p.bytes(field, []byte(s))
+}
+
+func (p *protoBuffer) strings(field int, ss []string) {
+	for _, s := range ss {
+		p.bytes(field, []byte(s))
+	}
+}
+
+// ints writes a packed repeated field.
+func (p *protoBuffer) ints(field int, vs []int) {
+	if len(vs) == 0 {
+		return
+	}
+	var m protoBuffer
+	for _, v := range vs {
+		m.varint(uint64(int64(v)))
+	}
+	p.bytes(field, m.b)
+}
+
+func (p *protoBuffer) message(field int, encode func(m *protoBuffer)) {
+	var m protoBuffer
+	encode(&m)
+	p.bytes(field, m.b)
+}
+
+// protoReader decodes a message of protocol buffers. The first error
+// is kept in err, and later reads return zero values.
+type protoReader struct {
+	b   []byte
+	err error
+}
+
+// next reads the tag of the next field. It returns false at the end
+// of the message or on errors.
+func (r *protoReader) next() (field, wireType int, ok bool) {
+	if r.err != nil || len(r.b) == 0 {
+		return 0, 0, false
+	}
+	tag := r.varint()
+	return int(tag >> 3), int(tag & 7), r.err == nil
+}
+
+func (r *protoReader) varint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = errProtoTruncated
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *protoReader) int() int {
+	return int(int64(r.varint()))
+}
+
+func (r *protoReader) bool() bool {
+	return r.varint() != 0
+}
+
+func (r *protoReader) bytes() []byte {
+	n := r.varint()
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.b)) {
+		r.err = errProtoTruncated
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *protoReader) string() string {
+	return string(r.bytes())
+}
+
+// ints reads a repeated int field, packed or not.
+func (r *protoReader) ints(wireType int, vs []int) []int {
+	if wireType == protoVarint {
+		return append(vs, r.int())
+	}
+	m := &protoReader{b: r.bytes()}
+	for len(m.b) > 0 && m.err == nil {
+		vs = append(vs, m.int())
+	}
+	if r.err == nil {
+		r.err = m.err
+	}
+	return vs
+}
+
+// message decodes the length delimited message of the current field
+// by decode.
+func (r *protoReader) message(decode func(m *protoReader)) {
+	m := &protoReader{b: r.bytes()}
+	if r.err != nil {
+		return
+	}
+	decode(m)
+	r.err = m.err
+}
+
+// skip skips the value of an unknown field.
+func (r *protoReader) skip(wireType int) {
+	switch wireType {
+	case protoVarint:
+		r.varint()
+	case protoBytes:
+		r.bytes()
+	case protoFixed64, protoFixed32:
+		n := 8
+		if wireType == protoFixed32 {
+			n = 4
+		}
+		if len(r.b) < n {
+			r.err = errProtoTruncated
+			return
+		}
+		r.b = r.b[n:]
+	default:
+		r.err = fmt.Errorf("unsupported wire type %d", wireType)
+	}
+}
+
+func encodeProtoVar(p *protoBuffer, v serializableVar) {
+	p.string(1, v.Type)
+	p.string(2, v.V)
+	p.string(3, v.Origin)
+	for _, c := range v.Children {
+		c := c
+		p.message(4, func(m *protoBuffer) { encodeProtoVar(m, c) })
+	}
+	p.bool(5, v.Export)
+}
+
+func decodeProtoVar(r *protoReader) serializableVar {
+	var v serializableVar
+	for {
+		field, wireType, ok := r.next()
+		if !ok {
+			return v
+		}
+		switch field {
+		case 1:
+			v.Type = r.string()
+		case 2:
+			v.V = r.string()
+		case 3:
+			v.Origin = r.string()
+		case 4:
+			r.message(func(m *protoReader) {
+				v.Children = append(v.Children, decodeProtoVar(m))
+			})
+		case 5:
+			v.Export = r.bool()
+		default:
+			r.skip(wireType)
+		}
+	}
+}
+
+func encodeProtoNode(p *protoBuffer, n *serializableDepNode) {
+	p.int(1, n.Output)
+	p.strings(2, n.Cmds)
+	p.ints(3, n.Deps)
+	p.ints(4, n.OrderOnlys)
+	p.ints(5, n.Parents)
+	p.bool(6, n.HasRule)
+	p.bool(7, n.IsPhony)
+	p.bool(8, n.IsIntermediate)
+	p.bool(9, n.IsPrecious)
+	p.bool(10, n.IsPatternRule)
+	p.ints(11, n.ActualInputs)
+	p.ints(12, n.TargetSpecificVars)
+	p.string(13, n.Filename)
+	p.int(14, n.Lineno)
+}
+
+func decodeProtoNode(r *protoReader) *serializableDepNode {
+	n := &serializableDepNode{}
+	for {
+		field, wireType, ok := r.next()
+		if !ok {
+			return n
+		}
+		switch field {
+		case 1:
+			n.Output = r.int()
+		case 2:
+			n.Cmds = append(n.Cmds, r.string())
+		case 3:
+			n.Deps = r.ints(wireType, n.Deps)
+		case 4:
+			n.OrderOnlys = r.ints(wireType, n.OrderOnlys)
+		case 5:
+			n.Parents = r.ints(wireType, n.Parents)
+		case 6:
+			n.HasRule = r.bool()
+		case 7:
+			n.IsPhony = r.bool()
+		case 8:
+			n.IsIntermediate = r.bool()
+		case 9:
+			n.IsPrecious = r.bool()
+		case 10:
+			n.IsPatternRule = r.bool()
+		case 11:
+			n.ActualInputs = r.ints(wireType, n.ActualInputs)
+		case 12:
+			n.TargetSpecificVars = r.ints(wireType, n.TargetSpecificVars)
+		case 13:
+			n.Filename = r.string()
+		case 14:
+			n.Lineno = r.int()
+		default:
+			r.skip(wireType)
+		}
+	}
+}
+
+// encodeProtoGraph encodes g as the Graph message. Maps are sorted by
+// keys, so the output is deterministic.
+func encodeProtoGraph(g serializableGraph) []byte {
+	p := &protoBuffer{}
+	p.int(1, GraphVersion)
+	for _, n := range g.Nodes {
+		n := n
+		p.message(2, func(m *protoBuffer) { encodeProtoNode(m, n) })
+	}
+	var names []string
+	for name := range g.Vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		v := g.Vars[name]
+		p.message(3, func(m *protoBuffer) {
+			m.string(1, name)
+			m.message(2, func(m *protoBuffer) { encodeProtoVar(m, v) })
+		})
+	}
+	for _, tsv := range g.Tsvs {
+		tsv := tsv
+		p.message(4, func(m *protoBuffer) {
+			m.string(1, tsv.Name)
+			m.message(2, func(m *protoBuffer) { encodeProtoVar(m, tsv.Value) })
+		})
+	}
+	p.strings(5, g.Targets)
+	p.strings(6, g.Roots)
+	for _, mk := range g.AccessedMks {
+		mk := mk
+		p.message(7, func(m *protoBuffer) {
+			m.string(1, mk.Filename)
+			m.bytes(2, mk.Hash[:])
+			m.int(3, int(mk.State))
+		})
+	}
+	names = names[:0]
+	for name := range g.Exports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		export := g.Exports[name]
+		p.message(8, func(m *protoBuffer) {
+			m.string(1, name)
+			m.bool(2, export)
+		})
+	}
+	p.bool(9, g.ExportAll)
+	p.bool(10, g.DeleteOnError)
+	names = names[:0]
+	for name, used := range g.UsedEnvs {
+		if used {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	p.strings(11, names)
+	p.bytes(12, g.EnvHash[:])
+	return p.b
+}
+
+func decodeProtoGraph(b []byte) (serializableGraph, error) {
+	g := serializableGraph{
+		Vars:     make(map[string]serializableVar),
+		Exports:  make(map[string]bool),
+		UsedEnvs: make(map[string]bool),
+	}
+	r := &protoReader{b: b}
+	version := 0
+	for {
+		field, wireType, ok := r.next()
+		if !ok {
+			break
+		}
+		switch field {
+		case 1:
+			version = r.int()
+		case 2:
+			r.message(func(m *protoReader) {
+				g.Nodes = append(g.Nodes, decodeProtoNode(m))
+			})
+		case 3:
+			r.message(func(m *protoReader) {
+				var name string
+				var v serializableVar
+				for {
+					field, wireType, ok := m.next()
+					if !ok {
+						break
+					}
+					switch field {
+					case 1:
+						name = m.string()
+					case 2:
+						m.message(func(m *protoReader) { v = decodeProtoVar(m) })
+					default:
+						m.skip(wireType)
+					}
+				}
+				g.Vars[name] = v
+			})
+		case 4:
+			r.message(func(m *protoReader) {
+				var tsv serializableTargetSpecificVar
+				for {
+					field, wireType, ok := m.next()
+					if !ok {
+						break
+					}
+					switch field {
+					case 1:
+						tsv.Name = m.string()
+					case 2:
+						m.message(func(m *protoReader) { tsv.Value = decodeProtoVar(m) })
+					default:
+						m.skip(wireType)
+					}
+				}
+				g.Tsvs = append(g.Tsvs, tsv)
+			})
+		case 5:
+			g.Targets = append(g.Targets, r.string())
+		case 6:
+			g.Roots = append(g.Roots, r.string())
+		case 7:
+			r.message(func(m *protoReader) {
+				mk := &accessedMakefile{}
+				for {
+					field, wireType, ok := m.next()
+					if !ok {
+						break
+					}
+					switch field {
+					case 1:
+						mk.Filename = m.string()
+					case 2:
+						copy(mk.Hash[:], m.bytes())
+					case 3:
+						mk.State = fileState(m.int())
+					default:
+						m.skip(wireType)
+					}
+				}
+				g.AccessedMks = append(g.AccessedMks, mk)
+			})
+		case 8:
+			r.message(func(m *protoReader) {
+				var name string
+				var export bool
+				for {
+					field, wireType, ok := m.next()
+					if !ok {
+						break
+					}
+					switch field {
+					case 1:
+						name = m.string()
+					case 2:
+						export = m.bool()
+					default:
+						m.skip(wireType)
+					}
+				}
+				g.Exports[name] = export
+			})
+		case 9:
+			g.ExportAll = r.bool()
+		case 10:
+			g.DeleteOnError = r.bool()
+		case 11:
+			g.UsedEnvs[r.string()] = true
+		case 12:
+			copy(g.EnvHash[:], r.bytes())
+		default:
+			r.skip(wireType)
+		}
+	}
+	if version > GraphVersion {
+		return g, fmt.Errorf("unsupported graph version %d; kati supports up to %d", version, GraphVersion)
+	}
+	return g, r.err
+}
+
+func (protoLoadSaver) Save(g *DepGraph, filename string, roots []string) error {
+	defer startPhase(phaseSerialize)()
+	startTime := time.Now()
+	sg, err := makeSerializableGraph(g, roots)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filename, encodeProtoGraph(sg), 0644)
+	if err != nil {
+		return err
+	}
+	logStats("proto serialize time: %q", time.Since(startTime))
+	return nil
+}
+
+func (protoLoadSaver) Load(filename string) (*DepGraph, error) {
+	defer startPhase(phaseSerialize)()
+	startTime := time.Now()
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	sg, err := decodeProtoGraph(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	dg, err := deserializeGraph(sg)
+	if err != nil {
+		return nil, err
+	}
+	logStats("proto deserialize time: %q", time.Since(startTime))
+	return dg, nil
+}
@@ -15,8 +15,13 @@
 package kati
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 )
 
 func showDeps(w io.Writer, n *DepNode, indent int, seen map[string]int) {
@@ -73,27 +78,341 @@ func handleNodeQuery(w io.Writer, q string, nodes []*DepNode) {
 	}
 }
 
+func findNode(nodes []*DepNode, q string, seen map[*DepNode]bool) *DepNode {
+	for _, n := range nodes {
+		if seen[n] {
+			continue
+		}
+		seen[n] = true
+		if n.Output == q {
+			return n
+		}
+		if d := findNode(n.Deps, q, seen); d != nil {
+			return d
+		}
+		if d := findNode(n.OrderOnlys, q, seen); d != nil {
+			return d
+		}
+	}
+	return nil
+}
+
+// shellQuote quotes s with single quotes for /bin/sh.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// showScript writes a standalone shell script which reproduces
+// building n: working directory, exported variables and the
+// recipe evaluated with its target specific variables.
+func showScript(w io.Writer, n *DepNode, g *DepGraph) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	err = g.loadVars()
+	if err != nil {
+		return err
+	}
+	ctx := newExecContext(g.vars, g.vpaths, false)
+	ctx.exports, ctx.exportAll = g.exports, g.exportAll
+	runners, _, err := createRunners(ctx, n)
+	if err != nil {
+		return err
+	}
+	// createRunners restores target specific variables before it
+	// returns, so set them again to evaluate exports and comments.
+	var tsvNames []string
+	for k, v := range n.TargetSpecificVars {
+		restore := ctx.ev.vars.save(k)
+		defer restore()
+		ctx.ev.vars[k] = v
+		tsvNames = append(tsvNames, k)
+	}
+	sort.Strings(tsvNames)
+
+	fmt.Fprintf(w, "#!/bin/sh\n")
+	fmt.Fprintf(w, "# Reproduces building %q.\n", n.Output)
+	fmt.Fprintf(w, "# Generated by kati %s\n", gitVersion)
+	if n.Filename != "" {
+		fmt.Fprintf(w, "# Recipe at %s:%d\n", n.Filename, n.Lineno)
+	}
+	if len(tsvNames) > 0 {
+		fmt.Fprintf(w, "#\n# Target specific variables:\n")
+		for _, k := range tsvNames {
+			v, err := ctx.ev.EvaluateVar(k)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(w, "#  %s=%s\n", k, v)
+		}
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "set -e")
+	fmt.Fprintf(w, "cd %s\n", shellQuote(wd))
+
+	var exports []string
+	for name := range g.exports {
+		exports = append(exports, name)
+	}
+	sort.Strings(exports)
+	for _, name := range exports {
+		if strings.ContainsAny(name, " \t\n\r") {
+			continue
+		}
+		if !g.exports[name] {
+			fmt.Fprintf(w, "unset %s\n", name)
+			continue
+		}
+		v, err := ctx.ev.EvaluateVar(name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "export %s=%s\n", name, shellQuote(exportValue(name, v)))
+	}
+	if len(runners) > 0 {
+		// Target specific variables exported only for n.
+		for _, e := range runners[0].env {
+			i := strings.IndexByte(e, '=')
+			if g.exports[e[:i]] {
+				continue
+			}
+			fmt.Fprintf(w, "export %s=%s\n", e[:i], shellQuote(e[i+1:]))
+		}
+	}
+	fmt.Fprintln(w)
+
+	for _, r := range runners {
+		cmd := cmdline(r.cmd)
+		if r.echo {
+			fmt.Fprintf(w, "echo %s\n", shellQuote(r.cmd))
+		}
+		fmt.Fprintf(w, "%s %s %s", r.shell, r.shellFlags, shellQuote(cmd))
+		if r.ignoreError {
+			fmt.Fprintf(w, " || true")
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
+}
+
+// expandQuery writes text expanded with global variables of g.
+func expandQuery(w io.Writer, text string, g *DepGraph) error {
+	err := g.loadVars()
+	if err != nil {
+		return err
+	}
+	v, _, err := parseExpr([]byte(text), nil, parseOp{})
+	if err != nil {
+		return err
+	}
+	ctx := newExecContext(g.vars, g.vpaths, false)
+	var buf evalBuffer
+	buf.resetSep()
+	err = v.Eval(&buf, ctx.ev)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, buf.String())
+	return nil
+}
+
+// inputs returns all inputs n depends on recursively, sorted.
+func inputs(n *DepNode) []string {
+	seen := make(map[string]bool)
+	visited := make(map[*DepNode]bool)
+	var walk func(n *DepNode)
+	walk = func(n *DepNode) {
+		if visited[n] {
+			return
+		}
+		visited[n] = true
+		for _, in := range n.ActualInputs {
+			seen[in] = true
+		}
+		for _, d := range n.Deps {
+			walk(d)
+		}
+	}
+	walk(n)
+	var ins []string
+	for in := range seen {
+		ins = append(ins, in)
+	}
+	sort.Strings(ins)
+	return ins
+}
+
+// escapeDepfilePath escapes s for a path in a make dependency file.
+func escapeDepfilePath(s string) string {
+	s = strings.Replace(s, "$", "$$", -1)
+	s = strings.Replace(s, "#", `\#`, -1)
+	return strings.Replace(s, " ", `\ `, -1)
+}
+
+// WriteDepfile writes a make dependency file to filename, which lists
+// all inputs target depends on recursively, like one generated by
+// `gcc -MD`.
+func WriteDepfile(filename, target string, g *DepGraph) (err error) {
+	n := findNode(g.nodes, target, make(map[*DepNode]bool))
+	if n == nil {
+		return fmt.Errorf("*** No rule to make target %q.", target)
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cerr := f.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+	fmt.Fprintf(f, "%s:", escapeDepfilePath(target))
+	for _, in := range inputs(n) {
+		fmt.Fprintf(f, " \\\n  %s", escapeDepfilePath(in))
+	}
+	fmt.Fprintln(f)
+	return nil
+}
+
+// ownership is targets defined by makefiles in a directory.
+type ownership struct {
+	dir      string
+	nodes    int
+	cmdBytes int
+}
+
+// showOwnership writes the number of targets and bytes of their
+// unevaluated commands for each directory of makefiles defining
+// them, largest first. Targets without rules are not counted.
+func showOwnership(w io.Writer, g *DepGraph) {
+	owners := make(map[string]*ownership)
+	seen := make(map[*DepNode]bool)
+	var walk func(nodes []*DepNode)
+	walk = func(nodes []*DepNode) {
+		for _, n := range nodes {
+			if seen[n] {
+				continue
+			}
+			seen[n] = true
+			if n.Filename != "" {
+				dir := filepath.Dir(n.Filename)
+				o, ok := owners[dir]
+				if !ok {
+					o = &ownership{dir: dir}
+					owners[dir] = o
+				}
+				o.nodes++
+				for _, cmd := range n.Cmds {
+					o.cmdBytes += len(cmd)
+				}
+			}
+			walk(n.Deps)
+			walk(n.OrderOnlys)
+		}
+	}
+	walk(g.nodes)
+	var owned []*ownership
+	for _, o := range owners {
+		owned = append(owned, o)
+	}
+	sort.Slice(owned, func(i, j int) bool {
+		if owned[i].cmdBytes != owned[j].cmdBytes {
+			return owned[i].cmdBytes > owned[j].cmdBytes
+		}
+		if owned[i].nodes != owned[j].nodes {
+			return owned[i].nodes > owned[j].nodes
+		}
+		return owned[i].dir < owned[j].dir
+	})
+	fmt.Fprintf(w, "%8s %12s %s\n", "targets", "cmd_bytes", "directory")
+	for _, o := range owned {
+		fmt.Fprintf(w, "%8d %12d %s\n", o.nodes, o.cmdBytes, o.dir)
+	}
+}
+
 // Query queries q in g.
-func Query(w io.Writer, q string, g *DepGraph) {
+// "script:<target>" prints a shell script to reproduce building target.
+// "inputs:<target>" prints all inputs target depends on recursively.
+// "$RULE_CONFLICTS" prints overridden commands as JSON.
+// "whynorule:<target>" explains why target has or has no rule,
+// which needs rules kept by LoadReq.KeepRules.
+// "$OWNERSHIP" prints the number of targets and bytes of commands for
+// each directory of makefiles defining them.
+// "expand:<text>" prints text expanded with global variables, e.g.
+// "expand:$(OUT_DIR)/bin".
+// Queries on a graph loaded by a LoadSaver don't read makefiles. Load
+// its snapshot by LoadEvalSnapshot for vpath and rule conflicts.
+func Query(w io.Writer, q string, g *DepGraph) error {
+	if q == "$RULE_CONFLICTS" {
+		conflicts := g.conflicts
+		if conflicts == nil {
+			conflicts = []RuleConflict{}
+		}
+		b, err := json.MarshalIndent(conflicts, "", " ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\n", b)
+		return nil
+	}
+
+	if q == "$OWNERSHIP" {
+		showOwnership(w, g)
+		return nil
+	}
+
 	if q == "$MAKEFILE_LIST" {
 		for _, mk := range g.accessedMks {
 			fmt.Fprintf(w, "%s: state=%d\n", mk.Filename, mk.State)
 		}
-		return
+		return nil
 	}
 
 	if q == "$*" {
+		err := g.loadVars()
+		if err != nil {
+			return err
+		}
 		for k, v := range g.vars {
 			fmt.Fprintf(w, "%s=%s\n", k, v.String())
 		}
-		return
+		return nil
 	}
 
 	if q == "*" {
 		for _, n := range g.nodes {
 			fmt.Fprintf(w, "%s\n", n.Output)
 		}
-		return
+		return nil
+	}
+
+	if strings.HasPrefix(q, "script:") {
+		target := strings.TrimPrefix(q, "script:")
+		n := findNode(g.nodes, target, make(map[*DepNode]bool))
+		if n == nil {
+			return fmt.Errorf("*** No rule to make target %q.", target)
+		}
+		return showScript(w, n, g)
+	}
+	if strings.HasPrefix(q, "inputs:") {
+		target := strings.TrimPrefix(q, "inputs:")
+		n := findNode(g.nodes, target, make(map[*DepNode]bool))
+		if n == nil {
+			return fmt.Errorf("*** No rule to make target %q.", target)
+		}
+		for _, in := range inputs(n) {
+			fmt.Fprintln(w, in)
+		}
+		return nil
+	}
+	if strings.HasPrefix(q, "expand:") {
+		return expandQuery(w, strings.TrimPrefix(q, "expand:"), g)
+	}
+	if strings.HasPrefix(q, "whynorule:") {
+		return g.whyNoRule(w, strings.TrimPrefix(q, "whynorule:"))
 	}
 	handleNodeQuery(w, q, g.nodes)
+	return nil
 }
@@ -0,0 +1,305 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteDepfile(t *testing.T) {
+	dir := chdirTemp(t, map[string]string{
+		"Makefile": `all: prog
+prog: main.o util.o | outdir
+main.o: main.c util.h
+util.o: util.c util.h
+util.h: util.h.in gen$$.sh
+outdir:
+`,
+	})
+	mk := filepath.Join(dir, "Makefile")
+	g := mustLoad(t, LoadReq{Makefile: mk})
+	d := filepath.Join(dir, "prog.d")
+	err := WriteDepfile(d, "prog", g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `prog: \
+  gen$$.sh \
+  main.c \
+  main.o \
+  util.c \
+  util.h \
+  util.h.in \
+  util.o
+`
+	if string(got) != want {
+		t.Errorf("WriteDepfile(%q)=%q; want %q", "prog", got, want)
+	}
+	err = WriteDepfile(d, "missing", g)
+	if err == nil {
+		t.Errorf("WriteDepfile(%q)=nil; want error", "missing")
+	}
+}
+
+func TestQueryOwnership(t *testing.T) {
+	chdirTemp(t, map[string]string{
+		"Makefile": `all: prog
+prog: lib/a.o lib/b.o
+	cc -o $@ $^
+include lib/lib.mk
+`,
+		"lib/lib.mk": `lib/a.o:
+	cc -c -o $@ a.c
+lib/b.o:
+	cc -c -o $@ b.c
+`,
+	})
+
+	g := mustLoad(t, LoadReq{Makefile: "Makefile"})
+	var buf bytes.Buffer
+	err := Query(&buf, "$OWNERSHIP", g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ` targets    cmd_bytes directory
+       2           30 lib
+       2           11 .
+`
+	if got := buf.String(); got != want {
+		t.Errorf("Query($OWNERSHIP)=\n%s\nwant=\n%s", got, want)
+	}
+}
+
+func TestQueryWhyNoRule(t *testing.T) {
+	chdirTemp(t, map[string]string{
+		"src/b.c": "",
+		"Makefile": `vpath %.c src
+all: a.o b.o
+	echo $^
+obj/%.o: %.c
+	cc -c -o $@ $<
+%.o: %.c
+	cc -c -o $@ $<
+`,
+	})
+
+	g := mustLoad(t, LoadReq{Makefile: "Makefile", NoBuiltinRules: true, KeepRules: true})
+	for _, tc := range []struct {
+		target string
+		want   string
+	}{
+		{
+			target: "all",
+			want: `all: EXPLICIT_RULE
+  Makefile:2: explicit rule
+`,
+		},
+		{
+			target: "b.o",
+			want: `b.o: IMPLICIT_RULE
+  Makefile:6: pattern rule %.o: %.c
+`,
+		},
+		{
+			target: "src/b.c",
+			want: `src/b.c: SOURCE_FILE
+  found as src/b.c
+`,
+		},
+		{
+			target: "a.o",
+			want: `a.o: NO_MATCHING_IMPLICIT_RULE
+  Makefile:6: pattern rule %.o: %.c: prerequisite "a.c" doesn't exist and has no explicit rule
+  vpath %.c: src/a.c doesn't exist
+  Makefile:4: obj/%.o: target doesn't match the pattern
+`,
+		},
+		{
+			target: "a.h",
+			want: `a.h: NO_RULE
+`,
+		},
+	} {
+		var buf bytes.Buffer
+		err := Query(&buf, "whynorule:"+tc.target, g)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != tc.want {
+			t.Errorf("Query(whynorule:%s)=\n%s\nwant=\n%s", tc.target, got, tc.want)
+		}
+	}
+
+	g, err := Load(LoadReq{Makefile: "Makefile"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Query(ioutil.Discard, "whynorule:a.o", g)
+	if err != errNoRules {
+		t.Errorf("Query(whynorule:a.o) without KeepRules=%v; want %v", err, errNoRules)
+	}
+}
+
+func TestQueryEvalSnapshot(t *testing.T) {
+	chdirTemp(t, map[string]string{
+		"src/main.c": "",
+		"Makefile": `OUT := out
+BIN = $(OUT)/bin
+vpath %.c src
+prog: main.c
+	cc -o $@ $^
+prog:
+	cc -o $@ $^ -lm
+`,
+	})
+
+	g := mustLoad(t, LoadReq{Makefile: "Makefile"})
+	err := GOB.Save(g, "graph.gob", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = SaveEvalSnapshot(g, "graph.snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err = GOB.Load("graph.gob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = LoadEvalSnapshot(g, "graph.snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := g.vpaths.exists("main.c"); !ok {
+		t.Errorf("vpath of main.c is not loaded: %#v", g.vpaths)
+	}
+	for _, tc := range []struct {
+		q    string
+		want string
+	}{
+		{
+			q:    "expand:$(BIN)/prog $(words a b)",
+			want: "out/bin/prog 2\n",
+		},
+		{
+			q:    "script:prog",
+			want: "cc -o prog main.c -lm",
+		},
+		{
+			q:    "$RULE_CONFLICTS",
+			want: `"target": "prog"`,
+		},
+	} {
+		var buf bytes.Buffer
+		err = Query(&buf, tc.q, g)
+		if err != nil {
+			t.Errorf("Query(%q)=%v", tc.q, err)
+			continue
+		}
+		if !strings.Contains(buf.String(), tc.want) {
+			t.Errorf("Query(%q)=%q; want %q", tc.q, buf.String(), tc.want)
+		}
+	}
+
+	err = ioutil.WriteFile("broken.snapshot", []byte("broken"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = LoadEvalSnapshot(g, "broken.snapshot")
+	if err == nil {
+		t.Errorf("LoadEvalSnapshot(broken.snapshot)=nil; want error")
+	}
+}
+
+func TestQueryScript(t *testing.T) {
+	dir := chdirTemp(t, map[string]string{
+		"in.txt": "in\n",
+		"Makefile": `export A := a b
+unexport B
+all: out/x
+out/x: export C := c'q
+out/x: FLAGS := -v
+out/x: in.txt
+	@mkdir -p $(@D)
+	-echo "$$A $$C $(FLAGS) $$B" > $@
+	cat $< >> $@
+`,
+	})
+	g := mustLoad(t, LoadReq{Makefile: "Makefile"})
+	var buf bytes.Buffer
+	err := Query(&buf, "script:out/x", g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := buf.String()
+	script = script[strings.Index(script, "# Recipe at"):]
+	want := `# Recipe at Makefile:7
+#
+# Target specific variables:
+#  C=c'q
+#  FLAGS=-v
+
+set -e
+cd ` + shellQuote(dir) + `
+export A='a b'
+unset B
+export MAKELEVEL='1'
+export C='c'\''q'
+
+/bin/sh -c 'mkdir -p out'
+echo 'echo "$A $C -v $B" > out/x'
+/bin/sh -c 'echo "$A $C -v $B" > out/x' || true
+echo 'cat in.txt >> out/x'
+/bin/sh -c 'cat in.txt >> out/x'
+`
+	if script != want {
+		t.Errorf("script:out/x=\n%s\nwant=\n%s", script, want)
+	}
+
+	// The script reproduces the recipe.
+	err = ioutil.WriteFile("script.sh", buf.Bytes(), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("/bin/sh", "script.sh")
+	cmd.Env = append(os.Environ(), "B=b")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("script.sh: %v\n%s", err, out)
+	}
+	b, err := ioutil.ReadFile("out/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "a b c'q -v \nin\n"; got != want {
+		t.Errorf("out/x=%q; want %q", got, want)
+	}
+
+	err = Query(&buf, "script:nosuchtarget", g)
+	if err == nil {
+		t.Errorf("Query(script:nosuchtarget)=nil; want error")
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"context"
+	"os"
+)
+
+// remakeIncludes runs rules of makefiles missing for include
+// directives, as GNU make does before it re-executes itself. It's an
+// error if a makefile has no rule, or its rule doesn't make it.
+// Makefiles which exist but are out of date are not remade.
+func remakeIncludes(ctx context.Context, er *evalResult, db *depBuilder, vars Vars) error {
+	var targets []string
+	for _, m := range er.missingIncludes {
+		targets = append(targets, m.filename)
+	}
+	nodes, err := db.Eval(targets)
+	if err != nil {
+		return err
+	}
+	hasRule := make(map[string]bool)
+	for _, n := range nodes {
+		hasRule[n.Output] = n.HasRule
+	}
+	for _, m := range er.missingIncludes {
+		if !hasRule[m.filename] {
+			return m.errorf("%v\nNOTE: kati has no rule to make it", m.err)
+		}
+	}
+
+	ex, err := NewExecutor(nil)
+	if err != nil {
+		return err
+	}
+	err = ex.ExecContext(ctx, &DepGraph{
+		nodes:   nodes,
+		vars:    vars,
+		exports: er.exports,
+		vpaths:  er.vpaths,
+	}, targets)
+	if err != nil {
+		return err
+	}
+	// Recipes may have changed directories cached while loading.
+	fsCache = newFsCache()
+	for _, m := range er.missingIncludes {
+		if _, err := os.Stat(m.filename); err != nil {
+			return m.errorf("%v\nNOTE: the rule didn't make it", m.err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,254 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// reportTopN is the number of rows in ranking tables of the report.
+const reportTopN = 20
+
+type reportCount struct {
+	Name    string
+	Count   int
+	Percent string
+}
+
+type reportSrcpos struct {
+	Target   string
+	Filename string
+	Lineno   int
+}
+
+type reportDupCmd struct {
+	Cmd     string
+	Count   int
+	Targets []reportSrcpos
+}
+
+// graphReport is statistics of a DepGraph shown by WriteHTMLReport.
+type graphReport struct {
+	Version    string
+	Nodes      int
+	Sizes      []reportCount
+	RuleTypes  []reportCount
+	Phony      reportCount
+	CmdLengths []reportCount
+	TopDirs    []reportCount
+	DupCmds    []reportDupCmd
+}
+
+// WriteHTMLReport writes statistics of g as an HTML page: counts of
+// targets by rule type, a histogram of command lengths, directories
+// with most targets, the ratio of phony targets, and commands shared
+// by targets of explicit rules, with links to the makefiles. Commands
+// are not evaluated.
+func WriteHTMLReport(w io.Writer, g *DepGraph) error {
+	return reportTemplate.Execute(w, newGraphReport(g))
+}
+
+func newGraphReport(g *DepGraph) *graphReport {
+	var nodes []*DepNode
+	seen := make(map[*DepNode]bool)
+	var walk func(ns []*DepNode)
+	walk = func(ns []*DepNode) {
+		for _, n := range ns {
+			if seen[n] {
+				continue
+			}
+			seen[n] = true
+			nodes = append(nodes, n)
+			walk(n.Deps)
+			walk(n.OrderOnlys)
+		}
+	}
+	walk(g.nodes)
+
+	total := len(nodes)
+	count := func(name string, n int) reportCount {
+		c := reportCount{Name: name, Count: n, Percent: "-"}
+		if total > 0 {
+			c.Percent = fmt.Sprintf("%.1f%%", float64(n)*100/float64(total))
+		}
+		return c
+	}
+
+	// Upper bounds of buckets of command lengths.
+	lengths := []int{1, 64, 256, 1024, 4096, 16384}
+	histogram := make([]int, len(lengths)+1)
+	var explicit, pattern, noCmds, noRule, phony int
+	var cmdSize, depsCnt, orderOnlysCnt, tsvCnt int
+	dirs := make(map[string]int)
+	cmds := make(map[string][]*DepNode)
+	for _, n := range nodes {
+		switch {
+		case !n.HasRule:
+			noRule++
+		case len(n.Cmds) == 0:
+			noCmds++
+		case n.IsPatternRule:
+			pattern++
+		default:
+			explicit++
+		}
+		if n.IsPhony {
+			phony++
+		}
+		cmd := strings.Join(n.Cmds, "\n")
+		i := sort.SearchInts(lengths, len(cmd)+1)
+		histogram[i]++
+		cmdSize += len(cmd)
+		depsCnt += len(n.Deps)
+		orderOnlysCnt += len(n.OrderOnlys)
+		tsvCnt += len(n.TargetSpecificVars)
+		if n.HasRule && !n.IsPhony {
+			dirs[filepath.Dir(n.Output)]++
+		}
+		if cmd != "" && !n.IsPatternRule {
+			cmds[cmd] = append(cmds[cmd], n)
+		}
+	}
+
+	r := &graphReport{
+		Version: gitVersion,
+		Nodes:   total,
+		Sizes: []reportCount{
+			{Name: "targets", Count: total},
+			{Name: "command bytes", Count: cmdSize, Percent: human(cmdSize)},
+			{Name: "prerequisites", Count: depsCnt},
+			{Name: "order-only prerequisites", Count: orderOnlysCnt},
+			{Name: "target specific variables", Count: tsvCnt},
+			{Name: "global variables", Count: len(g.vars) + len(g.serializedVars)},
+			{Name: "makefiles", Count: len(g.accessedMks)},
+		},
+		RuleTypes: []reportCount{
+			count("explicit rule with commands", explicit),
+			count("pattern or suffix rule", pattern),
+			count("rule without commands", noCmds),
+			count("no rule (source file)", noRule),
+		},
+		Phony: count("phony", phony),
+	}
+	for i, n := range histogram {
+		var name string
+		switch {
+		case i == 0:
+			name = "empty"
+		case i == len(lengths):
+			name = fmt.Sprintf(">= %d", lengths[i-1])
+		default:
+			name = fmt.Sprintf("%d - %d", lengths[i-1], lengths[i]-1)
+		}
+		r.CmdLengths = append(r.CmdLengths, count(name, n))
+	}
+
+	for dir, n := range dirs {
+		r.TopDirs = append(r.TopDirs, count(dir, n))
+	}
+	sort.Slice(r.TopDirs, func(i, j int) bool {
+		if r.TopDirs[i].Count != r.TopDirs[j].Count {
+			return r.TopDirs[i].Count > r.TopDirs[j].Count
+		}
+		return r.TopDirs[i].Name < r.TopDirs[j].Name
+	})
+	if len(r.TopDirs) > reportTopN {
+		r.TopDirs = r.TopDirs[:reportTopN]
+	}
+
+	for cmd, ns := range cmds {
+		if len(ns) < 2 {
+			continue
+		}
+		d := reportDupCmd{Cmd: cmd, Count: len(ns)}
+		for _, n := range ns {
+			d.Targets = append(d.Targets, reportSrcpos{
+				Target:   n.Output,
+				Filename: n.Filename,
+				Lineno:   n.Lineno,
+			})
+		}
+		r.DupCmds = append(r.DupCmds, d)
+	}
+	sort.Slice(r.DupCmds, func(i, j int) bool {
+		if r.DupCmds[i].Count != r.DupCmds[j].Count {
+			return r.DupCmds[i].Count > r.DupCmds[j].Count
+		}
+		return r.DupCmds[i].Cmd < r.DupCmds[j].Cmd
+	})
+	if len(r.DupCmds) > reportTopN {
+		r.DupCmds = r.DupCmds[:reportTopN]
+	}
+	return r
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"srcURL": func(p reportSrcpos) string {
+		return fmt.Sprintf("%s#L%d", p.Filename, p.Lineno)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>kati build graph report</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+th, td { border: 1px solid #ccc; padding: 2px 8px; text-align: left; }
+td.num { text-align: right; }
+pre { margin: 0; max-width: 80em; overflow: auto; }
+</style>
+</head>
+<body>
+<h1>kati build graph report</h1>
+<p>{{.Nodes}} targets, generated by kati {{.Version}}.</p>
+
+<h2>Sizes</h2>
+<table>
+{{range .Sizes}}<tr><th>{{.Name}}</th><td class="num">{{.Count}}</td><td>{{.Percent}}</td></tr>
+{{end}}</table>
+
+<h2>Rule types</h2>
+<table>
+<tr><th>type</th><th>targets</th><th>%</th></tr>
+{{range .RuleTypes}}<tr><td>{{.Name}}</td><td class="num">{{.Count}}</td><td class="num">{{.Percent}}</td></tr>
+{{end}}{{with .Phony}}<tr><td>{{.Name}}</td><td class="num">{{.Count}}</td><td class="num">{{.Percent}}</td></tr>
+{{end}}</table>
+
+<h2>Command lengths</h2>
+<table>
+<tr><th>bytes</th><th>targets</th><th>%</th></tr>
+{{range .CmdLengths}}<tr><td>{{.Name}}</td><td class="num">{{.Count}}</td><td class="num">{{.Percent}}</td></tr>
+{{end}}</table>
+
+<h2>Top directories</h2>
+<table>
+<tr><th>directory</th><th>targets</th><th>%</th></tr>
+{{range .TopDirs}}<tr><td>{{.Name}}</td><td class="num">{{.Count}}</td><td class="num">{{.Percent}}</td></tr>
+{{end}}</table>
+
+<h2>Duplicate commands</h2>
+<table>
+<tr><th>command</th><th>targets</th><th>rules</th></tr>
+{{range .DupCmds}}<tr><td><pre>{{.Cmd}}</pre></td><td class="num">{{.Count}}</td><td>{{range .Targets}}<a href="{{srcURL .}}">{{.Filename}}:{{.Lineno}}</a> {{.Target}}<br>{{end}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
@@ -0,0 +1,71 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHTMLReport(t *testing.T) {
+	chdirTemp(t, map[string]string{
+		"Makefile": `.PHONY: all
+all: out/a.o out/b.o out/c.stamp
+out/a.o: a.c
+	cc -c -o $@ $< <&1
+out/b.o: b.c
+	cc -c -o $@ $< <&1
+out/%.stamp:
+	touch $@
+`,
+	})
+	g := mustLoad(t, LoadReq{Makefile: "Makefile"})
+	r := newGraphReport(g)
+	if got, want := r.Nodes, 6; got != want {
+		t.Errorf("Nodes=%d; want %d", got, want)
+	}
+	var types []int
+	for _, c := range r.RuleTypes {
+		types = append(types, c.Count)
+	}
+	if want := []int{2, 1, 1, 2}; !reflect.DeepEqual(types, want) {
+		t.Errorf("rule types=%v; want %v", types, want)
+	}
+	if got, want := r.Phony.Count, 1; got != want {
+		t.Errorf("phony=%d; want %d", got, want)
+	}
+	if len(r.TopDirs) == 0 || r.TopDirs[0] != (reportCount{Name: "out", Count: 3, Percent: "50.0%"}) {
+		t.Errorf("TopDirs=%v; want out first", r.TopDirs)
+	}
+	if len(r.DupCmds) != 1 || r.DupCmds[0].Count != 2 {
+		t.Fatalf("DupCmds=%v; want a command of 2 targets", r.DupCmds)
+	}
+
+	var buf bytes.Buffer
+	err := WriteHTMLReport(&buf, g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`<pre>cc -c -o $@ $&lt; &lt;&amp;1</pre>`,
+		`<a href="Makefile#L4">Makefile:4</a> out/a.o`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("report doesn't contain %q:\n%s", want, buf.String())
+		}
+	}
+}
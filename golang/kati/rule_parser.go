@@ -68,6 +68,9 @@ type rule struct {
 	outputPatterns  []pattern
 	isDoubleColon   bool
 	isSuffixRule    bool
+	// isStaticPattern is true for rules expanded from a static
+	// pattern rule.
+	isStaticPattern bool
 	cmds            []string
 	cmdLineno       int
 }
@@ -124,19 +127,8 @@ func (r *rule) parseInputs(s []byte) {
 			}
 			continue
 		}
-		input = unescapeInput(input)
-		if !hasWildcardMetaByte(input) {
-			add(internBytes(input))
-			continue
-		}
-		m, _ := fsCache.Glob(string(input))
-		if len(m) == 0 {
-			add(internBytes(input))
-			continue
-		}
-		for _, t := range m {
-			add(intern(t))
-		}
+		// Wildcards are expanded by depBuilder.
+		add(internBytes(unescapeInput(input)))
 	}
 }
 
@@ -144,10 +136,14 @@ func (r *rule) parseVar(s []byte, rhs expr) (*assignAST, error) {
 	var lhsBytes []byte
 	var op string
 	// TODO(ukai): support override, export.
-	if s[len(s)-1] != '=' {
-		panic(fmt.Sprintf("unexpected lhs %q", s))
+	if len(s) == 0 || s[len(s)-1] != '=' {
+		return nil, fmt.Errorf("*** unexpected lhs %q", s)
+	}
+	var c byte
+	if len(s) > 1 {
+		c = s[len(s)-2] // s[len(s)-1] is '='
 	}
-	switch s[len(s)-2] { // s[len(s)-1] is '='
+	switch c {
 	case ':':
 		lhsBytes = trimSpaceBytes(s[:len(s)-2])
 		op = ":="
@@ -218,7 +214,7 @@ func (r *rule) parse(line []byte, assign *assignAST, rhs expr) (*assignAST, erro
 	rest := line[index:]
 	if assign != nil {
 		if len(rest) > 0 {
-			panic(fmt.Sprintf("pattern specific var? line:%q", line))
+			return nil, fmt.Errorf("*** pattern specific var? line:%q", line)
 		}
 		return assign, nil
 	}
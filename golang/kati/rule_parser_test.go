@@ -180,6 +180,20 @@ func TestRuleParser(t *testing.T) {
 				op:  ":=",
 			},
 		},
+		{
+			in: "foo: bar",
+			tsv: &assignAST{
+				lhs: literal("CFLAGS"),
+				rhs: literal("-g"),
+				op:  "=",
+			},
+			err: `*** pattern specific var? line:"foo: bar"`,
+		},
+		{
+			in:  "foo: ",
+			rhs: expr{literal("-g")},
+			err: `*** unexpected lhs " "`,
+		},
 		/* TODO
 		{
 			in:  "foo.o: %.c: %.c",
@@ -0,0 +1,78 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// fileSnapshot is the modification times of files under a directory.
+type fileSnapshot map[string]time.Time
+
+// snapshotFiles returns the fileSnapshot of files under dir. Files
+// created by kati itself, e.g. .kati_cache, are ignored.
+func snapshotFiles(dir string) (fileSnapshot, error) {
+	s := make(fileSnapshot)
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// The file may be removed by a recipe running in
+			// parallel.
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".kati_") {
+			return nil
+		}
+		s[filepath.Clean(path)] = fi.ModTime()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// written returns files created or modified in after, in sorted order.
+func (s fileSnapshot) written(after fileSnapshot) []string {
+	var files []string
+	for f, t := range after {
+		if bt, ok := s[f]; ok && bt.Equal(t) {
+			continue
+		}
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// undeclaredOutputs returns files written by the recipe of n, other
+// than the output of n.
+func undeclaredOutputs(n *DepNode, before, after fileSnapshot) []string {
+	output := filepath.Clean(n.Output)
+	var files []string
+	for _, f := range before.written(after) {
+		if f == output {
+			continue
+		}
+		files = append(files, f)
+	}
+	return files
+}
@@ -0,0 +1,65 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUndeclaredOutputs(t *testing.T) {
+	dir := chdirTemp(t, nil)
+	write := func(name string) {
+		err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("src.c")
+	write("stale.o")
+	write(".kati_cache")
+	before, err := snapshotFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	write("out.o")
+	write("tmp.d")
+	write(".kati_cache")
+	// Modification times may not have enough resolution.
+	future := time.Now().Add(time.Hour)
+	err = os.Chtimes(filepath.Join(dir, "stale.o"), future, future)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := snapshotFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := &DepNode{Output: filepath.Join(dir, "out.o")}
+	got := undeclaredOutputs(n, before, after)
+	want := []string{
+		filepath.Join(dir, "stale.o"),
+		filepath.Join(dir, "tmp.d"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("undeclaredOutputs(%q)=%q; want %q", n.Output, got, want)
+	}
+}
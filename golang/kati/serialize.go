@@ -25,9 +25,12 @@ import (
 	"io/ioutil"
 	"net/url"
 	"os"
+	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/glog"
@@ -55,13 +58,19 @@ var JSON LoadSaver
 // GOB is a gob loader/saver.
 var GOB LoadSaver
 
+// PROTO is a loader/saver of protocol buffers in the schema of
+// graph.proto, for tools not written in Go.
+var PROTO LoadSaver
+
 func init() {
 	JSON = jsonLoadSaver{}
 	GOB = gobLoadSaver{}
+	PROTO = protoLoadSaver{}
 }
 
 type jsonLoadSaver struct{}
 type gobLoadSaver struct{}
+type protoLoadSaver struct{}
 
 type dumpbuf struct {
 	w   bytes.Buffer
@@ -110,6 +119,8 @@ type serializableVar struct {
 	V        string
 	Origin   string
 	Children []serializableVar
+	// Export is true for exported target specific variables.
+	Export bool `json:",omitempty"`
 }
 
 type serializableDepNode struct {
@@ -120,6 +131,9 @@ type serializableDepNode struct {
 	Parents            []int
 	HasRule            bool
 	IsPhony            bool
+	IsIntermediate     bool
+	IsPrecious         bool
+	IsPatternRule      bool
 	ActualInputs       []int
 	TargetSpecificVars []int
 	Filename           string
@@ -132,13 +146,17 @@ type serializableTargetSpecificVar struct {
 }
 
 type serializableGraph struct {
-	Nodes       []*serializableDepNode
-	Vars        map[string]serializableVar
-	Tsvs        []serializableTargetSpecificVar
-	Targets     []string
-	Roots       []string
-	AccessedMks []*accessedMakefile
-	Exports     map[string]bool
+	Nodes         []*serializableDepNode
+	Vars          map[string]serializableVar
+	Tsvs          []serializableTargetSpecificVar
+	Targets       []string
+	Roots         []string
+	AccessedMks   []*accessedMakefile
+	Exports       map[string]bool
+	ExportAll     bool
+	DeleteOnError bool
+	UsedEnvs      map[string]bool
+	EnvHash       [sha1.Size]byte
 }
 
 func encGob(v interface{}) (string, error) {
@@ -187,16 +205,85 @@ func (ns *depNodesSerializer) serializeTarget(t string) int {
 	return id
 }
 
-func (ns *depNodesSerializer) serializeDepNodes(nodes []*DepNode) {
-	if ns.err != nil {
-		return
-	}
+// collectDepNodes appends nodes reachable from nodes which are not
+// collected yet to dst in depth first order.
+func (ns *depNodesSerializer) collectDepNodes(dst []*DepNode, nodes []*DepNode) []*DepNode {
 	for _, n := range nodes {
 		if ns.done[n.Output] {
 			continue
 		}
 		ns.done[n.Output] = true
+		dst = append(dst, n)
+		dst = ns.collectDepNodes(dst, n.Deps)
+		dst = ns.collectDepNodes(dst, n.OrderOnlys)
+	}
+	return dst
+}
+
+// encodedTsv is a target specific variable of a node, serialized and
+// encoded to be deduplicated.
+type encodedTsv struct {
+	sv  serializableTargetSpecificVar
+	key string
+}
+
+func encodeTsvs(n *DepNode) ([]encodedTsv, error) {
+	// Sort keys for consistent serialization.
+	var tsvKeys []string
+	for k := range n.TargetSpecificVars {
+		tsvKeys = append(tsvKeys, k)
+	}
+	sort.Strings(tsvKeys)
+
+	var tsvs []encodedTsv
+	for _, k := range tsvKeys {
+		v := n.TargetSpecificVars[k]
+		sv := serializableTargetSpecificVar{Name: k, Value: v.serialize()}
+		//gob := encGob(sv)
+		gob, err := encVar(k, v)
+		if err != nil {
+			return nil, err
+		}
+		tsvs = append(tsvs, encodedTsv{sv: sv, key: gob})
+	}
+	return tsvs, nil
+}
+
+// serializeDepNodes serializes nodes and their dependencies.
+// Serializing target specific variables dominates, so it runs in
+// parallel. Values shared by nodes may be parsed on first use, which
+// recursiveVar guards with parseOnce. Targets and variables are interned in depth first order
+// afterwards, so ids don't depend on scheduling.
+func (ns *depNodesSerializer) serializeDepNodes(nodes []*DepNode) {
+	if ns.err != nil {
+		return
+	}
+	nodes = ns.collectDepNodes(nil, nodes)
+
+	tsvs := make([][]encodedTsv, len(nodes))
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	var next int64 = -1
+	for w := 0; w < runtime.GOMAXPROCS(0); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= len(nodes) {
+					return
+				}
+				tsvs[i], errs[i] = encodeTsvs(nodes[i])
+			}
+		}()
+	}
+	wg.Wait()
 
+	for i, n := range nodes {
+		if errs[i] != nil {
+			ns.err = errs[i]
+			return
+		}
 		var deps []int
 		for _, d := range n.Deps {
 			deps = append(deps, ns.serializeTarget(d.Output))
@@ -214,28 +301,13 @@ func (ns *depNodesSerializer) serializeDepNodes(nodes []*DepNode) {
 			actualInputs = append(actualInputs, ns.serializeTarget(i))
 		}
 
-		// Sort keys for consistent serialization.
-		var tsvKeys []string
-		for k := range n.TargetSpecificVars {
-			tsvKeys = append(tsvKeys, k)
-		}
-		sort.Strings(tsvKeys)
-
 		var vars []int
-		for _, k := range tsvKeys {
-			v := n.TargetSpecificVars[k]
-			sv := serializableTargetSpecificVar{Name: k, Value: v.serialize()}
-			//gob := encGob(sv)
-			gob, err := encVar(k, v)
-			if err != nil {
-				ns.err = err
-				return
-			}
-			id, present := ns.tsvMap[gob]
+		for _, tsv := range tsvs[i] {
+			id, present := ns.tsvMap[tsv.key]
 			if !present {
 				id = len(ns.tsvs)
-				ns.tsvMap[gob] = id
-				ns.tsvs = append(ns.tsvs, sv)
+				ns.tsvMap[tsv.key] = id
+				ns.tsvs = append(ns.tsvs, tsv.sv)
 			}
 			vars = append(vars, id)
 		}
@@ -248,19 +320,14 @@ func (ns *depNodesSerializer) serializeDepNodes(nodes []*DepNode) {
 			Parents:            parents,
 			HasRule:            n.HasRule,
 			IsPhony:            n.IsPhony,
+			IsIntermediate:     n.IsIntermediate,
+			IsPrecious:         n.IsPrecious,
+			IsPatternRule:      n.IsPatternRule,
 			ActualInputs:       actualInputs,
 			TargetSpecificVars: vars,
 			Filename:           n.Filename,
 			Lineno:             n.Lineno,
 		})
-		ns.serializeDepNodes(n.Deps)
-		if ns.err != nil {
-			return
-		}
-		ns.serializeDepNodes(n.OrderOnlys)
-		if ns.err != nil {
-			return
-		}
 	}
 }
 
@@ -273,21 +340,32 @@ func makeSerializableVars(vars Vars) (r map[string]serializableVar) {
 }
 
 func makeSerializableGraph(g *DepGraph, roots []string) (serializableGraph, error) {
+	if g.parts != nil {
+		return serializableGraph{}, errMergedGraph
+	}
 	ns := newDepNodesSerializer()
 	ns.serializeDepNodes(g.nodes)
-	v := makeSerializableVars(g.vars)
+	v := g.serializedVars
+	if v == nil {
+		v = makeSerializableVars(g.vars)
+	}
 	return serializableGraph{
-		Nodes:       ns.nodes,
-		Vars:        v,
-		Tsvs:        ns.tsvs,
-		Targets:     ns.targets,
-		Roots:       roots,
-		AccessedMks: g.accessedMks,
-		Exports:     g.exports,
+		Nodes:         ns.nodes,
+		Vars:          v,
+		Tsvs:          ns.tsvs,
+		Targets:       ns.targets,
+		Roots:         roots,
+		AccessedMks:   g.accessedMks,
+		Exports:       g.exports,
+		ExportAll:     g.exportAll,
+		DeleteOnError: g.deleteOnError,
+		UsedEnvs:      g.usedEnvs,
+		EnvHash:       g.envHash,
 	}, ns.err
 }
 
 func (jsonLoadSaver) Save(g *DepGraph, filename string, roots []string) error {
+	defer startPhase(phaseSerialize)()
 	startTime := time.Now()
 	sg, err := makeSerializableGraph(g, roots)
 	if err != nil {
@@ -315,6 +393,7 @@ func (jsonLoadSaver) Save(g *DepGraph, filename string, roots []string) error {
 }
 
 func (gobLoadSaver) Save(g *DepGraph, filename string, roots []string) error {
+	defer startPhase(phaseSerialize)()
 	startTime := time.Now()
 	f, err := os.Create(filename)
 	if err != nil {
@@ -354,6 +433,75 @@ func cacheFilename(mk string, roots []string) string {
 	return url.QueryEscape(filename)
 }
 
+// cacheIgnoredEnvs are environment variables which don't invalidate
+// the cache, in addition to LoadReq.CacheIgnoreEnvs.
+var cacheIgnoredEnvs = []string{"TMPDIR"}
+
+// cacheEnvs returns usedEnvs except ones ignored for the cache,
+// sorted.
+func cacheEnvs(req LoadReq, usedEnvs map[string]bool) []string {
+	ignored := make(map[string]bool)
+	for _, name := range cacheIgnoredEnvs {
+		ignored[name] = true
+	}
+	for _, name := range req.CacheIgnoreEnvs {
+		ignored[name] = true
+	}
+	var names []string
+	for name := range usedEnvs {
+		if !ignored[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// envHash returns the digest of values of names in envs, which is a
+// list of NAME=VALUE.
+func envHash(names, envs []string) [sha1.Size]byte {
+	values := make(map[string]string)
+	for _, kv := range envs {
+		if i := strings.IndexByte(kv, '='); i >= 0 {
+			values[kv[:i]] = kv[i+1:]
+		}
+	}
+	h := sha1.New()
+	for _, name := range names {
+		v, ok := values[name]
+		fmt.Fprintf(h, "%s\x00%t\x00%s\x00", name, ok, v)
+	}
+	var sum [sha1.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// refreshEnvVars replaces variables from the environment in vars
+// with ones in envs, as they may differ from the environment the
+// cache was saved in.
+func refreshEnvVars(vars Vars, envs []string) error {
+	for name, v := range vars {
+		if v.Origin() == "environment" {
+			delete(vars, name)
+		}
+	}
+	for _, kv := range envs {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			return fmt.Errorf("A weird environment variable %q", kv)
+		}
+		if _, ok := vars[kv[:i]]; ok {
+			continue
+		}
+		vars[kv[:i]] = &recursiveVar{
+			expr:     literal(kv[i+1:]),
+			origin:   "environment",
+			unparsed: true,
+		}
+	}
+	return nil
+}
+
 func saveCache(g *DepGraph, roots []string) error {
 	if len(g.accessedMks) == 0 {
 		return fmt.Errorf("no Makefile is read")
@@ -373,7 +521,7 @@ func saveCache(g *DepGraph, roots []string) error {
 
 func deserializeSingleChild(sv serializableVar) (Value, error) {
 	if len(sv.Children) != 1 {
-		return nil, fmt.Errorf("unexpected number of children: %q", sv)
+		return nil, fmt.Errorf("unexpected number of children: %+v", sv)
 	}
 	return deserializeVar(sv.Children[0])
 }
@@ -431,12 +579,19 @@ func deserializeVar(sv serializableVar) (r Value, err error) {
 		if err != nil {
 			return nil, err
 		}
-		name, ok := dv.(literal)
-		if !ok {
+		// The name is tmpval if parsed without allocation.
+		switch dv.(type) {
+		case literal, tmpval:
+		default:
 			return nil, fmt.Errorf("func name is not literal %s: %T", dv, dv)
 		}
-		f := funcMap[string(name[1:])]()
-		f.AddArg(name)
+		name := dv.String()
+		mkf, ok := funcMap[name[1:]]
+		if !ok {
+			return nil, fmt.Errorf("unknown func %q", name)
+		}
+		f := mkf()
+		f.AddArg(dv)
 		for _, a := range sv.Children[1:] {
 			dv, err := deserializeVar(a)
 			if err != nil {
@@ -444,7 +599,7 @@ func deserializeVar(sv serializableVar) (r Value, err error) {
 			}
 			f.AddArg(dv)
 		}
-		return f, nil
+		return compactFunc(f), nil
 	case "funcEvalAssign":
 		rhs, err := deserializeVar(sv.Children[2])
 		if err != nil {
@@ -483,13 +638,32 @@ func deserializeVar(sv serializableVar) (r Value, err error) {
 			return nil, fmt.Errorf("not var: target specific var %s %T", dv, dv)
 		}
 		return &targetSpecificVar{
-			v:  v,
-			op: sv.Type,
+			v:      v,
+			op:     sv.Type,
+			export: sv.Export,
 		}, nil
 
 	default:
-		return nil, fmt.Errorf("unknown serialized variable type: %q", sv)
+		return nil, fmt.Errorf("unknown serialized variable type: %+v", sv)
+	}
+}
+
+// loadVars deserializes global variables of g if it was loaded by a
+// LoadSaver, which is deferred since queries of nodes don't need
+// them.
+func (g *DepGraph) loadVars() error {
+	if g.serializedVars == nil {
+		return nil
+	}
+	startTime := time.Now()
+	vars, err := deserializeVars(g.serializedVars)
+	if err != nil {
+		return err
 	}
+	g.vars = vars
+	g.serializedVars = nil
+	logStats("vars deserialize time: %q", time.Since(startTime))
+	return nil
 }
 
 func deserializeVars(vars map[string]serializableVar) (Vars, error) {
@@ -538,6 +712,9 @@ func deserializeNodes(g serializableGraph) (r []*DepNode, err error) {
 			Cmds:               n.Cmds,
 			HasRule:            n.HasRule,
 			IsPhony:            n.IsPhony,
+			IsIntermediate:     n.IsIntermediate,
+			IsPrecious:         n.IsPrecious,
+			IsPatternRule:      n.IsPatternRule,
 			ActualInputs:       actualInputs,
 			Filename:           n.Filename,
 			Lineno:             n.Lineno,
@@ -696,19 +873,20 @@ func deserializeGraph(g serializableGraph) (*DepGraph, error) {
 	if err != nil {
 		return nil, err
 	}
-	vars, err := deserializeVars(g.Vars)
-	if err != nil {
-		return nil, err
-	}
 	return &DepGraph{
-		nodes:       nodes,
-		vars:        vars,
-		accessedMks: g.AccessedMks,
-		exports:     g.Exports,
+		nodes:          nodes,
+		serializedVars: g.Vars,
+		accessedMks:    g.AccessedMks,
+		exports:        g.Exports,
+		exportAll:      g.ExportAll,
+		deleteOnError:  g.DeleteOnError,
+		usedEnvs:       g.UsedEnvs,
+		envHash:        g.EnvHash,
 	}, nil
 }
 
 func (jsonLoadSaver) Load(filename string) (*DepGraph, error) {
+	defer startPhase(phaseSerialize)()
 	startTime := time.Now()
 	f, err := os.Open(filename)
 	if err != nil {
@@ -731,6 +909,7 @@ func (jsonLoadSaver) Load(filename string) (*DepGraph, error) {
 }
 
 func (gobLoadSaver) Load(filename string) (*DepGraph, error) {
+	defer startPhase(phaseSerialize)()
 	startTime := time.Now()
 	f, err := os.Open(filename)
 	if err != nil {
@@ -752,13 +931,13 @@ func (gobLoadSaver) Load(filename string) (*DepGraph, error) {
 	return dg, nil
 }
 
-func loadCache(makefile string, roots []string) (*DepGraph, error) {
+func loadCache(req LoadReq) (*DepGraph, error) {
 	startTime := time.Now()
 	defer func() {
 		logStats("Cache lookup time: %q", time.Since(startTime))
 	}()
 
-	filename := cacheFilename(makefile, roots)
+	filename := cacheFilename(req.Makefile, req.Targets)
 	if !exists(filename) {
 		glog.Warningf("Cache not found %q", filename)
 		return nil, fmt.Errorf("cache not found: %s", filename)
@@ -766,7 +945,7 @@ func loadCache(makefile string, roots []string) (*DepGraph, error) {
 
 	g, err := GOB.Load(filename)
 	if err != nil {
-		glog.Warning("Cache load error %q: %v", filename, err)
+		glog.Warningf("Cache load error %q: %v", filename, err)
 		return nil, err
 	}
 	for _, mk := range g.accessedMks {
@@ -791,6 +970,19 @@ func loadCache(makefile string, roots []string) (*DepGraph, error) {
 			}
 		}
 	}
-	glog.Info("Cache found in %q", filename)
+	envs := cacheEnvs(req, g.usedEnvs)
+	if envHash(envs, req.EnvironmentVars) != g.envHash {
+		glog.Infof("Cache expired: environment variables %q", envs)
+		return nil, fmt.Errorf("cache expired: environment variables")
+	}
+	err = g.loadVars()
+	if err != nil {
+		return nil, err
+	}
+	err = refreshEnvVars(g.vars, req.EnvironmentVars)
+	if err != nil {
+		return nil, err
+	}
+	glog.Infof("Cache found in %q", filename)
 	return g, nil
 }
@@ -0,0 +1,313 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestMakeSerializableGraph(t *testing.T) {
+	c := &DepNode{Output: "c", HasRule: true}
+	b := &DepNode{
+		Output:  "b",
+		Deps:    []*DepNode{c},
+		HasRule: true,
+		TargetSpecificVars: Vars{
+			"Y": &targetSpecificVar{v: &simpleVar{value: []string{"y"}, origin: "file"}, op: ":="},
+			"X": &targetSpecificVar{v: &simpleVar{value: []string{"x"}, origin: "file"}, op: ":="},
+		},
+	}
+	a := &DepNode{
+		Output:       "a",
+		Deps:         []*DepNode{b, c},
+		HasRule:      true,
+		ActualInputs: []string{"b", "c"},
+		TargetSpecificVars: Vars{
+			"X": &targetSpecificVar{v: &simpleVar{value: []string{"x"}, origin: "file"}, op: ":="},
+		},
+	}
+	c.Parents = []*DepNode{a, b}
+	b.Parents = []*DepNode{a}
+
+	for i := 0; i < 10; i++ {
+		sg, err := makeSerializableGraph(&DepGraph{nodes: []*DepNode{a}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := sg.Targets, []string{"b", "c", "a"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("sg.Targets=%q; want %q", got, want)
+		}
+		var outputs []string
+		for _, n := range sg.Nodes {
+			outputs = append(outputs, sg.Targets[n.Output])
+		}
+		if got, want := outputs, []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("outputs=%q; want %q", got, want)
+		}
+		var tsvs [][]string
+		for _, n := range sg.Nodes {
+			var names []string
+			for _, id := range n.TargetSpecificVars {
+				names = append(names, sg.Tsvs[id].Name)
+			}
+			tsvs = append(tsvs, names)
+		}
+		if got, want := tsvs, [][]string{{"X"}, {"X", "Y"}, nil}; !reflect.DeepEqual(got, want) {
+			t.Errorf("tsvs=%q; want %q", got, want)
+		}
+		if got, want := len(sg.Tsvs), 2; got != want {
+			t.Errorf("len(sg.Tsvs)=%d; want %d", got, want)
+		}
+	}
+}
+
+func BenchmarkMakeSerializableGraph(b *testing.B) {
+	var nodes []*DepNode
+	var prev *DepNode
+	for i := 0; i < 10000; i++ {
+		n := &DepNode{
+			Output:       fmt.Sprintf("out/%d.o", i),
+			Cmds:         []string{"$(CC) -c $< -o $@"},
+			HasRule:      true,
+			ActualInputs: []string{fmt.Sprintf("src/%d.c", i)},
+			TargetSpecificVars: Vars{
+				"CFLAGS": &targetSpecificVar{
+					v:  &recursiveVar{expr: expr{literal("-O2 -I"), &varref{varname: literal("DIR")}}, origin: "file"},
+					op: "+=",
+				},
+				"DIR": &targetSpecificVar{v: &simpleVar{value: []string{fmt.Sprintf("dir%d", i%100)}, origin: "file"}, op: ":="},
+			},
+		}
+		if prev != nil {
+			n.Deps = []*DepNode{prev}
+			prev.Parents = []*DepNode{n}
+		}
+		nodes = append(nodes, n)
+		prev = n
+	}
+	g := &DepGraph{nodes: nodes}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := makeSerializableGraph(g, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestLoadCacheEnvs(t *testing.T) {
+	chdirTemp(t, map[string]string{
+		"Makefile": `ifeq ($(KATI_TEST_COND),1)
+X := yes
+endif
+X += $(TMPDIR)
+all:
+	echo $(X) $(KATI_TEST_RECIPE)
+`,
+	})
+	req := LoadReq{
+		Makefile:        "Makefile",
+		UseCache:        true,
+		EnvironmentVars: []string{"KATI_TEST_COND=1", "KATI_TEST_RECIPE=a", "TMPDIR=/tmp/1"},
+	}
+	_, err := Load(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		envs    []string
+		ok      bool
+		wantVar string
+	}{
+		{
+			envs:    []string{"KATI_TEST_COND=1", "KATI_TEST_RECIPE=b", "TMPDIR=/tmp/2"},
+			ok:      true,
+			wantVar: "b",
+		},
+		{
+			envs: []string{"KATI_TEST_COND=1", "KATI_TEST_RECIPE=a", "TMPDIR=/tmp/1", "KATI_TEST_NEW=1"},
+			ok:   true,
+		},
+		{
+			envs: []string{"KATI_TEST_COND=2", "KATI_TEST_RECIPE=a", "TMPDIR=/tmp/1"},
+		},
+		{
+			envs: []string{"KATI_TEST_RECIPE=a", "TMPDIR=/tmp/1"},
+		},
+	} {
+		req.EnvironmentVars = tc.envs
+		g, err := loadCache(req)
+		if (err == nil) != tc.ok {
+			t.Errorf("loadCache(%q)=_, %v; want ok=%t", tc.envs, err, tc.ok)
+			continue
+		}
+		if err != nil || tc.wantVar == "" {
+			continue
+		}
+		if got := g.vars.Lookup("KATI_TEST_RECIPE").String(); got != tc.wantVar {
+			t.Errorf("loadCache(%q): KATI_TEST_RECIPE=%q; want %q", tc.envs, got, tc.wantVar)
+		}
+	}
+}
+
+func TestProtoRoundTrip(t *testing.T) {
+	chdirTemp(t, map[string]string{
+		"Makefile": `export A := 1
+unexport B
+C = $(patsubst %.c,%.o,$(SRCS)) $(A:1=2)
+all: foo.o | dir
+foo.o: export D := $(C)
+foo.o: E += -O2
+%.o: %.c
+	cc $(E) -c $< -o $@
+foo.c:
+.DELETE_ON_ERROR:
+`,
+	})
+	g := mustLoad(t, LoadReq{Makefile: "Makefile", Targets: []string{"all"}})
+	sg, err := makeSerializableGraph(g, []string{"all"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := encodeProtoGraph(sg)
+	if !bytes.HasPrefix(b, []byte{1<<3 | protoVarint, GraphVersion}) {
+		t.Errorf("encoded graph starts with %x; want version field", b[:2])
+	}
+	got, err := decodeProtoGraph(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, used := range sg.UsedEnvs {
+		if !used {
+			delete(sg.UsedEnvs, name)
+		}
+	}
+	if !reflect.DeepEqual(got, sg) {
+		t.Errorf("decodeProtoGraph(encodeProtoGraph(sg))=\n%+v\nwant\n%+v", got, sg)
+	}
+
+	err = PROTO.Save(g, "graph.pb", []string{"all"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lg, err := PROTO.Load("graph.pb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lg.deleteOnError || !lg.exports["A"] || lg.exports["B"] {
+		t.Errorf("deleteOnError=%t exports=%v; want true, map[A:true B:false]", lg.deleteOnError, lg.exports)
+	}
+	var n *DepNode
+	for _, d := range lg.nodes[0].Deps {
+		if d.Output == "foo.o" {
+			n = d
+		}
+	}
+	if n == nil {
+		t.Fatalf("no foo.o in %v", lg.nodes[0].Deps)
+	}
+	tsv, ok := n.TargetSpecificVars["D"].(*targetSpecificVar)
+	if !ok || !tsv.export {
+		t.Errorf("D of foo.o=%v; want exported target specific var", n.TargetSpecificVars["D"])
+	}
+
+	b = encodeProtoGraph(serializableGraph{})
+	b[1] = GraphVersion + 1
+	_, err = decodeProtoGraph(b)
+	if err == nil {
+		t.Errorf("decodeProtoGraph(version %d)=_, nil; want error", GraphVersion+1)
+	}
+	b = encodeProtoGraph(sg)
+	_, err = decodeProtoGraph(b[:len(b)/2])
+	if err == nil {
+		t.Errorf("decodeProtoGraph(truncated)=_, nil; want error")
+	}
+}
+
+func TestLoadVarsLazily(t *testing.T) {
+	chdirTemp(t, map[string]string{
+		"Makefile": `X := hello
+all:
+	echo $(X)
+`,
+	})
+	g := mustLoad(t, LoadReq{Makefile: "Makefile"})
+	for _, ls := range []LoadSaver{GOB, JSON, PROTO} {
+		err := ls.Save(g, "graph", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lg, err := ls.Load("graph")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		err = Query(&buf, "all", lg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lg.vars != nil {
+			t.Errorf("%T: vars are deserialized by a node query", ls)
+		}
+		buf.Reset()
+		err = Query(&buf, "script:all", lg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "/bin/sh -c 'echo hello'\n"; !strings.HasSuffix(buf.String(), want) {
+			t.Errorf("%T: script:all=%q; want suffix %q", ls, buf.String(), want)
+		}
+		err = lg.LoadVars()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := lg.Vars().Lookup("X").String(); got != "hello" {
+			t.Errorf("%T: X=%q; want %q", ls, got, "hello")
+		}
+	}
+}
+
+func TestSerializeDepNodesSharedTsv(t *testing.T) {
+	// Nodes share a target specific variable parsed on first use,
+	// while their variables are serialized in parallel.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+	tsv := &targetSpecificVar{
+		v:  &recursiveVar{expr: literal("$(X) -O2"), origin: "command line", unparsed: true},
+		op: "=",
+	}
+	var nodes []*DepNode
+	for i := 0; i < 64; i++ {
+		nodes = append(nodes, &DepNode{
+			Output:             fmt.Sprintf("out%d", i),
+			TargetSpecificVars: Vars{"CFLAGS": tsv},
+		})
+	}
+	ns := newDepNodesSerializer()
+	ns.serializeDepNodes(nodes)
+	if ns.err != nil {
+		t.Fatal(ns.err)
+	}
+	for _, n := range ns.nodes {
+		if got, want := n.TargetSpecificVars, ns.nodes[0].TargetSpecificVars; len(got) != 1 || got[0] != want[0] {
+			t.Errorf("%s: tsvs=%v; want %v", ns.targets[n.Output], got, want)
+		}
+	}
+}
@@ -18,7 +18,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -57,6 +59,31 @@ var shBuiltins = []struct {
 		},
 		compact: compactShellDate,
 	},
+	{
+		name: "shell-uuidgen",
+		pattern: expr{
+			mustLiteralRE(`^uuidgen\s*$`),
+		},
+		compact: func(sh *funcShell, matches []Value) Value {
+			if ShellDateTimestamp.IsZero() {
+				return sh
+			}
+			return &funcShellUUID{funcShell: sh}
+		},
+	},
+	{
+		name: "shell-random",
+		// echo $$RANDOM
+		pattern: expr{
+			mustLiteralRE(`^echo \$RANDOM\s*$`),
+		},
+		compact: func(sh *funcShell, matches []Value) Value {
+			if ShellDateTimestamp.IsZero() {
+				return sh
+			}
+			return &funcShellRandom{funcShell: sh}
+		},
+	},
 }
 
 type funcShellAndroidRot13 struct {
@@ -91,11 +118,14 @@ func (f *funcShellAndroidRot13) Eval(w evalWriter, ev *Evaluator) error {
 	rot13(fargs[0])
 	w.Write(fargs[0])
 	abuf.release()
+	ev.setShellStatus(0)
 	return nil
 }
 
 var (
 	// ShellDateTimestamp is an timestamp used for $(shell date).
+	// If set, $(shell uuidgen) and $(shell echo $$RANDOM) also return
+	// pseudo random values seeded by it, so outputs are reproducible.
 	ShellDateTimestamp time.Time
 	shellDateFormatRef = map[string]string{
 		"%Y": "2006",
@@ -133,7 +163,65 @@ func compactShellDate(sh *funcShell, v []Value) Value {
 }
 
 func (f *funcShellDate) Eval(w evalWriter, ev *Evaluator) error {
-	fmt.Fprint(w, ShellDateTimestamp.Format(f.format))
+	// %s, seconds since the epoch, has no layout in time.Format.
+	for i, s := range strings.Split(f.format, "%s") {
+		if i > 0 {
+			fmt.Fprint(w, ShellDateTimestamp.Unix())
+		}
+		fmt.Fprint(w, ShellDateTimestamp.Format(s))
+	}
+	ev.setShellStatus(0)
+	return nil
+}
+
+var shellRand struct {
+	mu   sync.Mutex
+	seed time.Time
+	r    *rand.Rand
+}
+
+// shellRandom returns the pseudo random generator for
+// $(shell uuidgen) and $(shell echo $$RANDOM), seeded by
+// ShellDateTimestamp. It is reset if ShellDateTimestamp changes.
+func shellRandom(fn func(r *rand.Rand)) {
+	shellRand.mu.Lock()
+	defer shellRand.mu.Unlock()
+	if shellRand.r == nil || !shellRand.seed.Equal(ShellDateTimestamp) {
+		shellRand.seed = ShellDateTimestamp
+		shellRand.r = rand.New(rand.NewSource(ShellDateTimestamp.UnixNano()))
+	}
+	fn(shellRand.r)
+}
+
+type funcShellUUID struct {
+	*funcShell
+}
+
+func (f *funcShellUUID) Eval(w evalWriter, ev *Evaluator) error {
+	var u [16]byte
+	shellRandom(func(r *rand.Rand) {
+		r.Read(u[:])
+	})
+	// version 4 and variant 10 as uuidgen -r.
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	fmt.Fprintf(w, "%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+	ev.setShellStatus(0)
+	return nil
+}
+
+type funcShellRandom struct {
+	*funcShell
+}
+
+func (f *funcShellRandom) Eval(w evalWriter, ev *Evaluator) error {
+	var n int
+	shellRandom(func(r *rand.Rand) {
+		// $RANDOM of bash is in [0, 32767].
+		n = r.Intn(32768)
+	})
+	fmt.Fprint(w, n)
+	ev.setShellStatus(0)
 	return nil
 }
 
@@ -15,6 +15,7 @@
 package kati
 
 import (
+	"regexp"
 	"testing"
 	"time"
 )
@@ -100,3 +101,41 @@ func TestShellDate(t *testing.T) {
 		}
 	}
 }
+
+func TestShellReproducible(t *testing.T) {
+	ts, usb := ShellDateTimestamp, UseShellBuiltins
+	defer func() {
+		ShellDateTimestamp, UseShellBuiltins = ts, usb
+	}()
+	UseShellBuiltins = true
+	eval := func(in string) string {
+		v, _, err := parseExpr([]byte(in), nil, parseOp{alloc: true})
+		if err != nil {
+			t.Fatalf("parseExpr(%q)=_, _, %v", in, err)
+		}
+		var buf evalBuffer
+		err = v.Eval(&buf, NewEvaluator(Vars{}))
+		if err != nil {
+			t.Fatalf("%q.Eval()=%v", in, err)
+		}
+		return buf.String()
+	}
+	ShellDateTimestamp = time.Unix(1600000000, 0).UTC()
+	if got, want := eval("$(shell date +%s.%Y)"), "1600000000.2020"; got != want {
+		t.Errorf("$(shell date +%%s.%%Y)=%q; want %q", got, want)
+	}
+
+	in := "$(shell uuidgen) $(shell echo $$RANDOM) $(shell echo $$RANDOM)"
+	want := eval(in)
+	uuidRE := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12} \d+ \d+$`)
+	if !uuidRE.MatchString(want) {
+		t.Errorf("%s=%q; want match with %s", in, want, uuidRE)
+	}
+	// Reset by another timestamp to get the same sequence again.
+	ShellDateTimestamp = time.Unix(1, 0)
+	eval(in)
+	ShellDateTimestamp = time.Unix(1600000000, 0).UTC()
+	if got := eval(in); got != want {
+		t.Errorf("%s=%q; want %q", in, got, want)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+)
+
+// evalSnapshotVersion is incremented when evalSnapshot changes
+// incompatibly.
+const evalSnapshotVersion = 1
+
+// evalSnapshot is the state left by evaluating makefiles which a
+// LoadSaver doesn't save with the graph. With it, queries and builds
+// of a loaded graph give the same results as of the evaluated one.
+type evalSnapshot struct {
+	Version   int
+	VPaths    []serializableVpath
+	VPathDirs []string
+	Conflicts []RuleConflict
+	Stderrs   []ShellStderr
+}
+
+type serializableVpath struct {
+	Pattern string
+	Dirs    []string
+}
+
+// SaveEvalSnapshot saves the state of evaluating makefiles for g which
+// isn't saved by GOB, JSON or PROTO: vpath directives, VPATH, rule
+// conflicts and stderr of $(shell). Rules kept by LoadReq.KeepRules
+// are not saved, so "whynorule:" queries still need makefiles.
+func SaveEvalSnapshot(g *DepGraph, filename string) error {
+	if g.parts != nil {
+		return errMergedGraph
+	}
+	s := evalSnapshot{
+		Version:   evalSnapshotVersion,
+		VPathDirs: g.vpaths.dirs,
+		Conflicts: g.conflicts,
+		Stderrs:   g.stderrs,
+	}
+	for _, v := range g.vpaths.vpaths {
+		s.VPaths = append(s.VPaths, serializableVpath{Pattern: v.pattern, Dirs: v.dirs})
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(s)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// LoadEvalSnapshot loads the state saved by SaveEvalSnapshot into g,
+// usually a graph loaded by a LoadSaver.
+func LoadEvalSnapshot(g *DepGraph, filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var s evalSnapshot
+	err = gob.NewDecoder(f).Decode(&s)
+	if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	if s.Version != evalSnapshotVersion {
+		return fmt.Errorf("%s: snapshot version %d; want %d", filename, s.Version, evalSnapshotVersion)
+	}
+	g.vpaths = searchPaths{dirs: s.VPathDirs}
+	for _, v := range s.VPaths {
+		g.vpaths.vpaths = append(g.vpaths.vpaths, vpath{pattern: v.Pattern, dirs: v.Dirs})
+	}
+	g.conflicts = s.Conflicts
+	g.stderrs = s.Stderrs
+	return nil
+}
@@ -0,0 +1,228 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// Stamp records inputs of loading makefiles, which would change the
+// generated ninja file if they change.
+type Stamp struct {
+	// Files are makefiles, and directories read by the find
+	// emulator.
+	Files  []AccessedFile
+	Envs   []StampEnv
+	Shells []StampShell
+	// Globs are wildcards in prerequisites and $(wildcard) with
+	// the files they matched, checked before directories as they
+	// tell which pattern matches other files. Unrelated files in
+	// the same directories don't change them.
+	Globs []StampGlob
+
+	// Version is the version of kati which generated the ninja file.
+	Version string
+	// Args are NinjaGenerator.StampArgs.
+	Args []string
+}
+
+// StampEnv is an environment variable used by makefiles.
+type StampEnv struct {
+	Name    string
+	Value   string
+	Defined bool
+}
+
+// StampShell is a command run by $(shell) and its output.
+type StampShell struct {
+	Shell   string
+	Command string
+	Output  string
+}
+
+// StampGlob is a wildcard in prerequisites or $(wildcard) and files
+// it matched.
+type StampGlob struct {
+	Pattern string
+	Files   []string
+}
+
+// StampFilename returns the name of the stamp file for ninja files
+// with suffix, which is next to build<suffix>.ninja.
+func StampFilename(suffix string) string {
+	return fmt.Sprintf(".kati_stamp%s", suffix)
+}
+
+// NewStamp returns a Stamp for inputs used to load g. Directories are
+// recorded only if g was loaded with LoadReq.TraceFileAccess.
+func NewStamp(g *DepGraph) *Stamp {
+	return &Stamp{
+		Files:  g.AccessedFiles(),
+		Envs:   newStampEnvs(g.usedEnvs),
+		Shells: g.shells,
+		Globs:  g.globs,
+	}
+}
+
+// newStampEnvs returns StampEnv for names with their current values,
+// except cacheIgnoredEnvs, e.g. TMPDIR which may be different for
+// each recipe with ExecutorOpt.RecipeTmpDir.
+func newStampEnvs(names map[string]bool) []StampEnv {
+	var sorted []string
+	for name := range names {
+		if contains(cacheIgnoredEnvs, name) {
+			continue
+		}
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	var envs []StampEnv
+	for _, name := range sorted {
+		v, ok := os.LookupEnv(name)
+		envs = append(envs, StampEnv{Name: name, Value: v, Defined: ok})
+	}
+	return envs
+}
+
+// Save saves s in filename.
+func (s *Stamp) Save(filename string) error {
+	b, err := json.MarshalIndent(s, "", " ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, b, 0644)
+}
+
+// LoadStamp loads Stamp saved in filename.
+func LoadStamp(filename string) (*Stamp, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	s := &Stamp{}
+	err = json.Unmarshal(b, s)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return s, nil
+}
+
+// Diff re-evaluates inputs recorded in s: makefiles, environment
+// variables, wildcards in prerequisites, directories and $(shell)
+// commands, in this order.
+// It returns the first difference with old and new values, or "" if
+// nothing has changed.
+func (s *Stamp) Diff() (string, error) {
+	for _, f := range s.Files {
+		if f.IsDir {
+			continue
+		}
+		c, err := ioutil.ReadFile(f.Name)
+		exists := err == nil
+		if exists != f.Exists {
+			return fmt.Sprintf("makefile %s: exists %t => %t", f.Name, f.Exists, exists), nil
+		}
+		if h := sha1.Sum(c); exists && h != f.Hash {
+			return fmt.Sprintf("makefile %s: sha1 %x => %x", f.Name, f.Hash, h), nil
+		}
+	}
+	for _, e := range s.Envs {
+		v, ok := os.LookupEnv(e.Name)
+		if ok != e.Defined || v != e.Value {
+			return fmt.Sprintf("environment variable %s: %s => %s", e.Name, stampEnvValue(e.Value, e.Defined), stampEnvValue(v, ok)), nil
+		}
+	}
+	for _, g := range s.Globs {
+		files, err := fsCache.Glob(g.Pattern)
+		if err != nil {
+			return "", err
+		}
+		for i, f := range files {
+			files[i] = trimLeadingCurdir(f)
+		}
+		sort.Strings(files)
+		if strings.Join(files, " ") != strings.Join(g.Files, " ") {
+			return fmt.Sprintf("wildcard %s: %q => %q", g.Pattern, g.Files, files), nil
+		}
+	}
+	for _, f := range s.Files {
+		if !f.IsDir {
+			continue
+		}
+		h, exists := fsCache.dirHash(f.Name)
+		if exists != f.Exists {
+			return fmt.Sprintf("directory %s: exists %t => %t", f.Name, f.Exists, exists), nil
+		}
+		if h != f.Hash {
+			return fmt.Sprintf("directory %s: entries sha1 %x => %x", f.Name, f.Hash, h), nil
+		}
+	}
+	for _, sh := range s.Shells {
+		cmd := exec.Cmd{
+			Path: sh.Shell,
+			Args: []string{sh.Shell, "-c", sh.Command},
+		}
+		out, err := cmd.Output()
+		if _, ok := err.(*exec.ExitError); err != nil && !ok {
+			return "", err
+		}
+		if string(out) != sh.Output {
+			return fmt.Sprintf("$(shell %s): %q => %q", sh.Command, sh.Output, out), nil
+		}
+	}
+	return "", nil
+}
+
+// NeedsRegen reports why the ninja file with suffix needs to be
+// regenerated by kati run with args, or "" if the ninja file and its
+// stamp exist, they were generated by this version of kati with the
+// same args, and no inputs recorded in the stamp have changed. A
+// stamp which can't be loaded also needs regeneration. It doesn't
+// load makefiles, so it's much faster than regenerating.
+func NeedsRegen(suffix string, args []string) (string, error) {
+	ninja := (&NinjaGenerator{Suffix: suffix}).ninjaName()
+	if _, err := os.Stat(ninja); err != nil {
+		return fmt.Sprintf("%s doesn't exist", ninja), nil
+	}
+	filename := StampFilename(suffix)
+	if _, err := os.Stat(filename); err != nil {
+		return fmt.Sprintf("%s doesn't exist", filename), nil
+	}
+	s, err := LoadStamp(filename)
+	if err != nil {
+		return fmt.Sprintf("broken stamp: %v", err), nil
+	}
+	if s.Version != gitVersion {
+		return fmt.Sprintf("kati version: %q => %q", s.Version, gitVersion), nil
+	}
+	if strings.Join(s.Args, "\x00") != strings.Join(args, "\x00") {
+		return fmt.Sprintf("args: %q => %q", s.Args, args), nil
+	}
+	return s.Diff()
+}
+
+func stampEnvValue(v string, defined bool) string {
+	if !defined {
+		return "(undefined)"
+	}
+	return fmt.Sprintf("%q", v)
+}
@@ -0,0 +1,299 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStampDiff(t *testing.T) {
+	dir := chdirTemp(t, map[string]string{
+		"data": "1\n",
+	})
+	mk := filepath.Join(dir, "Makefile")
+	data := filepath.Join(dir, "data")
+	err := ioutil.WriteFile(mk, []byte(fmt.Sprintf("X := $(wildcard %s/*.c)\nY := $(shell cat %s)\nall:\n", dir, data)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := mustLoad(t, LoadReq{Makefile: mk, TraceFileAccess: true})
+	s := NewStamp(g)
+
+	for _, tc := range []struct {
+		change func() error
+		want   string
+	}{
+		{
+			change: func() error { return nil },
+		},
+		{
+			// Files not matching the pattern don't matter.
+			change: func() error { return ioutil.WriteFile(filepath.Join(dir, "a.h"), nil, 0644) },
+		},
+		{
+			change: func() error { return ioutil.WriteFile(data, []byte("2\n"), 0644) },
+			want:   fmt.Sprintf(`$(shell cat %s): "1\n" => "2\n"`, data),
+		},
+		{
+			change: func() error { return ioutil.WriteFile(filepath.Join(dir, "a.c"), nil, 0644) },
+			want:   fmt.Sprintf("wildcard %s/*.c: ", dir),
+		},
+		{
+			change: func() error { return ioutil.WriteFile(mk, []byte("all:\n"), 0644) },
+			want:   fmt.Sprintf("makefile %s: sha1 ", mk),
+		},
+	} {
+		err := tc.change()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fsCache = newFsCache()
+		got, err := s.Diff()
+		if err != nil {
+			t.Errorf("s.Diff()=_, %v; want nil error", err)
+			continue
+		}
+		if (tc.want == "" && got != "") || !strings.HasPrefix(got, tc.want) {
+			t.Errorf("s.Diff()=%q; want %q", got, tc.want)
+		}
+	}
+}
+
+func TestStampGlobs(t *testing.T) {
+	dir := chdirTemp(t, nil)
+	mk := filepath.Join(dir, "Makefile")
+	for _, name := range []string{"b.c", "a.c", "a.h"} {
+		err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := ioutil.WriteFile(mk, []byte(fmt.Sprintf("all: %s/*.c\n", dir)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsCache = newFsCache()
+	g := mustLoad(t, LoadReq{Makefile: mk})
+	if got, want := g.nodes[0].ActualInputs, []string{filepath.Join(dir, "a.c"), filepath.Join(dir, "b.c")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("inputs=%q; want %q", got, want)
+	}
+	s := NewStamp(g)
+
+	for _, tc := range []struct {
+		change func() error
+		want   string
+	}{
+		{
+			change: func() error { return ioutil.WriteFile(filepath.Join(dir, "b.h"), nil, 0644) },
+		},
+		{
+			change: func() error { return os.Remove(filepath.Join(dir, "a.c")) },
+			want:   fmt.Sprintf("wildcard %s/*.c: ", dir),
+		},
+	} {
+		err := tc.change()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fsCache = newFsCache()
+		got, err := s.Diff()
+		if err != nil {
+			t.Errorf("s.Diff()=_, %v; want nil error", err)
+			continue
+		}
+		if (tc.want == "" && got != "") || !strings.HasPrefix(got, tc.want) {
+			t.Errorf("s.Diff()=%q; want %q", got, tc.want)
+		}
+	}
+}
+
+func TestStampSortWildcard(t *testing.T) {
+	dir := chdirTemp(t, nil)
+	mk := filepath.Join(dir, "Makefile")
+	for _, name := range []string{"b.c", "a.c", "a.h"} {
+		err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := ioutil.WriteFile(mk, []byte(fmt.Sprintf("SRCS := $(sort $(wildcard %[1]s/*.c %[1]s/a.*))\nall:\n", dir)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fsCache = newFsCache()
+	g := mustLoad(t, LoadReq{Makefile: mk, TraceFileAccess: true})
+	want := fmt.Sprintf("%[1]s/a.c %[1]s/a.h %[1]s/b.c", dir)
+	if got := g.vars.Lookup("SRCS").String(); got != want {
+		t.Errorf("SRCS=%q; want %q", got, want)
+	}
+	s := NewStamp(g)
+	var pats []string
+	for _, g := range s.Globs {
+		pats = append(pats, g.Pattern)
+	}
+	if got, want := pats, []string{dir + "/*.c", dir + "/a.*"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("globs=%q; want %q", got, want)
+	}
+	for _, f := range s.Files {
+		if f.IsDir {
+			t.Errorf("stamp has directory %s read by $(sort $(wildcard))", f.Name)
+		}
+	}
+
+	for _, tc := range []struct {
+		change func() error
+		want   string
+	}{
+		{
+			change: func() error { return ioutil.WriteFile(filepath.Join(dir, "b.h"), nil, 0644) },
+		},
+		{
+			change: func() error { return ioutil.WriteFile(filepath.Join(dir, "c.c"), nil, 0644) },
+			want:   fmt.Sprintf("wildcard %s/*.c: ", dir),
+		},
+	} {
+		err := tc.change()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fsCache = newFsCache()
+		got, err := s.Diff()
+		if err != nil {
+			t.Errorf("s.Diff()=_, %v; want nil error", err)
+			continue
+		}
+		if (tc.want == "" && got != "") || !strings.HasPrefix(got, tc.want) {
+			t.Errorf("s.Diff()=%q; want %q", got, tc.want)
+		}
+	}
+}
+
+func TestStampEnvs(t *testing.T) {
+	dir := chdirTemp(t, map[string]string{
+		"Makefile": `X := $(KATI_TEST_USED)
+ifdef KATI_TEST_UNDEFINED
+Y := 1
+endif
+KATI_TEST_ASSIGNED := 1
+Z := $(KATI_TEST_ASSIGNED)
+all:
+`,
+	})
+	mk := filepath.Join(dir, "Makefile")
+	for _, name := range []string{"KATI_TEST_USED", "KATI_TEST_UNUSED", "KATI_TEST_UNDEFINED", "KATI_TEST_ASSIGNED"} {
+		defer os.Unsetenv(name)
+	}
+	os.Setenv("KATI_TEST_USED", "1")
+	os.Setenv("KATI_TEST_UNUSED", "1")
+	os.Setenv("KATI_TEST_ASSIGNED", "2")
+	os.Unsetenv("KATI_TEST_UNDEFINED")
+
+	g := mustLoad(t, LoadReq{Makefile: mk, EnvironmentVars: os.Environ()})
+	s := NewStamp(g)
+	envs := make(map[string]StampEnv)
+	for _, e := range s.Envs {
+		envs[e.Name] = e
+	}
+	if e, ok := envs["KATI_TEST_USED"]; !ok || !e.Defined || e.Value != "1" {
+		t.Errorf("stamp of KATI_TEST_USED=%v, %t; want defined with 1", e, ok)
+	}
+	if e, ok := envs["KATI_TEST_UNDEFINED"]; !ok || e.Defined {
+		t.Errorf("stamp of KATI_TEST_UNDEFINED=%v, %t; want undefined", e, ok)
+	}
+	for _, name := range []string{"KATI_TEST_UNUSED", "KATI_TEST_ASSIGNED"} {
+		if e, ok := envs[name]; ok {
+			t.Errorf("stamp of %s=%v; want none", name, e)
+		}
+	}
+
+	os.Setenv("KATI_TEST_UNUSED", "2")
+	os.Setenv("KATI_TEST_ASSIGNED", "3")
+	diff, err := s.Diff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff != "" {
+		t.Errorf("s.Diff()=%q; want no changes", diff)
+	}
+	os.Setenv("KATI_TEST_UNDEFINED", "1")
+	diff, err = s.Diff()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "environment variable KATI_TEST_UNDEFINED: "; !strings.HasPrefix(diff, want) {
+		t.Errorf("s.Diff()=%q; want %q", diff, want)
+	}
+}
+
+func TestNeedsRegen(t *testing.T) {
+	chdirTemp(t, map[string]string{
+		"Makefile": "all:\n\techo all\n",
+	})
+	args := []string{"-ninja", "-regen"}
+	want := "build.ninja doesn't exist"
+	if got, err := NeedsRegen("", args); err != nil || got != want {
+		t.Errorf("NeedsRegen()=%q, %v; want %q, nil", got, err, want)
+	}
+
+	g := mustLoad(t, LoadReq{Makefile: "Makefile", TraceFileAccess: true})
+	err := (&NinjaGenerator{StampArgs: args}).Save(g, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = ".kati_stamp doesn't exist"
+	if got, err := NeedsRegen("", args); err != nil || got != want {
+		t.Errorf("NeedsRegen() without Stamp=%q, %v; want %q, nil", got, err, want)
+	}
+
+	n := &NinjaGenerator{Stamp: true, StampArgs: args}
+	err = n.Save(g, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := NeedsRegen("", args); err != nil || got != "" {
+		t.Errorf("NeedsRegen()=%q, %v; want no changes", got, err)
+	}
+	want = "args: "
+	if got, err := NeedsRegen("", []string{"-ninja"}); err != nil || !strings.HasPrefix(got, want) {
+		t.Errorf("NeedsRegen(-ninja)=%q, %v; want %q", got, err, want)
+	}
+
+	err = ioutil.WriteFile("Makefile", []byte("all:\n\techo changed\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "makefile Makefile: sha1 "
+	if got, err := NeedsRegen("", args); err != nil || !strings.HasPrefix(got, want) {
+		t.Errorf("NeedsRegen() after change=%q, %v; want %q", got, err, want)
+	}
+
+	err = ioutil.WriteFile(StampFilename(""), []byte("{"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "broken stamp: "
+	if got, err := NeedsRegen("", args); err != nil || !strings.HasPrefix(got, want) {
+		t.Errorf("NeedsRegen() with broken stamp=%q, %v; want %q", got, err, want)
+	}
+}
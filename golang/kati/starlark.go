@@ -0,0 +1,197 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ExportStarlark writes rules in g as Starlark declarations, one
+// kati_genrule per target with commands. This is experimental, to
+// help migrating makefiles to Bazel; kati_genrule is not defined here
+// and should be provided by a macro, e.g. wrapping genrule.
+//
+//  kati_genrule(
+//      name = "foo.o",
+//      outs = ["foo.o"],
+//      srcs = ["foo.c"],
+//      cmd = "cc -c -o foo.o foo.c",
+//      env = {"CFLAGS": "-O2"},
+//  )
+//
+// srcs are prerequisites, and order-only prerequisites are in
+// order_only_srcs. cmd is the recipe evaluated with target specific
+// variables, joined with " && ", with "$" escaped as "$$". env has
+// the values of target specific variables.
+func ExportStarlark(w io.Writer, g *DepGraph) error {
+	if g.parts != nil {
+		return errMergedGraph
+	}
+	err := g.loadVars()
+	if err != nil {
+		return err
+	}
+	ctx := newExecContext(g.vars, g.vpaths, true)
+	fmt.Fprintf(w, "# Generated by kati %s\n", gitVersion)
+	names := make(map[string]bool)
+	seen := make(map[*DepNode]bool)
+	var walk func(nodes []*DepNode) error
+	walk = func(nodes []*DepNode) error {
+		for _, n := range nodes {
+			if seen[n] {
+				continue
+			}
+			seen[n] = true
+			if len(n.Cmds) > 0 {
+				err := exportStarlarkNode(w, ctx, n, names)
+				if err != nil {
+					return err
+				}
+			}
+			err := walk(n.Deps)
+			if err != nil {
+				return err
+			}
+			err = walk(n.OrderOnlys)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(g.nodes)
+}
+
+func exportStarlarkNode(w io.Writer, ctx *execContext, n *DepNode, names map[string]bool) error {
+	runners, _, err := createRunners(ctx, n)
+	if err != nil {
+		return err
+	}
+	var cmds []string
+	for _, r := range runners {
+		cmd := cmdline(r.cmd)
+		if r.ignoreError {
+			cmd = fmt.Sprintf("(%s) || true", cmd)
+		}
+		cmds = append(cmds, cmd)
+	}
+	// createRunners restores target specific variables before it
+	// returns, so set them again to evaluate them.
+	var tsvNames []string
+	for k, v := range n.TargetSpecificVars {
+		restore := ctx.ev.vars.save(k)
+		defer restore()
+		ctx.ev.vars[k] = v
+		tsvNames = append(tsvNames, k)
+	}
+	sort.Strings(tsvNames)
+	var env []string
+	for _, k := range tsvNames {
+		v, err := ctx.ev.EvaluateVar(k)
+		if err != nil {
+			return err
+		}
+		env = append(env, fmt.Sprintf("%s: %s", starlarkQuote(k), starlarkQuote(v)))
+	}
+
+	var srcs, orderOnlys []string
+	for _, d := range n.Deps {
+		srcs = append(srcs, starlarkQuote(d.Output))
+	}
+	for _, d := range n.OrderOnlys {
+		orderOnlys = append(orderOnlys, starlarkQuote(d.Output))
+	}
+
+	fmt.Fprintln(w)
+	if n.Filename != "" {
+		fmt.Fprintf(w, "# Recipe at %s:%d\n", n.Filename, n.Lineno)
+	}
+	fmt.Fprintf(w, "kati_genrule(\n")
+	fmt.Fprintf(w, "    name = %s,\n", starlarkQuote(starlarkName(n.Output, names)))
+	fmt.Fprintf(w, "    outs = [%s],\n", starlarkQuote(n.Output))
+	if len(srcs) > 0 {
+		fmt.Fprintf(w, "    srcs = [%s],\n", strings.Join(srcs, ", "))
+	}
+	if len(orderOnlys) > 0 {
+		fmt.Fprintf(w, "    order_only_srcs = [%s],\n", strings.Join(orderOnlys, ", "))
+	}
+	cmd := strings.Replace(strings.Join(cmds, " && "), "$", "$$", -1)
+	fmt.Fprintf(w, "    cmd = %s,\n", starlarkQuote(cmd))
+	if len(env) > 0 {
+		fmt.Fprintf(w, "    env = {%s},\n", strings.Join(env, ", "))
+	}
+	if n.IsPhony {
+		fmt.Fprintf(w, "    phony = True,\n")
+	}
+	fmt.Fprintf(w, ")\n")
+	return nil
+}
+
+// starlarkName returns a unique Bazel target name for output.
+// Characters not allowed in target names are replaced with '_'.
+func starlarkName(output string, names map[string]bool) string {
+	var buf bytes.Buffer
+	for _, c := range output {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+			buf.WriteRune(c)
+		case strings.ContainsRune("!%-@^_\"#$&'()*-+,;<=>?[]{|}~/.", c):
+			buf.WriteRune(c)
+		default:
+			buf.WriteByte('_')
+		}
+	}
+	// Empty, "." and ".." path components are not allowed either.
+	comps := strings.Split(buf.String(), "/")
+	for i, c := range comps {
+		if c == "" || c == "." || c == ".." {
+			comps[i] = "_" + c
+		}
+	}
+	name := strings.Join(comps, "/")
+	base := name
+	for i := 2; names[name]; i++ {
+		name = fmt.Sprintf("%s_%d", base, i)
+	}
+	names[name] = true
+	return name
+}
+
+// starlarkQuote quotes s as a Starlark string literal.
+func starlarkQuote(s string) string {
+	var buf bytes.Buffer
+	buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
@@ -0,0 +1,91 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExportStarlark(t *testing.T) {
+	chdirTemp(t, map[string]string{
+		"Makefile": `CFLAGS := -O2
+all: prog
+prog: main.o | out
+	-cc -o $@ $^ "$$HOME"
+main.o: CFLAGS += -g
+main.o: main.c
+	cc $(CFLAGS) -c -o $@ $<
+out:
+	mkdir -p $@ $(shell cat dirs.txt)
+`,
+		"main.c": "",
+	})
+	g := mustLoad(t, LoadReq{Makefile: "Makefile"})
+	var buf bytes.Buffer
+	err := ExportStarlark(&buf, g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+	got = got[strings.Index(got, "\n")+1:]
+	want := `
+# Recipe at Makefile:4
+kati_genrule(
+    name = "prog",
+    outs = ["prog"],
+    srcs = ["main.o"],
+    order_only_srcs = ["out"],
+    cmd = "(cc -o prog main.o \"$$HOME\") || true",
+)
+
+# Recipe at Makefile:7
+kati_genrule(
+    name = "main.o",
+    outs = ["main.o"],
+    srcs = ["main.c"],
+    cmd = "cc -O2 -g -c -o main.o main.c",
+    env = {"CFLAGS": "-O2 -g"},
+)
+
+# Recipe at Makefile:9
+kati_genrule(
+    name = "out",
+    outs = ["out"],
+    cmd = "mkdir -p out $$(cat dirs.txt)",
+)
+`
+	if got != want {
+		t.Errorf("ExportStarlark()=\n%s\nwant=\n%s", got, want)
+	}
+}
+
+func TestStarlarkName(t *testing.T) {
+	names := make(map[string]bool)
+	for _, tc := range []struct {
+		output, want string
+	}{
+		{output: "out/foo.o", want: "out/foo.o"},
+		{output: "out/foo:bar", want: "out/foo_bar"},
+		{output: "out/foo_bar", want: "out/foo_bar_2"},
+		{output: "../foo", want: "_../foo"},
+		{output: "/abs//x", want: "_/abs/_/x"},
+	} {
+		if got := starlarkName(tc.output, names); got != tc.want {
+			t.Errorf("starlarkName(%q)=%q; want=%q", tc.output, got, tc.want)
+		}
+	}
+}
@@ -15,10 +15,13 @@
 package kati
 
 import (
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"sort"
+	"strconv"
 	"sync"
 	"time"
 )
@@ -172,6 +175,144 @@ func (b byTotalTime) Less(i, j int) bool {
 	return b[i].Total > b[j].Total
 }
 
+// funcStat is statistics of evaluations of a function, or of calls of
+// it at a srcpos.
+type funcStat struct {
+	Name     string        `json:"name"`
+	Filename string        `json:"filename,omitempty"`
+	Lineno   int           `json:"lineno,omitempty"`
+	Count    int           `json:"count"`
+	Total    time.Duration `json:"total_ns"`
+	Longest  time.Duration `json:"longest_ns"`
+}
+
+func (s *funcStat) add(d time.Duration) {
+	s.Count++
+	s.Total += d
+	if d > s.Longest {
+		s.Longest = d
+	}
+}
+
+type funcStatsT struct {
+	mu       sync.Mutex
+	byName   map[string]*funcStat
+	bySrcpos map[funcSrcpos]*funcStat
+}
+
+type funcSrcpos struct {
+	name string
+	srcpos
+}
+
+var funcStats = newFuncStats()
+
+func newFuncStats() *funcStatsT {
+	return &funcStatsT{
+		byName:   make(map[string]*funcStat),
+		bySrcpos: make(map[funcSrcpos]*funcStat),
+	}
+}
+
+func (s *funcStatsT) add(name string, pos srcpos, t time.Time) {
+	if !EvalStatsFlag && !FuncStatsFlag {
+		return
+	}
+	d := time.Since(t)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fs := s.byName[name]
+	if fs == nil {
+		fs = &funcStat{Name: name}
+		s.byName[name] = fs
+	}
+	fs.add(d)
+	if !FuncStatsSrcpos {
+		return
+	}
+	key := funcSrcpos{name: name, srcpos: pos}
+	fs = s.bySrcpos[key]
+	if fs == nil {
+		fs = &funcStat{Name: name, Filename: pos.filename, Lineno: pos.lineno}
+		s.bySrcpos[key] = fs
+	}
+	fs.add(d)
+}
+
+// sorted returns statistics by function names, and by srcpos of calls
+// if FuncStatsSrcpos is set, in descending order of total durations.
+func (s *funcStatsT) sorted() (byName, bySrcpos []funcStat) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, fs := range s.byName {
+		byName = append(byName, *fs)
+	}
+	for _, fs := range s.bySrcpos {
+		bySrcpos = append(bySrcpos, *fs)
+	}
+	for _, l := range [][]funcStat{byName, bySrcpos} {
+		l := l
+		sort.Slice(l, func(i, j int) bool {
+			if l[i].Total != l[j].Total {
+				return l[i].Total > l[j].Total
+			}
+			if l[i].Name != l[j].Name {
+				return l[i].Name < l[j].Name
+			}
+			if l[i].Filename != l[j].Filename {
+				return l[i].Filename < l[j].Filename
+			}
+			return l[i].Lineno < l[j].Lineno
+		})
+	}
+	return byName, bySrcpos
+}
+
+// WriteFuncStats writes statistics of function evaluations collected
+// if FuncStatsFlag or EvalStatsFlag is set, in format "json" or "csv".
+// Durations are in nanoseconds. Statistics by srcpos of calls are
+// written too if FuncStatsSrcpos is set; in CSV, they are the rows
+// with filename.
+func WriteFuncStats(w io.Writer, format string) error {
+	byName, bySrcpos := funcStats.sorted()
+	switch format {
+	case "json":
+		v := struct {
+			Functions []funcStat `json:"functions"`
+			Srcpos    []funcStat `json:"srcpos,omitempty"`
+		}{
+			Functions: byName,
+			Srcpos:    bySrcpos,
+		}
+		if v.Functions == nil {
+			v.Functions = []funcStat{}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"name", "filename", "lineno", "count", "total_ns", "longest_ns"})
+		for _, fs := range append(byName, bySrcpos...) {
+			lineno := ""
+			if fs.Filename != "" {
+				lineno = strconv.Itoa(fs.Lineno)
+			}
+			cw.Write([]string{
+				fs.Name,
+				fs.Filename,
+				lineno,
+				strconv.Itoa(fs.Count),
+				strconv.FormatInt(int64(fs.Total), 10),
+				strconv.FormatInt(int64(fs.Longest), 10),
+			})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("unknown format of function stats: %q", format)
+}
+
 type shellStatsT struct {
 	mu       sync.Mutex
 	duration time.Duration
@@ -198,3 +339,31 @@ func (s *shellStatsT) Count() int {
 	defer s.mu.Unlock()
 	return s.count
 }
+
+// timestampStatsT counts timestamps of files looked up by Executor,
+// from cached dirents or by stat.
+type timestampStatsT struct {
+	mu     sync.Mutex
+	cached int
+	stats  int
+}
+
+var timestampStats = &timestampStatsT{}
+
+func (s *timestampStatsT) add(cached bool) {
+	s.mu.Lock()
+	if cached {
+		s.cached++
+	} else {
+		s.stats++
+	}
+	s.mu.Unlock()
+}
+
+// Counts returns the number of timestamps from cached dirents, and
+// the number of stat calls.
+func (s *timestampStatsT) Counts() (cached, stats int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cached, s.stats
+}
@@ -0,0 +1,93 @@
+// Copyright 2020 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"testing"
+)
+
+func TestWriteFuncStats(t *testing.T) {
+	chdirTemp(t, map[string]string{
+		"Makefile": `X := $(subst a,b,aaa)
+Y := $(subst a,c,aaa) $(strip  x )
+Z := $(subst a,d,aaa)
+all:
+`,
+	})
+	FuncStatsFlag, FuncStatsSrcpos = true, true
+	funcStats = newFuncStats()
+	defer func() {
+		FuncStatsFlag, FuncStatsSrcpos = false, false
+		funcStats = newFuncStats()
+	}()
+	_, err := Load(LoadReq{Makefile: "Makefile", Targets: []string{"all"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	err = WriteFuncStats(&buf, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Functions []funcStat `json:"functions"`
+		Srcpos    []funcStat `json:"srcpos"`
+	}
+	err = json.Unmarshal(buf.Bytes(), &got)
+	if err != nil {
+		t.Fatalf("json.Unmarshal(%q)=%v", buf.String(), err)
+	}
+	counts := make(map[string]int)
+	for _, fs := range got.Functions {
+		counts[fs.Name] = fs.Count
+	}
+	if counts["subst"] != 3 || counts["strip"] != 1 {
+		t.Errorf("functions=%v; want 3 subst and 1 strip", got.Functions)
+	}
+	lines := make(map[int]int)
+	for _, fs := range got.Srcpos {
+		if fs.Name == "subst" && fs.Filename == "Makefile" {
+			lines[fs.Lineno] += fs.Count
+		}
+	}
+	if lines[1] != 1 || lines[2] != 1 || lines[3] != 1 {
+		t.Errorf("srcpos=%v; want subst at lines 1, 2 and 3", got.Srcpos)
+	}
+
+	buf.Reset()
+	err = WriteFuncStats(&buf, "csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(records), 1+len(got.Functions)+len(got.Srcpos); got != want {
+		t.Errorf("csv has %d records; want %d", got, want)
+	}
+	if got, want := records[0][0], "name"; got != want {
+		t.Errorf("csv header=%q; want %q", records[0], want)
+	}
+
+	err = WriteFuncStats(&buf, "xml")
+	if err == nil {
+		t.Errorf("WriteFuncStats(xml)=nil; want error")
+	}
+}
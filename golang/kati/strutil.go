@@ -22,9 +22,9 @@ import (
 	"github.com/golang/glog"
 )
 
-var wsbytes = [256]bool{' ': true, '\t': true, '\n': true, '\r': true}
+// wsbytes is isspace(3) in the C locale, which GNU make uses to split words.
+var wsbytes = [256]bool{' ': true, '\t': true, '\n': true, '\v': true, '\f': true, '\r': true}
 
-// TODO(ukai): use unicode.IsSpace?
 func isWhitespace(ch rune) bool {
 	if int(ch) >= len(wsbytes) {
 		return false
@@ -128,91 +128,148 @@ func (ws *wordScanner) Remain() []byte {
 	return ws.in[ws.s:]
 }
 
-func matchPattern(pat, str string) bool {
+// splitPercent splits pat at its first % which is not quoted by a
+// backslash, as find_percent in GNU make. Backslashes before a % quote
+// it or each other, and are removed: `\%` is a literal %, and `\\%` is
+// a backslash followed by the wildcard. ok is false if pat has no
+// wildcard, in which case pre is pat with those backslashes removed.
+func splitPercent(pat string) (pre, post string, ok bool) {
 	i := strings.IndexByte(pat, '%')
 	if i < 0 {
-		return pat == str
+		return pat, "", false
+	}
+	if i == 0 || pat[i-1] != '\\' {
+		return pat[:i], pat[i+1:], true
+	}
+	var buf []byte
+	start := 0
+	for {
+		i := strings.IndexByte(pat[start:], '%')
+		if i < 0 {
+			buf = append(buf, pat[start:]...)
+			return string(buf), "", false
+		}
+		i += start
+		n := 0
+		for i-n > start && pat[i-n-1] == '\\' {
+			n++
+		}
+		buf = append(buf, pat[start:i-n]...)
+		for j := 0; j < n/2; j++ {
+			buf = append(buf, '\\')
+		}
+		if n%2 == 0 {
+			return string(buf), pat[i+1:], true
+		}
+		buf = append(buf, '%')
+		start = i + 1
 	}
-	return strings.HasPrefix(str, pat[:i]) && strings.HasSuffix(str, pat[i+1:])
 }
 
-func matchPatternBytes(pat, str []byte) bool {
+// splitPercentBytes is splitPercent for []byte. It doesn't allocate
+// unless the first % is preceded by a backslash.
+func splitPercentBytes(pat []byte) (pre, post []byte, ok bool) {
 	i := bytes.IndexByte(pat, '%')
 	if i < 0 {
-		return bytes.Equal(pat, str)
+		return pat, nil, false
+	}
+	if i == 0 || pat[i-1] != '\\' {
+		return pat[:i], pat[i+1:], true
 	}
-	return bytes.HasPrefix(str, pat[:i]) && bytes.HasSuffix(str, pat[i+1:])
+	spre, spost, ok := splitPercent(string(pat))
+	return []byte(spre), []byte(spost), ok
 }
 
-func substPattern(pat, repl, str string) string {
-	ps := strings.SplitN(pat, "%", 2)
-	if len(ps) != 2 {
-		if str == pat {
-			return repl
-		}
-		return str
+func matchPattern(pat, str string) bool {
+	pre, post, ok := splitPercent(pat)
+	if !ok {
+		return pre == str
 	}
-	in := str
-	trimed := str
-	if ps[0] != "" {
-		trimed = strings.TrimPrefix(in, ps[0])
-		if trimed == in {
-			return str
-		}
+	return len(str) >= len(pre)+len(post) && strings.HasPrefix(str, pre) && strings.HasSuffix(str, post)
+}
+
+func matchPatternBytes(pat, str []byte) bool {
+	pre, post, ok := splitPercentBytes(pat)
+	if !ok {
+		return bytes.Equal(pre, str)
+	}
+	return len(str) >= len(pre)+len(post) && bytes.HasPrefix(str, pre) && bytes.HasSuffix(str, post)
+}
+
+// substStem returns the part of str matched by % in the pattern split
+// as pre % post.
+func substStem(pre, post, str string) (string, bool) {
+	if len(str) < len(pre)+len(post) || !strings.HasPrefix(str, pre) || !strings.HasSuffix(str, post) {
+		return "", false
 	}
-	in = trimed
-	if ps[1] != "" {
-		trimed = strings.TrimSuffix(in, ps[1])
-		if trimed == in {
+	return str[len(pre) : len(str)-len(post)], true
+}
+
+// substPattern replaces str matching pat by repl, as $(patsubst). Only
+// the first unquoted % in pat and repl is special.
+func substPattern(pat, repl, str string) string {
+	pre, post, ok := splitPercent(pat)
+	if !ok {
+		if str != pre {
 			return str
 		}
+		// % in repl is kept as is if pat has no %.
+		rpre, rpost, ok := splitPercent(repl)
+		if !ok {
+			return rpre
+		}
+		return rpre + "%" + rpost
 	}
-
-	rs := strings.SplitN(repl, "%", 2)
-	if len(rs) != 2 {
-		return repl
+	stem, ok := substStem(pre, post, str)
+	if !ok {
+		return str
 	}
-	return rs[0] + trimed + rs[1]
+	rpre, rpost, ok := splitPercent(repl)
+	if !ok {
+		return rpre
+	}
+	return rpre + stem + rpost
 }
 
 func substPatternBytes(pat, repl, str []byte) (pre, subst, post []byte) {
-	i := bytes.IndexByte(pat, '%')
-	if i < 0 {
-		if bytes.Equal(str, pat) {
-			return repl, nil, nil
-		}
-		return str, nil, nil
-	}
-	in := str
-	trimed := str
-	if i > 0 {
-		trimed = bytes.TrimPrefix(in, pat[:i])
-		if bytes.Equal(trimed, in) {
+	ppre, ppost, ok := splitPercentBytes(pat)
+	if ok {
+		if len(str) < len(ppre)+len(ppost) || !bytes.HasPrefix(str, ppre) || !bytes.HasSuffix(str, ppost) {
 			return str, nil, nil
 		}
+	} else if !bytes.Equal(str, ppre) {
+		return str, nil, nil
 	}
-	in = trimed
-	if i < len(pat)-1 {
-		trimed = bytes.TrimSuffix(in, pat[i+1:])
-		if bytes.Equal(trimed, in) {
-			return str, nil, nil
-		}
+	rpre, rpost, rok := splitPercentBytes(repl)
+	if !rok {
+		return rpre, nil, nil
 	}
-
-	i = bytes.IndexByte(repl, '%')
-	if i < 0 {
-		return repl, nil, nil
+	if !ok {
+		return rpre, []byte{'%'}, rpost
 	}
-
-	return repl[:i], trimed, repl[i+1:]
+	return rpre, str[len(ppre) : len(str)-len(ppost)], rpost
 }
 
+// substRef returns str substituted as in $(var:pat=repl). If pat has
+// no %, it is the same as $(var:%pat=%repl), except % in repl is not
+// special.
 func substRef(pat, repl, str string) string {
-	if strings.IndexByte(pat, '%') >= 0 && strings.IndexByte(repl, '%') >= 0 {
-		return substPattern(pat, repl, str)
+	pre, post, ok := splitPercent(pat)
+	if !ok {
+		if strings.HasSuffix(str, pre) {
+			return str[:len(str)-len(pre)] + repl
+		}
+		return str
+	}
+	stem, ok := substStem(pre, post, str)
+	if !ok {
+		return str
+	}
+	rpre, rpost, ok := splitPercent(repl)
+	if !ok {
+		return rpre
 	}
-	str = strings.TrimSuffix(str, pat)
-	return str + repl
+	return rpre + stem + rpost
 }
 
 func stripExt(s string) string {
@@ -45,6 +45,10 @@ func TestSplitSpaces(t *testing.T) {
 			in:   "foo bar  ",
 			want: []string{"foo", "bar"},
 		},
+		{
+			in:   "\nfoo\n\tbar\r\nbaz\vqux\fquux\n",
+			want: []string{"foo", "bar", "baz", "qux", "quux"},
+		},
 	} {
 		got := splitSpaces(tc.in)
 		if !reflect.DeepEqual(got, tc.want) {
@@ -78,6 +82,10 @@ func TestWordScanner(t *testing.T) {
 			in:   "foo bar  ",
 			want: []string{"foo", "bar"},
 		},
+		{
+			in:   "\nfoo\n\tbar\r\nbaz\vqux\fquux\n",
+			want: []string{"foo", "bar", "baz", "qux", "quux"},
+		},
 	} {
 		ws := newWordScanner([]byte(tc.in))
 		var got []string
@@ -153,6 +161,42 @@ func TestSubstPattern(t *testing.T) {
 			in:   "x.x.c",
 			want: "x.x.c",
 		},
+		{
+			pat:  `a\%%`,
+			repl: "[%]",
+			in:   "a%b",
+			want: "[b]",
+		},
+		{
+			pat:  `\\%.c`,
+			repl: "%.o",
+			in:   `\x.c`,
+			want: "x.o",
+		},
+		{
+			pat:  `\%`,
+			repl: `x\%y`,
+			in:   "%",
+			want: "x%y",
+		},
+		{
+			pat:  "a",
+			repl: "x%y",
+			in:   "a",
+			want: "x%y",
+		},
+		{
+			pat:  "ab%ba",
+			repl: "X",
+			in:   "aba",
+			want: "aba",
+		},
+		{
+			pat:  "%",
+			repl: `\%%`,
+			in:   "a",
+			want: "%a",
+		},
 	} {
 		got := substPattern(tc.pat, tc.repl, tc.in)
 		if got != tc.want {
@@ -167,6 +211,83 @@ func TestSubstPattern(t *testing.T) {
 	}
 }
 
+func TestSubstRef(t *testing.T) {
+	for _, tc := range []struct {
+		pat  string
+		repl string
+		in   string
+		want string
+	}{
+		{
+			pat:  ".c",
+			repl: ".o",
+			in:   "x.c",
+			want: "x.o",
+		},
+		{
+			pat:  ".c",
+			repl: ".o",
+			in:   "x.h",
+			want: "x.h",
+		},
+		{
+			pat:  ".c",
+			repl: "%.o",
+			in:   "x.c",
+			want: "x%.o",
+		},
+		{
+			pat:  "%.c",
+			repl: "X",
+			in:   "x.c",
+			want: "X",
+		},
+		{
+			pat:  `a\%%`,
+			repl: "X%",
+			in:   "a%b",
+			want: "Xb",
+		},
+		{
+			pat:  `\%`,
+			repl: "Y",
+			in:   "%",
+			want: "Y",
+		},
+	} {
+		got := substRef(tc.pat, tc.repl, tc.in)
+		if got != tc.want {
+			t.Errorf(`substRef(%q,%q,%q)=%q, want %q`, tc.pat, tc.repl, tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestSplitPercent(t *testing.T) {
+	for _, tc := range []struct {
+		pat  string
+		pre  string
+		post string
+		ok   bool
+	}{
+		{pat: "%.c", pre: "", post: ".c", ok: true},
+		{pat: "a%b%c", pre: "a", post: "b%c", ok: true},
+		{pat: `a\%b%c`, pre: "a%b", post: "c", ok: true},
+		{pat: `a\\%b`, pre: `a\`, post: "b", ok: true},
+		{pat: `a\\\%b`, pre: `a\%b`, ok: false},
+		{pat: `a\b%\%`, pre: `a\b`, post: `\%`, ok: true},
+		{pat: "a.c", pre: "a.c", ok: false},
+	} {
+		pre, post, ok := splitPercent(tc.pat)
+		if pre != tc.pre || post != tc.post || ok != tc.ok {
+			t.Errorf("splitPercent(%q)=%q,%q,%t; want %q,%q,%t", tc.pat, pre, post, ok, tc.pre, tc.post, tc.ok)
+		}
+		bpre, bpost, ok := splitPercentBytes([]byte(tc.pat))
+		if string(bpre) != tc.pre || string(bpost) != tc.post || ok != tc.ok {
+			t.Errorf("splitPercentBytes(%q)=%q,%q,%t; want %q,%q,%t", tc.pat, bpre, bpost, ok, tc.pre, tc.post, tc.ok)
+		}
+	}
+}
+
 func TestRemoveComment(t *testing.T) {
 	for _, tc := range []struct {
 		in      string
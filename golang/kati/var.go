@@ -15,10 +15,10 @@
 package kati
 
 import (
-	"bytes"
 	"fmt"
 	"io"
 	"strings"
+	"sync"
 )
 
 // Var is an interface of make variable.
@@ -34,6 +34,10 @@ type Var interface {
 type targetSpecificVar struct {
 	v  Var
 	op string
+	// export is true if it's defined with "export", e.g.
+	// "foo: export A := a", so it's in the environment of commands
+	// of the target.
+	export bool
 }
 
 func (v *targetSpecificVar) Append(ev *Evaluator, s string) (Var, error) {
@@ -42,8 +46,9 @@ func (v *targetSpecificVar) Append(ev *Evaluator, s string) (Var, error) {
 		return nil, err
 	}
 	return &targetSpecificVar{
-		v:  nv,
-		op: v.op,
+		v:      nv,
+		op:     v.op,
+		export: v.export,
 	}, nil
 }
 func (v *targetSpecificVar) AppendVar(ev *Evaluator, v2 Value) (Var, error) {
@@ -52,8 +57,9 @@ func (v *targetSpecificVar) AppendVar(ev *Evaluator, v2 Value) (Var, error) {
 		return nil, err
 	}
 	return &targetSpecificVar{
-		v:  nv,
-		op: v.op,
+		v:      nv,
+		op:     v.op,
+		export: v.export,
 	}, nil
 }
 func (v *targetSpecificVar) Flavor() string {
@@ -78,6 +84,7 @@ func (v *targetSpecificVar) Eval(w evalWriter, ev *Evaluator) error {
 func (v *targetSpecificVar) serialize() serializableVar {
 	return serializableVar{
 		Type:     v.op,
+		Export:   v.export,
 		Children: []serializableVar{v.v.serialize()},
 	}
 }
@@ -85,6 +92,11 @@ func (v *targetSpecificVar) serialize() serializableVar {
 func (v *targetSpecificVar) dump(d *dumpbuf) {
 	d.Byte(valueTypeTSV)
 	d.Str(v.op)
+	if v.export {
+		d.Byte('x')
+	} else {
+		d.Byte('-')
+	}
 	v.v.dump(d)
 }
 
@@ -132,14 +144,7 @@ func (v *simpleVar) Append(ev *Evaluator, s string) (Var, error) {
 	if err != nil {
 		return nil, err
 	}
-	abuf := newEbuf()
-	err = val.Eval(abuf, ev)
-	if err != nil {
-		return nil, err
-	}
-	v.value = append(v.value, abuf.String())
-	abuf.release()
-	return v, nil
+	return v.AppendVar(ev, val)
 }
 
 func (v *simpleVar) AppendVar(ev *Evaluator, val Value) (Var, error) {
@@ -148,9 +153,26 @@ func (v *simpleVar) AppendVar(ev *Evaluator, val Value) (Var, error) {
 	if err != nil {
 		return nil, err
 	}
-	v.value = append(v.value, abuf.String())
+	s := abuf.String()
 	abuf.release()
-	return v, nil
+	return v.append(s), nil
+}
+
+// append returns a new simpleVar with s appended. Like GNU make, it
+// adds no space if either value is empty.
+func (v *simpleVar) append(s string) *simpleVar {
+	nv := &simpleVar{origin: v.origin}
+	switch {
+	case s == "":
+		nv.value = v.value
+	case v.String() == "":
+		nv.value = []string{s}
+	default:
+		// Copy v.value, since v may be shared, e.g. by target
+		// specific variables.
+		nv.value = append(v.value[:len(v.value):len(v.value)], s)
+	}
+	return nv
 }
 
 type automaticVar struct {
@@ -178,36 +200,36 @@ func (v *automaticVar) Append(ev *Evaluator, s string) (Var, error) {
 	if err != nil {
 		return nil, err
 	}
-	abuf := newEbuf()
-	err = val.Eval(abuf, ev)
-	if err != nil {
-		return nil, err
-	}
-	value := []string{string(v.value), abuf.String()}
-	abuf.release()
-	return &simpleVar{
-		value:  value,
-		origin: "file",
-	}, nil
+	return v.AppendVar(ev, val)
 }
 
 func (v *automaticVar) AppendVar(ev *Evaluator, val Value) (Var, error) {
-	abuf := newEbuf()
-	err := val.Eval(abuf, ev)
-	if err != nil {
-		return nil, err
-	}
-	value := []string{string(v.value), abuf.String()}
-	abuf.release()
-	return &simpleVar{
-		value:  value,
+	sv := &simpleVar{
+		value:  []string{string(v.value)},
 		origin: "file",
-	}, nil
+	}
+	return sv.AppendVar(ev, val)
 }
 
 type recursiveVar struct {
 	expr   Value
 	origin string
+	// srcpos is where the variable is defined, if known.
+	srcpos srcpos
+	// expanding is true while the variable is referenced by varref
+	// or varsubst, to detect recursive references.
+	expanding bool
+	// unparsed is true if expr is makefile text which is not parsed
+	// yet, e.g. a command line variable or `$(eval x = ...)`.
+	// It is parsed on the first expansion and cached in parsed, so
+	// the text is parsed only once however many times the variable
+	// is expanded. Assignments create a new recursiveVar, so the
+	// cache never gets stale. parseOnce guards the cache, as vars
+	// are serialized and dumped concurrently.
+	unparsed  bool
+	parseOnce sync.Once
+	parsed    Value
+	parseErr  error
 }
 
 func (v *recursiveVar) Flavor() string  { return "recursive" }
@@ -216,53 +238,92 @@ func (v *recursiveVar) IsDefined() bool { return true }
 
 func (v *recursiveVar) String() string { return v.expr.String() }
 func (v *recursiveVar) Eval(w evalWriter, ev *Evaluator) error {
-	v.expr.Eval(w, ev)
-	return nil
+	e, err := v.value()
+	if err != nil {
+		return err
+	}
+	return e.Eval(w, ev)
+}
+
+// value returns the parsed expr of v.
+func (v *recursiveVar) value() (Value, error) {
+	if !v.unparsed {
+		return v.expr, nil
+	}
+	v.parseOnce.Do(func() {
+		v.parsed, _, v.parseErr = parseExpr([]byte(v.expr.String()), nil, parseOp{alloc: true})
+	})
+	return v.parsed, v.parseErr
 }
+
 func (v *recursiveVar) serialize() serializableVar {
+	e, err := v.value()
+	if err != nil {
+		e = v.expr
+	}
 	return serializableVar{
 		Type:     "recursive",
-		Children: []serializableVar{v.expr.serialize()},
+		Children: []serializableVar{e.serialize()},
 		Origin:   v.origin,
 	}
 }
 func (v *recursiveVar) dump(d *dumpbuf) {
+	e, err := v.value()
+	if err != nil {
+		d.err = err
+		return
+	}
 	d.Byte(valueTypeRecursive)
-	v.expr.dump(d)
+	e.dump(d)
 	d.Str(v.origin)
 }
 
 func (v *recursiveVar) Append(_ *Evaluator, s string) (Var, error) {
-	var exp expr
-	if e, ok := v.expr.(expr); ok {
-		exp = append(e, literal(" "))
-	} else {
-		exp = expr{v.expr, literal(" ")}
-	}
 	sv, _, err := parseExpr([]byte(s), nil, parseOp{alloc: true})
 	if err != nil {
 		return nil, err
 	}
-	if aexpr, ok := sv.(expr); ok {
-		exp = append(exp, aexpr...)
-	} else {
-		exp = append(exp, sv)
-	}
-	v.expr = exp
-	return v, nil
+	return v.append(sv)
 }
 
 func (v *recursiveVar) AppendVar(ev *Evaluator, val Value) (Var, error) {
-	var buf bytes.Buffer
-	buf.WriteString(v.expr.String())
-	buf.WriteByte(' ')
-	buf.WriteString(val.String())
-	e, _, err := parseExpr(buf.Bytes(), nil, parseOp{alloc: true})
+	return v.append(val)
+}
+
+// append returns a new recursiveVar with val appended. Like GNU make,
+// it adds no space if either value is empty.
+func (v *recursiveVar) append(val Value) (*recursiveVar, error) {
+	e, err := v.value()
 	if err != nil {
 		return nil, err
 	}
-	v.expr = e
-	return v, nil
+	nv := &recursiveVar{
+		origin: v.origin,
+		srcpos: v.srcpos,
+	}
+	switch {
+	case val.String() == "":
+		nv.expr = e
+	case e.String() == "":
+		nv.expr = val
+	default:
+		// Build a new expr, since e may be shared, e.g. by target
+		// specific variables.
+		var exp expr
+		if ee, ok := e.(expr); ok {
+			exp = append(exp, ee...)
+		} else {
+			exp = append(exp, e)
+		}
+		exp = append(exp, literal(" "))
+		if e, ok := val.(expr); ok {
+			exp = append(exp, e...)
+		} else {
+			exp = append(exp, val)
+		}
+		nv.expr = exp
+	}
+	return nv, nil
 }
 
 type undefinedVar struct{}
@@ -289,18 +350,35 @@ func (undefinedVar) AppendVar(_ *Evaluator, val Value) (Var, error) {
 	return undefinedVar{}, nil
 }
 
+// appendVar returns the variable for `name += rhs` in origin, where
+// prev is the current value of name and app appends rhs to prev.
+// As GNU make does, it keeps prev as is if prev has an origin of
+// higher precedence, e.g. command line for a makefile, and the
+// result has origin, e.g. an environment variable becomes a file
+// variable.
+func appendVar(prev Var, origin string, app func() (Var, error)) (Var, error) {
+	if originPrecedence[prev.Origin()] > originPrecedence[origin] {
+		return prev, nil
+	}
+	v, err := app()
+	if err != nil {
+		return nil, err
+	}
+	switch v := v.(type) {
+	case *simpleVar:
+		v.origin = origin
+	case *recursiveVar:
+		v.origin = origin
+	}
+	return v, nil
+}
+
 // Vars is a map for make variables.
 type Vars map[string]Var
 
-// usedEnvs tracks what environment variables are used.
-var usedEnvs = map[string]bool{}
-
 // Lookup looks up named make variable.
 func (vt Vars) Lookup(name string) Var {
 	if v, ok := vt[name]; ok {
-		if strings.HasPrefix(v.Origin(), "environment") {
-			usedEnvs[name] = true
-		}
 		return v
 	}
 	return undefinedVar{}
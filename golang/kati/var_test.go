@@ -0,0 +1,257 @@
+// Copyright 2015 Google Inc. All rights reserved
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kati
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestAppend(t *testing.T) {
+	vars := Vars{
+		"X": &simpleVar{value: []string{"x"}, origin: "file"},
+	}
+	for _, tc := range []struct {
+		v          func() Var
+		rhs        string
+		want       string
+		wantFlavor string
+	}{
+		{
+			v:          func() Var { return &simpleVar{value: []string{"-O2"}, origin: "file"} },
+			rhs:        "-Wall $(X)",
+			want:       "-O2 -Wall x",
+			wantFlavor: "simple",
+		},
+		{
+			v:          func() Var { return &simpleVar{value: []string{""}, origin: "file"} },
+			rhs:        "$(X)",
+			want:       "x",
+			wantFlavor: "simple",
+		},
+		{
+			v:          func() Var { return &simpleVar{origin: "file"} },
+			rhs:        "a",
+			want:       "a",
+			wantFlavor: "simple",
+		},
+		{
+			v:          func() Var { return &simpleVar{value: []string{"a"}, origin: "file"} },
+			rhs:        "",
+			want:       "a",
+			wantFlavor: "simple",
+		},
+		{
+			v:          func() Var { return &simpleVar{value: []string{"a"}, origin: "file"} },
+			rhs:        "$(UNDEFINED)",
+			want:       "a",
+			wantFlavor: "simple",
+		},
+		{
+			v:          func() Var { return &recursiveVar{expr: literal("-g"), origin: "file"} },
+			rhs:        "-Wall $(X)",
+			want:       "-g -Wall x",
+			wantFlavor: "recursive",
+		},
+		{
+			v: func() Var {
+				return &recursiveVar{expr: expr{literal("-g "), &varref{varname: literal("X")}}, origin: "file"}
+			},
+			rhs:        "$(X)",
+			want:       "-g x x",
+			wantFlavor: "recursive",
+		},
+		{
+			v:          func() Var { return &recursiveVar{expr: literal(""), origin: "file"} },
+			rhs:        "$(X)",
+			want:       "x",
+			wantFlavor: "recursive",
+		},
+		{
+			v:          func() Var { return &recursiveVar{expr: literal("a"), origin: "file"} },
+			rhs:        "",
+			want:       "a",
+			wantFlavor: "recursive",
+		},
+		{
+			v: func() Var {
+				return &recursiveVar{expr: literal("$(X)"), origin: "command line", unparsed: true}
+			},
+			rhs:        "y",
+			want:       "x y",
+			wantFlavor: "recursive",
+		},
+		{
+			v:          func() Var { return &automaticVar{value: []byte("a")} },
+			rhs:        "$(X)",
+			want:       "a x",
+			wantFlavor: "simple",
+		},
+		{
+			v: func() Var {
+				return &targetSpecificVar{v: &simpleVar{value: []string{"a"}, origin: "file"}, op: "+="}
+			},
+			rhs:        "$(X)",
+			want:       "a x",
+			wantFlavor: "simple",
+		},
+		{
+			v: func() Var {
+				return &targetSpecificVar{v: &recursiveVar{expr: literal(""), origin: "file"}, op: "="}
+			},
+			rhs:        "$(X)",
+			want:       "x",
+			wantFlavor: "recursive",
+		},
+	} {
+		for _, useVar := range []bool{false, true} {
+			v := tc.v()
+			before := v.String()
+			ev := NewEvaluator(vars)
+			var got Var
+			var err error
+			if useVar {
+				var rhs Value
+				rhs, _, err = parseExpr([]byte(tc.rhs), nil, parseOp{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err = v.AppendVar(ev, rhs)
+			} else {
+				got, err = v.Append(ev, tc.rhs)
+			}
+			if err != nil {
+				t.Errorf("%q += %q: %v", before, tc.rhs, err)
+				continue
+			}
+			var buf evalBuffer
+			buf.resetSep()
+			err = got.Eval(&buf, ev)
+			if err != nil {
+				t.Errorf("%q += %q: %v", before, tc.rhs, err)
+				continue
+			}
+			if buf.String() != tc.want || got.Flavor() != tc.wantFlavor {
+				t.Errorf("%q += %q (AppendVar=%t) => %q (%s); want %q (%s)", before, tc.rhs, useVar, buf.String(), got.Flavor(), tc.want, tc.wantFlavor)
+			}
+			if v.String() != before {
+				t.Errorf("%q += %q (AppendVar=%t) modified the original variable to %q", before, tc.rhs, useVar, v.String())
+			}
+		}
+	}
+}
+
+func TestAppendVarOrigin(t *testing.T) {
+	for _, tc := range []struct {
+		prev   Var
+		origin string
+		want   string
+		wantO  string
+	}{
+		{
+			prev:   &recursiveVar{expr: literal("/bin"), origin: "environment"},
+			origin: "file",
+			want:   "/bin x",
+			wantO:  "file",
+		},
+		{
+			prev:   &recursiveVar{expr: literal("cc"), origin: "default"},
+			origin: "file",
+			want:   "cc x",
+			wantO:  "file",
+		},
+		{
+			prev:   &recursiveVar{expr: literal("a"), origin: "command line"},
+			origin: "file",
+			want:   "a",
+			wantO:  "command line",
+		},
+		{
+			prev:   &simpleVar{value: []string{"a"}, origin: "override"},
+			origin: "file",
+			want:   "a",
+			wantO:  "override",
+		},
+		{
+			prev:   &simpleVar{value: []string{"a"}, origin: "command line"},
+			origin: "override",
+			want:   "a x",
+			wantO:  "override",
+		},
+	} {
+		ev := NewEvaluator(make(Vars))
+		got, err := appendVar(tc.prev, tc.origin, func() (Var, error) {
+			return tc.prev.Append(ev, "x")
+		})
+		if err != nil {
+			t.Errorf("appendVar(%q, %q): %v", tc.prev, tc.origin, err)
+			continue
+		}
+		if got.String() != tc.want || got.Origin() != tc.wantO {
+			t.Errorf("appendVar(%q (%s), %q)=%q (%s); want %q (%s)", tc.prev, tc.prev.Origin(), tc.origin, got, got.Origin(), tc.want, tc.wantO)
+		}
+	}
+}
+
+func TestRecursiveVarUnparsed(t *testing.T) {
+	vars := Vars{
+		"X": &simpleVar{value: []string{"x"}, origin: "file"},
+	}
+	v := &recursiveVar{expr: literal("$(X) $$"), origin: "command line", unparsed: true}
+	ev := NewEvaluator(vars)
+	for i := 0; i < 2; i++ {
+		var buf evalBuffer
+		buf.resetSep()
+		err := v.Eval(&buf, ev)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := buf.String(), "x $"; got != want {
+			t.Errorf("expansion #%d of %q=%q; want %q", i, v.String(), got, want)
+		}
+	}
+	parsed := v.parsed
+	if parsed == nil {
+		t.Fatalf("parsed expr of %q is not cached", v.String())
+	}
+	if _, err := v.value(); err != nil || v.parsed.String() != parsed.String() {
+		t.Errorf("v.value()=_, %v; parsed %q; want cached %q", err, v.parsed, parsed)
+	}
+	if got, want := v.String(), "$(X) $$"; got != want {
+		t.Errorf("v.String()=%q; want %q", got, want)
+	}
+}
+
+func TestRecursiveVarUnparsedConcurrent(t *testing.T) {
+	v := &recursiveVar{expr: literal("$(X) $(Y)"), origin: "command line", unparsed: true}
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = v.value()
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("value() #%d=_, %v", i, err)
+		}
+	}
+	if got, want := v.parsed.String(), "$(X) $(Y)"; got != want {
+		t.Errorf("parsed=%q; want %q", got, want)
+	}
+}
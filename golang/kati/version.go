@@ -14,4 +14,46 @@
 
 package kati
 
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// gitVersion is set by -ldflags "-X ...kati.gitVersion=..." in
+// Makefile.kati.
 var gitVersion string
+
+var (
+	buildIDOnce sync.Once
+	buildIDStr  string
+)
+
+// buildID identifies the kati binary for caches, which must not be
+// shared by different parsers. It is gitVersion if set, or the sha1
+// of the executable otherwise, e.g. with a plain `go build`.
+func buildID() string {
+	buildIDOnce.Do(func() {
+		if gitVersion != "" {
+			buildIDStr = gitVersion
+			return
+		}
+		exe, err := os.Executable()
+		if err != nil {
+			return
+		}
+		f, err := os.Open(exe)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		h := sha1.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return
+		}
+		buildIDStr = fmt.Sprintf("%x", h.Sum(nil))
+	})
+	return buildIDStr
+}
@@ -15,11 +15,15 @@
 package kati
 
 import (
+	"bytes"
 	"container/heap"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -38,6 +42,17 @@ type job struct {
 	numDeps  int
 	depsTs   int64
 	id       int
+	// priority is the critical path length of the job, if
+	// ExecutorOpt.CriticalPath is set. Ready jobs with higher
+	// priority run first.
+	priority int
+	// ran is true if commands of the job were run.
+	ran bool
+	// depsRan is true if commands of a dependency were run.
+	depsRan bool
+	// finished is true once the job is done. Until then, a new
+	// parent waits for it even if it is running.
+	finished bool
 
 	runners []runner
 }
@@ -66,6 +81,9 @@ func (jq jobQueue) Len() int      { return len(jq) }
 func (jq jobQueue) Swap(i, j int) { jq[i], jq[j] = jq[j], jq[i] }
 
 func (jq jobQueue) Less(i, j int) bool {
+	if jq[i].priority != jq[j].priority {
+		return jq[i].priority > jq[j].priority
+	}
 	// First come, first serve, for GNU make compatibility.
 	return jq[i].id < jq[j].id
 }
@@ -116,7 +134,7 @@ func (w *worker) Wait() {
 }
 
 func (j *job) createRunners() ([]runner, error) {
-	runners, _, err := createRunners(j.ex.ctx, j.n)
+	runners, _, err := createRunners(j.ex.contextOf(j.n), j.n)
 	return runners, err
 }
 
@@ -129,11 +147,23 @@ func getTimestamp(filename string) int64 {
 	return st.ModTime().Unix()
 }
 
+// timestamp is getTimestamp for the up-to-date check of filename. Until
+// a recipe runs, the filesystem is as it was when makefiles were loaded,
+// so the mtime in the dirents cached by fsCache is used and stat is
+// called only on a cache miss.
+func (ex *Executor) timestamp(filename string) int64 {
+	if atomic.LoadInt32(&ex.recipeRan) != 0 {
+		timestampStats.add(false)
+		return getTimestamp(filename)
+	}
+	return fsCache.timestamp(filename)
+}
+
 func (j *job) build() error {
 	if j.n.IsPhony {
 		j.outputTs = -2 // trigger cmd even if all inputs don't exist.
 	} else {
-		j.outputTs = getTimestamp(j.n.Output)
+		j.outputTs = j.ex.timestamp(j.n.Output)
 	}
 
 	if !j.n.HasRule {
@@ -146,24 +176,110 @@ func (j *job) build() error {
 		return fmt.Errorf("*** No rule to make target %q, needed by %q.", j.n.Output, j.parents[0].n.Output)
 	}
 
-	if j.outputTs >= j.depsTs {
+	upToDate := j.outputTs >= j.depsTs
+	log := j.ex.buildLog
+	if j.n.IsPhony {
+		log = nil
+	}
+	var rr []runner
+	var inputsMtime int64
+	if log != nil {
+		var err error
+		rr, err = j.createRunners()
+		if err != nil {
+			return err
+		}
+		inputsMtime = j.inputsMtime()
+		if e, ok := log.lookup(j.n.Output); ok && e.Mtime == mtimeNano(j.n.Output) {
+			// The output is as the last build left it, so it's
+			// up to date unless its commands or inputs changed.
+			upToDate = !j.depsRan && e.InputsMtime >= inputsMtime && e.CmdHash == cmdHash(rr)
+		}
+	}
+	if upToDate {
 		// TODO: stats.
 		return errNothingDone
 	}
 
-	rr, err := j.createRunners()
-	if err != nil {
-		return err
+	var err error
+	if log == nil {
+		rr, err = j.createRunners()
+		if err != nil {
+			return err
+		}
 	}
 	if len(rr) == 0 {
 		return errNothingDone
 	}
-	for _, r := range rr {
-		err := r.run(j.n.Output)
-		glog.Warningf("cmd result for %q: %v", j.n.Output, err)
+	j.ran = !DryRunFlag
+	if j.ran {
+		atomic.StoreInt32(&j.ex.recipeRan, 1)
+	}
+	var before fileSnapshot
+	if j.ex.sandboxWarnings && j.ran {
+		j.ex.sandboxMu.Lock()
+		defer j.ex.sandboxMu.Unlock()
+		before, err = snapshotFiles(".")
 		if err != nil {
-			exit := exitStatus(err)
-			return fmt.Errorf("*** [%s] Error %d", j.n.Output, exit)
+			return err
+		}
+	}
+	retries, err := j.retryCount()
+	if err != nil {
+		return err
+	}
+	var mtime time.Time
+	if st, err := os.Stat(j.n.Output); err == nil {
+		mtime = st.ModTime()
+	}
+	// run is rr with TMPDIR, which is not in the build log.
+	run := rr
+	var tmpDir string
+	if j.ex.recipeTmpDir && j.ran {
+		tmpDir, run, err = withTmpDir(rr)
+		if err != nil {
+			return err
+		}
+	}
+	startTime := time.Now()
+	defer func() {
+		atomic.AddInt64(&j.ex.recipeTime, int64(time.Since(startTime)))
+	}()
+	for attempt := 0; ; attempt++ {
+		err = j.runRecipe(run)
+		if err == nil || attempt >= retries || j.ex.context.Err() != nil {
+			break
+		}
+		backoff := retryBackoff << uint(attempt)
+		warn(srcpos{filename: j.n.Filename, lineno: j.n.Lineno}, "recipe for target %q failed (attempt %d of %d), retrying in %v: %v", j.n.Output, attempt+1, retries+1, backoff, err)
+		select {
+		case <-j.ex.context.Done():
+			return j.ex.context.Err()
+		case <-time.After(backoff):
+		}
+	}
+	if err != nil {
+		if j.ex.deleteFailedOutputs || j.ex.interrupted() != 0 {
+			j.removeIncomplete(mtime)
+		}
+		if tmpDir != "" {
+			warn(srcpos{filename: j.n.Filename, lineno: j.n.Lineno}, "TMPDIR of failed recipe for target %q is kept in %s", j.n.Output, tmpDir)
+		}
+		return err
+	}
+	if tmpDir != "" {
+		err = os.RemoveAll(tmpDir)
+		if err != nil {
+			glog.Warningf("failed to remove TMPDIR of %s: %v", j.n.Output, err)
+		}
+	}
+	if before != nil {
+		after, err := snapshotFiles(".")
+		if err != nil {
+			return err
+		}
+		for _, f := range undeclaredOutputs(j.n, before, after) {
+			warn(srcpos{filename: j.n.Filename, lineno: j.n.Lineno}, "target %q wrote undeclared file %q", j.n.Output, f)
 		}
 	}
 
@@ -175,9 +291,216 @@ func (j *job) build() error {
 			j.outputTs = time.Now().Unix()
 		}
 	}
+	if log != nil && j.ran {
+		if mtime := mtimeNano(j.n.Output); mtime >= 0 {
+			log.record(j.n.Output, buildLogEntry{
+				Mtime:       mtime,
+				InputsMtime: inputsMtime,
+				CmdHash:     cmdHash(rr),
+			})
+		}
+	}
+	return nil
+}
+
+// withTmpDir creates a temporary directory for a recipe, and returns
+// it and rr with TMPDIR set to it.
+func withTmpDir(rr []runner) (string, []runner, error) {
+	dir, err := ioutil.TempDir("", "kati-recipe")
+	if err != nil {
+		return "", nil, err
+	}
+	run := make([]runner, len(rr))
+	for i, r := range rr {
+		// Runners of a recipe may share env. The last value is
+		// used for duplicated names.
+		r.env = append(r.env[:len(r.env):len(r.env)], "TMPDIR="+dir)
+		run[i] = r
+	}
+	return dir, run, nil
+}
+
+// inputsMtime returns the latest mtime of inputs of the job in
+// nanoseconds, for the build log.
+func (j *job) inputsMtime() int64 {
+	latest := int64(-1)
+	for _, d := range j.n.Deps {
+		if mtime := mtimeNano(d.Output); mtime > latest {
+			latest = mtime
+		}
+	}
+	return latest
+}
+
+// removeIncomplete removes the output of the job whose recipe failed
+// or was interrupted, if the recipe modified it since mtime. Precious
+// and phony targets are kept.
+func (j *job) removeIncomplete(mtime time.Time) {
+	if j.n.IsPrecious || j.n.IsPhony {
+		return
+	}
+	st, err := os.Stat(j.n.Output)
+	if err != nil || st.ModTime().Equal(mtime) {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "kati: *** Deleting file '%s'\n", j.n.Output)
+	err = os.Remove(j.n.Output)
+	if err != nil {
+		glog.Warningf("failed to remove incomplete target: %v", err)
+	}
+}
+
+// retryBackoff is the wait before the first retry of a failing
+// recipe. It doubles on each retry.
+var retryBackoff = time.Second
+
+// runRecipe runs commands of the recipe in order, and stops at the
+// first failure.
+func (j *job) runRecipe(rr []runner) error {
+	command, protocol, err := j.persistentWorker()
+	if err != nil {
+		return err
+	}
+	for _, r := range rr {
+		err := j.ex.context.Err()
+		if err != nil {
+			return err
+		}
+		var out []byte
+		if command != "" {
+			out, err = j.ex.workers.runInWorker(j.ex.context, r, command, protocol, j.n.Output)
+			if _, ok := err.(workerExitError); err != nil && !ok && j.ex.context.Err() == nil {
+				return fmt.Errorf("%s:%d: *** [%s] %v", j.n.Filename, j.n.Lineno, j.n.Output, err)
+			}
+		} else {
+			out, err = r.run(j.ex.context, j.n.Output, j.ex.killSignal)
+		}
+		glog.Warningf("cmd result for %q: %v", j.n.Output, err)
+		if cerr := j.ex.context.Err(); cerr != nil {
+			return cerr
+		}
+		if err != nil {
+			return j.withOutputTail(j.recipeError(r, err), r, out)
+		}
+	}
 	return nil
 }
 
+// retryCount returns how many times a failing recipe of the job is
+// retried, given by the target specific variable KATI_RETRY or
+// ExecutorOpt.Retries.
+func (j *job) retryCount() (int, error) {
+	s, ok, err := j.targetVar("KATI_RETRY")
+	if err != nil {
+		return 0, err
+	}
+	if ok {
+		n, ok := numericValueForFunc(s)
+		if !ok {
+			return 0, fmt.Errorf("%s:%d: *** invalid KATI_RETRY %q for target %q", j.n.Filename, j.n.Lineno, s, j.n.Output)
+		}
+		return n, nil
+	}
+	for _, r := range j.ex.retries {
+		if matchPattern(r.Pattern, j.n.Output) {
+			return r.Count, nil
+		}
+	}
+	return 0, nil
+}
+
+// targetVar evaluates the target specific variable name of the job,
+// with spaces trimmed. It returns false if the variable is not set.
+func (j *job) targetVar(name string) (string, bool, error) {
+	v, ok := j.n.TargetSpecificVars[name]
+	if !ok {
+		return "", false, nil
+	}
+	var buf evalBuffer
+	buf.resetSep()
+	ctx := j.ex.contextOf(j.n)
+	ctx.mu.Lock()
+	err := v.Eval(&buf, ctx.ev)
+	ctx.mu.Unlock()
+	if err != nil {
+		return "", false, err
+	}
+	return strings.TrimSpace(buf.String()), true, nil
+}
+
+// persistentWorker returns the command to start the persistent
+// worker which runs commands of the recipe, given by the target
+// specific variable KATI_WORKER, and the protocol to talk to it,
+// named by KATI_WORKER_PROTOCOL ("json" by default). The command is
+// empty unless ExecutorOpt.PersistentWorkers is set.
+func (j *job) persistentWorker() (string, WorkerProtocol, error) {
+	if j.ex.workers == nil {
+		return "", nil, nil
+	}
+	command, _, err := j.targetVar("KATI_WORKER")
+	if err != nil || command == "" {
+		return "", nil, err
+	}
+	name, _, err := j.targetVar("KATI_WORKER_PROTOCOL")
+	if err != nil {
+		return "", nil, err
+	}
+	if name == "" {
+		name = "json"
+	}
+	p, ok := lookupWorkerProtocol(name)
+	if !ok {
+		return "", nil, fmt.Errorf("%s:%d: *** unknown KATI_WORKER_PROTOCOL %q for target %q", j.n.Filename, j.n.Lineno, name, j.n.Output)
+	}
+	return command, p, nil
+}
+
+// recipeError returns the error for a failed recipe. Failures to start
+// the shell and exit status 127 (command not found) carry the srcpos of
+// the recipe and the shell, since the shell's own message rarely says
+// which target it came from.
+func (j *job) recipeError(r runner, err error) error {
+	if code, ok := err.(workerExitError); ok {
+		return fmt.Errorf("*** [%s] Error %d", j.n.Output, int(code))
+	}
+	if _, ok := err.(*exec.ExitError); !ok {
+		return fmt.Errorf("%s:%d: *** [%s] Failed to run SHELL %q: %v", j.n.Filename, j.n.Lineno, j.n.Output, r.shell, err)
+	}
+	exit := exitStatus(err)
+	if exit == 127 {
+		var cmd string
+		if ws := strings.Fields(cmdline(r.cmd)); len(ws) > 0 {
+			cmd = ws[0]
+		}
+		return fmt.Errorf("*** [%s:%d: %s] Error %d (command %q not found by SHELL %s)", j.n.Filename, j.n.Lineno, j.n.Output, exit, cmd, r.shell)
+	}
+	return fmt.Errorf("*** [%s] Error %d", j.n.Output, exit)
+}
+
+// withOutputTail appends the end of the output of the failed command
+// of r to err, with the target, the srcpos and the command, if
+// ExecutorOpt.FailureOutputTail is set.
+func (j *job) withOutputTail(err error, r runner, out []byte) error {
+	n := j.ex.failureOutputTail
+	if n <= 0 {
+		return err
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s:%d: recipe for target %q failed running: %s\n", j.n.Filename, j.n.Lineno, j.n.Output, cmdline(r.cmd))
+	if len(out) == 0 {
+		sb.WriteString("(no output)")
+		return fmt.Errorf("%w\n%s", err, sb.String())
+	}
+	if len(out) > n {
+		fmt.Fprintf(&sb, "last %d bytes of %d bytes of output:\n", n, len(out))
+		out = out[len(out)-n:]
+	} else {
+		sb.WriteString("output:\n")
+	}
+	sb.Write(bytes.TrimRight(out, "\n"))
+	return fmt.Errorf("%w\n%s", err, sb.String())
+}
+
 func (wm *workerManager) handleJobs() error {
 	for {
 		if len(wm.freeWorkers) == 0 {
@@ -186,6 +509,17 @@ func (wm *workerManager) handleJobs() error {
 		if wm.readyQueue.Len() == 0 {
 			return nil
 		}
+		// At least one job runs regardless of the load, as GNU
+		// make does.
+		if len(wm.busyWorkers) > 0 && wm.loadTooHigh() {
+			if wm.loadRecheck == nil {
+				wm.loadRecheck = time.After(loadRecheckInterval)
+			}
+			return nil
+		}
+		if wm.maxLoad > 0 {
+			wm.recentStarts = append(wm.recentStarts, time.Now())
+		}
 		j := heap.Pop(&wm.readyQueue).(*job)
 		glog.V(1).Infof("run: %s", j.n.Output)
 
@@ -204,6 +538,9 @@ func (wm *workerManager) updateParents(j *job) {
 		if p.depsTs < j.outputTs {
 			p.depsTs = j.outputTs
 		}
+		if j.ran {
+			p.depsRan = true
+		}
 		wm.maybePushToReadyQueue(p)
 	}
 }
@@ -225,11 +562,21 @@ type workerManager struct {
 
 	finishCnt int
 	skipCnt   int
+
+	// maxLoad is ExecutorOpt.MaxLoad. While the load average is
+	// too high, loadRecheck fires to check it again, and
+	// recentStarts are when jobs started recently.
+	maxLoad      float64
+	loadavg      loadAverager
+	loadRecheck  <-chan time.Time
+	recentStarts []time.Time
 }
 
-func newWorkerManager(numJobs int) (*workerManager, error) {
+func newWorkerManager(numJobs int, maxLoad float64) (*workerManager, error) {
 	wm := &workerManager{
 		maxJobs:     numJobs,
+		maxLoad:     maxLoad,
+		loadavg:     systemLoadAverage,
 		jobChan:     make(chan *job),
 		resultChan:  make(chan jobResult),
 		newDepChan:  make(chan newDep),
@@ -276,7 +623,7 @@ func (wm *workerManager) maybePushToReadyQueue(j *job) {
 }
 
 func (wm *workerManager) handleNewDep(j *job, neededBy *job) {
-	if j.numDeps < 0 {
+	if j.finished {
 		neededBy.numDeps--
 		if neededBy.id > 0 {
 			panic("FIXME: already in WM... can this happen?")
@@ -301,6 +648,7 @@ Loop:
 			glog.V(1).Infof("done: %s", jr.j.n.Output)
 			delete(wm.busyWorkers, jr.w)
 			wm.freeWorkers = append(wm.freeWorkers, jr.w)
+			jr.j.finished = true
 			wm.updateParents(jr.j)
 			wm.finishCnt++
 			if jr.err == errNothingDone {
@@ -316,6 +664,8 @@ Loop:
 			wm.handleNewDep(af.j, af.neededBy)
 			glog.V(1).Infof("dep: %s (%d) %s", af.neededBy.n.Output, af.neededBy.numDeps, af.j.n.Output)
 		case done = <-wm.waitChan:
+		case <-wm.loadRecheck:
+			wm.loadRecheck = nil
 		}
 		err = wm.handleJobs()
 		if err != nil {
@@ -92,6 +92,8 @@ var normalizeKati = []normalization{
 	{regexp.MustCompile(`/bin/sh: line 0: `), ""},
 	{regexp.MustCompile(`/bin/sh: `), ""},
 	{regexp.MustCompile(`.*: warning for parse error in an unevaluated line: [^\n]*`), ""},
+	// Go kati explains exit status 127 of recipes.
+	{regexp.MustCompile(`\[\S+:\d+: (\S+)\] Error 127 \([^\n]*`), "[$1] Error 127"},
 	{regexp.MustCompile(`([^\n ]+: )?FindEmulator: `), ""},
 	// kati log ifles in find_command.mk
 	{regexp.MustCompile(` (\./+)+kati\.\S+`), ""},
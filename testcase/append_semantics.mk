@@ -0,0 +1,54 @@
+# TODO(c): Fix
+S := -O2
+R = -g
+E :=
+ER =
+S_TSV := -O2
+R_TSV = -g
+
+S += -Wall $(X)
+R += -Wall $(X)
+E += x
+ER += y
+U += u $(X)
+X := late
+NE :=
+NE +=
+NR =
+NR +=
+SE := a
+SE +=
+RE = a
+RE +=
+$(eval EV := a)
+$(eval EV += b)
+$(eval EE :=)
+$(eval EE += c)
+
+$(info S=[$(S)] $(flavor S))
+$(info R=[$(R)] $(flavor R))
+$(info E=[$(E)] $(flavor E))
+$(info ER=[$(ER)] $(flavor ER))
+$(info U=[$(U)] $(flavor U))
+$(info NE=[$(NE)] NR=[$(NR)])
+$(info SE=[$(SE)] RE=[$(RE)])
+$(info EV=[$(EV)] EE=[$(EE)])
+
+PATH += /nonexistent
+$(info PATH: $(origin PATH) $(flavor PATH))
+override OV := o
+OV += p
+$(info OV=[$(OV)] $(origin OV))
+override OV += q
+$(info OV=[$(OV)] $(origin OV))
+CC += -m32
+$(info CC: $(origin CC))
+
+test: a b c d
+a: S_TSV += -a $(Y)
+b: S_TSV += -b
+c: R_TSV += -c $(Y)
+d: NEW += -d
+Y := y
+a b c d:
+	@echo $@ [$(S_TSV)] [$(R_TSV)] [$(NEW)]
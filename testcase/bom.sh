@@ -0,0 +1,26 @@
+#!/bin/bash
+# TODO(c): not implemented
+#
+# Copyright 2020 Google Inc. All rights reserved
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#      http:#www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+set -u
+
+mk="$@"
+
+# A makefile starting with a UTF-8 BOM. It's written here, as a
+# testcase can't have a TODO line before the BOM.
+printf '\xef\xbb\xbf# A makefile starting with a UTF-8 BOM.\nA := PASS\n\ntest:\n\techo $(A)\n' > Makefile
+
+${mk} 2>&1
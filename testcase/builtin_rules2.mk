@@ -0,0 +1,11 @@
+# TODO(c): not implemented
+CC := echo cc
+CXX := echo c++
+
+test: foo.o bar.o baz.o
+	@echo $(RM) $(LINK.o) $(OUTPUT_OPTION) $(COMPILE.S)
+
+foo.cpp bar.c baz.cc:
+	touch $@
+
+.PHONY: test
@@ -0,0 +1,27 @@
+# TODO(c): Fix
+# Function names of $(call) computed from variables and other calls,
+# as in module types dispatching to their build functions.
+
+define build-cc-module
+cc:$(1):$(2)
+endef
+define build-java-module
+java:$(1):$(2)
+endef
+
+module-type = $(strip $(1))
+build-func = build-$(call module-type,$(1))-module
+type := cc
+
+# A trailing blank of the computed name is stripped.
+dispatch = $(call $(call build-func,$(1)) ,$(2),$(3))
+
+strip := not the builtin
+
+test:
+	echo $(call $(strip build-$(type)-module),a,b)
+	echo $(call $(call build-func, java ),c)
+	echo $(call dispatch,cc,d,e)
+	echo $(foreach t,cc java,$(call build-$(t)-module,$(t)))
+	echo [$(call $(empty),f)]
+	echo [$(call strip,  g  h  )] [$(call subst,a,b,xa,ya)]
@@ -0,0 +1,21 @@
+# TODO(c): Fix
+# Makefiles with CRLF line endings, in define bodies, continued
+# lines and recipes.
+
+define multi
+echo a
+echo b
+endef
+define empty
+endef
+X := 1 \
+  2
+ifeq ($(X),1 2)
+RESULT := PASS
+endif
+
+test:
+	$(multi)
+	@echo $(RESULT) \
+	  continued
+	echo [$(empty)]
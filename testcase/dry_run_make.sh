@@ -0,0 +1,39 @@
+#!/bin/bash
+# TODO(c): Fix
+#
+# Copyright 2020 Google Inc. All rights reserved
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#      http:#www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+set -u
+
+mk="$@"
+
+cat <<EOF > Makefile
+MAKE := true
+
+test:
+	touch not_run
+	+touch plus
+	\$(MAKE) && touch make_paren
+	\${MAKE} && touch make_brace
+EOF
+
+${mk} -n 2>&1
+for f in not_run plus make_paren make_brace; do
+  if [ -e ${f} ]; then
+    echo "${f} exists"
+  else
+    echo "${f} does not exist"
+  fi
+done
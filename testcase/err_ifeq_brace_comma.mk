@@ -0,0 +1,8 @@
+# TODO(c): Fix
+# GNU make finds the comma by counting parentheses only, so the
+# first argument is "${call f".
+f = $(1)
+ifeq (${call f,a,b},a)
+endif
+
+test:
@@ -0,0 +1,6 @@
+X = a
+X = $(X) extra
+Y = $(X:a=b)
+
+test:
+	echo $(Y)
@@ -1,4 +1,4 @@
-# TODO(all/test2): Fix
+# TODO(c/test2): Fix
 
 test1:
 	touch a.src
@@ -0,0 +1,28 @@
+# TODO(c): Fix
+# $(eval x = ...) must be same as evaluating the text, even if the
+# value has newlines or comments.
+define nl
+
+
+endef
+h := \#
+y := 1$(nl)r1: ; @echo r1
+z := 2$(nl)r2: ; @echo r2
+
+$(eval x1 = $(y))
+$(eval x2 = a $(h) b)
+$(eval export x3 = 3)
+$(eval override x4 = 4)
+ifeq (a,b)
+$(eval x5 = $(y))
+$(eval r3: ; @echo r3)
+endif
+$(eval x6 := $(z))
+$(eval x7 += a)
+$(eval x8 = 8 $(nl)x9 = 9)
+$(eval x10 = a\#b)
+
+test: r1 r2
+	echo x1=[$(x1)] x2=[$(x2)] x3=[$(x3)] x4=[$(x4)] x5=[$(x5)]
+	echo x6=[$(x6)] x7=[$(x7)] x8=[$(x8)] x9=[$(x9)] x10=[$(x10)]
+	echo export $$x3 [$(filter export% override%,$(.VARIABLES))]
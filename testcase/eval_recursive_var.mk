@@ -0,0 +1,8 @@
+y := FAIL
+$(eval x = $$(y))
+$(eval z += $$(y))
+$(eval w ?= $$(y))
+y := PASS
+
+test:
+	echo $(x) $(z) $(w)
@@ -0,0 +1,12 @@
+# TODO(c): .EXPORT_ALL_VARIABLES is not supported
+.EXPORT_ALL_VARIABLES:
+
+FOO := foo
+BAR = $(FOO)bar
+unexport BAZ
+BAZ := baz
+a-b := x
+CC := mycc
+
+test:
+	env | grep -E '^(FOO|BAR|BAZ|a-b|CC|CXX|MAKEFILE_LIST)=' | sort
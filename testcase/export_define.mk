@@ -0,0 +1,14 @@
+# TODO(c): Fix
+export define FOO
+foo
+  bar $$HOME
+endef
+
+define BAR
+bar
+endef
+export BAR
+
+test:
+	@echo "$$FOO"
+	@echo "$$BAR"
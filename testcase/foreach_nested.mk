@@ -0,0 +1,18 @@
+i := outer
+empty :=
+
+# Nested foreach over the same variable.
+r1 := $(foreach i,a b,$(foreach i,1 2,$(i))-$(i))
+r2 := $(foreach i,a b,$(i)$(foreach i,$(empty),$(i))$(i))
+r3 := $(foreach i,,$(i))
+r4 := $(foreach i,x,$(foreach j,$(i) y,$(foreach i,z,$(i)$(j))$(i)))
+
+r5 := $(foreach u,a,$(foreach u,b,$(u))$(u))
+
+test:
+	echo $(r1)
+	echo $(r2)
+	echo "$(r3)"
+	echo $(r4)
+	echo $(i)
+	echo $(r5) $(origin u) "$(u)"
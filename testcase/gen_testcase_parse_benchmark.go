@@ -15,17 +15,26 @@
 // gen_testcase_parse_benchmark is a program to generate benchmark tests
 // for parsing testcases.
 //
+// With -fuzz_corpus, it generates go-fuzz corpora from testcases
+// instead. See golang/kati/fuzz.go.
+//
 package main
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strings"
 	"text/template"
 )
 
+var fuzzCorpus = flag.String("fuzz_corpus", "", "generate fuzz corpora in the `dir` instead of benchmark tests")
+
 const preamble = `package kati
 
 import (
@@ -81,7 +90,54 @@ func writeBenchmarkTest(w io.Writer, fname string) {
 	}
 }
 
+func writeCorpus(dir string, data []byte) {
+	err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("%x", sha1.Sum(data))), data, 0644)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// writeFuzzCorpus writes each testcase to <dir>/makefile/corpus, each
+// line to <dir>/expr/corpus, and each line from each '$' to
+// <dir>/dollar/corpus.
+func writeFuzzCorpus(dir string, fnames []string) {
+	for _, name := range []string{"makefile", "expr", "dollar"} {
+		err := os.MkdirAll(filepath.Join(dir, name, "corpus"), 0755)
+		if err != nil {
+			panic(err)
+		}
+	}
+	for _, fname := range fnames {
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			panic(err)
+		}
+		writeCorpus(filepath.Join(dir, "makefile", "corpus"), data)
+		for _, line := range bytes.Split(data, []byte{'\n'}) {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			writeCorpus(filepath.Join(dir, "expr", "corpus"), line)
+			for i, c := range line {
+				if c == '$' && i+1 < len(line) {
+					writeCorpus(filepath.Join(dir, "dollar", "corpus"), line[i:])
+				}
+			}
+		}
+	}
+}
+
 func main() {
+	flag.Parse()
+	matches, err := filepath.Glob("testcase/*.mk")
+	if err != nil {
+		panic(err)
+	}
+	if *fuzzCorpus != "" {
+		writeFuzzCorpus(*fuzzCorpus, matches)
+		return
+	}
+
 	f, err := os.Create("testcase_parse_benchmark_test.go")
 	if err != nil {
 		panic(err)
@@ -93,10 +149,6 @@ func main() {
 		}
 	}()
 	fmt.Fprint(f, preamble)
-	matches, err := filepath.Glob("testcase/*.mk")
-	if err != nil {
-		panic(err)
-	}
 	for _, tc := range matches {
 		writeBenchmarkTest(f, tc)
 	}
@@ -0,0 +1,51 @@
+# TODO(c): Fix
+# Conditionals with commas in nested function calls, from patterns
+# used in Android makefiles.
+
+comma := ,
+empty :=
+space := $(empty) $(empty)
+TARGET_ARCH := arm64
+TARGET_2ND_ARCH := arm
+PRODUCT_PACKAGES := foo bar,baz
+my_sdk := current,system
+
+is-arch = $(filter $(1),$(TARGET_ARCH) $(TARGET_2ND_ARCH))
+pair = $(1),$(2)
+to-list = $(subst $(comma),$(space),$(1))
+
+RESULT :=
+
+ifeq ($(call is-arch,arm64),arm64)
+RESULT += 1
+endif
+ifeq ($(call pair,a,b),a,b)
+RESULT += 2
+endif
+ifneq ($(filter %$(comma)system,$(my_sdk)),)
+RESULT += 3
+endif
+ifeq ($(word 2,$(call to-list,$(my_sdk))),system)
+RESULT += 4
+endif
+ifeq ((a,b),(a,b))
+RESULT += 5
+endif
+ifeq (a(,)b,a(,)b)
+RESULT += 6
+endif
+ifneq ($(patsubst %,(%),$(TARGET_ARCH)),(arm64))
+RESULT += FAIL7
+endif
+ifeq ($(if $(filter true,$(WITH_DEXPREOPT)),dex,nodex),nodex)
+RESULT += 8
+endif
+ifeq ($(strip $(foreach p,$(PRODUCT_PACKAGES),$(if $(findstring $(comma),$(p)),$(p)))),bar,baz)
+RESULT += 9
+endif
+ifeq ($(lastword (a) (b)),(b))
+RESULT += 10
+endif
+
+test:
+	echo $(RESULT)
@@ -0,0 +1,42 @@
+# TODO(c): Fix
+# Blanks in "ifeq (lhs,rhs)" are trimmed after lhs and before rhs,
+# but kept before lhs and after rhs, before expansion.
+
+A := a
+empty :=
+
+RESULT :=
+
+ifeq ($(A) ,a)
+RESULT += 1
+endif
+ifeq ($(A)	,a)
+RESULT += 2
+endif
+ifneq (a,a )
+RESULT += 3
+endif
+ifneq ( a,a)
+RESULT += 4
+endif
+ifeq (a, a)
+RESULT += 5
+endif
+ifeq ($(strip $(UNDEFINED)), )
+RESULT += 6
+endif
+ifeq ($(strip $(UNDEFINED)) , )
+RESULT += 7
+endif
+ifneq ($(UNDEFINED),$(empty) )
+RESULT += 8
+endif
+ifeq ($(A)$(empty) ,a)
+RESULT += 9
+endif
+ifneq ($(A) $(empty),a)
+RESULT += 10
+endif
+
+test:
+	echo $(RESULT)
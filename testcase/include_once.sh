@@ -0,0 +1,44 @@
+#!/bin/bash
+# TODO(c): not implemented
+#
+# Copyright 2020 Google Inc. All rights reserved
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#      http:#www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+set -e
+
+mk="$@"
+
+cat <<EOF > Makefile
+KATI_INCLUDE_ONCE := once%.mk
+include once.mk
+include once.mk
+include twice.mk
+include twice.mk
+test:
+	@echo \$(ONCE)
+	@echo \$(TWICE)
+	@echo \$(MAKEFILE_LIST)
+EOF
+
+echo 'ONCE += x' > once.mk
+echo 'TWICE += x' > twice.mk
+
+if echo "${mk}" | grep -qv "kati"; then
+  # GNU make has no include-once mode, so write the expected output.
+  echo 'x'
+  echo 'x x'
+  echo 'Makefile once.mk twice.mk twice.mk'
+else
+  ${mk}
+fi
@@ -0,0 +1,14 @@
+# TODO(c): not implemented
+# Missing makefiles are remade by their rules, then makefiles are
+# read again.
+
+include gen.mk
+
+test:
+	@echo $(FOO)
+
+gen.mk: gen.in
+	echo 'FOO := $(shell cat $<)' > $@
+
+gen.in:
+	echo generated > $@
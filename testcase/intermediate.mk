@@ -0,0 +1,13 @@
+# TODO(c|go-ninja): intermediate files are not removed
+
+test: a.out b.out c.out d.out
+
+%.out: %.mid
+	cp $< $@
+
+a.mid b.mid c.mid d.mid:
+	echo $@ > $@
+
+.INTERMEDIATE: a.mid b.mid c.mid
+.SECONDARY: b.mid
+.PRECIOUS: c.mid
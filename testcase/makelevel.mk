@@ -0,0 +1,12 @@
+# TODO(c): Fix
+$(info MAKELEVEL=$(MAKELEVEL))
+
+ifeq ($(MAKELEVEL),0)
+LEVEL := top
+else
+LEVEL := sub
+endif
+
+test:
+	echo $(LEVEL) $(MAKELEVEL) $$MAKELEVEL
+	sh -c 'echo $$MAKELEVEL'
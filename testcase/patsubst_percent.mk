@@ -0,0 +1,14 @@
+# TODO(c): Fix
+# Only the first % not quoted by a backslash is a wildcard.
+x := a%b a.c \a.c % foo.h
+
+test:
+	echo [$(patsubst a\%%,[%],$(x))]
+	echo [$(patsubst %.c,%%.o,$(x))]
+	echo [$(patsubst \\%.c,%.o,$(x))]
+	echo [$(patsubst ab%ba,X,aba abba abxba)]
+	echo [$(patsubst a,x%y,a b)]
+	echo [$(patsubst \%,x\%y,$(x))]
+	echo [$(filter a\%%,$(x))] [$(filter-out \%,$(x))]
+	echo [$(x:.c=.o)] [$(x:%.c=X)] [$(x:.c=%.o)]
+	echo [$(x:a\%%=X%)] [$(x:\%=Y)]
@@ -0,0 +1,16 @@
+# TODO(c): not implemented
+.RECIPEPREFIX := >
+test: a b c
+>@echo test
+>@echo \
+>  continued
+a:
+> @echo a
+
+.RECIPEPREFIX =
+b:
+	@echo b
+
+.RECIPEPREFIX := >>
+c:
+>@echo c
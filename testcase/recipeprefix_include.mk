@@ -0,0 +1,14 @@
+# TODO(c): not implemented
+# .RECIPEPREFIX applies to included and evaluated makefiles.
+.RECIPEPREFIX := >
+
+test: a b
+
+$(shell printf 'a:\n>@echo a\n' > recipeprefix_include.inc)
+include recipeprefix_include.inc
+
+define rule_b
+b:
+>@echo b
+endef
+$(eval $(rule_b))
@@ -0,0 +1,13 @@
+# TODO(c): not implemented
+test: default errexit bash
+
+default:
+	false; echo PASS
+
+errexit: .SHELLFLAGS := -ec
+errexit:
+	-false; echo NOT_REACHED
+
+bash: SHELL := /bin/bash
+bash:
+	echo $${BASH_VERSION:+PASS}
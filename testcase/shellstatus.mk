@@ -0,0 +1,24 @@
+# TODO(c): not implemented
+$(info [$(.SHELLSTATUS)])
+X := $(shell true)
+$(info $(.SHELLSTATUS))
+X := $(shell false)
+$(info $(.SHELLSTATUS))
+X := $(shell echo foo; exit 3)
+$(info $(X) $(.SHELLSTATUS))
+X := $(shell kill -TERM $$$$)
+$(info $(.SHELLSTATUS))
+X := $(shell /nonexistent/command 2>/dev/null)
+$(info $(.SHELLSTATUS))
+
+ifneq ($(.SHELLSTATUS),0)
+$(info failed)
+endif
+
+.SHELLSTATUS := 5
+X := $(shell true)
+$(info $(.SHELLSTATUS))
+
+test:
+	echo $(.SHELLSTATUS)
+	echo $(shell exit 2) $(.SHELLSTATUS)
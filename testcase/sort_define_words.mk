@@ -0,0 +1,17 @@
+define list
+c.o
+b.o	a.o
+d.o
+endef
+
+ff := $(shell printf 'y\fx\vw')
+sorted := $(sort $(list) b.o)
+
+test:
+	echo $(words $(list))
+	echo $(sorted)
+	echo $(firstword $(list)) $(lastword $(list)) $(word 3,$(list))
+	echo $(filter a.o d.o,$(list))
+	echo $(patsubst %.o,%.c,$(list))
+	echo $(addprefix out/,$(list))
+	echo $(words $(ff)) $(sort $(ff))
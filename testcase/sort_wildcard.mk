@@ -0,0 +1,7 @@
+$(shell mkdir -p sw && touch sw/b.c sw/a.c sw/a.h sw/c.txt)
+
+test:
+	echo $(sort $(wildcard sw/*.c))
+	echo $(sort $(wildcard sw/*.c sw/a.* ./sw/*.h))
+	echo $(sort $(wildcard sw/*.none))
+	echo $(sort $(wildcard sw/*.c) sw/0.c)
@@ -0,0 +1,13 @@
+# TODO(c): Fix
+# Preparation: create foo.c and foo.cc
+test1:
+	touch foo.c foo.cc
+
+# foo.o should match .cc.o, as .cc comes before .c in .SUFFIXES.
+test2: foo.o
+
+CC := echo cc
+CXX := echo c++
+
+.SUFFIXES:
+.SUFFIXES: .o .cc .c
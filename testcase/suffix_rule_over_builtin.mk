@@ -0,0 +1,15 @@
+# TODO(c): Fix
+# A suffix rule in the makefile wins over the builtin rule for the
+# same suffixes, but not over a builtin rule for other ones.
+CC := echo cc
+AS := echo as
+
+test: a.o b.o
+
+.c.o:
+	@echo suffix $<
+
+a.c b.s:
+	touch $@
+
+.PHONY: test
@@ -0,0 +1,16 @@
+# TODO(c): Fix
+export BAR := global
+
+test: foo bar baz
+
+foo: export FOO := foo's value
+foo:
+	echo FOO=$$FOO BAR=$$BAR
+
+bar: BAR := bar
+bar:
+	echo BAR=$$BAR FOO=$${FOO:-unset}
+
+baz: export BAZ = $@
+baz:
+	echo BAZ=$$BAZ
@@ -0,0 +1,13 @@
+# TODO(c): Fix
+A := global
+
+test: foo bar
+
+foo: override A := foo
+foo:
+	@echo $@ $(A) $(origin A)
+
+bar: override B = $@
+bar: B += appended
+bar:
+	@echo $@ $(B) $(origin B)
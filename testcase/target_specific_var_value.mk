@@ -0,0 +1,22 @@
+# TODO(c): Fix
+A = global $(B)
+B = b
+C = global
+D = global
+
+test: A = tsv $(B)
+test: A += more
+test: C := simple
+test: D = tsv
+test: D ?= ignored
+
+test: foo
+	echo '$(value A)|$(flavor A)|$(origin A)|$(A)'
+	echo '$(value C)|$(flavor C)|$(origin C)'
+	echo '$(value D)|$(flavor D)|$(origin D)'
+	echo '$(value @)|$(flavor @)|$(origin @)'
+	echo '$(value <)|$(flavor <)|$(origin <)|$(flavor ^)'
+	echo '$(flavor @D)|$(origin @D)|$(@D)'
+
+foo:
+	echo '$(value A)|$(flavor A)|$(A)'
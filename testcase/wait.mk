@@ -0,0 +1,11 @@
+# .WAIT is a special target since GNU make 4.4. Define it for older
+# versions.
+.WAIT:
+
+test: a .WAIT b c .WAIT d
+	echo $@
+
+a b c d:
+	echo $@
+
+.PHONY: test a b c d
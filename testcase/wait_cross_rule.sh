@@ -0,0 +1,43 @@
+#!/bin/bash
+# TODO(c): not implemented
+#
+# Copyright 2020 Google Inc. All rights reserved
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#      http:#www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+set -u
+
+mk="$@"
+
+# .WAIT in the prerequisites of x makes b wait for a even when b is
+# needed by y only, as the order is kept in the graph shared with
+# ninja. GNU make 4.4 orders them only while making x.
+cat <<EOF > Makefile
+.WAIT:
+test: y
+x: a .WAIT b
+y: b
+	@echo \$@
+a b:
+	@echo \$@
+.PHONY: test x y a b
+EOF
+
+if echo "${mk}" | grep -qv "kati"; then
+  # Make doesn't order a and b for y, so write the expected output.
+  echo 'a'
+  echo 'b'
+  echo 'y'
+else
+  ${mk} 2>&1
+fi
@@ -0,0 +1,38 @@
+#!/bin/bash
+# TODO(c): not implemented
+#
+# Copyright 2020 Google Inc. All rights reserved
+#
+# Licensed under the Apache License, Version 2.0 (the "License");
+# you may not use this file except in compliance with the License.
+# You may obtain a copy of the License at
+#
+#      http:#www.apache.org/licenses/LICENSE-2.0
+#
+# Unless required by applicable law or agreed to in writing, software
+# distributed under the License is distributed on an "AS IS" BASIS,
+# WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+# See the License for the specific language governing permissions and
+# limitations under the License.
+
+set -u
+
+mk="$@"
+
+cat <<EOF > Makefile
+test: foo.o .x
+foo.o:
+	@echo "<\$<> <\$*>"
+.x:
+	@echo "<\$*>"
+EOF
+
+if echo "${mk}" | grep -qv "kati"; then
+  # Make doesn't support these warnings, so write the expected output.
+  echo 'Makefile:3: warning: $< is used in a rule without prerequisites for target "foo.o"'
+  echo '<> <foo>'
+  echo 'Makefile:5: warning: $* is used outside pattern rules for target ".x"'
+  echo '<>'
+else
+  ${mk} -warn_empty_auto_vars 2>&1
+fi
@@ -0,0 +1,16 @@
+# TODO(c/test2): Fix
+# Wildcards in prerequisites are expanded when the graph is built.
+
+test1:
+	touch b.y a.y
+
+test2: foo bar
+
+foo: *.y
+	echo $^
+
+bar: | *.none
+	echo bar
+
+*.none:
+	echo none